@@ -0,0 +1,90 @@
+package overlayfs
+
+import (
+	"fmt"
+)
+
+// RenamePair is a rename from Old to New, see RenameBatch.
+type RenamePair struct {
+	Old, New string
+}
+
+// BatchError is returned by RemoveBatch and RenameBatch when one or more items failed.
+type BatchError struct {
+	// Errs holds the result of each item in the batch, nil for those that succeeded.
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	var (
+		failed int
+		first  error
+	)
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d operations failed, first error: %v", failed, len(e.Errs), first)
+}
+
+// Unwrap returns the errors of the items that failed.
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// RemoveBatch removes the named files or empty directories, continuing on errors.
+// If any of them fails, a *BatchError with the result of each item is returned.
+// If the overlay isn't writable, that error is returned without trying any of them.
+func (ofs *OverlayFs) RemoveBatch(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if err := ofs.checkWritable("remove", names[0]); err != nil {
+		return err
+	}
+	return batch(len(names), func(i int) error {
+		return ofs.Remove(names[i])
+	})
+}
+
+// RenameBatch applies the renames in order, continuing on errors.
+// If any of them fails, a *BatchError with the result of each item is returned.
+// If the overlay isn't writable, that error is returned without trying any of them.
+func (ofs *OverlayFs) RenameBatch(pairs []RenamePair) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	if err := ofs.checkWritable("rename", pairs[0].Old); err != nil {
+		return err
+	}
+	return batch(len(pairs), func(i int) error {
+		return ofs.Rename(pairs[i].Old, pairs[i].New)
+	})
+}
+
+// batch calls apply for each of n items and collects the errors.
+func batch(n int, apply func(i int) error) error {
+	var errs []error
+	for i := 0; i < n; i++ {
+		if err := apply(i); err != nil {
+			if errs == nil {
+				errs = make([]error, n)
+			}
+			errs[i] = err
+		}
+	}
+	if errs != nil {
+		return &BatchError{Errs: errs}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestRemoveBatch(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")}, FirstWritable: true})
+	c.Assert(ofs.RemoveBatch(nil), qt.IsNil)
+	c.Assert(ofs.RemoveBatch([]string{"mydir/f1-1.txt", "mydir/f2-1.txt"}), qt.IsNil)
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.DeepEquals, []string{"f1-2.txt", "f2-2.txt"})
+
+	// Files in lower filesystems can't be removed.
+	c.Assert(afero.WriteFile(ofs, "mydir/new.txt", []byte("new"), 0o666), qt.IsNil)
+	err := ofs.RemoveBatch([]string{"mydir/notfound.txt", "mydir/new.txt", "mydir/f2-2.txt"})
+	var berr *BatchError
+	c.Assert(errors.As(err, &berr), qt.IsTrue)
+	c.Assert(berr.Errs, qt.HasLen, 3)
+	c.Assert(berr.Errs[0], qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(berr.Errs[1], qt.IsNil)
+	c.Assert(berr.Errs[2], qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(err, qt.ErrorMatches, `2 of 3 operations failed, first error: remove mydir/notfound.txt: .*`)
+
+	ro := New(Options{Fss: []afero.Fs{basicFs("1", "1")}})
+	c.Assert(ro.RemoveBatch([]string{"mydir/f1-1.txt"}), qt.ErrorIs, ErrReadOnly)
+}
+
+func TestRenameBatch(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1")}, FirstWritable: true})
+	err := ofs.RenameBatch([]RenamePair{
+		{Old: "mydir/f1-1.txt", New: "mydir/a.txt"},
+		{Old: "mydir/notfound.txt", New: "mydir/b.txt"},
+		{Old: "mydir/a.txt", New: "mydir/c.txt"},
+	})
+	var berr *BatchError
+	c.Assert(errors.As(err, &berr), qt.IsTrue)
+	c.Assert(berr.Errs[0], qt.IsNil)
+	c.Assert(berr.Errs[1], qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(berr.Errs[2], qt.IsNil)
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.DeepEquals, []string{"c.txt", "f2-1.txt"})
+
+	ro := New(Options{Fss: []afero.Fs{basicFs("1", "1")}})
+	c.Assert(ro.RenameBatch([]RenamePair{{Old: "mydir/f1-1.txt", New: "mydir/a.txt"}}), qt.ErrorIs, ErrReadOnly)
+}
@@ -0,0 +1,100 @@
+package overlayfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// BOMEntry is a file in a bill of materials, see BOM.
+// It marshals to JSON with the field names in lower camel case.
+type BOMEntry struct {
+	// Path is the slash separated path relative to the root.
+	Path string `json:"path"`
+
+	Size int64 `json:"size"`
+
+	// SHA256 is the hex encoded SHA-256 hash of the content.
+	SHA256 string `json:"sha256"`
+
+	// Layer is the index of the filesystem the file comes from.
+	Layer int `json:"layer"`
+
+	// LayerName and LayerVersion are Layer.Label, defaulting to the filesystem's name,
+	// and Layer.Version of the filesystem the file comes from.
+	LayerName    string `json:"layerName"`
+	LayerVersion string `json:"layerVersion,omitempty"`
+}
+
+// BOM returns a bill of materials for the merged view of the tree rooted at root:
+// the regular files in walk order, each attributed to the filesystem it comes from.
+func (ofs *OverlayFs) BOM(root string) ([]BOMEntry, error) {
+	e := ofs.newExporter(context.Background(), ExportOptions{Root: root})
+	var entries []BOMEntry
+	err := e.walk(func(path string, d fs.DirEntry, err error) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		layer, err := ofs.sourceLayer(path)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := e.copyFileTo(h, path); err != nil {
+			return err
+		}
+		info := ofs.layers[layer]
+		name := info.label
+		if name == "" {
+			name = ofs.fss[layer].Name()
+		}
+		entries = append(entries, BOMEntry{
+			Path:         filepath.ToSlash(rel),
+			Size:         fi.Size(),
+			SHA256:       hex.EncodeToString(h.Sum(nil)),
+			Layer:        layer,
+			LayerName:    name,
+			LayerVersion: info.version,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// sourceLayer returns the index of the filesystem name is found in.
+func (ofs *OverlayFs) sourceLayer(name string) (int, error) {
+	for i, fs := range ofs.fss {
+		if _, _, _, err := ofs.statRecursive(fs, name, false); err == nil || !os.IsNotExist(err) {
+			return i, err
+		}
+	}
+	return -1, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// WriteBOMCSV writes entries to w as CSV with a header row.
+func WriteBOMCSV(w io.Writer, entries []BOMEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "size", "sha256", "layer", "layerName", "layerVersion"})
+	for _, e := range entries {
+		cw.Write([]string{e.Path, strconv.FormatInt(e.Size, 10), e.SHA256, strconv.Itoa(e.Layer), e.LayerName, e.LayerVersion})
+	}
+	cw.Flush()
+	return cw.Error()
+}
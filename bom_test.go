@@ -0,0 +1,50 @@
+package overlayfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestBOM(t *testing.T) {
+	c := qt.New(t)
+
+	project := fsFromTxtTar(`
+-- layouts/index.html --
+project index
+`)
+	theme := fsFromTxtTar(`
+-- layouts/index.html --
+theme index
+-- layouts/single.html --
+theme single
+`)
+	ofs := New(Options{Fss: []afero.Fs{project, Layer{Fs: theme, Label: "github.com/example/theme", Version: "v1.2.0"}}})
+
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+
+	entries, err := ofs.BOM("layouts")
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.DeepEquals, []BOMEntry{
+		{Path: "index.html", Size: 13, SHA256: sum("project index"), Layer: 0, LayerName: "MemMapFS"},
+		{Path: "single.html", Size: 12, SHA256: sum("theme single"), Layer: 1, LayerName: "github.com/example/theme", LayerVersion: "v1.2.0"},
+	})
+
+	b, err := json.Marshal(entries[1])
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, `{"path":"single.html","size":12,"sha256":"`+sum("theme single")+`","layer":1,"layerName":"github.com/example/theme","layerVersion":"v1.2.0"}`)
+
+	var buf bytes.Buffer
+	c.Assert(WriteBOMCSV(&buf, entries), qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, "path,size,sha256,layer,layerName,layerVersion\n"+
+		"index.html,13,"+sum("project index")+",0,MemMapFS,\n"+
+		"single.html,12,"+sum("theme single")+",1,github.com/example/theme,v1.2.0\n")
+}
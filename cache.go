@@ -0,0 +1,245 @@
+package overlayfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ Cache = (*mapCache)(nil)
+	_ Cache = (*statCache)(nil)
+)
+
+// Cache is a cache used for the overlay's internal caches, see Options.Cache.
+// It must be safe for concurrent use.
+// The values are internal to the overlay and must be returned as set.
+// As a Cache may be shared between overlays, invalidating the caches of one overlay
+// doesn't clear it; the entries set before are no longer used and are left for the Cache to evict.
+type Cache interface {
+	// Get returns the value for key, if found.
+	Get(key string) (any, bool)
+
+	// Set sets the value for key. The cache may drop it at any time.
+	Set(key string, value any)
+
+	// Delete deletes the value for key, if found.
+	Delete(key string)
+
+	// Clear deletes all values.
+	Clear()
+}
+
+// InvalidateCaches invalidates all cached results, e.g. of DirSizes and the stat cache.
+// Writes through the overlay invalidate the caches automatically; call this
+// after modifying the filesystems directly.
+func (ofs *OverlayFs) InvalidateCaches() {
+	ofs.caches.invalidate()
+}
+
+// caches holds cached results computed from the merged view.
+// It's shared by the shallow copies of an OverlayFs, which are told apart in the keys,
+// so a write through any of them invalidates all.
+type caches struct {
+	// Incremented on invalidation. It's part of the keys, so results computed
+	// during an invalidation are never returned.
+	gen atomic.Uint64
+
+	dirSizes Cache
+
+	// Set to Options.Cache, if set, for the lookups in fingerprinted layers.
+	layers Cache
+
+	// Whether the caches are Options.Cache, which may be shared with other overlays.
+	shared bool
+
+	// Set if the stat cache is enabled, see Options.StatCache.
+	stat     Cache
+	statTTLs statTTLs
+	stale    time.Duration // See StatCacheOptions.StaleWhileRevalidate.
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+	now      func() time.Time
+
+	revalidateMu sync.Mutex
+	revalidating map[string]bool
+	revalidateWg sync.WaitGroup // For tests.
+}
+
+func newCaches(cache Cache, statOpts StatCacheOptions) *caches {
+	c := &caches{dirSizes: cache, stat: cache, layers: cache, shared: cache != nil, now: time.Now}
+	if cache == nil {
+		c.dirSizes = &mapCache{m: make(map[string]any)}
+		if statOpts.MaxEntries > 0 {
+			c.stat = newStatCache(statOpts)
+		}
+	}
+	if c.stat != nil {
+		c.statTTLs = newStatTTLs(statOpts)
+		c.stale = statOpts.StaleWhileRevalidate
+		c.revalidating = make(map[string]bool)
+	}
+	return c
+}
+
+// key returns the key for name in the cache of the given kind.
+func (c *caches) key(kind string, ofs *OverlayFs, name string) string {
+	return fmt.Sprintf("overlayfs/%s/%d/%d/%s", kind, ofs.id, c.gen.Load(), name)
+}
+
+// invalidate makes the entries cached so far unused, as the generation is part of the keys.
+// The built-in caches are also cleared to free the memory.
+func (c *caches) invalidate() {
+	c.gen.Add(1)
+	if c.shared {
+		return
+	}
+	c.dirSizes.Clear()
+	if c.stat != nil && c.stat != c.dirSizes {
+		c.stat.Clear()
+	}
+}
+
+// generation returns the number of times the caches have been invalidated.
+func (c *caches) generation() uint64 {
+	return c.gen.Load()
+}
+
+type statEntry struct {
+	fs      afero.Fs
+	fi      os.FileInfo
+	ok      bool
+	err     error
+	expires time.Time // Zero if the entry doesn't expire.
+}
+
+// statLookup returns the cached result of lookup for key, or calls lookup and caches its result.
+func (c *caches) statLookup(key lookupKey, lookup func(lookupKey) (afero.Fs, os.FileInfo, bool, error)) (afero.Fs, os.FileInfo, bool, error) {
+	kind := "stat"
+	if key.lstatIfPossible {
+		kind = "lstat"
+	}
+	ck := c.key(kind, key.ofs, key.name)
+	if v, found := c.stat.Get(ck); found {
+		if e, ok := v.(*statEntry); ok {
+			now := c.now()
+			if e.expires.IsZero() || now.Before(e.expires) {
+				c.hits.Add(1)
+				return e.fs, e.fi, e.ok, e.err
+			}
+			if c.stale > 0 && now.Before(e.expires.Add(c.stale)) {
+				c.hits.Add(1)
+				c.revalidate(ck, key, lookup)
+				return e.fs, e.fi, e.ok, e.err
+			}
+		}
+		c.stat.Delete(ck)
+	}
+	c.misses.Add(1)
+	fs, fi, ok, err := lookup(key)
+	c.setStat(ck, key.name, fs, fi, ok, err)
+	return fs, fi, ok, err
+}
+
+// setStat caches the result of a lookup of name, if it's cacheable.
+func (c *caches) setStat(ck, name string, fs afero.Fs, fi os.FileInfo, ok bool, err error) {
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	ttl := c.statTTLs.forName(name)
+	if ttl < 0 {
+		return
+	}
+	e := &statEntry{fs: fs, fi: fi, ok: ok, err: err}
+	if ttl > 0 {
+		e.expires = c.now().Add(ttl)
+	}
+	c.stat.Set(ck, e)
+}
+
+// revalidate looks up key again in the background and replaces the stale entry for ck,
+// unless a revalidation of ck is already running.
+func (c *caches) revalidate(ck string, key lookupKey, lookup func(lookupKey) (afero.Fs, os.FileInfo, bool, error)) {
+	c.revalidateMu.Lock()
+	if c.revalidating[ck] {
+		c.revalidateMu.Unlock()
+		return
+	}
+	c.revalidating[ck] = true
+	c.revalidateMu.Unlock()
+
+	c.revalidateWg.Add(1)
+	go func() {
+		defer func() {
+			// A panicking lookup leaves the stale entry to expire.
+			recover()
+			c.revalidateMu.Lock()
+			delete(c.revalidating, ck)
+			c.revalidateMu.Unlock()
+			c.revalidateWg.Done()
+		}()
+		fs, fi, ok, err := lookup(key)
+		c.setStat(ck, key.name, fs, fi, ok, err)
+	}()
+}
+
+// statTTLs are the TTLs of the stat cache, see StatCacheOptions.
+type statTTLs struct {
+	ttl      time.Duration
+	prefixes []prefixTTL // Longest prefix first.
+}
+
+type prefixTTL struct {
+	prefix string
+	ttl    time.Duration
+}
+
+// forName returns the TTL for name.
+func (t statTTLs) forName(name string) time.Duration {
+	if len(t.prefixes) == 0 {
+		return t.ttl
+	}
+	name = cleanScopePath(name)
+	for _, p := range t.prefixes {
+		if p.prefix == "." || name == p.prefix || strings.HasPrefix(name, p.prefix+"/") {
+			return p.ttl
+		}
+	}
+	return t.ttl
+}
+
+// mapCache is the default Cache for the caches not bounded in size.
+type mapCache struct {
+	mu sync.Mutex
+	m  map[string]any
+}
+
+func (c *mapCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, found := c.m[key]
+	return v, found
+}
+
+func (c *mapCache) Set(key string, value any) {
+	c.mu.Lock()
+	c.m[key] = value
+	c.mu.Unlock()
+}
+
+func (c *mapCache) Delete(key string) {
+	c.mu.Lock()
+	delete(c.m, key)
+	c.mu.Unlock()
+}
+
+func (c *mapCache) Clear() {
+	c.mu.Lock()
+	clear(c.m)
+	c.mu.Unlock()
+}
@@ -0,0 +1,90 @@
+package overlayfs
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+type testCache struct {
+	mu     sync.Mutex
+	m      map[string]any
+	clears int
+}
+
+func (c *testCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, found := c.m[key]
+	return v, found
+}
+
+func (c *testCache) Set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = value
+}
+
+func (c *testCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, key)
+}
+
+func (c *testCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clears++
+	clear(c.m)
+}
+
+func (c *testCache) keys(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for k := range c.m {
+		if strings.HasPrefix(k, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCache(t *testing.T) {
+	c := qt.New(t)
+
+	cache := &testCache{m: make(map[string]any)}
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}, FirstWritable: true, Cache: cache})
+
+	_, err := ofs.Stat("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	_, err = ofs.Stat("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ofs.StatCacheStats(), qt.DeepEquals, CacheStats{Hits: 1, Misses: 1})
+	c.Assert(cache.keys("overlayfs/stat/"), qt.Equals, 1)
+
+	sizes, err := ofs.DirSizes("")
+	c.Assert(err, qt.IsNil)
+	sizes2, err := ofs.DirSizes("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sizes2, qt.DeepEquals, sizes)
+	c.Assert(cache.keys("overlayfs/dirsizes/"), qt.Equals, 1)
+
+	// Writes through the overlay invalidate the entries, but don't clear the cache,
+	// which may be shared with other overlays.
+	c.Assert(afero.WriteFile(ofs, "mydir/new.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(cache.clears, qt.Equals, 0)
+	_, err = ofs.Stat("mydir/new.txt")
+	c.Assert(err, qt.IsNil)
+	sizes, err = ofs.DirSizes("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sizes["mydir"].Files, qt.Equals, sizes2["mydir"].Files+1)
+
+	// Overlays sharing a cache don't see each other's entries.
+	ofs2 := New(Options{Fss: []afero.Fs{basicFs("3", "1")}, Cache: cache})
+	_, err = ofs2.Stat("mydir/f1-1.txt")
+	c.Assert(err, qt.Not(qt.IsNil))
+}
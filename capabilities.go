@@ -0,0 +1,77 @@
+package overlayfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/spf13/afero"
+)
+
+// Capabilities describes what a filesystem in the overlay supports, see OverlayFs.Capabilities.
+type Capabilities struct {
+	// Writable is set if writes through the overlay can be routed to the filesystem.
+	Writable bool
+
+	// Lstat is set if LstatIfPossible uses lstat, i.e. symbolic links aren't followed.
+	Lstat bool
+
+	// Symlinks is set if symbolic links can be read, see afero.LinkReader.
+	Symlinks bool
+
+	// ReadDirFile is set if its directories implement fs.ReadDirFile.
+	ReadDirFile bool
+
+	// Seek is set if its files support seeking.
+	Seek bool
+
+	// AtomicRename is set if Rename replaces the target atomically, as with the os and memory filesystems.
+	AtomicRename bool
+}
+
+// Capabilities reports what the filesystem at index i supports, see Filesystem.
+// They're derived from its type and by probing its root without modifying it,
+// so the result should be kept rather than asked for on every operation.
+// The zero value is returned if i is out of range.
+func (ofs *OverlayFs) Capabilities(i int) Capabilities {
+	if i < 0 || i >= len(ofs.fss) {
+		return Capabilities{}
+	}
+	var caps Capabilities
+	for _, j := range ofs.writableLayers() {
+		caps.Writable = caps.Writable || i == j
+	}
+
+	lfs := ofs.layer(ofs.fss[i])
+	if lstater, ok := lfs.(afero.Lstater); ok {
+		_, lstat, err := lstater.LstatIfPossible(".")
+		caps.Lstat = err == nil && lstat
+	}
+	if lr, ok := lfs.(afero.LinkReader); ok {
+		// Reading a directory as a link fails with a different error when links are supported.
+		_, err := lr.ReadlinkIfPossible(".")
+		caps.Symlinks = err != nil && !errors.Is(err, afero.ErrNoReadlink)
+	}
+	if f, err := lfs.Open("."); err == nil {
+		_, caps.ReadDirFile = f.(fs.ReadDirFile)
+		_, err = f.Seek(0, io.SeekStart)
+		caps.Seek = err == nil
+		f.Close()
+	}
+
+	switch unwrapRefCounted(unwrapScoped(ofs.fss[i])).(type) {
+	case *afero.OsFs, *afero.MemMapFs:
+		caps.AtomicRename = true
+	case *afero.BasePathFs:
+		// Only the os filesystem supports lstat.
+		caps.AtomicRename = caps.Lstat
+	}
+	return caps
+}
+
+func unwrapRefCounted(fs afero.Fs) afero.Fs {
+	if r, ok := fs.(*RefCountedFs); ok {
+		return r.Fs
+	}
+	return fs
+}
@@ -0,0 +1,60 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestCapabilities(t *testing.T) {
+	c := qt.New(t)
+
+	osFs := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+	ofs := New(Options{
+		Fss: []afero.Fs{
+			noReadDirFs{afero.NewMemMapFs()},
+			readDirFs{afero.NewMemMapFs()},
+			NewRefCountedFs(osFs),
+			afero.NewReadOnlyFs(basicFs("1", "1")),
+			afero.NewMemMapFs(),
+		},
+		FirstWritable: true,
+	})
+
+	c.Assert(ofs.Capabilities(0), qt.Equals, Capabilities{Writable: true, Seek: true})
+	c.Assert(ofs.Capabilities(1), qt.Equals, Capabilities{ReadDirFile: true, Seek: true})
+	c.Assert(ofs.Capabilities(2), qt.Equals, Capabilities{Lstat: true, Symlinks: true, ReadDirFile: true, Seek: true, AtomicRename: true})
+	c.Assert(ofs.Capabilities(3).AtomicRename, qt.IsFalse)
+	c.Assert(ofs.Capabilities(3).Lstat, qt.IsFalse)
+	c.Assert(ofs.Capabilities(4).AtomicRename, qt.IsTrue)
+	c.Assert(ofs.Capabilities(5), qt.Equals, Capabilities{})
+}
+
+// readDirFs wraps a filesystem so its files implement fs.ReadDirFile,
+// whether the files of the wrapped filesystem do or not.
+type readDirFs struct {
+	afero.Fs
+}
+
+func (rfs readDirFs) Open(name string) (afero.File, error) {
+	f, err := rfs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readDirFile{f}, nil
+}
+
+type readDirFile struct {
+	afero.File
+}
+
+func (f readDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	fis, err := f.Readdir(n)
+	dirEntries := make([]fs.DirEntry, len(fis))
+	for i, fi := range fis {
+		dirEntries[i] = dirEntry{fi}
+	}
+	return dirEntries, err
+}
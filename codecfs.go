@@ -0,0 +1,299 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs         = (*CodecFs)(nil)
+	_ afero.Lstater    = (*CodecFs)(nil)
+	_ afero.LinkReader = (*CodecFs)(nil)
+	_ afero.Linker     = (*CodecFs)(nil)
+	_ XattrFs          = (*CodecFs)(nil)
+	_ fs.ReadDirFile   = (*codecFile)(nil)
+)
+
+// PathCodec translates between the logical names presented by the overlay
+// and the physical names stored in a filesystem, e.g. percent-encoded or hashed names.
+// Both functions operate on a single path element.
+type PathCodec struct {
+	// Encode translates a logical name to its physical name.
+	Encode func(name string) string
+
+	// Decode translates a physical name read from a directory to its logical name.
+	Decode func(name string) string
+}
+
+func (c PathCodec) encodePath(name string) string {
+	return mapPath(name, c.Encode)
+}
+
+func (c PathCodec) decodePath(name string) string {
+	return mapPath(name, c.Decode)
+}
+
+// mapPath applies fn to each element of name.
+func mapPath(name string, fn func(string) string) string {
+	parts := strings.Split(name, string(filepath.Separator))
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts[i] = fn(part)
+	}
+	return strings.Join(parts, string(filepath.Separator))
+}
+
+// CodecFs is a filesystem that translates all names using a PathCodec.
+// The paths in the errors it returns and the targets of symbolic links
+// are translated the same way.
+type CodecFs struct {
+	fs    afero.Fs
+	codec PathCodec
+}
+
+// NewCodecFs creates a new CodecFs that presents the logical names of fs using codec.
+func NewCodecFs(fs afero.Fs, codec PathCodec) *CodecFs {
+	return &CodecFs{fs: fs, codec: codec}
+}
+
+// Name returns the name of this filesystem.
+func (c *CodecFs) Name() string {
+	return "codecfs"
+}
+
+// Create implements afero.Fs.Create.
+func (c *CodecFs) Create(name string) (afero.File, error) {
+	return c.wrapFile(name)(c.fs.Create(c.codec.encodePath(name)))
+}
+
+// Mkdir implements afero.Fs.Mkdir.
+func (c *CodecFs) Mkdir(name string, perm os.FileMode) error {
+	return c.fixErr(c.fs.Mkdir(c.codec.encodePath(name), perm))
+}
+
+// MkdirAll implements afero.Fs.MkdirAll.
+func (c *CodecFs) MkdirAll(path string, perm os.FileMode) error {
+	return c.fixErr(c.fs.MkdirAll(c.codec.encodePath(path), perm))
+}
+
+// Open implements afero.Fs.Open.
+func (c *CodecFs) Open(name string) (afero.File, error) {
+	return c.wrapFile(name)(c.fs.Open(c.codec.encodePath(name)))
+}
+
+// OpenFile implements afero.Fs.OpenFile.
+func (c *CodecFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	return c.wrapFile(name)(c.fs.OpenFile(c.codec.encodePath(name), flag, perm))
+}
+
+// Remove implements afero.Fs.Remove.
+func (c *CodecFs) Remove(name string) error {
+	return c.fixErr(c.fs.Remove(c.codec.encodePath(name)))
+}
+
+// RemoveAll implements afero.Fs.RemoveAll.
+func (c *CodecFs) RemoveAll(path string) error {
+	return c.fixErr(c.fs.RemoveAll(c.codec.encodePath(path)))
+}
+
+// Rename implements afero.Fs.Rename.
+func (c *CodecFs) Rename(oldname, newname string) error {
+	return c.fixErr(c.fs.Rename(c.codec.encodePath(oldname), c.codec.encodePath(newname)))
+}
+
+// Stat implements afero.Fs.Stat.
+func (c *CodecFs) Stat(name string) (os.FileInfo, error) {
+	fi, err := c.fs.Stat(c.codec.encodePath(name))
+	if err != nil {
+		return nil, c.fixErr(err)
+	}
+	return c.decodeFileInfo(fi), nil
+}
+
+// LstatIfPossible implements afero.Lstater.
+func (c *CodecFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	lstater, ok := c.fs.(afero.Lstater)
+	if !ok {
+		fi, err := c.Stat(name)
+		return fi, false, err
+	}
+	fi, ok, err := lstater.LstatIfPossible(c.codec.encodePath(name))
+	if err != nil {
+		return nil, ok, c.fixErr(err)
+	}
+	return c.decodeFileInfo(fi), ok, nil
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (c *CodecFs) ReadlinkIfPossible(name string) (string, error) {
+	if lr, ok := c.fs.(afero.LinkReader); ok {
+		target, err := lr.ReadlinkIfPossible(c.codec.encodePath(name))
+		if err != nil {
+			return "", c.fixErr(err)
+		}
+		return c.codec.decodePath(target), nil
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+// SymlinkIfPossible implements afero.Linker.
+func (c *CodecFs) SymlinkIfPossible(oldname, newname string) error {
+	if linker, ok := c.fs.(afero.Linker); ok {
+		return c.fixErr(linker.SymlinkIfPossible(c.codec.encodePath(oldname), c.codec.encodePath(newname)))
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+// GetXattr implements XattrFs.
+func (c *CodecFs) GetXattr(name, attr string) ([]byte, error) {
+	xfs, ok := asXattrFs(c.fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	v, err := xfs.GetXattr(c.codec.encodePath(name), attr)
+	return v, c.fixErr(err)
+}
+
+// SetXattr implements XattrFs.
+func (c *CodecFs) SetXattr(name, attr string, value []byte) error {
+	xfs, ok := asXattrFs(c.fs)
+	if !ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return c.fixErr(xfs.SetXattr(c.codec.encodePath(name), attr, value))
+}
+
+// ListXattr implements XattrFs.
+func (c *CodecFs) ListXattr(name string) ([]string, error) {
+	xfs, ok := asXattrFs(c.fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	attrs, err := xfs.ListXattr(c.codec.encodePath(name))
+	return attrs, c.fixErr(err)
+}
+
+// Chmod implements afero.Fs.Chmod.
+func (c *CodecFs) Chmod(name string, mode os.FileMode) error {
+	return c.fixErr(c.fs.Chmod(c.codec.encodePath(name), mode))
+}
+
+// Chown implements afero.Fs.Chown.
+func (c *CodecFs) Chown(name string, uid, gid int) error {
+	return c.fixErr(c.fs.Chown(c.codec.encodePath(name), uid, gid))
+}
+
+// Chtimes implements afero.Fs.Chtimes.
+func (c *CodecFs) Chtimes(name string, atime, mtime time.Time) error {
+	return c.fixErr(c.fs.Chtimes(c.codec.encodePath(name), atime, mtime))
+}
+
+func (c *CodecFs) wrapFile(name string) func(afero.File, error) (afero.File, error) {
+	return func(f afero.File, err error) (afero.File, error) {
+		if err != nil {
+			return nil, c.fixErr(err)
+		}
+		return &codecFile{File: f, name: name, c: c}, nil
+	}
+}
+
+// fixErr translates the physical paths in err to logical names.
+func (c *CodecFs) fixErr(err error) error {
+	switch e := err.(type) {
+	case *fs.PathError:
+		return &fs.PathError{Op: e.Op, Path: c.codec.decodePath(e.Path), Err: e.Err}
+	case *os.LinkError:
+		return &os.LinkError{Op: e.Op, Old: c.codec.decodePath(e.Old), New: c.codec.decodePath(e.New), Err: e.Err}
+	}
+	return err
+}
+
+func (c *CodecFs) decodeFileInfo(fi os.FileInfo) os.FileInfo {
+	return namedFileInfo{FileInfo: fi, name: c.codec.Decode(fi.Name())}
+}
+
+// codecFile decodes the names of a file and its directory entries.
+type codecFile struct {
+	afero.File
+	name string
+	c    *CodecFs
+}
+
+func (f *codecFile) Name() string {
+	return f.name
+}
+
+func (f *codecFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.c.decodeFileInfo(fi), nil
+}
+
+func (f *codecFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	for i, fi := range fis {
+		fis[i] = f.c.decodeFileInfo(fi)
+	}
+	return fis, err
+}
+
+func (f *codecFile) Readdirnames(n int) ([]string, error) {
+	names, err := f.File.Readdirnames(n)
+	for i, name := range names {
+		names[i] = f.c.codec.Decode(name)
+	}
+	return names, err
+}
+
+func (f *codecFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if rdf, ok := f.File.(fs.ReadDirFile); ok {
+		dirEntries, err := rdf.ReadDir(n)
+		for i, dirEntry := range dirEntries {
+			dirEntries[i] = namedDirEntry{DirEntry: dirEntry, name: f.c.codec.Decode(dirEntry.Name())}
+		}
+		return dirEntries, err
+	}
+	fis, err := f.Readdir(n)
+	dirEntries := make([]fs.DirEntry, len(fis))
+	for i, fi := range fis {
+		dirEntries[i] = dirEntry{fi}
+	}
+	return dirEntries, err
+}
+
+// namedFileInfo is an os.FileInfo with a different name.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string {
+	return fi.name
+}
+
+// namedDirEntry is a fs.DirEntry with a different name.
+type namedDirEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (d namedDirEntry) Name() string {
+	return d.name
+}
+
+func (d namedDirEntry) Info() (fs.FileInfo, error) {
+	fi, err := d.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return namedFileInfo{FileInfo: fi, name: d.name}, nil
+}
@@ -0,0 +1,97 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestCodecFs(t *testing.T) {
+	c := qt.New(t)
+	codec := PathCodec{
+		Encode: url.PathEscape,
+		Decode: func(name string) string {
+			s, err := url.PathUnescape(name)
+			if err != nil {
+				return name
+			}
+			return s
+		},
+	}
+
+	encoded := fsFromTxtTar(`
+-- my%20dir/hello%20world.txt --
+hello
+-- my%20dir/plain.txt --
+plain
+`)
+	cfs := NewCodecFs(encoded, codec)
+	ofs := New(Options{Fss: []afero.Fs{cfs, basicFs("1", "1")}, FirstWritable: true})
+
+	c.Assert(readFile(c, ofs, "my dir/hello world.txt"), qt.Equals, "hello")
+	fi, err := ofs.Stat("my dir/hello world.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Name(), qt.Equals, "hello world.txt")
+	c.Assert(readDirnames(c, ofs, "my dir"), qt.DeepEquals, []string{"hello world.txt", "plain.txt"})
+
+	f, err := ofs.Open("my dir")
+	c.Assert(err, qt.IsNil)
+	dirEntries, err := f.(fs.ReadDirFile).ReadDir(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(dirEntries[0].Name(), qt.Equals, "hello world.txt")
+	fi, err = dirEntries[0].Info()
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Name(), qt.Equals, "hello world.txt")
+	c.Assert(f.Close(), qt.IsNil)
+
+	c.Assert(afero.WriteFile(ofs, "my dir/a b.txt", []byte("ab"), 0o666), qt.IsNil)
+	_, err = encoded.Stat("my%20dir/a%20b.txt")
+	c.Assert(err, qt.IsNil)
+
+	// Errors report the logical names.
+	_, err = cfs.Stat(filepath.FromSlash("my dir/not found.txt"))
+	var perr *fs.PathError
+	c.Assert(errors.As(err, &perr), qt.IsTrue)
+	c.Assert(perr.Path, qt.Equals, filepath.FromSlash("my dir/not found.txt"))
+	err = cfs.Rename(filepath.FromSlash("my dir/not found.txt"), "b c.txt")
+	c.Assert(errors.As(err, &perr), qt.IsTrue)
+	c.Assert(perr.Path, qt.Equals, filepath.FromSlash("my dir/not found.txt"))
+}
+
+func TestCodecFsOptionalInterfaces(t *testing.T) {
+	c := qt.New(t)
+	codec := PathCodec{Encode: url.PathEscape, Decode: func(name string) string {
+		s, _ := url.PathUnescape(name)
+		return s
+	}}
+	dir := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "f%201.txt"), []byte("f"), 0o666), qt.IsNil)
+	cfs := NewCodecFs(afero.NewBasePathFs(afero.NewOsFs(), dir), codec)
+
+	if err := cfs.SymlinkIfPossible("f 1.txt", "link 1.txt"); err != nil {
+		t.Skipf("symlinks not supported: %s", err)
+	}
+	_, err := os.Lstat(filepath.Join(dir, "link%201.txt"))
+	c.Assert(err, qt.IsNil)
+	target, err := cfs.ReadlinkIfPossible("link 1.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(filepath.Base(target), qt.Equals, "f 1.txt")
+	c.Assert(readFile(c, cfs, "link 1.txt"), qt.Equals, "f")
+
+	xfs := NewCodecFs(NewXattrMapFs(afero.NewMemMapFs()), codec)
+	c.Assert(afero.WriteFile(xfs, "g 1.txt", []byte("g"), 0o666), qt.IsNil)
+	c.Assert(xfs.SetXattr("g 1.txt", "user.lang", []byte("en")), qt.IsNil)
+	v, err := xfs.GetXattr("g 1.txt", "user.lang")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "en")
+	_, err = xfs.ListXattr("h 1.txt")
+	var perr *fs.PathError
+	c.Assert(errors.As(err, &perr), qt.IsTrue)
+	c.Assert(perr.Path, qt.Equals, "h 1.txt")
+}
@@ -0,0 +1,120 @@
+package overlayfs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/afero"
+)
+
+// Compact writes the merged view of layers, in order, to dst as a single filesystem,
+// merging directories with the DirsMerger of ofs.
+// Only directories and regular files are written, with their mode and modification time.
+// With Options.Whiteouts, the whiteouts in layers hiding names not in the merged view are
+// kept in dst, so dst hides the same names as layers in the filesystems below it.
+func (ofs *OverlayFs) Compact(dst afero.Fs, layers ...afero.Fs) error {
+	view := *ofs
+	view.fss, view.layers = addLayers(nil, nil, layers...)
+	view.firstWritable, view.writeFs, view.writeRules = false, nil, nil
+	view.onMiss, view.access = nil, nil
+	view.newInstance()
+
+	if err := view.MaterializeTo(context.Background(), dst, ExportOptions{PreserveAttrs: PreserveMode | PreserveTimes}); err != nil {
+		return err
+	}
+	if !ofs.whiteouts {
+		return nil
+	}
+	for _, lfs := range view.fss {
+		err := afero.Walk(view.layer(lfs), "", func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				if path == "" && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || !isWhiteout(path) {
+				return nil
+			}
+			return view.compactWhiteout(dst, path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactWhiteout writes the whiteout marker wh to dst if the name it hides is not in
+// the merged view and its directory is in dst.
+// Otherwise it's either redundant or hidden by a whiteout of one of its parents.
+func (ofs *OverlayFs) compactWhiteout(dst afero.Fs, wh string) error {
+	name := filepath.Join(filepath.Dir(wh), filepath.Base(wh)[len(ociWhiteoutPrefix):])
+	if _, _, _, err := ofs.statLayers(name, true); !os.IsNotExist(err) {
+		return err
+	}
+	if dir := filepath.Dir(wh); dir != "." && dir != string(filepath.Separator) {
+		if fi, err := dst.Stat(dir); err != nil || !fi.IsDir() {
+			return nil
+		}
+	}
+	f, err := dst.Create(wh)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Compacted creates a shallow copy of the filesystem with each run of two or more
+// consecutive read-only filesystems of the same weight replaced by a single in-memory
+// filesystem holding their merged view, see Compact.
+// This reduces the number of filesystems each lookup goes through in deep stacks.
+// The writable filesystems are kept, and the WriteRules are updated to keep writing to them.
+func (ofs OverlayFs) Compacted() (*OverlayFs, error) {
+	writable := ofs.writableLayers()
+	var (
+		fss     []afero.Fs
+		layers  []layerInfo
+		indexes = make(map[int]int)
+	)
+	for i := 0; i < len(ofs.fss); {
+		j := i + 1
+		if !slices.Contains(writable, i) {
+			for j < len(ofs.fss) && !slices.Contains(writable, j) && ofs.layers[j].weight == ofs.layers[i].weight {
+				j++
+			}
+		}
+		if j-i == 1 {
+			indexes[i] = len(fss)
+			fss, layers = append(fss, ofs.fss[i]), append(layers, ofs.layers[i])
+			i = j
+			continue
+		}
+		dst := afero.NewMemMapFs()
+		if err := ofs.Compact(dst, ofs.fss[i:j]...); err != nil {
+			return nil, err
+		}
+		fss, layers = append(fss, dst), append(layers, layerInfo{weight: ofs.layers[i].weight})
+		i = j
+	}
+
+	if ofs.writeRules != nil {
+		rules := make([]WriteRule, len(ofs.writeRules))
+		for k, r := range ofs.writeRules {
+			if j, ok := indexes[r.Layer]; ok {
+				r.Layer = j
+			} else {
+				// Not a filesystem, rejected with ErrNoWritableFilesystem.
+				r.Layer = -1
+			}
+			rules[k] = r
+		}
+		ofs.writeRules = rules
+	}
+	ofs.fss, ofs.layers = fss, layers
+	ofs.newInstance()
+	return &ofs, nil
+}
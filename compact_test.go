@@ -0,0 +1,109 @@
+package overlayfs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestCompact(t *testing.T) {
+	c := qt.New(t)
+
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	top := fsFromTxtTar(`
+-- a/b.txt --
+b1
+-- a/.wh.c.txt --
+-- .wh.d --
+-- .wh.e.txt --
+`)
+	mid := fsFromTxtTar(`
+-- a/b.txt --
+b2
+-- a/f.txt --
+f
+-- d/g.txt --
+g
+-- .wh.h.txt --
+-- e.txt --
+e
+`)
+	bottom := fsFromTxtTar(`
+-- a/c.txt --
+c
+-- d/i.txt --
+i
+-- h.txt --
+h
+-- j.txt --
+j
+`)
+	c.Assert(top.Chtimes(filepath.FromSlash("a/b.txt"), mtime, mtime), qt.IsNil)
+
+	ofs := New(Options{Fss: []afero.Fs{top, mid, bottom}, Whiteouts: true})
+	dst := afero.NewMemMapFs()
+	c.Assert(ofs.Compact(dst, top, mid), qt.IsNil)
+
+	c.Assert(readFile(c, dst, "a/b.txt"), qt.Equals, "b1")
+	c.Assert(readFile(c, dst, "a/f.txt"), qt.Equals, "f")
+	fi, err := dst.Stat(filepath.FromSlash("a/b.txt"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.ModTime().Equal(mtime), qt.IsTrue)
+	c.Assert(readDirnames(c, dst, "a"), qt.DeepEquals, []string{".wh.c.txt", "b.txt", "f.txt"})
+	// e.txt is hidden in the merged view; d was hidden by top, so its contents in mid are gone.
+	c.Assert(readDirnames(c, dst, ""), qt.DeepEquals, []string{".wh.d", ".wh.e.txt", ".wh.h.txt", "a"})
+
+	compacted := New(Options{Fss: []afero.Fs{dst, bottom}, Whiteouts: true})
+	for _, dir := range []string{"", "a"} {
+		c.Assert(readDirnames(c, compacted, dir), qt.DeepEquals, readDirnames(c, ofs, dir), qt.Commentf(dir))
+	}
+
+	c.Run("Without whiteouts", func(c *qt.C) {
+		dst := afero.NewMemMapFs()
+		c.Assert(New(Options{}).Compact(dst, mid, bottom), qt.IsNil)
+		c.Assert(readDirnames(c, dst, "d"), qt.DeepEquals, []string{"g.txt", "i.txt"})
+		c.Assert(readDirnames(c, dst, ""), qt.DeepEquals, []string{".wh.h.txt", "a", "d", "e.txt", "h.txt", "j.txt"})
+	})
+}
+
+func TestCompacted(t *testing.T) {
+	c := qt.New(t)
+
+	w, assets := afero.NewMemMapFs(), afero.NewMemMapFs()
+	l1 := fsFromTxtTar(`
+-- a.txt --
+a1
+`)
+	l2 := fsFromTxtTar(`
+-- a.txt --
+a2
+-- b.txt --
+b2
+`)
+	l3 := fsFromTxtTar(`
+-- c.txt --
+c3
+`)
+	ofs := New(Options{
+		Fss:           []afero.Fs{w, l1, l2, assets, l3, Layer{Fs: fsFromTxtTar("-- d.txt --\nd"), Weight: -1}},
+		FirstWritable: true,
+		WriteRules:    []WriteRule{{Exts: []string{".css"}, Layer: 3}},
+	})
+
+	compacted, err := ofs.Compacted()
+	c.Assert(err, qt.IsNil)
+	c.Assert(compacted.NumFilesystems(), qt.Equals, 5)
+	c.Assert(compacted.Filesystem(0), qt.Equals, w)
+	c.Assert(compacted.Filesystem(2), qt.Equals, assets)
+	c.Assert(compacted.Filesystem(3), qt.Equals, l3)
+	c.Assert(readFile(c, compacted, "a.txt"), qt.Equals, "a1")
+	c.Assert(readFile(c, compacted, "b.txt"), qt.Equals, "b2")
+	c.Assert(readDirnames(c, compacted, ""), qt.DeepEquals, readDirnames(c, ofs, ""))
+
+	c.Assert(afero.WriteFile(compacted, "main.css", []byte("body{}"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, assets, "main.css"), qt.Equals, "body{}")
+	c.Assert(ofs.NumFilesystems(), qt.Equals, 6)
+}
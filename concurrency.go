@@ -0,0 +1,328 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs         = limitedFs{}
+	_ afero.Lstater    = limitedFs{}
+	_ afero.LinkReader = limitedFs{}
+	_ afero.Linker     = limitedFs{}
+	_ XattrFs          = limitedFs{}
+	_ afero.File       = limitedFile{}
+)
+
+// opLimiter limits the number of concurrent layer operations, see Options.MaxConcurrentOps.
+// It's shared by the shallow copies of an OverlayFs.
+type opLimiter struct {
+	sem          chan struct{}
+	failWhenBusy bool
+}
+
+func newOpLimiter(max int, failWhenBusy bool) *opLimiter {
+	return &opLimiter{sem: make(chan struct{}, max), failWhenBusy: failWhenBusy}
+}
+
+func (l *opLimiter) acquire(op, name string) error {
+	if l.failWhenBusy {
+		select {
+		case l.sem <- struct{}{}:
+			return nil
+		default:
+			return &fs.PathError{Op: op, Path: name, Err: ErrBusy}
+		}
+	}
+	l.sem <- struct{}{}
+	return nil
+}
+
+func (l *opLimiter) release() {
+	<-l.sem
+}
+
+// limitedFs runs the operations on fs and the files it returns through an opLimiter.
+type limitedFs struct {
+	fs afero.Fs
+	l  *opLimiter
+}
+
+func (lfs limitedFs) file(f afero.File, name string) afero.File {
+	if f == nil {
+		return nil
+	}
+	return limitedFile{File: f, l: lfs.l, name: name}
+}
+
+func (lfs limitedFs) Name() string {
+	return lfs.fs.Name()
+}
+
+func (lfs limitedFs) Create(name string) (afero.File, error) {
+	if err := lfs.l.acquire("create", name); err != nil {
+		return nil, err
+	}
+	defer lfs.l.release()
+	f, err := lfs.fs.Create(name)
+	return lfs.file(f, name), err
+}
+
+func (lfs limitedFs) Mkdir(name string, perm os.FileMode) error {
+	if err := lfs.l.acquire("mkdir", name); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return lfs.fs.Mkdir(name, perm)
+}
+
+func (lfs limitedFs) MkdirAll(path string, perm os.FileMode) error {
+	if err := lfs.l.acquire("mkdir", path); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return lfs.fs.MkdirAll(path, perm)
+}
+
+func (lfs limitedFs) Open(name string) (afero.File, error) {
+	if err := lfs.l.acquire("open", name); err != nil {
+		return nil, err
+	}
+	defer lfs.l.release()
+	f, err := lfs.fs.Open(name)
+	return lfs.file(f, name), err
+}
+
+func (lfs limitedFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if err := lfs.l.acquire("open", name); err != nil {
+		return nil, err
+	}
+	defer lfs.l.release()
+	f, err := lfs.fs.OpenFile(name, flag, perm)
+	return lfs.file(f, name), err
+}
+
+func (lfs limitedFs) Remove(name string) error {
+	if err := lfs.l.acquire("remove", name); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return lfs.fs.Remove(name)
+}
+
+func (lfs limitedFs) RemoveAll(path string) error {
+	if err := lfs.l.acquire("removeall", path); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return lfs.fs.RemoveAll(path)
+}
+
+func (lfs limitedFs) Rename(oldname, newname string) error {
+	if err := lfs.l.acquire("rename", oldname); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return lfs.fs.Rename(oldname, newname)
+}
+
+func (lfs limitedFs) Stat(name string) (os.FileInfo, error) {
+	if err := lfs.l.acquire("stat", name); err != nil {
+		return nil, err
+	}
+	defer lfs.l.release()
+	return lfs.fs.Stat(name)
+}
+
+func (lfs limitedFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if err := lfs.l.acquire("lstat", name); err != nil {
+		return nil, false, err
+	}
+	defer lfs.l.release()
+	if lstater, ok := lfs.fs.(afero.Lstater); ok {
+		return lstater.LstatIfPossible(name)
+	}
+	fi, err := lfs.fs.Stat(name)
+	return fi, false, err
+}
+
+func (lfs limitedFs) ReadlinkIfPossible(name string) (string, error) {
+	if err := lfs.l.acquire("readlink", name); err != nil {
+		return "", err
+	}
+	defer lfs.l.release()
+	if lr, ok := lfs.fs.(afero.LinkReader); ok {
+		return lr.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+func (lfs limitedFs) SymlinkIfPossible(oldname, newname string) error {
+	if err := lfs.l.acquire("symlink", newname); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	if linker, ok := lfs.fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+func (lfs limitedFs) Chmod(name string, mode os.FileMode) error {
+	if err := lfs.l.acquire("chmod", name); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return lfs.fs.Chmod(name, mode)
+}
+
+func (lfs limitedFs) Chown(name string, uid, gid int) error {
+	if err := lfs.l.acquire("chown", name); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return lfs.fs.Chown(name, uid, gid)
+}
+
+func (lfs limitedFs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := lfs.l.acquire("chtimes", name); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return lfs.fs.Chtimes(name, atime, mtime)
+}
+
+func (lfs limitedFs) GetXattr(name, attr string) ([]byte, error) {
+	xfs, ok := asXattrFs(lfs.fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	if err := lfs.l.acquire("getxattr", name); err != nil {
+		return nil, err
+	}
+	defer lfs.l.release()
+	return xfs.GetXattr(name, attr)
+}
+
+func (lfs limitedFs) SetXattr(name, attr string, value []byte) error {
+	xfs, ok := asXattrFs(lfs.fs)
+	if !ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	if err := lfs.l.acquire("setxattr", name); err != nil {
+		return err
+	}
+	defer lfs.l.release()
+	return xfs.SetXattr(name, attr, value)
+}
+
+func (lfs limitedFs) ListXattr(name string) ([]string, error) {
+	xfs, ok := asXattrFs(lfs.fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	if err := lfs.l.acquire("listxattr", name); err != nil {
+		return nil, err
+	}
+	defer lfs.l.release()
+	return xfs.ListXattr(name)
+}
+
+// limitedFile runs the operations on a file returned by a limitedFs through its opLimiter.
+// Close is not limited, so a busy overlay doesn't leak handles.
+type limitedFile struct {
+	afero.File
+	l    *opLimiter
+	name string
+}
+
+func (f limitedFile) Read(p []byte) (int, error) {
+	if err := f.l.acquire("read", f.name); err != nil {
+		return 0, err
+	}
+	defer f.l.release()
+	return f.File.Read(p)
+}
+
+func (f limitedFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.l.acquire("read", f.name); err != nil {
+		return 0, err
+	}
+	defer f.l.release()
+	return f.File.ReadAt(p, off)
+}
+
+func (f limitedFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.l.acquire("seek", f.name); err != nil {
+		return 0, err
+	}
+	defer f.l.release()
+	return f.File.Seek(offset, whence)
+}
+
+func (f limitedFile) Write(p []byte) (int, error) {
+	if err := f.l.acquire("write", f.name); err != nil {
+		return 0, err
+	}
+	defer f.l.release()
+	return f.File.Write(p)
+}
+
+func (f limitedFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.l.acquire("write", f.name); err != nil {
+		return 0, err
+	}
+	defer f.l.release()
+	return f.File.WriteAt(p, off)
+}
+
+func (f limitedFile) WriteString(s string) (int, error) {
+	if err := f.l.acquire("write", f.name); err != nil {
+		return 0, err
+	}
+	defer f.l.release()
+	return f.File.WriteString(s)
+}
+
+func (f limitedFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.l.acquire("readdir", f.name); err != nil {
+		return nil, err
+	}
+	defer f.l.release()
+	return f.File.Readdir(count)
+}
+
+func (f limitedFile) Readdirnames(n int) ([]string, error) {
+	if err := f.l.acquire("readdir", f.name); err != nil {
+		return nil, err
+	}
+	defer f.l.release()
+	return f.File.Readdirnames(n)
+}
+
+func (f limitedFile) Stat() (os.FileInfo, error) {
+	if err := f.l.acquire("stat", f.name); err != nil {
+		return nil, err
+	}
+	defer f.l.release()
+	return f.File.Stat()
+}
+
+func (f limitedFile) Sync() error {
+	if err := f.l.acquire("sync", f.name); err != nil {
+		return err
+	}
+	defer f.l.release()
+	return f.File.Sync()
+}
+
+func (f limitedFile) Truncate(size int64) error {
+	if err := f.l.acquire("truncate", f.name); err != nil {
+		return err
+	}
+	defer f.l.release()
+	return f.File.Truncate(size)
+}
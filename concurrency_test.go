@@ -0,0 +1,95 @@
+package overlayfs
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+// blockingFs blocks Stat until unblocked if armed, recording the max number of concurrent calls.
+type blockingFs struct {
+	afero.Fs
+	armed   atomic.Bool
+	started chan struct{}
+	unblock chan struct{}
+
+	running, max atomic.Int32
+}
+
+func newBlockingFs(fs afero.Fs) *blockingFs {
+	return &blockingFs{Fs: fs, started: make(chan struct{}, 100), unblock: make(chan struct{})}
+}
+
+func (fs *blockingFs) Stat(name string) (os.FileInfo, error) {
+	if !fs.armed.Load() {
+		return fs.Fs.Stat(name)
+	}
+	n := fs.running.Add(1)
+	defer fs.running.Add(-1)
+	for {
+		max := fs.max.Load()
+		if n <= max || fs.max.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	fs.started <- struct{}{}
+	<-fs.unblock
+	return fs.Fs.Stat(name)
+}
+
+func TestMaxConcurrentOps(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Wait", func(c *qt.C) {
+		bfs := newBlockingFs(basicFs("1", "1"))
+		ofs := New(Options{Fss: []afero.Fs{bfs}, MaxConcurrentOps: 2})
+		bfs.armed.Store(true)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := ofs.Stat("mydir/f1-1.txt")
+				c.Check(err, qt.IsNil)
+			}()
+		}
+		<-bfs.started
+		<-bfs.started
+		close(bfs.unblock)
+		wg.Wait()
+		c.Assert(bfs.max.Load(), qt.Equals, int32(2))
+	})
+
+	c.Run("FailWhenBusy", func(c *qt.C) {
+		bfs := newBlockingFs(basicFs("1", "1"))
+		ofs := New(Options{Fss: []afero.Fs{bfs}, MaxConcurrentOps: 1, FailWhenBusy: true})
+
+		f, err := ofs.Open("mydir/f1-1.txt")
+		c.Assert(err, qt.IsNil)
+		bfs.armed.Store(true)
+
+		done := make(chan error)
+		go func() {
+			_, err := ofs.Stat("mydir/f1-1.txt")
+			done <- err
+		}()
+		<-bfs.started
+
+		_, err = ofs.Stat("mydir/f1-1.txt")
+		c.Assert(err, qt.ErrorIs, ErrBusy)
+		_, err = f.Read(make([]byte, 1))
+		c.Assert(err, qt.ErrorIs, ErrBusy)
+		// Close is not limited.
+		c.Assert(f.Close(), qt.IsNil)
+
+		close(bfs.unblock)
+		c.Assert(<-done, qt.IsNil)
+		bfs.armed.Store(false)
+		c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+	})
+}
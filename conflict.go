@@ -0,0 +1,136 @@
+package overlayfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ConflictError is returned from Close of a file opened for writing with Options.DetectConflicts
+// set if the file changed underneath since it was read through the overlay.
+// The content written is kept in ConflictName instead of overwriting Name.
+type ConflictError struct {
+	Name         string
+	ConflictName string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: changed since read, written to %s", e.Name, e.ConflictName)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// conflicts records the version of the files read through the overlay, see Options.DetectConflicts.
+type conflicts struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	versions map[string]fileVersion
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func newConflicts() *conflicts {
+	return &conflicts{now: time.Now, versions: make(map[string]fileVersion)}
+}
+
+// seen records fi as the version of name last seen through the overlay.
+func (c *conflicts) seen(name string, fi os.FileInfo) {
+	c.mu.Lock()
+	c.versions[filepath.Clean(name)] = fileVersion{modTime: fi.ModTime(), size: fi.Size()}
+	c.mu.Unlock()
+}
+
+// changed reports whether name, currently fi, has changed since it was last seen.
+func (c *conflicts) changed(name string, fi os.FileInfo) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, found := c.versions[filepath.Clean(name)]
+	return found && (!fi.ModTime().Equal(v.modTime) || fi.Size() != v.size)
+}
+
+// conflictName returns the name of the sibling to write name to on a conflict.
+func (c *conflicts) conflictName(name string) string {
+	return name + ".conflict-" + c.now().UTC().Format("20060102T150405.000000000Z")
+}
+
+// openFileChecked opens name in wfs for writing, or a conflict sibling if name has changed
+// in the overlay since it was read.
+func (ofs *OverlayFs) openFileChecked(wfs afero.Fs, op, name string, flag int, perm os.FileMode) (afero.File, error) {
+	f := &conflictFile{c: ofs.conflicts, wfs: wfs, name: name}
+	var lfs afero.Fs
+	if fs, fi, _, err := ofs.statLayers(name, false); err == nil && !fi.IsDir() && ofs.conflicts.changed(name, fi) {
+		f.conflictName = ofs.conflicts.conflictName(name)
+		name, flag = f.conflictName, flag|os.O_CREATE|os.O_EXCL
+		if op != "create" && flag&os.O_TRUNC == 0 {
+			// Start from the current content, like a copy-up would.
+			lfs, perm = fs, fi.Mode().Perm()
+		}
+	}
+	var err error
+	if op == "create" && f.conflictName == "" {
+		f.File, err = wfs.Create(name)
+	} else {
+		f.File, err = wfs.OpenFile(name, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lfs != nil {
+		if err := ofs.copyConflictContent(f.File, lfs, f.name, flag); err != nil {
+			f.File.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// copyConflictContent copies the content of name in lfs into the conflict sibling dst,
+// leaving dst positioned as if it had been opened with flag.
+func (ofs *OverlayFs) copyConflictContent(dst afero.File, lfs afero.Fs, name string, flag int) error {
+	in, err := lfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := ofs.copyBuffer(dst, in); err != nil {
+		return err
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil
+	}
+	_, err = dst.Seek(0, io.SeekStart)
+	return err
+}
+
+// conflictFile records the version written on Close, or reports the conflict.
+type conflictFile struct {
+	afero.File
+	c            *conflicts
+	wfs          afero.Fs
+	name         string
+	conflictName string // Set if the content is written to a conflict sibling.
+}
+
+func (f *conflictFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if f.conflictName != "" {
+		return &ConflictError{Name: f.name, ConflictName: f.conflictName}
+	}
+	if fi, err := f.wfs.Stat(f.name); err == nil {
+		f.c.seen(f.name, fi)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package overlayfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestDetectConflicts(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := basicFs("1", "1")
+	ofs := New(Options{Fss: []afero.Fs{fs1, basicFs("2", "2")}, FirstWritable: true, DetectConflicts: true})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ofs.conflicts.now = func() time.Time { return now }
+
+	// Never read.
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-1.txt", []byte("a"), 0o666), qt.IsNil)
+
+	// Read, then written through the overlay.
+	c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "a")
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-1.txt", []byte("ab"), 0o666), qt.IsNil)
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-1.txt", []byte("abc"), 0o666), qt.IsNil)
+
+	// Changed underneath.
+	c.Assert(afero.WriteFile(fs1, "mydir/f1-1.txt", []byte("other"), 0o666), qt.IsNil)
+	err := afero.WriteFile(ofs, "mydir/f1-1.txt", []byte("mine"), 0o666)
+	c.Assert(errors.Is(err, ErrConflict), qt.IsTrue)
+	var cerr *ConflictError
+	c.Assert(errors.As(err, &cerr), qt.IsTrue)
+	c.Assert(cerr.ConflictName, qt.Equals, "mydir/f1-1.txt.conflict-20240501T120000.000000000Z")
+	c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "other")
+	c.Assert(readFile(c, ofs, cerr.ConflictName), qt.Equals, "mine")
+
+	// Having been read again, it can be written.
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-1.txt", []byte("mine"), 0o666), qt.IsNil)
+
+	// A change of the modification time only.
+	c.Assert(fs1.Chtimes("mydir/f1-1.txt", now, now), qt.IsNil)
+	now = now.Add(time.Second)
+	f, err := ofs.Create("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(errors.Is(f.Close(), ErrConflict), qt.IsTrue)
+
+	// Read from a lower filesystem and changed there.
+	fs2 := basicFs("2", "2")
+	ofs = New(Options{Fss: []afero.Fs{basicFs("1", "1"), fs2}, FirstWritable: true, DetectConflicts: true})
+	c.Assert(readFile(c, ofs, "mydir/f1-2.txt"), qt.Equals, "f1-2")
+	c.Assert(afero.WriteFile(fs2, "mydir/f1-2.txt", []byte("changed"), 0o666), qt.IsNil)
+	c.Assert(errors.Is(afero.WriteFile(ofs, "mydir/f1-2.txt", []byte("mine"), 0o666), ErrConflict), qt.IsTrue)
+}
+
+func TestDetectConflictsNoTrunc(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		name string
+		flag int
+		want string
+	}{
+		{"append", os.O_WRONLY | os.O_APPEND, "other!"},
+		{"overwrite", os.O_RDWR, "!ther"},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			fs1 := basicFs("1", "1")
+			ofs := New(Options{Fss: []afero.Fs{fs1}, FirstWritable: true, DetectConflicts: true})
+			c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+
+			// Changed underneath.
+			c.Assert(afero.WriteFile(fs1, "mydir/f1-1.txt", []byte("other"), 0o666), qt.IsNil)
+			f, err := ofs.OpenFile("mydir/f1-1.txt", test.flag, 0o666)
+			c.Assert(err, qt.IsNil)
+			_, err = f.Write([]byte("!"))
+			c.Assert(err, qt.IsNil)
+			var cerr *ConflictError
+			c.Assert(errors.As(f.Close(), &cerr), qt.IsTrue)
+			c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "other")
+			c.Assert(readFile(c, ofs, cerr.ConflictName), qt.Equals, test.want)
+		})
+	}
+}
+
+func TestDetectConflictsSniffed(t *testing.T) {
+	c := qt.New(t)
+
+	disk, blobs := afero.NewMemMapFs(), afero.NewMemMapFs()
+	lower := fsFromTxtTar(`
+-- data.bin --
+data
+`)
+	ofs := New(Options{
+		Fss:             []afero.Fs{disk, blobs, lower},
+		FirstWritable:   true,
+		DetectConflicts: true,
+		WriteRules:      []WriteRule{{ContentTypes: []string{"image/*"}, Layer: 1}},
+	})
+
+	c.Assert(readFile(c, ofs, "data.bin"), qt.Equals, "data")
+	c.Assert(afero.WriteFile(ofs, "data.bin", []byte("mine"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, disk, "data.bin"), qt.Equals, "mine")
+
+	// Changed underneath.
+	c.Assert(afero.WriteFile(disk, "data.bin", []byte("other"), 0o666), qt.IsNil)
+	err := afero.WriteFile(ofs, "data.bin", []byte("mine again"), 0o666)
+	c.Assert(errors.Is(err, ErrConflict), qt.IsTrue)
+	c.Assert(readFile(c, ofs, "data.bin"), qt.Equals, "other")
+}
@@ -0,0 +1,49 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// writeFsForCopyUp is writeFsFor with name copied up into the returned filesystem
+// if Options.CopyUp is set.
+func (ofs *OverlayFs) writeFsForCopyUp(op, name string) (afero.Fs, error) {
+	wfs, err := ofs.writeFsFor(op, name)
+	if err != nil || !ofs.copyUpEnabled {
+		return wfs, err
+	}
+	return wfs, ofs.copyUp(wfs, name)
+}
+
+// copyUp copies name, a file or a directory without its entries, from the filesystem
+// it's found in into wfs, if not already there, keeping its mode and modification time.
+func (ofs *OverlayFs) copyUp(wfs afero.Fs, name string) error {
+	if _, err := wfs.Stat(name); !os.IsNotExist(err) {
+		return err
+	}
+	lfs, fi, _, err := ofs.statLayers(name, true)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := wfs.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+		return err
+	}
+	switch {
+	case fi.IsDir():
+		err = wfs.Mkdir(name, fi.Mode().Perm())
+	case fi.Mode().IsRegular():
+		err = ofs.copyFile(wfs, lfs, name, fi.Mode().Perm())
+	default:
+		err = &fs.PathError{Op: "copyup", Path: name, Err: ErrNotSupported}
+	}
+	if err != nil {
+		return err
+	}
+	return wfs.Chtimes(name, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,77 @@
+package overlayfs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestCopyUp(t *testing.T) {
+	c := qt.New(t)
+
+	fs1, fs2 := afero.NewMemMapFs(), basicFs("2", "2")
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(fs2.Chtimes("mydir/f2-2.txt", mtime, mtime), qt.IsNil)
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}, FirstWritable: true, CopyUp: true})
+
+	f, err := ofs.OpenFile("mydir/f1-2.txt", os.O_WRONLY|os.O_APPEND, 0o666)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString("!")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(readFile(c, fs1, "mydir/f1-2.txt"), qt.Equals, "f1-2!")
+	c.Assert(readFile(c, fs2, "mydir/f1-2.txt"), qt.Equals, "f1-2")
+
+	c.Assert(ofs.Chmod("mydir/f2-2.txt", 0o600), qt.IsNil)
+	fi, err := fs1.Stat("mydir/f2-2.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Mode().Perm(), qt.Equals, os.FileMode(0o600))
+	c.Assert(fi.ModTime().Equal(mtime), qt.IsTrue)
+	c.Assert(readFile(c, fs1, "mydir/f2-2.txt"), qt.Equals, "f2-2")
+
+	c.Assert(ofs.Rename("mydir/f2-2.txt", "mydir/renamed.txt"), qt.IsNil)
+	c.Assert(readFile(c, ofs, "mydir/renamed.txt"), qt.Equals, "f2-2")
+
+	// Directories are copied without their entries.
+	c.Assert(ofs.Chtimes("mydir", mtime, mtime), qt.IsNil)
+	fi, err = fs1.Stat("mydir")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.ModTime().Equal(mtime), qt.IsTrue)
+
+	// Truncated files are not copied.
+	f, err = ofs.OpenFile("mydir/f1-2.txt", os.O_WRONLY|os.O_TRUNC, 0o666)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(readFile(c, ofs, "mydir/f1-2.txt"), qt.Equals, "")
+
+	// Without CopyUp.
+	ofs = New(Options{Fss: []afero.Fs{afero.NewMemMapFs(), fs2}, FirstWritable: true})
+	c.Assert(ofs.Chmod("mydir/f2-2.txt", 0o600), qt.ErrorIs, os.ErrNotExist)
+}
+
+func TestCopyUpSniffed(t *testing.T) {
+	c := qt.New(t)
+
+	disk, blobs := afero.NewMemMapFs(), afero.NewMemMapFs()
+	lower := fsFromTxtTar(`
+-- data.bin --
+data
+`)
+	ofs := New(Options{
+		Fss:           []afero.Fs{disk, blobs, lower},
+		FirstWritable: true,
+		CopyUp:        true,
+		WriteRules:    []WriteRule{{ContentTypes: []string{"image/*"}, Layer: 1}},
+	})
+
+	f, err := ofs.OpenFile("data.bin", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString("!")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(readFile(c, disk, "data.bin"), qt.Equals, "data!")
+	c.Assert(readFile(c, lower, "data.bin"), qt.Equals, "data")
+}
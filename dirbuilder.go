@@ -0,0 +1,82 @@
+package overlayfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// DirBuilder builds a Dir merging a set of directories, e.g. the same directory
+// in filesystems not part of an OverlayFs. The zero value is ready to use:
+//
+//	dir, err := new(DirBuilder).WithName("content").WithInfo(info).AddOpener(open1, open2).Build()
+type DirBuilder struct {
+	name    string
+	merge   DirsMerger
+	info    func() (os.FileInfo, error)
+	openers []func() (afero.File, error)
+	strict  bool
+}
+
+// WithName sets the name returned by Dir.Name.
+func (b *DirBuilder) WithName(name string) *DirBuilder {
+	b.name = name
+	return b
+}
+
+// WithMerger sets the DirsMerger used to merge the directories.
+// If not set, or nil, a default DirsMerger is used.
+func (b *DirBuilder) WithMerger(merge DirsMerger) *DirBuilder {
+	b.merge = merge
+	return b
+}
+
+// WithInfo sets the func used to stat the directory. It's required.
+func (b *DirBuilder) WithInfo(info func() (os.FileInfo, error)) *DirBuilder {
+	b.info = info
+	return b
+}
+
+// WithStrict sets whether the operations not supported on the Dir, e.g. Read and Write,
+// return errors instead of panicking, see Options.Strict.
+func (b *DirBuilder) WithStrict(strict bool) *DirBuilder {
+	b.strict = strict
+	return b
+}
+
+// AddOpener adds funcs opening the directories to merge, in order of priority.
+// At least one is required.
+func (b *DirBuilder) AddOpener(open ...func() (afero.File, error)) *DirBuilder {
+	b.openers = append(b.openers, open...)
+	return b
+}
+
+// Build validates the settings and returns a new Dir.
+// The errors returned wrap fs.ErrInvalid.
+func (b *DirBuilder) Build() (*Dir, error) {
+	if b.info == nil {
+		return nil, fmt.Errorf("overlayfs: info must not be nil: %w", fs.ErrInvalid)
+	}
+	if len(b.openers) == 0 {
+		return nil, fmt.Errorf("overlayfs: dirOpeners must not be empty: %w", fs.ErrInvalid)
+	}
+	for i, open := range b.openers {
+		if open == nil {
+			return nil, fmt.Errorf("overlayfs: dirOpener %d must not be nil: %w", i, fs.ErrInvalid)
+		}
+	}
+	merge := b.merge
+	if merge == nil {
+		merge = defaultDirMerger
+	}
+
+	dir := getDir()
+	dir.name = b.name
+	dir.dirOpeners = append(dir.dirOpeners, b.openers...)
+	dir.info = b.info
+	dir.merge = merge
+	dir.strict = b.strict
+	return dir, nil
+}
@@ -0,0 +1,59 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestDirBuilder(t *testing.T) {
+	c := qt.New(t)
+	fs1, fs2 := basicFs("1", "1"), basicFs("2", "2")
+	fi1, _ := fs1.Stat("mydir")
+	info := func() (os.FileInfo, error) { return fi1, nil }
+	opener := func(fs afero.Fs) func() (afero.File, error) {
+		return func() (afero.File, error) { return fs.Open("mydir") }
+	}
+
+	b := new(DirBuilder).WithName("mydir").WithInfo(info).AddOpener(opener(fs1)).AddOpener(opener(fs2))
+	dir, err := b.Build()
+	c.Assert(err, qt.IsNil)
+	c.Assert(dir.Name(), qt.Equals, "mydir")
+	names, err := dir.Readdirnames(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f1-1.txt", "f2-1.txt", "f1-2.txt", "f2-2.txt"})
+	c.Assert(dir.Close(), qt.IsNil)
+
+	// The builder can be reused.
+	dir, err = b.WithMerger(func(lofi, bofi []fs.DirEntry) []fs.DirEntry { return lofi }).Build()
+	c.Assert(err, qt.IsNil)
+	names, err = dir.Readdirnames(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.HasLen, 0)
+	c.Assert(dir.Close(), qt.IsNil)
+
+	// Strict.
+	dir, err = b.WithStrict(true).Build()
+	c.Assert(err, qt.IsNil)
+	_, err = dir.Read(make([]byte, 1))
+	c.Assert(err, qt.ErrorIs, ErrNotSupported)
+	_, err = dir.WriteString("foo")
+	c.Assert(err, qt.ErrorIs, ErrNotSupported)
+	c.Assert(dir.Close(), qt.IsNil)
+	dir, err = b.WithStrict(false).Build()
+	c.Assert(err, qt.IsNil)
+	c.Assert(func() { dir.Read(make([]byte, 1)) }, qt.PanicMatches, ".*not supported.*")
+	c.Assert(dir.Close(), qt.IsNil)
+
+	for _, b := range []*DirBuilder{
+		new(DirBuilder).AddOpener(opener(fs1)),
+		new(DirBuilder).WithInfo(info),
+		new(DirBuilder).WithInfo(info).AddOpener(opener(fs1), nil),
+	} {
+		_, err := b.Build()
+		c.Assert(err, qt.ErrorIs, fs.ErrInvalid)
+	}
+}
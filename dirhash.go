@@ -0,0 +1,55 @@
+package overlayfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DirHash returns the h1: hash of the files in the merged view of the tree rooted at root.
+// It's identical to the hash computed by dirhash.HashDir(dir, "", dirhash.Hash1)
+// in golang.org/x/mod/sumdb/dirhash over a materialized copy of the tree in dir.
+func (ofs *OverlayFs) DirHash(root string) (string, error) {
+	e := ofs.newExporter(context.Background(), ExportOptions{Root: root})
+	files := make(map[string]string)
+	var names []string
+	err := e.walk(func(path string, d fs.DirEntry, err error) error {
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return fmt.Errorf("%s is not a directory", root)
+		}
+		name := filepath.ToSlash(rel)
+		if strings.Contains(name, "\n") {
+			return errors.New("dirhash: filenames with newlines are not supported")
+		}
+		files[name] = path
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(names)
+	summary := sha256.New()
+	for _, name := range names {
+		h := sha256.New()
+		if _, err := e.copyFileTo(h, files[name]); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(summary, "%x  %s\n", h.Sum(nil), name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil)), nil
+}
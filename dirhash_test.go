@@ -0,0 +1,45 @@
+package overlayfs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestDirHash(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := fsFromTxtTar(`
+-- mod/xyz --
+data for xyz
+-- mod/a/b --
+data for a/b
+`)
+	fs2 := fsFromTxtTar(`
+-- mod/xyz --
+shadowed
+-- mod/a.b --
+data for a.b
+-- other/c --
+c
+`)
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+
+	// As in the dirhash.Hash1 tests.
+	h := sha256.New()
+	fmt.Fprintf(h, "%x  %s\n", sha256.Sum256([]byte("data for a.b")), "a.b")
+	fmt.Fprintf(h, "%x  %s\n", sha256.Sum256([]byte("data for a/b")), "a/b")
+	fmt.Fprintf(h, "%x  %s\n", sha256.Sum256([]byte("data for xyz")), "xyz")
+	want := "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	got, err := ofs.DirHash("mod")
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.Equals, want)
+
+	_, err = ofs.DirHash("mod/xyz")
+	c.Assert(err, qt.ErrorMatches, ".*is not a directory")
+}
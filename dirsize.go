@@ -0,0 +1,88 @@
+package overlayfs
+
+import (
+	"context"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Size is the disk usage of a directory in the merged view, see DirSizes.
+type Size struct {
+	// Bytes is the total size of the regular files.
+	Bytes int64
+
+	// Files is the number of regular files.
+	Files int
+
+	// Layers is Bytes broken down by the filesystem each file comes from,
+	// indexed as the filesystems in the overlay.
+	Layers []int64
+}
+
+// DirSizes returns the sizes of the directories directly below root in the merged view,
+// keyed by their slash separated path relative to root. Files directly in root are keyed ".".
+//
+// The result is cached until the filesystems are modified through the overlay or
+// InvalidateCaches is called.
+func (ofs *OverlayFs) DirSizes(root string) (map[string]Size, error) {
+	key := ofs.caches.key("dirsizes", ofs, cleanScopePath(root))
+	v, _ := ofs.caches.dirSizes.Get(key)
+	sizes, found := v.(map[string]Size)
+	if !found {
+		var err error
+		sizes, err = ofs.dirSizes(root)
+		if err != nil {
+			return nil, err
+		}
+		ofs.caches.dirSizes.Set(key, sizes)
+	}
+	// Don't let the caller modify the cached sizes.
+	sizes = maps.Clone(sizes)
+	for k, s := range sizes {
+		s.Layers = slices.Clone(s.Layers)
+		sizes[k] = s
+	}
+	return sizes, nil
+}
+
+func (ofs *OverlayFs) dirSizes(root string) (map[string]Size, error) {
+	e := ofs.newExporter(context.Background(), ExportOptions{Root: root})
+	sizes := make(map[string]Size)
+	err := e.walk(func(path string, d fs.DirEntry, err error) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		top, _, found := strings.Cut(filepath.ToSlash(rel), "/")
+		if !found {
+			top = "."
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		layer, err := ofs.sourceLayer(path)
+		if err != nil {
+			return err
+		}
+		s := sizes[top]
+		if s.Layers == nil {
+			s.Layers = make([]int64, len(ofs.fss))
+		}
+		s.Bytes += fi.Size()
+		s.Files++
+		s.Layers[layer] += fi.Size()
+		sizes[top] = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
@@ -0,0 +1,70 @@
+package overlayfs
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestDirSizes(t *testing.T) {
+	c := qt.New(t)
+
+	project := fsFromTxtTar(`
+-- content/a.md --
+aaaa
+-- content/b.md --
+bb
+-- README --
+readme
+`)
+	theme := fsFromTxtTar(`
+-- content/a.md --
+theme a
+-- content/c.md --
+ccc
+-- static/logo.png --
+logo
+`)
+	ofs := New(Options{Fss: []afero.Fs{project, theme}, FirstWritable: true})
+
+	sizes, err := ofs.DirSizes("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sizes, qt.DeepEquals, map[string]Size{
+		".":       {Bytes: 6, Files: 1, Layers: []int64{6, 0}},
+		"content": {Bytes: 9, Files: 3, Layers: []int64{6, 3}},
+		"static":  {Bytes: 4, Files: 1, Layers: []int64{0, 4}},
+	})
+
+	sizes, err = ofs.DirSizes("content")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sizes, qt.DeepEquals, map[string]Size{
+		".": {Bytes: 9, Files: 3, Layers: []int64{6, 3}},
+	})
+
+	// The result is cached and the cache isn't modified through the result.
+	sizes["."].Layers[0] = 42
+	afero.WriteFile(theme, "static/other.png", []byte("other"), 0o666)
+	sizes, err = ofs.DirSizes("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sizes["static"], qt.DeepEquals, Size{Bytes: 4, Files: 1, Layers: []int64{0, 4}})
+
+	ofs.InvalidateCaches()
+	sizes, err = ofs.DirSizes("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sizes["static"], qt.DeepEquals, Size{Bytes: 9, Files: 2, Layers: []int64{0, 9}})
+
+	// Writes through the overlay invalidate the cache.
+	f, err := ofs.Create("static/logo.png")
+	c.Assert(err, qt.IsNil)
+	f.Write([]byte("new logo"))
+	c.Assert(f.Close(), qt.IsNil)
+	sizes, err = ofs.DirSizes("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sizes["static"], qt.DeepEquals, Size{Bytes: 13, Files: 2, Layers: []int64{8, 5}})
+
+	c.Assert(ofs.Remove("README"), qt.IsNil)
+	sizes, err = ofs.DirSizes("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sizes["."], qt.DeepEquals, Size{})
+}
@@ -0,0 +1,106 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// The errors returned by the overlay. All of them can be matched using errors.Is,
+// and some also match a more general error from the standard library, noted below.
+var (
+	// ErrReadOnly is returned when writing to an overlay without a writable filesystem,
+	// see Options.FirstWritable. It also matches fs.ErrPermission.
+	ErrReadOnly = &overlayError{msg: "read-only filesystem", base: fs.ErrPermission}
+
+	// ErrNoWritableFilesystem is returned when an overlay nominated as writable has no filesystems.
+	ErrNoWritableFilesystem = errors.New("no writable filesystem")
+
+	// ErrAmbiguous is returned when a name resolves to different files in a way the overlay can't decide between,
+	// e.g. when more than one name in a directory matches case-insensitively, see Options.WindowsPaths.
+	ErrAmbiguous = errors.New("ambiguous name")
+
+	// ErrNotSupported is returned when an operation is not supported by the filesystem(s) involved.
+	// It also matches errors.ErrUnsupported.
+	ErrNotSupported = &overlayError{msg: "operation not supported", base: errors.ErrUnsupported}
+
+	// ErrXattrNotSupported is returned when the filesystem holding a file does not support extended attributes.
+	// It also matches ErrNotSupported.
+	ErrXattrNotSupported = &overlayError{msg: "extended attributes not supported", base: ErrNotSupported}
+
+	// ErrStaleHandle is returned when using a handle opened before the overlay changed,
+	// e.g. a Dir opened from a MutableFs, see Options.RemergeStaleDirs.
+	ErrStaleHandle = errors.New("stale handle")
+
+	// ErrQuotaExceeded is returned when a write would exceed a configured quota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrConflict is matched by a *ConflictError, see Options.DetectConflicts.
+	ErrConflict = errors.New("conflicting write")
+
+	// ErrTooLarge is matched by a *TooLargeError, see Options.MaxReadSize.
+	ErrTooLarge = errors.New("file too large")
+
+	// ErrIntegrity is returned when a file's content does not match its expected checksum,
+	// see ExportOptions.Verify.
+	ErrIntegrity = errors.New("integrity check failed")
+
+	// ErrLayerPanic is matched by a *LayerPanicError, see Options.RecoverPanics.
+	ErrLayerPanic = errors.New("layer panicked")
+
+	// ErrLimitExceeded is returned (wrapped in a *LimitExceededError) when a walk exceeds
+	// one of the limits set in Options.MaxWalkDepth or Options.MaxWalkEntries.
+	ErrLimitExceeded = errors.New("limit exceeded")
+
+	// ErrReservedName is returned when Options.WindowsPaths is set and a path
+	// contains a reserved Windows device name, e.g. CON or LPT1.
+	ErrReservedName = errors.New("reserved name")
+
+	// ErrRootEscape is returned when Options.RejectRootEscapes is set and a path
+	// resolves to a location outside of its filesystem's base path.
+	ErrRootEscape = errors.New("path escapes filesystem root")
+
+	// ErrBusy is returned when Options.FailWhenBusy is set and an operation
+	// would exceed Options.MaxConcurrentOps.
+	ErrBusy = errors.New("too many concurrent operations")
+)
+
+// errIsDir is returned when reading a Dir. Like the error from os, it matches syscall.EISDIR,
+// and it also matches ErrNotSupported.
+var errIsDir error = isDirError{}
+
+type isDirError struct{}
+
+func (isDirError) Error() string { return "is a directory" }
+
+func (isDirError) Is(target error) bool {
+	return target == syscall.EISDIR || target == ErrNotSupported || target == errors.ErrUnsupported
+}
+
+// notDirError returns the error for reading the entries of the file name,
+// matching syscall.ENOTDIR like the error from os.
+func notDirError(name string) error {
+	return &fs.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+}
+
+// overlayError is a sentinel error that also matches a more general error.
+type overlayError struct {
+	msg  string
+	base error
+}
+
+func (e *overlayError) Error() string { return e.msg }
+
+func (e *overlayError) Unwrap() error { return e.base }
+
+// checkWritable returns a *fs.PathError wrapping ErrReadOnly or ErrNoWritableFilesystem
+// if op on name can not be performed.
+func (ofs *OverlayFs) checkWritable(op, name string) error {
+	if !ofs.writable() {
+		return &fs.PathError{Op: op, Path: name, Err: ErrReadOnly}
+	}
+	if len(ofs.fss) == 0 {
+		return &fs.PathError{Op: op, Path: name, Err: ErrNoWritableFilesystem}
+	}
+	return nil
+}
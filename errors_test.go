@@ -0,0 +1,64 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestErrors(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(ErrReadOnly, qt.ErrorIs, fs.ErrPermission)
+	c.Assert(ErrNotSupported, qt.ErrorIs, errors.ErrUnsupported)
+	c.Assert(ErrXattrNotSupported, qt.ErrorIs, ErrNotSupported)
+	c.Assert(ErrXattrNotSupported, qt.ErrorIs, errors.ErrUnsupported)
+
+	all := []error{
+		ErrReadOnly, ErrNoWritableFilesystem, ErrAmbiguous, ErrNotSupported, ErrStaleHandle,
+		ErrQuotaExceeded, ErrIntegrity, ErrLayerPanic, ErrLimitExceeded, ErrReservedName, ErrRootEscape, ErrBusy,
+	}
+	for i, err1 := range all {
+		for j, err2 := range all {
+			c.Assert(errors.Is(err1, err2), qt.Equals, i == j, qt.Commentf("%v vs %v", err1, err2))
+		}
+	}
+}
+
+func TestWriteOpsErrors(t *testing.T) {
+	c := qt.New(t)
+
+	ops := func(ofs *OverlayFs) map[string]error {
+		_, errOpen := ofs.OpenFile("mydir/f1-1.txt", os.O_RDWR, 0o666)
+		_, errCreate := ofs.Create("mydir/new.txt")
+		return map[string]error{
+			"chmod":     ofs.Chmod("mydir/f1-1.txt", 0o666),
+			"chown":     ofs.Chown("mydir/f1-1.txt", 1, 1),
+			"chtimes":   ofs.Chtimes("mydir/f1-1.txt", time.Now(), time.Now()),
+			"mkdir":     ofs.Mkdir("mydir/newdir", 0o777),
+			"mkdirall":  ofs.MkdirAll("mydir/newdir/sub", 0o777),
+			"open":      errOpen,
+			"remove":    ofs.Remove("mydir/f1-1.txt"),
+			"removeall": ofs.RemoveAll("mydir"),
+			"rename":    ofs.Rename("mydir/f1-1.txt", "mydir/f1-2.txt"),
+			"create":    errCreate,
+			"setxattr":  ofs.SetXattr("mydir/f1-1.txt", "user.a", nil),
+		}
+	}
+
+	for name, err := range ops(New(Options{Fss: []afero.Fs{basicFs("1", "1")}})) {
+		c.Assert(err, qt.ErrorIs, ErrReadOnly, qt.Commentf(name))
+		c.Assert(err, qt.ErrorIs, fs.ErrPermission, qt.Commentf(name))
+		var perr *fs.PathError
+		c.Assert(errors.As(err, &perr), qt.IsTrue, qt.Commentf(name))
+	}
+
+	for name, err := range ops(New(Options{FirstWritable: true})) {
+		c.Assert(err, qt.ErrorIs, ErrNoWritableFilesystem, qt.Commentf(name))
+	}
+}
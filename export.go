@@ -0,0 +1,748 @@
+package overlayfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing/fstest"
+
+	"github.com/spf13/afero"
+)
+
+// ExportOptions configures the bulk export operations MaterializeTo and WriteTar.
+type ExportOptions struct {
+	// Root is the directory in the overlay to export.
+	Root string
+
+	// Progress, if set, is called after each exported file or directory.
+	// Note that Progress may be called concurrently when Workers > 1.
+	Progress func(p ProgressInfo)
+
+	// Workers, if > 1, is the number of files to read concurrently.
+	// Directories are still created in walk order, and tar entries are
+	// written in walk order regardless of the order the reads complete.
+	// For tar output, only files up to 1 MiB are read ahead; larger
+	// files are streamed when their turn comes.
+	Workers int
+
+	// StateFile, if set, makes MaterializeTo resumable.
+	// Each copied file is recorded with its SHA-256 hash and the size and modification time
+	// of the source file in the named file in dst. Files already recorded whose source is
+	// unchanged and whose copy in dst still matches the recorded hash are skipped on later runs.
+	// The state file is removed when MaterializeTo completes successfully.
+	// It's not used when Incremental is set.
+	StateFile string
+
+	// Incremental, if set, makes MaterializeTo compare the files with their copies in dst
+	// and only copy those changed, see ExportCompare.
+	Incremental ExportCompare
+
+	// Delete makes an incremental MaterializeTo remove the files and directories below Root
+	// in dst not in the overlay. Removed files with the same content as new files
+	// are moved instead of copying the new files.
+	Delete bool
+
+	// DryRun makes an incremental MaterializeTo report the changes it would make
+	// without making them.
+	DryRun bool
+
+	// Changes, if set, is called for each change made by an incremental MaterializeTo,
+	// or, with DryRun, each change that would be made.
+	// Note that Changes may be called concurrently when Workers > 1.
+	Changes func(c ExportChange)
+
+	// RateLimiter, if set, limits the rate of files and bytes read from the overlay.
+	// If not set, Options.RateLimiter is used.
+	// The operations run with PriorityBackground unless another priority is set in the context.
+	RateLimiter *RateLimiter
+
+	// Verify, if set, makes MaterializeTo read back each file it copies to dst and compare
+	// its SHA-256 hash with that of the content read from the overlay.
+	// A mismatch is returned as an error matching ErrIntegrity.
+	Verify bool
+
+	// PreserveAttrs selects the attributes MaterializeTo replicates from the overlay.
+	// Ownership is only replicated when permitted, e.g. when running as root.
+	// WriteTar always records the mode, ownership and modification time in the tar headers.
+	PreserveAttrs PreserveAttrs
+}
+
+// PreserveAttrs is a set of file attributes to replicate when copying files.
+type PreserveAttrs uint8
+
+const (
+	// PreserveMode replicates the mode bits.
+	PreserveMode PreserveAttrs = 1 << iota
+
+	// PreserveOwner replicates the owner and group, when permitted.
+	PreserveOwner
+
+	// PreserveTimes replicates the modification time.
+	PreserveTimes
+
+	// PreserveXattrs replicates the extended attributes, when permitted, see XattrFs.
+	// Files in filesystems not supporting extended attributes have none.
+	PreserveXattrs
+
+	// PreserveAll replicates all of the above.
+	PreserveAll = PreserveMode | PreserveOwner | PreserveTimes | PreserveXattrs
+)
+
+// ProgressInfo describes the progress of a long-running operation.
+type ProgressInfo struct {
+	// Items is the number of files and directories done so far.
+	Items int
+
+	// Bytes is the number of file bytes copied so far.
+	Bytes int64
+
+	// Path is the path of the last file or directory done.
+	Path string
+}
+
+type exporter struct {
+	ofs  *OverlayFs
+	ctx  context.Context
+	opts ExportOptions
+
+	mu       sync.Mutex
+	progress ProgressInfo
+}
+
+func (ofs *OverlayFs) newExporter(ctx context.Context, opts ExportOptions) *exporter {
+	if _, ok := priorityFromContext(ctx); !ok {
+		ctx = WithPriority(ctx, PriorityBackground)
+	}
+	if opts.RateLimiter == nil {
+		opts.RateLimiter = ofs.rateLimiter
+	}
+	return &exporter{ofs: ofs, ctx: ctx, opts: opts}
+}
+
+// walk walks the export root, checking for cancellation before each entry.
+func (e *exporter) walk(fn fs.WalkDirFunc) error {
+	return e.ofs.WalkDir(e.opts.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := e.ctx.Err(); err != nil {
+			return err
+		}
+		return fn(path, d, nil)
+	})
+}
+
+func (e *exporter) done(path string, n int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.progress.Items++
+	e.progress.Bytes += n
+	e.progress.Path = path
+	if e.opts.Progress != nil {
+		e.opts.Progress(e.progress)
+	}
+}
+
+// MaterializeTo copies the merged view of the tree rooted at opts.Root into dst,
+// keeping the paths relative to the overlay root.
+// Only directories and regular files are copied.
+func (ofs *OverlayFs) MaterializeTo(ctx context.Context, dst afero.Fs, opts ExportOptions) error {
+	e := ofs.newExporter(ctx, opts)
+	if opts.Incremental != 0 {
+		return e.materializeIncremental(dst)
+	}
+
+	var state *resumeState
+	if opts.StateFile != "" {
+		var err error
+		if state, err = openResumeState(dst, opts.StateFile); err != nil {
+			return err
+		}
+	}
+
+	// The directory attributes are applied when all files are copied,
+	// as creating the files would change the directory modification times.
+	type dirInfo struct {
+		path string
+		fi   fs.FileInfo
+	}
+	var dirs []dirInfo
+
+	g := newWorkGroup(opts.Workers)
+	err := e.walk(func(path string, d fs.DirEntry, err error) error {
+		if d.IsDir() {
+			if err := dst.MkdirAll(path, 0o777); err != nil {
+				return err
+			}
+			// The root of the overlay is the root of dst, which is left as is.
+			if opts.PreserveAttrs != 0 && path != "" && path != "." {
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				dirs = append(dirs, dirInfo{path, fi})
+			}
+			e.done(path, 0)
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return g.Go(func() error {
+			if state == nil {
+				n, err := e.copyFile(dst, path, nil)
+				if err != nil {
+					return err
+				}
+				e.done(path, n)
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if state.isDone(dst, path, fi) {
+				e.done(path, 0)
+				return nil
+			}
+			h := sha256.New()
+			n, err := e.copyFile(dst, path, h)
+			if err != nil {
+				return err
+			}
+			if err := state.record(path, h.Sum(nil), fi); err != nil {
+				return err
+			}
+			e.done(path, n)
+			return nil
+		})
+	})
+	if gerr := g.Wait(); err == nil {
+		err = gerr
+	}
+	if err == nil {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err = e.preserveAttrs(dst, dirs[i].path, dirs[i].fi); err != nil {
+				break
+			}
+		}
+	}
+	if state != nil {
+		if cerr := state.close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = dst.Remove(opts.StateFile)
+		}
+	}
+	return err
+}
+
+// resumeState tracks the files copied by MaterializeTo.
+// Each line in the state file is on the form "<hex sha256>  <size>  <mod time>  <path>",
+// where the size and modification time, in Unix nanoseconds, are those of the source file.
+type resumeState struct {
+	mu   sync.Mutex
+	done map[string]resumeEntry
+	f    afero.File
+}
+
+// resumeEntry is a file recorded in the state file.
+type resumeEntry struct {
+	hash        string
+	fingerprint string // The size and modification time of the source file.
+}
+
+func openResumeState(dst afero.Fs, name string) (*resumeState, error) {
+	s := &resumeState{done: make(map[string]resumeEntry)}
+	if b, err := afero.ReadFile(dst, name); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.SplitN(line, "  ", 4)
+			if len(fields) == 4 {
+				s.done[fields[3]] = resumeEntry{hash: fields[0], fingerprint: fields[1] + "  " + fields[2]}
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := dst.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+// sourceFingerprint returns the fingerprint of the source file fi recorded in the state file.
+func sourceFingerprint(fi fs.FileInfo) string {
+	return fmt.Sprintf("%d  %d", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// isDone reports whether path is recorded as done, the source file fi hasn't changed since,
+// and its copy in dst is intact.
+func (s *resumeState) isDone(dst afero.Fs, path string, fi fs.FileInfo) bool {
+	s.mu.Lock()
+	entry, found := s.done[path]
+	s.mu.Unlock()
+	if !found || entry.fingerprint != sourceFingerprint(fi) {
+		return false
+	}
+	f, err := dst.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == entry.hash
+}
+
+func (s *resumeState) record(path string, sum []byte, fi fs.FileInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintf(s.f, "%x  %s  %s\n", sum, sourceFingerprint(fi), path)
+	return err
+}
+
+func (s *resumeState) close() error {
+	return s.f.Close()
+}
+
+// WriteTar writes the merged view of the tree rooted at opts.Root to w as a tar archive.
+// The entry names are relative to opts.Root and slash separated.
+// Only directories and regular files are written.
+func (ofs *OverlayFs) WriteTar(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	e := ofs.newExporter(ctx, opts)
+	tw := newTarWriter(e, tar.NewWriter(w))
+	err := e.walk(func(path string, d fs.DirEntry, err error) error {
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(opts.Root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		return tw.add(hdr, path)
+	})
+	if terr := tw.close(); err == nil {
+		err = terr
+	}
+	return err
+}
+
+// ToMapFS returns a snapshot of the merged view of the tree rooted at root as a fstest.MapFS.
+// The names are relative to root and slash separated.
+// Only directories and regular files are included.
+func (ofs *OverlayFs) ToMapFS(root string) (fstest.MapFS, error) {
+	e := ofs.newExporter(context.Background(), ExportOptions{Root: root})
+	m := make(fstest.MapFS)
+	err := e.walk(func(path string, d fs.DirEntry, err error) error {
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := &fstest.MapFile{Mode: fi.Mode(), ModTime: fi.ModTime()}
+		if !d.IsDir() {
+			var buf bytes.Buffer
+			if _, err := e.copyFileTo(&buf, path); err != nil {
+				return err
+			}
+			f.Data = buf.Bytes()
+		}
+		m[filepath.ToSlash(rel)] = f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// maxTarReadAhead is the largest file body a tarWriter reads ahead
+// into memory; larger bodies are streamed in order.
+const maxTarReadAhead = 1 << 20
+
+// tarWriter writes tar entries in the order they're added,
+// reading the file contents concurrently if configured.
+type tarWriter struct {
+	e  *exporter
+	tw *tar.Writer
+
+	// Set when reading concurrently.
+	sem     chan struct{}
+	queue   chan tarEntry
+	writeMu sync.Mutex
+	writeWg sync.WaitGroup
+	err     error
+}
+
+type tarEntry struct {
+	hdr *tar.Header
+
+	// The path to read the content from, empty for entries without content.
+	path string
+	body chan tarBody
+}
+
+type tarBody struct {
+	b   []byte
+	err error
+}
+
+func newTarWriter(e *exporter, tw *tar.Writer) *tarWriter {
+	w := &tarWriter{e: e, tw: tw}
+	if e.opts.Workers > 1 {
+		w.sem = make(chan struct{}, e.opts.Workers)
+		w.queue = make(chan tarEntry, e.opts.Workers)
+		w.writeWg.Add(1)
+		go w.writeLoop()
+	}
+	return w
+}
+
+func (w *tarWriter) add(hdr *tar.Header, path string) error {
+	if w.sem == nil {
+		return w.write(tarEntry{hdr: hdr, path: path}, nil)
+	}
+	if err := w.firstErr(); err != nil {
+		return err
+	}
+	entry := tarEntry{hdr: hdr, path: path}
+	if hdr.Typeflag != tar.TypeDir && path != "" && hdr.Size <= maxTarReadAhead {
+		entry.body = make(chan tarBody, 1)
+		w.sem <- struct{}{}
+		go func() {
+			buf := bytes.NewBuffer(make([]byte, 0, hdr.Size))
+			_, err := w.e.copyFileTo(buf, path)
+			entry.body <- tarBody{b: buf.Bytes(), err: err}
+		}()
+	}
+	w.queue <- entry
+	return nil
+}
+
+func (w *tarWriter) writeLoop() {
+	defer w.writeWg.Done()
+	for entry := range w.queue {
+		var body *tarBody
+		if entry.body != nil {
+			b := <-entry.body
+			<-w.sem
+			body = &b
+		}
+		if w.firstErr() != nil {
+			// Drain the queue.
+			continue
+		}
+		if body != nil && body.err != nil {
+			w.setErr(body.err)
+			continue
+		}
+		if err := w.write(entry, body); err != nil {
+			w.setErr(err)
+		}
+	}
+}
+
+func (w *tarWriter) write(entry tarEntry, body *tarBody) error {
+	if err := w.tw.WriteHeader(entry.hdr); err != nil {
+		return err
+	}
+	if entry.path == "" {
+		// An entry without content, e.g. a whiteout.
+		return nil
+	}
+	if entry.hdr.Typeflag == tar.TypeDir {
+		w.e.done(entry.path, 0)
+		return nil
+	}
+	var (
+		n   int64
+		err error
+	)
+	if body != nil {
+		var nn int
+		nn, err = w.tw.Write(body.b)
+		n = int64(nn)
+	} else {
+		n, err = w.e.copyFileTo(w.tw, entry.path)
+	}
+	if err != nil {
+		return err
+	}
+	w.e.done(entry.path, n)
+	return nil
+}
+
+func (w *tarWriter) firstErr() error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.err
+}
+
+func (w *tarWriter) setErr(err error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *tarWriter) close() error {
+	if w.queue != nil {
+		close(w.queue)
+		w.writeWg.Wait()
+		if err := w.firstErr(); err != nil {
+			return err
+		}
+	}
+	return w.tw.Close()
+}
+
+// workGroup runs functions on a bounded number of goroutines,
+// or inline if workers <= 1.
+type workGroup struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newWorkGroup(workers int) *workGroup {
+	g := &workGroup{}
+	if workers > 1 {
+		g.sem = make(chan struct{}, workers)
+	}
+	return g
+}
+
+// Go runs fn, blocking until a worker is available.
+// It returns the first error from a previously run fn, if any.
+func (g *workGroup) Go(fn func() error) error {
+	if g.sem == nil {
+		return fn()
+	}
+	if err := g.firstErr(); err != nil {
+		return err
+	}
+	g.sem <- struct{}{}
+	g.wg.Add(1)
+	go func() {
+		defer func() {
+			<-g.sem
+			g.wg.Done()
+		}()
+		if err := fn(); err != nil {
+			g.mu.Lock()
+			if g.err == nil {
+				g.err = err
+			}
+			g.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Wait waits for all running functions to finish and returns the first error, if any.
+func (g *workGroup) Wait() error {
+	g.wg.Wait()
+	return g.firstErr()
+}
+
+func (g *workGroup) firstErr() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// copyFile copies the named file into the same path in dst.
+// If h is not nil, the copied bytes are also written to h.
+func (e *exporter) copyFile(dst afero.Fs, name string, h hash.Hash) (int64, error) {
+	src, err := e.open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := dst.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	var w io.Writer = f
+	if h != nil {
+		w = io.MultiWriter(w, h)
+	}
+	var vh hash.Hash
+	if e.opts.Verify {
+		vh = sha256.New()
+		w = io.MultiWriter(w, vh)
+	}
+	n, err := e.ofs.copyBuffer(w, e.reader(src))
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+	if vh != nil {
+		if err := verifyCopy(dst, name, vh.Sum(nil)); err != nil {
+			return n, err
+		}
+	}
+	return n, e.preserveAttrs(dst, name, fi)
+}
+
+// verifyCopy checks that the SHA-256 hash of name in dst is sum.
+func verifyCopy(dst afero.Fs, name string, sum []byte) error {
+	f, err := dst.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return &fs.PathError{Op: "verify", Path: name, Err: ErrIntegrity}
+	}
+	return nil
+}
+
+// preserveAttrs replicates the attributes of fi selected in e.opts.PreserveAttrs to name in dst.
+func (e *exporter) preserveAttrs(dst afero.Fs, name string, fi fs.FileInfo) error {
+	p := e.opts.PreserveAttrs
+	// Set the owner first, as changing it may clear the setuid and setgid bits.
+	if p&PreserveOwner != 0 {
+		if uid, gid, ok := fileOwner(fi); ok {
+			if err := dst.Chown(name, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+				return err
+			}
+		}
+	}
+	if p&PreserveMode != 0 {
+		if err := dst.Chmod(name, fi.Mode()); err != nil {
+			return err
+		}
+	}
+	if p&PreserveXattrs != 0 {
+		if err := e.copyXattrs(dst, name); err != nil {
+			return err
+		}
+	}
+	if p&PreserveTimes != 0 {
+		if err := dst.Chtimes(name, fi.ModTime(), fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyXattrs replicates the extended attributes of name in the overlay to name in dst.
+func (e *exporter) copyXattrs(dst afero.Fs, name string) error {
+	attrs, err := e.ofs.ListXattr(name)
+	if err != nil {
+		if errors.Is(err, ErrXattrNotSupported) {
+			return nil
+		}
+		return err
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	xfs, ok := asXattrFs(dst)
+	if !ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	for _, attr := range attrs {
+		v, err := e.ofs.GetXattr(name, attr)
+		if err != nil {
+			return err
+		}
+		if err := xfs.SetXattr(name, attr, v); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *exporter) copyFileTo(w io.Writer, name string) (int64, error) {
+	src, err := e.open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	return e.ofs.copyBuffer(w, e.reader(src))
+}
+
+// reader returns r wrapped to stop when e.ctx is done, and limited by the RateLimiter, if set.
+func (e *exporter) reader(r io.Reader) io.Reader {
+	return e.opts.RateLimiter.reader(e.ctx, contextReader{ctx: e.ctx, r: r})
+}
+
+// contextReader is a reader failing with the error of ctx once it's done,
+// so cancellation also stops the copying of large files.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (e *exporter) open(name string) (afero.File, error) {
+	if err := e.opts.RateLimiter.WaitOp(e.ctx); err != nil {
+		return nil, err
+	}
+	return e.ofs.open(name, e.ofs.dirEntryArena)
+}
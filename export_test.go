@@ -0,0 +1,391 @@
+package overlayfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestMaterializeTo(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("1", "2"), basicFs("2", "2")}})
+	dst := afero.NewMemMapFs()
+
+	var progress []ProgressInfo
+	opts := ExportOptions{
+		Root: "mydir",
+		Progress: func(p ProgressInfo) {
+			progress = append(progress, p)
+		},
+	}
+
+	c.Assert(ofs.MaterializeTo(context.Background(), dst, opts), qt.IsNil)
+	c.Assert(readDirnames(c, dst, "mydir"), qt.DeepEquals, []string{"f1-1.txt", "f1-2.txt", "f2-1.txt", "f2-2.txt"})
+	c.Assert(readFile(c, dst, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+	c.Assert(readFile(c, dst, "mydir/f2-2.txt"), qt.Equals, "f2-2")
+
+	c.Assert(progress, qt.HasLen, 5)
+	c.Assert(progress[4].Items, qt.Equals, 5)
+	c.Assert(progress[4].Bytes, qt.Equals, int64(16))
+}
+
+func TestMaterializeToCancel(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	opts := ExportOptions{
+		Root: "mydir",
+		Progress: func(p ProgressInfo) {
+			if p.Items == 2 {
+				cancel()
+			}
+		},
+	}
+
+	c.Assert(ofs.MaterializeTo(ctx, afero.NewMemMapFs(), opts), qt.ErrorIs, context.Canceled)
+}
+
+func TestMaterializeToCancelLargeFile(t *testing.T) {
+	c := qt.New(t)
+	src := afero.NewMemMapFs()
+	c.Assert(afero.WriteFile(src, "large.bin", make([]byte, 1<<20), 0o666), qt.IsNil)
+	ofs := New(Options{Fss: []afero.Fs{src}})
+	ctx, cancel := context.WithCancel(context.Background())
+	dst := &cancelOnWriteFs{Fs: afero.NewMemMapFs(), cancel: cancel}
+
+	c.Assert(ofs.MaterializeTo(ctx, dst, ExportOptions{}), qt.ErrorIs, context.Canceled)
+	fi, err := dst.Stat("large.bin")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Size(), qt.Equals, int64(defaultCopyBufferSize))
+}
+
+// cancelOnWriteFs calls cancel on the first write to any of its files.
+type cancelOnWriteFs struct {
+	afero.Fs
+	cancel context.CancelFunc
+}
+
+func (cfs *cancelOnWriteFs) OpenFile(name string, flag int, perm fs.FileMode) (afero.File, error) {
+	f, err := cfs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return cancelOnWriteFile{File: f, cancel: cfs.cancel}, nil
+}
+
+type cancelOnWriteFile struct {
+	afero.File
+	cancel context.CancelFunc
+}
+
+func (f cancelOnWriteFile) Write(p []byte) (int, error) {
+	f.cancel()
+	return f.File.Write(p)
+}
+
+func TestMaterializeToVerify(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1")}})
+
+	c.Assert(ofs.MaterializeTo(context.Background(), afero.NewMemMapFs(), ExportOptions{Verify: true}), qt.IsNil)
+
+	dst := &corruptOnWriteFs{Fs: afero.NewMemMapFs()}
+	err := ofs.MaterializeTo(context.Background(), dst, ExportOptions{Verify: true})
+	c.Assert(err, qt.ErrorIs, ErrIntegrity)
+	c.Assert(err, qt.ErrorMatches, "verify .*f[12]-1.txt: integrity check failed")
+
+	// Not enabled.
+	c.Assert(ofs.MaterializeTo(context.Background(), &corruptOnWriteFs{Fs: afero.NewMemMapFs()}, ExportOptions{}), qt.IsNil)
+}
+
+// corruptOnWriteFs flips the first byte written to its files.
+type corruptOnWriteFs struct {
+	afero.Fs
+}
+
+func (cfs *corruptOnWriteFs) OpenFile(name string, flag int, perm fs.FileMode) (afero.File, error) {
+	f, err := cfs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptOnWriteFile{File: f}, nil
+}
+
+type corruptOnWriteFile struct {
+	afero.File
+	written bool
+}
+
+func (f *corruptOnWriteFile) Write(p []byte) (int, error) {
+	if !f.written && len(p) > 0 {
+		f.written = true
+		p = append([]byte{^p[0]}, p[1:]...)
+	}
+	return f.File.Write(p)
+}
+
+func TestMaterializeToResume(t *testing.T) {
+	c := qt.New(t)
+	fs1 := basicFs("1", "1")
+	ofs := New(Options{Fss: []afero.Fs{fs1, basicFs("2", "2")}})
+	dst := afero.NewMemMapFs()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var progress ProgressInfo
+	opts := ExportOptions{
+		Root:      "mydir",
+		StateFile: ".materialize-state",
+		Progress: func(p ProgressInfo) {
+			progress = p
+			if p.Items == 3 {
+				cancel()
+			}
+		},
+	}
+
+	c.Assert(ofs.MaterializeTo(ctx, dst, opts), qt.ErrorIs, context.Canceled)
+	c.Assert(progress.Bytes, qt.Equals, int64(8))
+	_, err := dst.Stat(opts.StateFile)
+	c.Assert(err, qt.IsNil)
+
+	// Tamper with one of the copied files; it should be copied again.
+	c.Assert(afero.WriteFile(dst, "mydir/f2-1.txt", []byte("foo"), 0o666), qt.IsNil)
+	// Change the source of another; it should be copied again.
+	c.Assert(afero.WriteFile(fs1, "mydir/f1-1.txt", []byte("f1-1 changed"), 0o666), qt.IsNil)
+
+	c.Assert(ofs.MaterializeTo(context.Background(), dst, opts), qt.IsNil)
+	c.Assert(progress.Items, qt.Equals, 5)
+	c.Assert(progress.Bytes, qt.Equals, int64(24))
+	c.Assert(readFile(c, dst, "mydir/f1-1.txt"), qt.Equals, "f1-1 changed")
+	c.Assert(readFile(c, dst, "mydir/f2-1.txt"), qt.Equals, "f2-1")
+	c.Assert(readFile(c, dst, "mydir/f2-2.txt"), qt.Equals, "f2-2")
+	_, err = dst.Stat(opts.StateFile)
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+}
+
+func TestMaterializeToPreserveAttrs(t *testing.T) {
+	c := qt.New(t)
+	src := basicFs("1", "1")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Assert(src.Chmod("mydir/f1-1.txt", 0o600), qt.IsNil)
+	c.Assert(src.Chtimes("mydir/f1-1.txt", mtime, mtime), qt.IsNil)
+	c.Assert(src.Chmod("mydir", 0o750), qt.IsNil)
+	c.Assert(src.Chtimes("mydir", mtime, mtime), qt.IsNil)
+	ofs := New(Options{Fss: []afero.Fs{src, basicFs("2", "2")}})
+
+	for _, dst := range []afero.Fs{afero.NewMemMapFs(), afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())} {
+		c.Assert(ofs.MaterializeTo(context.Background(), dst, ExportOptions{Root: "mydir", PreserveAttrs: PreserveAll}), qt.IsNil)
+		fi, err := dst.Stat("mydir/f1-1.txt")
+		c.Assert(err, qt.IsNil)
+		c.Assert(fi.Mode().Perm(), qt.Equals, fs.FileMode(0o600))
+		c.Assert(fi.ModTime().Equal(mtime), qt.IsTrue)
+		fi, err = dst.Stat("mydir")
+		c.Assert(err, qt.IsNil)
+		c.Assert(fi.Mode().Perm(), qt.Equals, fs.FileMode(0o750))
+		c.Assert(fi.ModTime().Equal(mtime), qt.IsTrue)
+	}
+
+	// Not preserved by default.
+	dst := afero.NewMemMapFs()
+	c.Assert(ofs.MaterializeTo(context.Background(), dst, ExportOptions{Root: "mydir"}), qt.IsNil)
+	fi, err := dst.Stat("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.ModTime().Equal(mtime), qt.IsFalse)
+}
+
+func TestMaterializeToPreserveXattrs(t *testing.T) {
+	c := qt.New(t)
+	src := NewXattrMapFs(basicFs("1", "1"))
+	c.Assert(src.SetXattr("mydir/f1-1.txt", "user.lang", []byte("en")), qt.IsNil)
+	ofs := New(Options{Fss: []afero.Fs{src, basicFs("2", "2")}})
+
+	dst := NewXattrMapFs(afero.NewMemMapFs())
+	c.Assert(ofs.MaterializeTo(context.Background(), dst, ExportOptions{Root: "mydir", PreserveAttrs: PreserveXattrs}), qt.IsNil)
+	v, err := dst.GetXattr("mydir/f1-1.txt", "user.lang")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "en")
+	attrs, err := dst.ListXattr("mydir/f1-2.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(attrs, qt.HasLen, 0)
+
+	err = ofs.MaterializeTo(context.Background(), afero.NewMemMapFs(), ExportOptions{Root: "mydir", PreserveAttrs: PreserveXattrs})
+	c.Assert(err, qt.ErrorIs, ErrXattrNotSupported)
+}
+
+func TestWriteTar(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("1", "2"), basicFs("2", "2")}})
+
+	var buf bytes.Buffer
+	c.Assert(ofs.WriteTar(context.Background(), &buf, ExportOptions{Root: "mydir"}), qt.IsNil)
+
+	files := readTar(c, &buf)
+	c.Assert(files, qt.DeepEquals, map[string]string{
+		"f1-1.txt": "f1-1",
+		"f2-1.txt": "f2-1",
+		"f1-2.txt": "f1-2",
+		"f2-2.txt": "f2-2",
+	})
+}
+
+func TestToMapFS(t *testing.T) {
+	c := qt.New(t)
+	fs1 := fsFromTxtTar(`
+-- mydir/sub/f.txt --
+sub
+`)
+	ofs := New(Options{Fss: []afero.Fs{fs1, basicFs("1", "1"), basicFs("2", "1")}})
+
+	m, err := ofs.ToMapFS("mydir")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fstest.TestFS(m, "f1-1.txt", "f2-1.txt", "sub/f.txt"), qt.IsNil)
+	c.Assert(string(m["f1-1.txt"].Data), qt.Equals, "f1-1")
+	c.Assert(string(m["sub/f.txt"].Data), qt.Equals, "sub")
+	c.Assert(m["sub"].Mode.IsDir(), qt.IsTrue)
+
+	m, err = ofs.ToMapFS(".")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fstest.TestFS(m, "mydir/f1-1.txt", "mydir/sub/f.txt"), qt.IsNil)
+
+	_, err = ofs.ToMapFS("notfound")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+}
+
+func TestExportWorkers(t *testing.T) {
+	c := qt.New(t)
+	createFs := func(fileID string) afero.Fs {
+		fs := afero.NewMemMapFs()
+		for i := 0; i < 20; i++ {
+			c.Assert(afero.WriteFile(fs, fmt.Sprintf("mydir/sub%d/f%s-%d.txt", i%3, fileID, i), []byte(fmt.Sprintf("f%s-%d", fileID, i)), 0o666), qt.IsNil)
+		}
+		return fs
+	}
+	ofs := New(Options{Fss: []afero.Fs{createFs("1"), createFs("2"), createFs("3")}})
+
+	writeTar := func(workers int) []byte {
+		var buf bytes.Buffer
+		c.Assert(ofs.WriteTar(context.Background(), &buf, ExportOptions{Root: "mydir", Workers: workers}), qt.IsNil)
+		return buf.Bytes()
+	}
+
+	want := writeTar(1)
+	c.Assert(readTar(c, bytes.NewReader(want)), qt.HasLen, 63)
+	for i := 0; i < 5; i++ {
+		c.Assert(bytes.Equal(writeTar(4), want), qt.IsTrue)
+	}
+
+	dst := afero.NewMemMapFs()
+	var items int
+	opts := ExportOptions{
+		Root:    "mydir",
+		Workers: 4,
+		Progress: func(p ProgressInfo) {
+			items = p.Items
+		},
+	}
+	c.Assert(ofs.MaterializeTo(context.Background(), dst, opts), qt.IsNil)
+	c.Assert(items, qt.Equals, 64)
+	c.Assert(readFile(c, dst, "mydir/sub1/f2-7.txt"), qt.Equals, "f2-7")
+}
+
+func TestExportWorkersLargeFile(t *testing.T) {
+	c := qt.New(t)
+	fs := afero.NewMemMapFs()
+	large := strings.Repeat("a", maxTarReadAhead+1)
+	for i := 0; i < 5; i++ {
+		c.Assert(afero.WriteFile(fs, fmt.Sprintf("mydir/f%d.txt", i), []byte(fmt.Sprintf("f%d", i)), 0o666), qt.IsNil)
+	}
+	c.Assert(afero.WriteFile(fs, "mydir/f2.txt", []byte(large), 0o666), qt.IsNil)
+	ofs := New(Options{Fss: []afero.Fs{fs}})
+
+	var buf bytes.Buffer
+	c.Assert(ofs.WriteTar(context.Background(), &buf, ExportOptions{Root: "mydir", Workers: 4}), qt.IsNil)
+	files := readTar(c, &buf)
+	c.Assert(files["f2.txt"] == large, qt.IsTrue)
+	c.Assert(files["f3.txt"], qt.Equals, "f3")
+}
+
+func readTar(c *qt.C, r io.Reader) map[string]string {
+	c.Helper()
+	files := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		b, err := io.ReadAll(tr)
+		c.Assert(err, qt.IsNil)
+		files[hdr.Name] = string(b)
+	}
+	return files
+}
+
+func BenchmarkMaterializeTo(b *testing.B) {
+	createFs := func(fileID string) afero.Fs {
+		fs := afero.NewMemMapFs()
+		for i := 0; i < 100; i++ {
+			if err := afero.WriteFile(fs, fmt.Sprintf("mydir/f%s-%d.txt", fileID, i), []byte("foo"), 0o666); err != nil {
+				b.Fatal(err)
+			}
+		}
+		return fs
+	}
+	fss := []afero.Fs{createFs("1"), createFs("2"), createFs("3")}
+
+	for _, size := range []int{512, defaultCopyBufferSize} {
+		ofs := New(Options{Fss: fss, CopyBufferSize: size})
+		b.Run(fmt.Sprintf("CopyBufferSize %d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := ofs.MaterializeTo(context.Background(), afero.NewMemMapFs(), ExportOptions{Root: "mydir"}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCopyBuffer compares copying many small files with pooled buffers,
+// as done by the overlay, to allocating a buffer per copy.
+func BenchmarkCopyBuffer(b *testing.B) {
+	ofs := New(Options{})
+	content := []byte("foo")
+	// Hide io.Discard's ReaderFrom, which would bypass the buffer.
+	dst := struct{ io.Writer }{io.Discard}
+
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 300; j++ {
+				if _, err := ofs.copyBuffer(dst, io.LimitReader(bytes.NewReader(content), 1024)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 300; j++ {
+				buf := make([]byte, ofs.copyBufferSize)
+				if _, err := io.CopyBuffer(dst, io.LimitReader(bytes.NewReader(content), 1024), buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package overlayfs
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ fmt.Formatter = (*OverlayFs)(nil)
+	_ fmt.Formatter = (*Dir)(nil)
+)
+
+// Format implements fmt.Formatter.
+// The %v and %s verbs print the name and the layers on one line,
+// %+v prints the layer tree, including nested overlays, and the options set.
+func (ofs *OverlayFs) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && f.Flag('+'):
+		fmt.Fprintf(f, "%s\n", ofs.Name())
+		ofs.formatLayers(f, "  ")
+		if opts := ofs.formatOptions(); len(opts) > 0 {
+			fmt.Fprintf(f, "  options: %s\n", strings.Join(opts, " "))
+		}
+	case verb == 'v' || verb == 's':
+		names := make([]string, len(ofs.fss))
+		for i, fs := range ofs.fss {
+			names[i] = fs.Name()
+		}
+		fmt.Fprintf(f, "%s%v", ofs.Name(), names)
+	default:
+		fmt.Fprintf(f, "%%!%c(*overlayfs.OverlayFs=%s)", verb, ofs.Name())
+	}
+}
+
+// formatLayers writes a line per layer, indented by indent, and the layers of nested overlays below it.
+func (ofs *OverlayFs) formatLayers(w io.Writer, indent string) {
+	for i, fs := range ofs.fss {
+		var attrs []string
+		if i == 0 && ofs.firstWritable {
+			attrs = append(attrs, "writable")
+		}
+		info := ofs.layers[i]
+		if info.weight != 0 {
+			attrs = append(attrs, fmt.Sprintf("weight=%d", info.weight))
+		}
+		if info.label != "" {
+			attrs = append(attrs, fmt.Sprintf("label=%q", info.label))
+		}
+		if info.version != "" {
+			attrs = append(attrs, fmt.Sprintf("version=%q", info.version))
+		}
+		if sfs, ok := fs.(scopedFs); ok {
+			attrs = append(attrs, fmt.Sprintf("only=%v", []string(sfs.roots)))
+		}
+		fmt.Fprintf(w, "%s%d: %s", indent, i, fs.Name())
+		if len(attrs) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(attrs, ", "))
+		}
+		fmt.Fprintln(w)
+		formatNested(w, unwrapScoped(fs), indent+"   ")
+	}
+}
+
+// formatNested writes the filesystems of fs, if it's a FilesystemIterator.
+func formatNested(w io.Writer, fs afero.Fs, indent string) {
+	switch v := fs.(type) {
+	case *OverlayFs:
+		v.formatLayers(w, indent)
+	case FilesystemIterator:
+		for i := 0; i < v.NumFilesystems(); i++ {
+			nfs := v.Filesystem(i)
+			fmt.Fprintf(w, "%s%d: %s\n", indent, i, nfs.Name())
+			formatNested(w, nfs, indent+"   ")
+		}
+	}
+}
+
+// formatOptions returns the options set that change the behavior of the overlay.
+func (ofs *OverlayFs) formatOptions() []string {
+	var opts []string
+	flag := func(set bool, name string) {
+		if set {
+			opts = append(opts, name)
+		}
+	}
+	value := func(set bool, name string, v any) {
+		if set {
+			opts = append(opts, fmt.Sprintf("%s=%v", name, v))
+		}
+	}
+	value(len(ofs.writeRules) > 0, "writeRules", len(ofs.writeRules))
+	value(ofs.maxWalkDepth > 0, "maxWalkDepth", ofs.maxWalkDepth)
+	value(ofs.maxWalkEntries > 0, "maxWalkEntries", ofs.maxWalkEntries)
+	flag(ofs.orderedWalk, "orderedWalk")
+	flag(ofs.deterministicOrder, "deterministicOrder")
+	flag(ofs.rateLimiter != nil, "rateLimiter")
+	if ofs.opLimiter != nil {
+		value(true, "maxConcurrentOps", cap(ofs.opLimiter.sem))
+	}
+	flag(ofs.lookups != nil, "dedupLookups")
+	flag(ofs.handles != nil, "trackHandles")
+	flag(ofs.dirEntryArena, "dirEntryArena")
+	flag(ofs.windowsPaths, "windowsPaths")
+	flag(ofs.rejectRootEscapes, "rejectRootEscapes")
+	flag(ofs.mergedDirInfo, "mergedDirInfo")
+	flag(ofs.osDirSemantics, "osDirSemantics")
+	flag(ofs.remergeStaleDirs, "remergeStaleDirs")
+	flag(ofs.recoverPanics, "recoverPanics")
+	value(ofs.ignoreFile != "", "ignoreFile", ofs.ignoreFile)
+	if ofs.quota != nil {
+		value(true, "quota", ofs.quota.limit)
+	}
+	flag(ofs.hermetic != nil, "hermetic")
+	return opts
+}
+
+// Format implements fmt.Formatter.
+// The %v and %s verbs print the name of the directory,
+// %+v also prints the number of directories merged, the read offset and the entries not yet read.
+func (d *Dir) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && f.Flag('+'):
+		if d.isClosed() {
+			fmt.Fprintf(f, "Dir(%s) closed", d.name)
+			return
+		}
+		fmt.Fprintf(f, "Dir(%s) dirs=%d", d.name, len(d.fss)+len(d.dirOpeners))
+		if !d.loaded {
+			fmt.Fprint(f, " not loaded")
+			return
+		}
+		pending := make([]string, 0, len(d.fis)-min(d.offset, len(d.fis)))
+		for _, fi := range d.fis[min(d.offset, len(d.fis)):] {
+			pending = append(pending, fi.Name())
+		}
+		fmt.Fprintf(f, " offset=%d/%d pending=%v", d.offset, len(d.fis), pending)
+	case verb == 'v' || verb == 's':
+		fmt.Fprintf(f, "Dir(%s)", d.name)
+	default:
+		fmt.Fprintf(f, "%%!%c(*overlayfs.Dir=%s)", verb, d.name)
+	}
+}
@@ -0,0 +1,45 @@
+package overlayfs
+
+import (
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestFormat(t *testing.T) {
+	c := qt.New(t)
+
+	nested := New(Options{Name: "theme-union", Fss: []afero.Fs{basicFs("2", "2"), basicFs("3", "3")}})
+	ofs := New(Options{
+		Fss: []afero.Fs{
+			basicFs("1", "1"),
+			Layer{Fs: nested, Weight: -1, Label: "github.com/bep/theme", Version: "v1.2.0", Only: []string{"mydir"}},
+		},
+		FirstWritable:      true,
+		DeterministicOrder: true,
+		MaxConcurrentOps:   4,
+	})
+
+	c.Assert(fmt.Sprintf("%v", ofs), qt.Equals, "overlayfs[MemMapFS theme-union]")
+	c.Assert(fmt.Sprintf("%s", ofs), qt.Equals, "overlayfs[MemMapFS theme-union]")
+	c.Assert(fmt.Sprintf("%d", ofs), qt.Equals, "%!d(*overlayfs.OverlayFs=overlayfs)")
+	c.Assert(fmt.Sprintf("%+v", ofs), qt.Equals, `overlayfs
+  0: MemMapFS (writable)
+  1: theme-union (weight=-1, label="github.com/bep/theme", version="v1.2.0", only=[mydir])
+     0: MemMapFS
+     1: MemMapFS
+  options: orderedWalk deterministicOrder maxConcurrentOps=4
+`)
+
+	f, err := ofs.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	dir := f.(*Dir)
+	c.Assert(fmt.Sprintf("%v", dir), qt.Equals, "Dir(mydir)")
+	c.Assert(fmt.Sprintf("%+v", dir), qt.Equals, "Dir(mydir) dirs=2 not loaded")
+	_, err = dir.Readdirnames(2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fmt.Sprintf("%+v", dir), qt.Equals, "Dir(mydir) dirs=2 offset=2/6 pending=[f1-3.txt f2-1.txt f2-2.txt f2-3.txt]")
+	c.Assert(dir.Close(), qt.IsNil)
+}
@@ -0,0 +1,117 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// FuzzPaths checks that Stat, Open, ReadDir and Glob agree with each other
+// and don't panic for arbitrary paths on an overlay of a MemMapFs and an OsFs.
+// The seed corpus is in testdata/fuzz/FuzzPaths.
+func FuzzPaths(f *testing.F) {
+	for _, name := range []string{
+		"",
+		".",
+		"/",
+		"mydir",
+		"mydir/f1-1.txt",
+		"mydir/f2-1.txt",
+		"mydir//f1-1.txt",
+		"mydir/./f2-1.txt",
+		"mydir/../mydir/f1-1.txt",
+		"../../../etc/passwd",
+		"mydir/f1-1.txt/",
+		"mydir/\x00",
+		"mydir/f1-1.txt\x00.png",
+		strings.Repeat("a", 300),
+		"mydir/" + strings.Repeat("ü", 200),
+		"mydir/日本語.txt",
+		"mydir/*",
+		"mydir/[",
+		`mydir\f1-1.txt`,
+	} {
+		f.Add(name)
+	}
+
+	mem := basicFs("1", "1")
+	osDir := f.TempDir()
+	osFs := afero.NewBasePathFs(afero.NewOsFs(), osDir)
+	if err := osFs.Mkdir("mydir", 0o777); err != nil {
+		f.Fatal(err)
+	}
+	if err := afero.WriteFile(osFs, "mydir/f2-1.txt", []byte("f2-1"), 0o666); err != nil {
+		f.Fatal(err)
+	}
+	if err := afero.WriteFile(osFs, "mydir/日本語.txt", []byte("ja"), 0o666); err != nil {
+		f.Fatal(err)
+	}
+	ofss := []*OverlayFs{
+		New(Options{Fss: []afero.Fs{mem, osFs}}),
+		New(Options{Fss: []afero.Fs{mem, osFs}, WindowsPaths: true, RejectRootEscapes: true}),
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		for _, ofs := range ofss {
+			checkPath(t, ofs, name)
+		}
+	})
+}
+
+func checkPath(t *testing.T, ofs *OverlayFs, name string) {
+	// MemMapFs resolves ".." to the root, but not "../foo", so only check
+	// the consistency of names derived from name when it stays within the root.
+	rooted := fs.ValidPath(filepath.ToSlash(filepath.Clean(name)))
+
+	fi, statErr := ofs.Stat(name)
+
+	file, openErr := ofs.Open(name)
+	if openErr == nil {
+		defer file.Close()
+	}
+	if (statErr == nil) != (openErr == nil) {
+		t.Fatalf("Stat and Open disagree for %q: %v vs %v", name, statErr, openErr)
+	}
+
+	if statErr == nil && fi.IsDir() {
+		// A directory found in only one filesystem is returned as is and may
+		// not implement fs.ReadDirFile.
+		entries, err := file.Readdir(-1)
+		if err != nil {
+			t.Fatalf("%q: Readdir: %v", name, err)
+		}
+		seen := make(map[string]bool)
+		for _, e := range entries {
+			if seen[e.Name()] {
+				t.Fatalf("%q: duplicate entry %q", name, e.Name())
+			}
+			seen[e.Name()] = true
+			if !rooted {
+				continue
+			}
+			if _, err := ofs.Stat(filepath.Join(name, e.Name())); err != nil {
+				t.Fatalf("%q: Stat of entry %q: %v", name, e.Name(), err)
+			}
+		}
+	}
+
+	matches, err := afero.Glob(ofs, name)
+	if err != nil {
+		if !errors.Is(err, filepath.ErrBadPattern) {
+			t.Fatalf("%q: Glob: %v", name, err)
+		}
+		return
+	}
+	if !rooted {
+		return
+	}
+	for _, m := range matches {
+		if _, err := ofs.Stat(m); err != nil {
+			t.Fatalf("%q: Stat of Glob match %q: %v", name, m, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package overlayfs
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Glob returns the names in the merged view matching pattern, with the syntax of filepath.Match,
+// or nil if there are none.
+// Names shadowed in lower layers are matched once, and directories are read with the DirsMerger,
+// so the result is the same as globbing a copy of the merged view.
+// The matches in each directory are sorted. As in filepath.Glob, the only error returned is
+// filepath.ErrBadPattern; errors reading directories are ignored.
+func (ofs *OverlayFs) Glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	defer ofs.foregroundOp()()
+	return ofs.glob(pattern)
+}
+
+func (ofs *OverlayFs) glob(pattern string) ([]string, error) {
+	if !hasGlobMeta(pattern) {
+		if _, _, err := ofs.LstatIfPossible(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, file := filepath.Split(pattern)
+	dir = cleanGlobDir(dir)
+	if !hasGlobMeta(dir) {
+		return ofs.globDir(dir, file, nil)
+	}
+
+	dirs, err := ofs.glob(dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		if matches, err = ofs.globDir(d, file, matches); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// globDir appends the names in dir matching pattern to matches.
+func (ofs *OverlayFs) globDir(dir, pattern string, matches []string) ([]string, error) {
+	fi, err := ofs.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return matches, nil
+	}
+	entries, err := ofs.readDir(dir)
+	if err != nil {
+		return matches, nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		matched, err := filepath.Match(pattern, n)
+		if err != nil {
+			return matches, err
+		}
+		if matched {
+			matches = append(matches, filepath.Join(dir, n))
+		}
+	}
+	return matches, nil
+}
+
+func cleanGlobDir(dir string) string {
+	switch dir {
+	case "":
+		return "."
+	case string(filepath.Separator):
+		return dir
+	}
+	return dir[:len(dir)-1]
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
@@ -0,0 +1,55 @@
+package overlayfs
+
+import (
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestGlob(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := fsFromTxtTar(`
+-- a/b.txt --
+1
+-- a/c.md --
+1
+-- d/b.txt --
+1
+`)
+	fs2 := fsFromTxtTar(`
+-- a/b.txt --
+2
+-- a/a.txt --
+2
+-- e/b.txt --
+2
+`)
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+	glob := func(pattern string) []string {
+		matches, err := ofs.Glob(filepath.FromSlash(pattern))
+		c.Assert(err, qt.IsNil)
+		for i, m := range matches {
+			matches[i] = filepath.ToSlash(m)
+		}
+		return matches
+	}
+
+	c.Assert(glob("a/*.txt"), qt.DeepEquals, []string{"a/a.txt", "a/b.txt"})
+	c.Assert(glob("*/b.txt"), qt.DeepEquals, []string{"a/b.txt", "d/b.txt", "e/b.txt"})
+	c.Assert(glob("*"), qt.DeepEquals, []string{"a", "d", "e"})
+	c.Assert(glob("a/c.md"), qt.DeepEquals, []string{"a/c.md"})
+	c.Assert(glob("a/nope.md"), qt.IsNil)
+	c.Assert(glob("x/*"), qt.IsNil)
+
+	_, err := ofs.Glob("a/[")
+	c.Assert(err, qt.Equals, filepath.ErrBadPattern)
+	_, err = ofs.Glob("nope/[")
+	c.Assert(err, qt.Equals, filepath.ErrBadPattern)
+
+	matches, err := ofs.IOFS().Glob("*/b.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(matches, qt.DeepEquals, []string{"a/b.txt", "d/b.txt", "e/b.txt"})
+}
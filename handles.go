@@ -0,0 +1,120 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.File     = (*trackedFile)(nil)
+	_ fs.ReadDirFile = (*trackedFile)(nil)
+)
+
+// OpenHandle is a file or directory opened through the overlay and not yet closed,
+// see Options.TrackHandles.
+type OpenHandle struct {
+	Name string
+
+	// Stack is the stack trace of the goroutine that opened the handle.
+	Stack []byte
+}
+
+// OpenHandles returns the files and directories opened through the overlay and not
+// yet closed, in the order they were opened.
+// It returns nil if Options.TrackHandles is not set.
+func (ofs *OverlayFs) OpenHandles() []OpenHandle {
+	if ofs.handles == nil {
+		return nil
+	}
+	return ofs.handles.list()
+}
+
+// handleRegistry tracks open handles. It's shared by the shallow copies of an OverlayFs.
+type handleRegistry struct {
+	mu   sync.Mutex
+	seq  int
+	open map[any]trackedHandle
+}
+
+type trackedHandle struct {
+	seq int
+	OpenHandle
+}
+
+func newHandleRegistry() *handleRegistry {
+	return &handleRegistry{open: make(map[any]trackedHandle)}
+}
+
+func (r *handleRegistry) add(key any, name string) {
+	stack := debug.Stack()
+	r.mu.Lock()
+	r.seq++
+	r.open[key] = trackedHandle{seq: r.seq, OpenHandle: OpenHandle{Name: name, Stack: stack}}
+	r.mu.Unlock()
+}
+
+func (r *handleRegistry) remove(key any) {
+	r.mu.Lock()
+	delete(r.open, key)
+	r.mu.Unlock()
+}
+
+func (r *handleRegistry) list() []OpenHandle {
+	r.mu.Lock()
+	handles := make([]trackedHandle, 0, len(r.open))
+	for _, h := range r.open {
+		handles = append(handles, h)
+	}
+	r.mu.Unlock()
+	sort.Slice(handles, func(i, j int) bool { return handles[i].seq < handles[j].seq })
+	open := make([]OpenHandle, len(handles))
+	for i, h := range handles {
+		open[i] = h.OpenHandle
+	}
+	return open
+}
+
+// trackOpen returns a func registering the opened file name if Options.TrackHandles is set.
+// A *Dir is registered as is so it keeps its type; other files are wrapped.
+func (ofs *OverlayFs) trackOpen(name string) func(afero.File, error) (afero.File, error) {
+	return func(f afero.File, err error) (afero.File, error) {
+		if err != nil || ofs.handles == nil {
+			return f, err
+		}
+		if d, ok := f.(*Dir); ok {
+			d.handles = ofs.handles
+			ofs.handles.add(d, name)
+			return d, nil
+		}
+		tf := &trackedFile{File: f, handles: ofs.handles}
+		ofs.handles.add(tf, name)
+		return tf, nil
+	}
+}
+
+// trackedFile is a file registered in a handleRegistry until closed.
+type trackedFile struct {
+	afero.File
+	handles *handleRegistry
+}
+
+func (f *trackedFile) Close() error {
+	f.handles.remove(f)
+	return f.File.Close()
+}
+
+func (f *trackedFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if rdf, ok := f.File.(fs.ReadDirFile); ok {
+		return rdf.ReadDir(n)
+	}
+	fis, err := f.Readdir(n)
+	dirEntries := make([]fs.DirEntry, len(fis))
+	for i, fi := range fis {
+		dirEntries[i] = dirEntry{fi}
+	}
+	return dirEntries, err
+}
@@ -0,0 +1,62 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestOpenHandles(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")}, FirstWritable: true, TrackHandles: true})
+	c.Assert(ofs.OpenHandles(), qt.HasLen, 0)
+
+	names := func() []string {
+		var names []string
+		for _, h := range ofs.OpenHandles() {
+			names = append(names, h.Name)
+		}
+		return names
+	}
+
+	d, err := ofs.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	_, isDir := d.(*Dir)
+	c.Assert(isDir, qt.IsTrue)
+	f, err := ofs.Open("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	w, err := ofs.Create("mydir/new.txt")
+	c.Assert(err, qt.IsNil)
+	r, err := ofs.OpenFile("mydir/f2-1.txt", os.O_RDONLY, 0)
+	c.Assert(err, qt.IsNil)
+
+	// Shallow copies share the handles.
+	c.Assert(ofs.Append(afero.NewMemMapFs()).OpenHandles(), qt.HasLen, 4)
+	c.Assert(names(), qt.DeepEquals, []string{"mydir", "mydir/f1-1.txt", "mydir/new.txt", "mydir/f2-1.txt"})
+	c.Assert(strings.Contains(string(ofs.OpenHandles()[0].Stack), "TestOpenHandles"), qt.IsTrue)
+
+	c.Assert(d.Close(), qt.IsNil)
+	c.Assert(w.Close(), qt.IsNil)
+	c.Assert(names(), qt.DeepEquals, []string{"mydir/f1-1.txt", "mydir/f2-1.txt"})
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(r.Close(), qt.IsNil)
+	c.Assert(ofs.OpenHandles(), qt.HasLen, 0)
+
+	// A directory in a single filesystem is wrapped, but keeps ReadDir.
+	ofs = New(Options{Fss: []afero.Fs{basicFs("1", "1")}, TrackHandles: true})
+	d, err = ofs.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	entries, err := d.(fs.ReadDirFile).ReadDir(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 2)
+	c.Assert(ofs.OpenHandles(), qt.HasLen, 1)
+	c.Assert(d.Close(), qt.IsNil)
+	c.Assert(ofs.OpenHandles(), qt.HasLen, 0)
+
+	c.Assert(New(Options{}).OpenHandles(), qt.IsNil)
+}
@@ -0,0 +1,70 @@
+package overlayfs
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// TestingT is the subset of testing.TB used by AssertHermetic.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// AssertHermetic creates a shallow copy of the filesystem that reports an error to t
+// for every operation reaching the OS filesystem outside of the given roots.
+// Filesystems of type *afero.OsFs and *afero.BasePathFs are considered OS filesystems.
+// The operations are not stopped, so all violations in a test are reported.
+func (ofs OverlayFs) AssertHermetic(t TestingT, roots ...string) *OverlayFs {
+	h := &hermeticCheck{t: t}
+	for _, root := range roots {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		h.roots = append(h.roots, root)
+	}
+	ofs.hermetic = h
+	ofs.newInstance()
+	return &ofs
+}
+
+type hermeticCheck struct {
+	t     TestingT
+	roots []string
+}
+
+// wrap returns wrapped wrapped to check all names if fs is an OS filesystem.
+func (h *hermeticCheck) wrap(fs, wrapped afero.Fs) afero.Fs {
+	var realPath func(name string) (string, error)
+	switch v := fs.(type) {
+	case *afero.OsFs:
+		realPath = filepath.Abs
+	case *afero.BasePathFs:
+		realPath = func(name string) (string, error) {
+			name, err := v.RealPath(name)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Abs(name)
+		}
+	default:
+		return wrapped
+	}
+	return nameFs{fs: wrapped, name: func(op, name string) (string, error) {
+		if p, err := realPath(name); err == nil && !h.allowed(p) {
+			h.t.Helper()
+			h.t.Errorf("overlayfs: %s %s: outside of hermetic roots %v", op, p, h.roots)
+		}
+		return name, nil
+	}}
+}
+
+func (h *hermeticCheck) allowed(name string) bool {
+	for _, root := range h.roots {
+		if isWithin(root, name) {
+			return true
+		}
+	}
+	return false
+}
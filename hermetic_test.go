@@ -0,0 +1,53 @@
+package overlayfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+type recordingT struct {
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertHermetic(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	inputs, other := filepath.Join(dir, "inputs"), filepath.Join(dir, "other")
+	for _, d := range []string{inputs, other} {
+		c.Assert(os.MkdirAll(d, 0o777), qt.IsNil)
+		c.Assert(os.WriteFile(filepath.Join(d, "f.txt"), []byte(d), 0o666), qt.IsNil)
+	}
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), afero.NewOsFs()}})
+	rt := &recordingT{}
+	hofs := ofs.AssertHermetic(rt, inputs)
+
+	c.Assert(readFile(c, hofs, filepath.Join(inputs, "f.txt")), qt.Equals, inputs)
+	c.Assert(readFile(c, hofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+	c.Assert(rt.errors, qt.HasLen, 0)
+
+	c.Assert(readFile(c, hofs, filepath.Join(other, "f.txt")), qt.Equals, other)
+	c.Assert(rt.errors, qt.Not(qt.HasLen), 0)
+	c.Assert(rt.errors[0], qt.Contains, "outside of hermetic roots")
+
+	// The original is not affected.
+	rt.errors = nil
+	c.Assert(readFile(c, ofs, filepath.Join(other, "f.txt")), qt.Equals, other)
+	c.Assert(rt.errors, qt.HasLen, 0)
+
+	// BasePathFs is checked using its real path.
+	hofs = New(Options{Fss: []afero.Fs{afero.NewBasePathFs(afero.NewOsFs(), other)}}).AssertHermetic(rt, inputs)
+	c.Assert(readFile(c, hofs, "f.txt"), qt.Equals, other)
+	c.Assert(rt.errors, qt.Not(qt.HasLen), 0)
+}
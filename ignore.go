@@ -0,0 +1,150 @@
+package overlayfs
+
+import (
+	"bufio"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ignoreRule is a rule in a .gitignore style ignore file, see Options.IgnoreFile.
+type ignoreRule struct {
+	// The directory of the ignore file, cleaned as in cleanScopePath.
+	base string
+
+	// The pattern split into path segments.
+	segments []string
+
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parseIgnoreRules parses the rules in an ignore file in the directory base.
+func parseIgnoreRules(base, content string) []ignoreRule {
+	var rules []ignoreRule
+	sc := bufio.NewScanner(strings.NewReader(content))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A pattern with a slash at the start or in the middle is relative to base.
+		r.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		r.segments = strings.Split(line, "/")
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// match reports whether the slash separated name, relative to the filesystem root, matches r.
+func (r ignoreRule) match(name string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "." {
+		if !strings.HasPrefix(name, r.base+"/") {
+			return false
+		}
+		name = name[len(r.base)+1:]
+	}
+	if !r.anchored {
+		return matchSegments(r.segments, []string{path.Base(name)})
+	}
+	return matchSegments(r.segments, strings.Split(name, "/"))
+}
+
+// matchSegments matches the path segments in name against the pattern segments,
+// where a "**" segment matches zero or more segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// ignoreFilter returns a func reporting whether to keep an entry in the directory dir,
+// or nil if no ignore rules are configured.
+// The rules are loaded on first use.
+func (ofs *OverlayFs) ignoreFilter(dir string) func(fs.DirEntry) bool {
+	if ofs.ignoreFile == "" && len(ofs.ignorePatterns) == 0 {
+		return nil
+	}
+	dir = cleanScopePath(dir)
+	var rules []ignoreRule
+	var loaded bool
+	return func(d fs.DirEntry) bool {
+		if !loaded {
+			rules = ofs.ignoreRules(dir)
+			loaded = true
+		}
+		name := path.Join(dir, d.Name())
+		ignored := false
+		for _, r := range rules {
+			if r.match(name, d.IsDir()) {
+				ignored = !r.negate
+			}
+		}
+		return !ignored
+	}
+}
+
+// ignoreRules returns the rules applying to the entries in dir in order of increasing
+// precedence: Options.IgnorePatterns and then the ignore files from the root down to dir.
+func (ofs *OverlayFs) ignoreRules(dir string) []ignoreRule {
+	rules := parseIgnoreRules(".", strings.Join(ofs.ignorePatterns, "\n"))
+	if ofs.ignoreFile == "" {
+		return rules
+	}
+	dirs := []string{"."}
+	if dir != "." {
+		parts := strings.Split(dir, "/")
+		for i := range parts {
+			dirs = append(dirs, strings.Join(parts[:i+1], "/"))
+		}
+	}
+	for _, d := range dirs {
+		f, err := ofs.open(path.Join(d, ofs.ignoreFile), false)
+		if err != nil {
+			continue
+		}
+		var sb strings.Builder
+		_, err = ofs.copyBuffer(&sb, f)
+		f.Close()
+		if err != nil {
+			ofs.logger.Warn("failed to read ignore file", "dir", d, "error", err)
+			continue
+		}
+		rules = append(rules, parseIgnoreRules(d, sb.String())...)
+	}
+	return rules
+}
@@ -0,0 +1,115 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestIgnoreFile(t *testing.T) {
+	c := qt.New(t)
+
+	project := fsFromTxtTar(`
+-- .gitignore --
+*.log
+/build/
+!keep.log
+-- content/a.md --
+a
+-- content/debug.log --
+debug
+-- content/keep.log --
+keep
+-- build/out.txt --
+out
+-- docs/.gitignore --
+!*.log
+drafts/
+-- docs/notes.log --
+notes
+-- docs/drafts/d.md --
+draft
+-- docs/build/b.txt --
+b
+`)
+	theme := fsFromTxtTar(`
+-- content/theme.log --
+theme log
+-- content/b.md --
+b
+`)
+	ofs := New(Options{Fss: []afero.Fs{project, theme}, IgnoreFile: ".gitignore", DeterministicOrder: true})
+
+	c.Assert(readDirnames(c, ofs, "/"), qt.DeepEquals, []string{".gitignore", "content", "docs"})
+	// The rules apply to entries from all layers.
+	c.Assert(readDirnames(c, ofs, "content"), qt.DeepEquals, []string{"a.md", "b.md", "keep.log"})
+	// The nearest ignore file takes precedence; /build/ is anchored to the root.
+	c.Assert(readDirnames(c, ofs, "docs"), qt.DeepEquals, []string{".gitignore", "build", "notes.log"})
+
+	var walked []string
+	c.Assert(afero.Walk(ofs, "", func(path string, info fs.FileInfo, err error) error {
+		c.Assert(err, qt.IsNil)
+		if !info.IsDir() {
+			walked = append(walked, filepath.ToSlash(path))
+		}
+		return nil
+	}), qt.IsNil)
+	c.Assert(walked, qt.DeepEquals, []string{
+		".gitignore", "content/a.md", "content/b.md", "content/keep.log",
+		"docs/.gitignore", "docs/build/b.txt", "docs/notes.log",
+	})
+
+	matches, err := afero.Glob(ofs, "content/*.log")
+	c.Assert(err, qt.IsNil)
+	c.Assert(matches, qt.DeepEquals, []string{filepath.FromSlash("content/keep.log")})
+
+	// Ignored files can still be opened.
+	c.Assert(readFile(c, ofs, "content/debug.log"), qt.Equals, "debug")
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{
+		Fss: []afero.Fs{fsFromTxtTar(`
+-- a/b/c.tmp --
+c
+-- a/b/d.txt --
+d
+-- a/e.tmp --
+e
+-- node_modules/x.js --
+x
+`)},
+		IgnorePatterns: []string{"# comment", "a/**/*.tmp", "node_modules/"},
+	})
+
+	c.Assert(readDirnames(c, ofs, "/"), qt.DeepEquals, []string{"a"})
+	c.Assert(readDirnames(c, ofs, "a"), qt.DeepEquals, []string{"b"})
+	c.Assert(readDirnames(c, ofs, "a/b"), qt.DeepEquals, []string{"d.txt"})
+}
+
+func TestParseIgnoreRules(t *testing.T) {
+	c := qt.New(t)
+
+	rules := parseIgnoreRules("docs", "# comment\n\n\\#hash\n!keep\nout/\n/root.txt\n**/x/*.go \n")
+	c.Assert(rules, qt.HasLen, 5)
+
+	match := func(pattern int, name string, isDir bool) bool {
+		return rules[pattern].match(name, isDir)
+	}
+	c.Assert(match(0, "docs/#hash", false), qt.IsTrue)
+	c.Assert(match(0, "#hash", false), qt.IsFalse)
+	c.Assert(rules[1].negate, qt.IsTrue)
+	c.Assert(match(1, "docs/a/keep", false), qt.IsTrue)
+	c.Assert(match(2, "docs/a/out", true), qt.IsTrue)
+	c.Assert(match(2, "docs/a/out", false), qt.IsFalse)
+	c.Assert(match(3, "docs/root.txt", false), qt.IsTrue)
+	c.Assert(match(3, "docs/a/root.txt", false), qt.IsFalse)
+	c.Assert(match(4, "docs/x/a.go", false), qt.IsTrue)
+	c.Assert(match(4, "docs/a/b/x/a.go", false), qt.IsTrue)
+	c.Assert(match(4, "docs/a/b/x/y/a.go", false), qt.IsFalse)
+}
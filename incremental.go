@@ -0,0 +1,371 @@
+package overlayfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// ExportCompare selects how an incremental MaterializeTo decides whether a file in dst
+// is up to date, see ExportOptions.Incremental.
+type ExportCompare uint8
+
+const (
+	// CompareSizeModTime considers a file up to date if its size and modification time match.
+	// It implies PreserveTimes.
+	CompareSizeModTime ExportCompare = iota + 1
+
+	// CompareHash considers a file up to date if its size and SHA-256 hash match.
+	CompareHash
+)
+
+func (c ExportCompare) String() string {
+	switch c {
+	case CompareSizeModTime:
+		return "size and modtime"
+	case CompareHash:
+		return "hash"
+	}
+	return fmt.Sprintf("ExportCompare(%d)", int(c))
+}
+
+// ExportOp is the kind of an ExportChange.
+type ExportOp uint8
+
+const (
+	// ExportCreate is a file or directory created in dst.
+	ExportCreate ExportOp = iota + 1
+
+	// ExportUpdate is a file in dst replaced with the file in the overlay.
+	ExportUpdate
+
+	// ExportMove is a file in dst renamed from a path removed from the overlay
+	// to a new path with the same content.
+	ExportMove
+
+	// ExportDelete is a file or directory removed from dst.
+	ExportDelete
+)
+
+func (op ExportOp) String() string {
+	switch op {
+	case ExportCreate:
+		return "create"
+	case ExportUpdate:
+		return "update"
+	case ExportMove:
+		return "move"
+	case ExportDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("ExportOp(%d)", int(op))
+}
+
+// ExportChange is a change made to dst by an incremental MaterializeTo.
+type ExportChange struct {
+	Op   ExportOp
+	Path string
+
+	// From is the old path for ExportMove.
+	From string
+}
+
+func (c ExportChange) String() string {
+	if c.Op == ExportMove {
+		return fmt.Sprintf("%s %s -> %s", c.Op, c.From, c.Path)
+	}
+	return fmt.Sprintf("%s %s", c.Op, c.Path)
+}
+
+type exportEntry struct {
+	path string
+	fi   fs.FileInfo
+}
+
+// incremental holds the state of an incremental MaterializeTo.
+type incremental struct {
+	e   *exporter
+	dst afero.Fs
+
+	// Files and directories in dst not in the overlay.
+	// Directories are only listed if their parent is not.
+	removed []exportEntry
+
+	// The removed files by size, the candidates for moves.
+	mu         sync.Mutex
+	candidates map[int64][]string
+	moved      map[string]bool
+}
+
+// materializeIncremental is MaterializeTo with opts.Incremental set.
+func (e *exporter) materializeIncremental(dst afero.Fs) error {
+	if e.opts.Incremental == CompareSizeModTime {
+		e.opts.PreserveAttrs |= PreserveTimes
+	}
+	inc := &incremental{e: e, dst: dst, candidates: make(map[int64][]string), moved: make(map[string]bool)}
+
+	var dirs, files []exportEntry
+	seen := make(map[string]bool)
+	err := e.walk(func(path string, d fs.DirEntry, err error) error {
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		seen[path] = true
+		if d.IsDir() {
+			dirs = append(dirs, exportEntry{path, fi})
+		} else {
+			files = append(files, exportEntry{path, fi})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if e.opts.Delete {
+		if err := inc.collectRemoved(seen); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := inc.syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	g := newWorkGroup(e.opts.Workers)
+	for _, file := range files {
+		file := file
+		if err := g.Go(func() error { return inc.syncFile(file) }); err != nil {
+			break
+		}
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	for _, entry := range inc.removed {
+		if inc.moved[entry.path] {
+			continue
+		}
+		if err := inc.apply(ExportChange{Op: ExportDelete, Path: entry.path}, func() error {
+			return dst.RemoveAll(entry.path)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if e.opts.PreserveAttrs != 0 && !e.opts.DryRun {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := e.preserveAttrs(dst, dirs[i].path, dirs[i].fi); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectRemoved collects the entries in dst below the export root not in seen.
+func (inc *incremental) collectRemoved(seen map[string]bool) error {
+	root := inc.e.opts.Root
+	removedDirs := make(map[string]bool)
+	return afero.Walk(inc.dst, root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := inc.e.ctx.Err(); err != nil {
+			return err
+		}
+		if seen[path] {
+			return nil
+		}
+		if !removedDirs[filepath.Dir(path)] {
+			inc.removed = append(inc.removed, exportEntry{path, info})
+		}
+		if info.IsDir() {
+			removedDirs[path] = true
+		} else if info.Mode().IsRegular() {
+			inc.candidates[info.Size()] = append(inc.candidates[info.Size()], path)
+		}
+		return nil
+	})
+}
+
+func (inc *incremental) syncDir(dir exportEntry) error {
+	if err := inc.e.ctx.Err(); err != nil {
+		return err
+	}
+	defer inc.e.done(dir.path, 0)
+	dfi, err := inc.dst.Stat(dir.path)
+	switch {
+	case err == nil && dfi.IsDir():
+		return nil
+	case err == nil:
+		return inc.apply(ExportChange{Op: ExportUpdate, Path: dir.path}, func() error {
+			if err := inc.dst.Remove(dir.path); err != nil {
+				return err
+			}
+			return inc.dst.MkdirAll(dir.path, 0o777)
+		})
+	case os.IsNotExist(err):
+		return inc.apply(ExportChange{Op: ExportCreate, Path: dir.path}, func() error {
+			return inc.dst.MkdirAll(dir.path, 0o777)
+		})
+	default:
+		return err
+	}
+}
+
+func (inc *incremental) syncFile(file exportEntry) error {
+	e := inc.e
+	dfi, err := inc.dst.Stat(file.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err != nil {
+		from, err := inc.findMove(file)
+		if err != nil {
+			return err
+		}
+		if from != "" {
+			err := inc.apply(ExportChange{Op: ExportMove, Path: file.path, From: from}, func() error {
+				if err := inc.dst.Rename(from, file.path); err != nil {
+					return err
+				}
+				return e.preserveAttrs(inc.dst, file.path, file.fi)
+			})
+			if err == nil {
+				e.done(file.path, 0)
+			}
+			return err
+		}
+		return inc.copy(ExportChange{Op: ExportCreate, Path: file.path})
+	}
+
+	if !dfi.IsDir() {
+		upToDate, err := inc.upToDate(file, dfi)
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			e.done(file.path, 0)
+			return nil
+		}
+	}
+	return inc.copy(ExportChange{Op: ExportUpdate, Path: file.path})
+}
+
+// copy copies the file in change.Path into dst, replacing any directory in its place.
+func (inc *incremental) copy(change ExportChange) error {
+	var n int64
+	err := inc.apply(change, func() error {
+		if change.Op == ExportUpdate {
+			if err := inc.dst.RemoveAll(change.Path); err != nil {
+				return err
+			}
+		}
+		var err error
+		n, err = inc.e.copyFile(inc.dst, change.Path, nil)
+		return err
+	})
+	if err == nil {
+		inc.e.done(change.Path, n)
+	}
+	return err
+}
+
+// apply reports change and, unless in a dry run, applies it.
+func (inc *incremental) apply(change ExportChange, fn func() error) error {
+	if !inc.e.opts.DryRun {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	if inc.e.opts.Changes != nil {
+		inc.e.opts.Changes(change)
+	}
+	return nil
+}
+
+// upToDate reports whether dfi in dst is an up to date copy of file.
+func (inc *incremental) upToDate(file exportEntry, dfi fs.FileInfo) (bool, error) {
+	if file.fi.Size() != dfi.Size() {
+		return false, nil
+	}
+	if inc.e.opts.Incremental == CompareSizeModTime {
+		return file.fi.ModTime().Equal(dfi.ModTime()), nil
+	}
+	srcSum, err := inc.srcHash(file.path)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := inc.dstHash(file.path)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(srcSum, dstSum), nil
+}
+
+// findMove returns a removed file in dst with the same content as file, if any,
+// and claims it.
+func (inc *incremental) findMove(file exportEntry) (string, error) {
+	inc.mu.Lock()
+	defer inc.mu.Unlock()
+	candidates := inc.candidates[file.fi.Size()]
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	srcSum, err := inc.srcHash(file.path)
+	if err != nil {
+		return "", err
+	}
+	for i, candidate := range candidates {
+		dstSum, err := inc.dstHash(candidate)
+		if err != nil {
+			return "", err
+		}
+		if bytes.Equal(srcSum, dstSum) {
+			inc.candidates[file.fi.Size()] = append(candidates[:i:i], candidates[i+1:]...)
+			inc.moved[candidate] = true
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+func (inc *incremental) srcHash(name string) ([]byte, error) {
+	h := sha256.New()
+	if _, err := inc.e.copyFileTo(h, name); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (inc *incremental) dstHash(name string) ([]byte, error) {
+	f, err := inc.dst.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
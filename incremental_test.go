@@ -0,0 +1,113 @@
+package overlayfs
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestMaterializeToIncremental(t *testing.T) {
+	ctx := context.Background()
+
+	for _, compare := range []ExportCompare{CompareSizeModTime, CompareHash} {
+		t.Run(compare.String(), func(t *testing.T) {
+			c := qt.New(t)
+
+			src := fsFromTxtTar(`
+-- public/index.html --
+index
+-- public/about.html --
+about
+-- public/posts/p1.html --
+p1
+-- public/posts/p2.html --
+p2
+`)
+			ofs := New(Options{Fss: []afero.Fs{src}, FirstWritable: true})
+			dst := afero.NewMemMapFs()
+
+			var (
+				mu      sync.Mutex
+				changes []string
+			)
+			opts := ExportOptions{
+				Root:        "public",
+				Incremental: compare,
+				Delete:      true,
+				Workers:     2,
+				Changes: func(change ExportChange) {
+					mu.Lock()
+					defer mu.Unlock()
+					changes = append(changes, filepath.ToSlash(change.String()))
+				},
+			}
+			materialize := func(opts ExportOptions) []string {
+				c.Helper()
+				changes = nil
+				c.Assert(ofs.MaterializeTo(ctx, dst, opts), qt.IsNil)
+				sort.Strings(changes)
+				return changes
+			}
+
+			c.Assert(materialize(opts), qt.DeepEquals, []string{
+				"create public",
+				"create public/about.html",
+				"create public/index.html",
+				"create public/posts",
+				"create public/posts/p1.html",
+				"create public/posts/p2.html",
+			})
+			c.Assert(materialize(opts), qt.HasLen, 0)
+
+			// Change, add, move and remove some files.
+			c.Assert(afero.WriteFile(ofs, "public/index.html", []byte("INDEX"), 0o666), qt.IsNil)
+			c.Assert(ofs.Chtimes("public/index.html", time.Now(), time.Now().Add(time.Hour)), qt.IsNil)
+			c.Assert(afero.WriteFile(ofs, "public/new.html", []byte("new"), 0o666), qt.IsNil)
+			c.Assert(ofs.MkdirAll("public/archive", 0o777), qt.IsNil)
+			c.Assert(ofs.Rename("public/posts/p1.html", "public/archive/p1.html"), qt.IsNil)
+			c.Assert(ofs.Remove("public/posts/p2.html"), qt.IsNil)
+			c.Assert(ofs.Remove("public/posts"), qt.IsNil)
+			c.Assert(ofs.Remove("public/about.html"), qt.IsNil)
+			c.Assert(afero.WriteFile(dst, "public/stray.txt", []byte("stray"), 0o666), qt.IsNil)
+
+			want := []string{
+				"create public/archive",
+				"create public/new.html",
+				"delete public/about.html",
+				"delete public/posts",
+				"delete public/stray.txt",
+				"move public/posts/p1.html -> public/archive/p1.html",
+				"update public/index.html",
+			}
+
+			dryRun := opts
+			dryRun.DryRun = true
+			c.Assert(materialize(dryRun), qt.DeepEquals, want)
+			c.Assert(readFile(c, dst, "public/index.html"), qt.Equals, "index")
+
+			c.Assert(materialize(opts), qt.DeepEquals, want)
+			c.Assert(materialize(opts), qt.HasLen, 0)
+
+			got := make(map[string]string)
+			c.Assert(afero.Walk(dst, "", func(path string, info fs.FileInfo, err error) error {
+				c.Assert(err, qt.IsNil)
+				if !info.IsDir() {
+					got[filepath.ToSlash(path)] = readFile(c, dst, path)
+				}
+				return nil
+			}), qt.IsNil)
+			c.Assert(got, qt.DeepEquals, map[string]string{
+				"public/index.html":      "INDEX",
+				"public/new.html":        "new",
+				"public/archive/p1.html": "p1",
+			})
+		})
+	}
+}
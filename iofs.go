@@ -0,0 +1,117 @@
+package overlayfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ fs.FS         = IOFS{}
+	_ fs.StatFS     = IOFS{}
+	_ fs.ReadDirFS  = IOFS{}
+	_ fs.ReadFileFS = IOFS{}
+	_ fs.GlobFS     = IOFS{}
+)
+
+// IOFS returns the merged view as an fs.FS, e.g. for http.FS, template.ParseFS and fs.WalkDir.
+// Unlike afero.IOFS, ReadDir reads the merged directories directly.
+func (ofs *OverlayFs) IOFS() IOFS {
+	return IOFS{ofs: ofs}
+}
+
+// IOFS is an fs.FS, fs.StatFS, fs.ReadDirFS, fs.ReadFileFS and fs.GlobFS view of an OverlayFs, see OverlayFs.IOFS.
+// The names are slash separated and unrooted, as described in fs.ValidPath.
+type IOFS struct {
+	ofs *OverlayFs
+}
+
+// Open implements fs.FS.
+// Directories implement fs.ReadDirFile.
+func (f IOFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	file, err := f.ofs.Open(filepath.FromSlash(name))
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := file.(*Dir); ok {
+		// fs.ReadDirFile has the os.File semantics.
+		d.osSemantics = true
+		return d, nil
+	}
+	return ioFile{file}, nil
+}
+
+// Stat implements fs.StatFS.
+func (f IOFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.ofs.Stat(filepath.FromSlash(name))
+}
+
+// ReadDir implements fs.ReadDirFS.
+// The entries are sorted by name.
+func (f IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := f.ofs.ReadDir(filepath.FromSlash(name))
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (f IOFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.ofs.ReadFile(filepath.FromSlash(name))
+}
+
+// Glob implements fs.GlobFS, see OverlayFs.Glob.
+func (f IOFS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	matches, err := f.ofs.Glob(filepath.FromSlash(pattern))
+	for i, m := range matches {
+		matches[i] = filepath.ToSlash(m)
+	}
+	return matches, err
+}
+
+// ioFile adapts a file from a filesystem to the io/fs interfaces.
+type ioFile struct {
+	afero.File
+}
+
+// ReadAt implements io.ReaderAt, which requires an error when fewer than len(p) bytes are read.
+func (f ioFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	if n < len(p) && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f ioFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if fi, err := f.File.Stat(); err == nil && !fi.IsDir() {
+		return nil, notDirError(f.File.Name())
+	}
+	fis, err := f.File.Readdir(n)
+	entries := make([]fs.DirEntry, len(fis))
+	for i, fi := range fis {
+		entries[i] = fs.FileInfoToDirEntry(fi)
+	}
+	if n > 0 && len(entries) == 0 && err == nil {
+		err = io.EOF
+	}
+	return entries, err
+}
@@ -0,0 +1,44 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestIOFS(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}})
+	iofs := ofs.IOFS()
+	c.Assert(fstest.TestFS(iofs, "mydir/f1-1.txt", "mydir/f2-2.txt", "mydir/f1-2.txt"), qt.IsNil)
+
+	entries, err := iofs.ReadDir("mydir")
+	c.Assert(err, qt.IsNil)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	c.Assert(names, qt.DeepEquals, []string{"f1-1.txt", "f1-2.txt", "f2-1.txt", "f2-2.txt"})
+
+	b, err := fs.ReadFile(iofs, "mydir/f1-2.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "f1-2")
+
+	var walked []string
+	c.Assert(fs.WalkDir(iofs, ".", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	}), qt.IsNil)
+	c.Assert(walked, qt.HasLen, 6)
+
+	_, err = iofs.Open("/mydir")
+	c.Assert(err, qt.ErrorIs, fs.ErrInvalid)
+	_, err = iofs.Stat("../mydir")
+	c.Assert(err, qt.ErrorIs, fs.ErrInvalid)
+	_, err = iofs.Open("mydir/missing.txt")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+}
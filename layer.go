@@ -0,0 +1,99 @@
+package overlayfs
+
+import (
+	"log/slog"
+	"slices"
+
+	"github.com/spf13/afero"
+)
+
+var _ slog.LogValuer = Layer{}
+
+// Layer is a filesystem with a weight deciding its priority in the overlay.
+// Pass it to Options.Fss or Append in place of the filesystem.
+//
+// Filesystems with a higher weight take priority over those with a lower weight,
+// regardless of the order they were added in.
+// Filesystems with the same weight keep the order they were added in,
+// and filesystems not wrapped in a Layer have weight 0.
+// This allows independently registered groups of filesystems to interleave in a defined order.
+type Layer struct {
+	afero.Fs
+	Weight int
+
+	// Only, if set, limits the layer to the trees below these roots, e.g. "layouts" and "static".
+	// Other files in the layer are not visible in the overlay and can't be written to,
+	// and the directories leading up to the roots only list entries leading to a root.
+	Only []string
+
+	// Limits are checked by OverlayFs.Verify.
+	Limits LayerLimits
+
+	// Label and Version describe the layer in reports, e.g. the path and version
+	// of the module it comes from. Label defaults to the filesystem's name.
+	Label   string
+	Version string
+}
+
+// layerInfo holds the settings of a Layer after it has been added to the overlay.
+type layerInfo struct {
+	weight  int
+	limits  LayerLimits
+	label   string
+	version string
+}
+
+// LogValue implements slog.LogValuer.
+func (l Layer) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("name", l.Fs.Name()),
+		slog.Int("weight", l.Weight),
+		slog.Any("only", l.Only),
+		slog.String("label", l.Label),
+		slog.String("version", l.Version),
+	)
+}
+
+// addLayers returns copies of fss and infos with add inserted by weight.
+// Layers in add are unwrapped, or wrapped in a scopedFs if Layer.Only is set.
+func addLayers(fss []afero.Fs, infos []layerInfo, add ...afero.Fs) ([]afero.Fs, []layerInfo) {
+	fss = slices.Clone(fss)
+	infos = slices.Clone(infos)
+	for _, fs := range add {
+		fs, info := newLayer(fs)
+		i := len(fss)
+		for i > 0 && infos[i-1].weight < info.weight {
+			i--
+		}
+		fss = slices.Insert(fss, i, fs)
+		infos = slices.Insert(infos, i, info)
+	}
+	return fss, infos
+}
+
+// newLayer returns fs unwrapped, or wrapped in a scopedFs if Layer.Only is set, and its settings.
+func newLayer(fs afero.Fs) (afero.Fs, layerInfo) {
+	var info layerInfo
+	if l, ok := fs.(Layer); ok {
+		fs, info = l.Fs, layerInfo{weight: l.Weight, limits: l.Limits, label: l.Label, version: l.Version}
+		if len(l.Only) > 0 {
+			fs = newScopedFs(fs, l.Only)
+		}
+	}
+	return fs, info
+}
+
+// shiftWriteRules returns a copy of rules with the layers at index from and above moved by delta.
+func shiftWriteRules(rules []WriteRule, from, delta int) []WriteRule {
+	if rules == nil {
+		return nil
+	}
+	shifted := make([]WriteRule, len(rules))
+	for i, r := range rules {
+		if r.Layer >= from {
+			r.Layer += delta
+		}
+		shifted[i] = r
+	}
+	return shifted
+}
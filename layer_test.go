@@ -0,0 +1,117 @@
+package overlayfs
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestLayerWeight(t *testing.T) {
+	c := qt.New(t)
+	fsA := fsFromTxtTar(`
+-- f.txt --
+a
+`)
+	fsB := fsFromTxtTar(`
+-- f.txt --
+b
+`)
+	fsC := fsFromTxtTar(`
+-- f.txt --
+c
+`)
+	fsD := fsFromTxtTar(`
+-- f.txt --
+d
+`)
+	fsE := fsFromTxtTar(`
+-- f.txt --
+e
+`)
+
+	ofs1 := New(Options{Fss: []afero.Fs{Layer{Fs: fsA, Weight: 10}, fsB}})
+	c.Assert(readFile(c, ofs1, "f.txt"), qt.Equals, "a")
+
+	ofs2 := ofs1.Append(Layer{Fs: fsC, Weight: 5}, Layer{Fs: fsD, Weight: 20}, Layer{Fs: fsE, Weight: 10})
+	c.Assert(readFile(c, ofs2, "f.txt"), qt.Equals, "d")
+	c.Assert(ofs2.NumFilesystems(), qt.Equals, 5)
+	for i, fs := range []afero.Fs{fsD, fsA, fsE, fsC, fsB} {
+		c.Assert(ofs2.Filesystem(i), qt.Equals, fs, qt.Commentf("%d", i))
+	}
+
+	// The original is not modified.
+	c.Assert(ofs1.NumFilesystems(), qt.Equals, 2)
+	c.Assert(ofs1.Filesystem(0), qt.Equals, fsA)
+	c.Assert(ofs1.Filesystem(1), qt.Equals, fsB)
+
+	// Unweighted filesystems keep the append order.
+	ofs3 := New(Options{Fss: []afero.Fs{fsA}}).Append(fsB, fsC)
+	for i, fs := range []afero.Fs{fsA, fsB, fsC} {
+		c.Assert(ofs3.Filesystem(i), qt.Equals, fs)
+	}
+
+	// Negative weights go after the unweighted.
+	ofs4 := ofs3.Append(Layer{Fs: fsD, Weight: -1}, fsE)
+	for i, fs := range []afero.Fs{fsA, fsB, fsC, fsE, fsD} {
+		c.Assert(ofs4.Filesystem(i), qt.Equals, fs)
+	}
+
+	// Writes go to the first filesystem after ordering.
+	ofs5 := New(Options{Fss: []afero.Fs{fsB, Layer{Fs: fsA, Weight: 1}}, FirstWritable: true})
+	c.Assert(afero.WriteFile(ofs5, "g.txt", []byte("g"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, fsA, "g.txt"), qt.Equals, "g")
+}
+
+func TestLayerComposition(t *testing.T) {
+	c := qt.New(t)
+	fss := make([]afero.Fs, 5)
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		fss[i] = fsFromTxtTar("-- f.txt --\n" + id)
+	}
+	fsA, fsB, fsC, fsD, fsE := fss[0], fss[1], fss[2], fss[3], fss[4]
+	assertFss := func(ofs *OverlayFs, want ...afero.Fs) {
+		c.Helper()
+		c.Assert(ofs.NumFilesystems(), qt.Equals, len(want))
+		for i, fs := range want {
+			c.Assert(ofs.Filesystem(i), qt.Equals, fs, qt.Commentf("%d", i))
+		}
+	}
+
+	ofs := New(Options{Fss: []afero.Fs{Layer{Fs: fsA, Weight: 10}, fsB}})
+	prepended := ofs.Prepend(fsC, fsD)
+	assertFss(prepended, fsA, fsC, fsD, fsB)
+	assertFss(ofs.Prepend(Layer{Fs: fsC, Weight: 20}), fsC, fsA, fsB)
+	assertFss(ofs, fsA, fsB)
+	c.Assert(readFile(c, prepended.Prepend(fsE), "f.txt"), qt.Equals, "a")
+
+	insert := func(i int, fs afero.Fs) *OverlayFs {
+		copied, err := ofs.InsertLayer(i, fs)
+		c.Assert(err, qt.IsNil)
+		return copied
+	}
+	replace := func(i int, fs afero.Fs) *OverlayFs {
+		copied, err := ofs.ReplaceLayer(i, fs)
+		c.Assert(err, qt.IsNil)
+		return copied
+	}
+	assertFss(insert(1, fsC), fsA, fsC, fsB)
+	assertFss(insert(2, fsC), fsA, fsB, fsC)
+	assertFss(insert(0, fsC).Append(Layer{Fs: fsD, Weight: 10}), fsC, fsA, fsD, fsB)
+	assertFss(replace(1, fsC), fsA, fsC)
+	c.Assert(readFile(c, replace(0, fsE), "f.txt"), qt.Equals, "e")
+
+	_, err := ofs.InsertLayer(3, fsC)
+	c.Assert(err, qt.ErrorMatches, `.*index 3 out of range.*`)
+	_, err = ofs.InsertLayer(-1, fsC)
+	c.Assert(err, qt.ErrorMatches, `.*index -1 out of range.*`)
+	_, err = ofs.ReplaceLayer(2, fsC)
+	c.Assert(err, qt.ErrorMatches, `.*index 2 out of range.*`)
+
+	// The WriteRules keep writing to the same filesystems.
+	w1, w2 := afero.NewMemMapFs(), afero.NewMemMapFs()
+	ofs = New(Options{Fss: []afero.Fs{w1, fsA, w2}, FirstWritable: true, WriteRules: []WriteRule{{Exts: []string{".png"}, Layer: 2}}})
+	ofs = insert(1, fsB)
+	c.Assert(afero.WriteFile(ofs, "g.png", []byte("g"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, w2, "g.png"), qt.Equals, "g")
+}
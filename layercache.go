@@ -0,0 +1,104 @@
+package overlayfs
+
+import (
+	"os"
+	"slices"
+
+	"github.com/spf13/afero"
+)
+
+// layerStatEntry is a cached lookup in a fingerprinted layer.
+// fs is the unwrapped filesystem the name was found in, which may be nested in the layer.
+type layerStatEntry struct {
+	fs  afero.Fs
+	fi  os.FileInfo
+	ok  bool
+	err error
+}
+
+// fingerprintLayers returns the fingerprints of the filesystems, see Options.LayerFingerprint.
+// Writable filesystems are never fingerprinted.
+func (ofs *OverlayFs) fingerprintLayers() []string {
+	if ofs.layerFingerprint == nil || ofs.caches.layers == nil {
+		return nil
+	}
+	fingerprints := make([]string, len(ofs.fss))
+	writable := ofs.writableLayers()
+	for i, fs := range ofs.fss {
+		if !slices.Contains(writable, i) {
+			if sfs, ok := fs.(subLayerFs); ok {
+				// The names in a sub directory are not the names in the filesystem.
+				if fp := ofs.layerFingerprint(sfs.fs); fp != "" {
+					fingerprints[i] = fp + "/sub:" + sfs.dir
+				}
+				continue
+			}
+			if mfs, ok := fs.(mountFs); ok {
+				if fp := ofs.layerFingerprint(mfs.fs); fp != "" {
+					fingerprints[i] = fp + "/mount:" + mfs.prefix
+				}
+				continue
+			}
+			fingerprints[i] = ofs.layerFingerprint(fs)
+		}
+	}
+	return fingerprints
+}
+
+// fingerprint returns the fingerprint of the filesystem at index i, or "" if it has none.
+func (ofs *OverlayFs) fingerprint(i int) string {
+	if i >= len(ofs.fingerprints) {
+		return ""
+	}
+	return ofs.fingerprints[i]
+}
+
+// statLayer looks up name in the filesystem at index i, sharing the result with other
+// overlays with the same layer if it's fingerprinted.
+func (ofs *OverlayFs) statLayer(i int, name string, lstatIfPossible bool) (afero.Fs, os.FileInfo, bool, error) {
+	fp := ofs.fingerprint(i)
+	if fp == "" {
+		fs, fi, ok, err := ofs.statRecursive(ofs.fss[i], name, lstatIfPossible)
+		if fs != nil {
+			fs = ofs.layer(fs)
+		}
+		return fs, fi, ok, err
+	}
+	kind := "stat"
+	if lstatIfPossible {
+		kind = "lstat"
+	}
+	key := "overlayfs/layer/" + fp + "/" + kind + "/" + name
+	v, _ := ofs.caches.layers.Get(key)
+	e, found := v.(*layerStatEntry)
+	if !found {
+		e = &layerStatEntry{}
+		e.fs, e.fi, e.ok, e.err = ofs.statRecursive(ofs.fss[i], name, lstatIfPossible)
+		if e.err != nil && !os.IsNotExist(e.err) {
+			return nil, nil, false, e.err
+		}
+		ofs.caches.layers.Set(key, e)
+	}
+	if e.fs == nil {
+		return nil, nil, false, e.err
+	}
+	return ofs.layer(e.fs), e.fi, e.ok, e.err
+}
+
+// layerDirs returns the unwrapped filesystems in the filesystem at index i with a directory name,
+// sharing the result with other overlays with the same layer if it's fingerprinted.
+func (ofs *OverlayFs) layerDirs(i int, name string) []afero.Fs {
+	fp := ofs.fingerprint(i)
+	if fp == "" {
+		return ofs.collectDirsRecursive(ofs.fss[i], name, nil)
+	}
+	key := "overlayfs/layer/" + fp + "/dirs/" + name
+	if v, found := ofs.caches.layers.Get(key); found {
+		if dirs, ok := v.([]afero.Fs); ok {
+			return dirs
+		}
+	}
+	dirs := ofs.collectDirsRecursive(ofs.fss[i], name, nil)
+	ofs.caches.layers.Set(key, dirs)
+	return dirs
+}
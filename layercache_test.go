@@ -0,0 +1,73 @@
+package overlayfs
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+type statCountingFs struct {
+	afero.Fs
+	stats atomic.Int32
+}
+
+func (fs *statCountingFs) Stat(name string) (os.FileInfo, error) {
+	fs.stats.Add(1)
+	return fs.Fs.Stat(name)
+}
+
+func TestLayerFingerprint(t *testing.T) {
+	c := qt.New(t)
+
+	theme := &statCountingFs{Fs: basicFs("2", "2")}
+	cache := &testCache{m: make(map[string]any)}
+	fingerprint := func(fs afero.Fs) string {
+		if fs == afero.Fs(theme) {
+			return "theme@v1"
+		}
+		return ""
+	}
+	newOverlay := func(lang string) *OverlayFs {
+		return New(Options{Fss: []afero.Fs{basicFs(lang, "1"), theme}, Cache: cache, LayerFingerprint: fingerprint})
+	}
+	en, nn := newOverlay("en"), newOverlay("nn")
+
+	for _, ofs := range []*OverlayFs{en, nn} {
+		_, err := ofs.Stat("mydir/f1-2.txt")
+		c.Assert(err, qt.IsNil)
+		_, err = ofs.Stat("mydir/missing.txt")
+		c.Assert(err, qt.Not(qt.IsNil))
+	}
+	c.Assert(theme.stats.Load(), qt.Equals, int32(2))
+
+	for _, ofs := range []*OverlayFs{en, nn} {
+		c.Assert(readDirnames(c, ofs, "mydir"), qt.HasLen, 4)
+	}
+	c.Assert(theme.stats.Load(), qt.Equals, int32(3))
+	c.Assert(readFile(c, nn, "mydir/f1-2.txt"), qt.Equals, "f1-2")
+
+	// The writable filesystem is never fingerprinted.
+	fs1 := basicFs("1", "1")
+	ofs := New(Options{Fss: []afero.Fs{fs1, theme}, FirstWritable: true, Cache: cache, LayerFingerprint: func(afero.Fs) string { return "all" }})
+	c.Assert(ofs.fingerprints, qt.DeepEquals, []string{"", "all"})
+	_, err := ofs.Stat("mydir/new.txt")
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(afero.WriteFile(fs1, "mydir/new.txt", []byte("new"), 0o666), qt.IsNil)
+	ofs.InvalidateCaches()
+	_, err = ofs.Stat("mydir/new.txt")
+	c.Assert(err, qt.IsNil)
+
+	// Writes through one overlay don't drop the lookups shared by the others.
+	stats := theme.stats.Load()
+	c.Assert(afero.WriteFile(ofs, "mydir/other.txt", []byte("other"), 0o666), qt.IsNil)
+	c.Assert(cache.clears, qt.Equals, 0)
+	_, err = en.Stat("mydir/f1-2.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(theme.stats.Load(), qt.Equals, stats)
+
+	// Without a Cache there's nothing to share.
+	c.Assert(New(Options{Fss: []afero.Fs{theme}, LayerFingerprint: fingerprint}).fingerprints, qt.IsNil)
+}
@@ -0,0 +1,50 @@
+package overlayfs
+
+import (
+	"context"
+	"log/slog"
+)
+
+var (
+	_ slog.LogValuer = (*OverlayFs)(nil)
+	_ slog.LogValuer = Event{}
+)
+
+// LogValue implements slog.LogValuer.
+func (ofs *OverlayFs) LogValue() slog.Value {
+	names := make([]string, len(ofs.fss))
+	for i, fs := range ofs.fss {
+		names[i] = fs.Name()
+	}
+	return slog.GroupValue(
+		slog.String("name", ofs.Name()),
+		slog.Any("layers", names),
+		slog.Bool("writable", ofs.writable()),
+	)
+}
+
+// LogValue implements slog.LogValuer.
+func (e Event) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("op", e.Op.String()),
+		slog.String("path", e.Name),
+		slog.Int("layer", e.Layer),
+	}
+	if e.OldName != "" {
+		attrs = append(attrs, slog.String("old", e.OldName))
+	}
+	if e.IsDir {
+		attrs = append(attrs, slog.Bool("dir", true))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// discardHandler is a slog.Handler that discards all records.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
@@ -0,0 +1,58 @@
+package overlayfs
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestLogValue(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	ofs := New(Options{Fss: []afero.Fs{afero.NewMemMapFs(), afero.NewOsFs()}, FirstWritable: true})
+	logger.Info("ofs", "fs", ofs)
+	logger.Info("event", "event", Event{Name: "a/b.txt", Op: Rename, Layer: 1, OldName: "a/a.txt"})
+	logger.Info("event", "event", Event{Name: "a", Op: Create | Remove, IsDir: true})
+
+	c.Assert(buf.String(), qt.Equals, `level=INFO msg=ofs fs.name=overlayfs fs.layers="[MemMapFS OsFs]" fs.writable=true
+level=INFO msg=event event.op=RENAME event.path=a/b.txt event.layer=1 event.old=a/a.txt
+level=INFO msg=event event.op=CREATE|REMOVE event.path=a event.layer=0 event.dir=true
+`)
+}
+
+func TestName(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	c.Assert(New(Options{}).Name(), qt.Equals, "overlayfs")
+
+	ofs := New(Options{Name: "content-union", Fss: []afero.Fs{afero.NewMemMapFs()}, Logger: logger})
+	c.Assert(ofs.Name(), qt.Equals, "content-union")
+	c.Assert(ofs.Append(afero.NewMemMapFs()).Name(), qt.Equals, "content-union")
+
+	ofs.logger.Warn("failed")
+	logger.Info("ofs", "fs", ofs)
+	c.Assert(buf.String(), qt.Equals, `level=WARN msg=failed overlay=content-union
+level=INFO msg=ofs fs.name=content-union fs.layers=[MemMapFS] fs.writable=false
+`)
+}
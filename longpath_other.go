@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package overlayfs
+
+const longPathsNeeded = false
+
+// fixLongPath returns name unchanged; long paths are only a problem on Windows.
+func fixLongPath(name string) string {
+	return name
+}
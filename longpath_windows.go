@@ -0,0 +1,28 @@
+package overlayfs
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const longPathsNeeded = true
+
+// fixLongPath returns the extended-length form of name if its absolute path exceeds MAX_PATH.
+// The os package only does this for names that are already absolute.
+func fixLongPath(name string) string {
+	// Directories are limited to MAX_PATH minus room for an 8.3 file name,
+	// so use the same limit as the os package.
+	const maxLen = 248
+	if strings.HasPrefix(name, `\\?\`) || (filepath.IsAbs(name) && len(name) < maxLen) {
+		return name
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil || len(abs) < maxLen {
+		return name
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC path.
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
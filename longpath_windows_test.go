@@ -0,0 +1,45 @@
+package overlayfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestLongPathWindows(t *testing.T) {
+	c := qt.New(t)
+	wd, err := os.Getwd()
+	c.Assert(err, qt.IsNil)
+	dir := t.TempDir()
+	c.Assert(os.Chdir(dir), qt.IsNil)
+	defer os.Chdir(wd)
+
+	// A relative path with an absolute path longer than MAX_PATH.
+	name := filepath.Join(strings.Repeat("abcdefghij", 20), strings.Repeat("klmnopqrst", 10), "file.txt")
+	ofs := New(Options{Fss: []afero.Fs{afero.NewOsFs()}, FirstWritable: true})
+
+	c.Assert(ofs.MkdirAll(filepath.Dir(name), 0o777), qt.IsNil)
+	f, err := ofs.Create(name)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString("long")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+
+	_, err = ofs.Stat(name)
+	c.Assert(err, qt.IsNil)
+	c.Assert(readFile(c, ofs, name), qt.Equals, "long")
+}
+
+func TestFixLongPath(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(fixLongPath(`C:\short`), qt.Equals, `C:\short`)
+	long := `C:\` + strings.Repeat(`a\`, 130) + "f.txt"
+	c.Assert(fixLongPath(long), qt.Equals, `\\?\`+long)
+	c.Assert(fixLongPath(`\\?\`+long), qt.Equals, `\\?\`+long)
+	uncLong := `\\server\share\` + strings.Repeat(`a\`, 130) + "f.txt"
+	c.Assert(fixLongPath(uncLong), qt.Equals, `\\?\UNC\server\share\`+strings.Repeat(`a\`, 130)+"f.txt")
+}
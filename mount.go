@@ -0,0 +1,156 @@
+package overlayfs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
+)
+
+var _ afero.Fs = mountFs{}
+
+// NewMounted creates a new read-only OverlayFs with each filesystem in mounts mounted
+// at its key, a slash separated prefix, e.g. "/static" and "/content", see Mount.
+// Filesystems mounted deeper take priority, and "/" mounts a filesystem at the root.
+// Use Mount with New for other options.
+func NewMounted(mounts map[string]afero.Fs) *OverlayFs {
+	prefixes := make([]string, 0, len(mounts))
+	for prefix := range mounts {
+		prefixes = append(prefixes, prefix)
+	}
+	depth := func(prefix string) int {
+		if prefix = cleanScopePath(prefix); prefix == "." {
+			return 0
+		}
+		return strings.Count(prefix, "/") + 1
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if di, dj := depth(prefixes[i]), depth(prefixes[j]); di != dj {
+			return di > dj
+		}
+		return cleanScopePath(prefixes[i]) < cleanScopePath(prefixes[j])
+	})
+	fss := make([]afero.Fs, len(prefixes))
+	for i, prefix := range prefixes {
+		fss[i] = Mount(prefix, mounts[prefix])
+	}
+	return New(Options{Fss: fss})
+}
+
+// Mount returns fs with its root mounted at prefix, a slash separated path, e.g. "static/images",
+// for use as a filesystem in the overlay in place of a BasePathFs of a parent directory.
+// The directories leading up to prefix are read-only and list only the next directory towards prefix.
+// Other names don't exist.
+func Mount(prefix string, fs afero.Fs) afero.Fs {
+	prefix = cleanScopePath(prefix)
+	if prefix == "." {
+		return fs
+	}
+	return mountFs{
+		nameFs: nameFs{
+			fs: fs,
+			name: func(op, name string) (string, error) {
+				slashed := cleanScopePath(name)
+				if slashed == prefix {
+					return ".", nil
+				}
+				if rel, ok := strings.CutPrefix(slashed, prefix+"/"); ok {
+					return filepath.FromSlash(rel), nil
+				}
+				if isMountParent(slashed, prefix) {
+					return "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+				}
+				return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+			},
+			errPath: func(name string) string {
+				return filepath.Join(filepath.FromSlash(prefix), name)
+			},
+		},
+		prefix: prefix,
+	}
+}
+
+// mountFs is a filesystem mounted at prefix, see Mount.
+type mountFs struct {
+	nameFs
+	prefix string // Slash separated.
+}
+
+// isMountParent reports whether the slash separated name is a directory leading up to prefix.
+func isMountParent(name, prefix string) bool {
+	return name == "." || strings.HasPrefix(prefix, name+"/")
+}
+
+// parent returns the directory leading up to the prefix named name, if it is one.
+func (m mountFs) parent(name string) (*mem.FileData, bool) {
+	slashed := cleanScopePath(name)
+	if !isMountParent(slashed, m.prefix) {
+		return nil, false
+	}
+	child := m.prefix
+	if slashed != "." {
+		child = m.prefix[len(slashed)+1:]
+	}
+	child, _, _ = strings.Cut(child, "/")
+
+	dir, sub := newMountDir(name), newMountDir(filepath.Join(name, child))
+	mem.AddToMemDir(dir, sub)
+	return dir, true
+}
+
+// newMountDir creates a read-only directory leading up to a mount prefix.
+func newMountDir(name string) *mem.FileData {
+	dir := mem.CreateDir(name)
+	mem.SetMode(dir, os.ModeDir|0o555)
+	mem.SetModTime(dir, time.Time{})
+	return dir
+}
+
+func (m mountFs) Open(name string) (afero.File, error) {
+	if dir, ok := m.parent(name); ok {
+		return mem.NewReadOnlyFileHandle(dir), nil
+	}
+	return m.nameFs.Open(name)
+}
+
+func (m mountFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if dir, ok := m.parent(name); ok {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		return mem.NewReadOnlyFileHandle(dir), nil
+	}
+	return m.nameFs.OpenFile(name, flag, perm)
+}
+
+func (m mountFs) Stat(name string) (os.FileInfo, error) {
+	if dir, ok := m.parent(name); ok {
+		return mem.GetFileInfo(dir), nil
+	}
+	return m.nameFs.Stat(name)
+}
+
+func (m mountFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if dir, ok := m.parent(name); ok {
+		return mem.GetFileInfo(dir), false, nil
+	}
+	return m.nameFs.LstatIfPossible(name)
+}
+
+func (m mountFs) Mkdir(name string, perm os.FileMode) error {
+	if _, ok := m.parent(name); ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return m.nameFs.Mkdir(name, perm)
+}
+
+func (m mountFs) MkdirAll(path string, perm os.FileMode) error {
+	if _, ok := m.parent(path); ok {
+		return nil
+	}
+	return m.nameFs.MkdirAll(path, perm)
+}
@@ -0,0 +1,81 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestNewMounted(t *testing.T) {
+	c := qt.New(t)
+
+	static := fsFromTxtTar(`
+-- main.css --
+static
+-- images/logo.png --
+logo
+`)
+	content := fsFromTxtTar(`
+-- posts/p1.md --
+p1
+`)
+	root := fsFromTxtTar(`
+-- config.toml --
+config
+-- static/main.css --
+root
+-- static/robots.txt --
+robots
+`)
+	ofs := NewMounted(map[string]afero.Fs{
+		"/static":          static,
+		"/content/blog":    content,
+		"/":                root,
+		"assets/js/vendor": afero.NewMemMapFs(),
+	})
+
+	c.Assert(ofs.NumFilesystems(), qt.Equals, 4)
+	c.Assert(readFile(c, ofs, "static/main.css"), qt.Equals, "static")
+	c.Assert(readFile(c, ofs, "static/robots.txt"), qt.Equals, "robots")
+	c.Assert(readFile(c, ofs, "static/images/logo.png"), qt.Equals, "logo")
+	c.Assert(readFile(c, ofs, "content/blog/posts/p1.md"), qt.Equals, "p1")
+	c.Assert(readFile(c, ofs, "config.toml"), qt.Equals, "config")
+
+	c.Assert(readDirnames(c, ofs, ""), qt.DeepEquals, []string{"assets", "content", "static", "config.toml"})
+	c.Assert(readDirnames(c, ofs, "content"), qt.DeepEquals, []string{"blog"})
+	c.Assert(readDirnames(c, ofs, "assets/js"), qt.DeepEquals, []string{"vendor"})
+	c.Assert(readDirnames(c, ofs, "static"), qt.DeepEquals, []string{"images", "main.css", "robots.txt"})
+
+	fi, err := ofs.Stat("content")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.IsDir(), qt.IsTrue)
+	c.Assert(fi.Name(), qt.Equals, "content")
+
+	_, err = ofs.Stat(filepath.FromSlash("content/posts/p1.md"))
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	_, err = Mount("content/blog", content).Stat(filepath.FromSlash("content/blog/nope.md"))
+	c.Assert(err.(*fs.PathError).Path, qt.Equals, filepath.FromSlash("content/blog/nope.md"))
+}
+
+func TestMount(t *testing.T) {
+	c := qt.New(t)
+
+	data := afero.NewMemMapFs()
+	m := Mount("data/json", data)
+	c.Assert(Mount("/", data), qt.Equals, data)
+
+	ofs := New(Options{Fss: []afero.Fs{m}, FirstWritable: true})
+	c.Assert(ofs.MkdirAll(filepath.FromSlash("data/json/a"), 0o777), qt.IsNil)
+	c.Assert(afero.WriteFile(ofs, filepath.FromSlash("data/json/a/b.json"), []byte("{}"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, data, "a/b.json"), qt.Equals, "{}")
+	c.Assert(ofs.Mkdir("data", 0o777), qt.ErrorIs, fs.ErrExist)
+	c.Assert(ofs.Remove("data"), qt.ErrorIs, fs.ErrPermission)
+	_, err := ofs.Create(filepath.FromSlash("other/c.json"))
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	_, err = m.OpenFile("data", os.O_WRONLY, 0)
+	c.Assert(err, qt.ErrorIs, fs.ErrPermission)
+}
@@ -0,0 +1,72 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// MoveToWritable moves the files matching pattern, see Glob, from the filesystems below
+// the writable filesystem they're routed to into it, keeping their modes and modification times,
+// and hides the originals with whiteouts, e.g. to consolidate layers in a migration.
+// The files in matching directories are moved, too. It returns the names of the files moved,
+// also when it fails, and requires Options.Whiteouts.
+func (ofs *OverlayFs) MoveToWritable(pattern string) (moved []string, err error) {
+	if !ofs.whiteouts {
+		return nil, &fs.PathError{Op: "move", Path: pattern, Err: ErrNotSupported}
+	}
+	if err := ofs.checkWritable("move", pattern); err != nil {
+		return nil, err
+	}
+	matches, err := ofs.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		err := ofs.WalkDir(match, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			ok, err := ofs.moveToWritable(name)
+			if ok {
+				moved = append(moved, name)
+			}
+			return err
+		})
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// moveToWritable moves the file name into the writable filesystem it's routed to,
+// if it's found in a filesystem below it, and reports whether it did.
+func (ofs *OverlayFs) moveToWritable(name string) (bool, error) {
+	layer, _, err := ofs.writeTarget("move", name, false)
+	if err != nil {
+		return false, err
+	}
+	source, err := ofs.sourceLayer(name)
+	if err != nil || source <= layer {
+		return false, err
+	}
+	wfs, err := ofs.writeLayer("move", name, layer)
+	if err != nil {
+		return false, err
+	}
+	defer ofs.caches.invalidate()
+	// Keep the modes of the directories leading up to name.
+	var parents []string
+	for dir := filepath.Dir(name); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		if err := ofs.copyUp(wfs, parents[i]); err != nil {
+			return false, err
+		}
+	}
+	if err := ofs.copyUp(wfs, name); err != nil {
+		return false, err
+	}
+	return true, ofs.whiteout(wfs, name)
+}
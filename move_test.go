@@ -0,0 +1,58 @@
+package overlayfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestMoveToWritable(t *testing.T) {
+	c := qt.New(t)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	lower := fsFromTxtTar(`
+-- a/b/c.txt --
+c
+-- a/d.md --
+d
+-- e.txt --
+e
+`)
+	c.Assert(lower.Chtimes("a/b/c.txt", mtime, mtime), qt.IsNil)
+	c.Assert(lower.Chmod("a/b", 0o750), qt.IsNil)
+	w := afero.NewMemMapFs()
+	c.Assert(afero.WriteFile(w, "e.txt", []byte("e2"), 0o666), qt.IsNil)
+	ofs := New(Options{Fss: []afero.Fs{w, lower}, FirstWritable: true, Whiteouts: true})
+	before := readDirnames(c, ofs, "a")
+
+	moved, err := ofs.MoveToWritable("a")
+	c.Assert(err, qt.IsNil)
+	c.Assert(moved, qt.DeepEquals, []string{filepath.FromSlash("a/b/c.txt"), filepath.FromSlash("a/d.md")})
+	c.Assert(readFile(c, w, "a/b/c.txt"), qt.Equals, "c")
+	fi, err := w.Stat(filepath.FromSlash("a/b/c.txt"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.ModTime().Equal(mtime), qt.IsTrue)
+	fi, err = w.Stat(filepath.FromSlash("a/b"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Mode().Perm(), qt.Equals, os.FileMode(0o750))
+	c.Assert(readDirnames(c, ofs, "a"), qt.DeepEquals, before)
+
+	// The originals are hidden.
+	c.Assert(ofs.Remove(filepath.FromSlash("a/d.md")), qt.IsNil)
+	_, err = ofs.Stat(filepath.FromSlash("a/d.md"))
+	c.Assert(err, qt.ErrorIs, afero.ErrFileNotFound)
+
+	// Already in the writable filesystem.
+	moved, err = ofs.MoveToWritable("*.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(moved, qt.IsNil)
+
+	_, err = New(Options{Fss: []afero.Fs{w, lower}, FirstWritable: true}).MoveToWritable("a")
+	c.Assert(err, qt.ErrorIs, ErrNotSupported)
+	_, err = New(Options{Fss: []afero.Fs{w, lower}, Whiteouts: true}).MoveToWritable("a")
+	c.Assert(err, qt.ErrorIs, ErrReadOnly)
+}
@@ -0,0 +1,247 @@
+package overlayfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs      = (*MutableFs)(nil)
+	_ afero.Lstater = (*MutableFs)(nil)
+	_ layerSet      = (*MutableFs)(nil)
+)
+
+// MutableFs is an overlay whose filesystems can be added and removed while it's in use,
+// e.g. theme modules mounted and unmounted while serving.
+// Each operation runs on a consistent snapshot of the filesystems; files already open keep
+// reading from the snapshot they were opened in, except that a Dir detects the change,
+// see Options.RemergeStaleDirs.
+type MutableFs struct {
+	mu  sync.Mutex // Serializes the changes.
+	cur atomic.Pointer[OverlayFs]
+
+	// The number of references to each snapshot: one for the current snapshot and one per
+	// open file. A snapshot's references to RefCountedFs layers are released when it has none left.
+	refsMu sync.Mutex
+	refs   map[*OverlayFs]int
+	closed bool
+
+	// Incremented when the filesystems change.
+	gen atomic.Uint64
+}
+
+// Mutable returns a MutableFs starting with the filesystems and options of ofs.
+// Changes to it don't affect ofs.
+func (ofs *OverlayFs) Mutable() *MutableFs {
+	m := &MutableFs{refs: make(map[*OverlayFs]int)}
+	snapshot := ofs.Append()
+	snapshot.retainLayers()
+	snapshot.layerSet = m
+	m.cur.Store(snapshot)
+	m.refs[snapshot] = 1
+	return m
+}
+
+// Current returns the current snapshot of the overlay, e.g. to use methods not on MutableFs.
+func (m *MutableFs) Current() *OverlayFs {
+	return m.cur.Load()
+}
+
+// AddLayer adds fs to the overlay, with the same semantics as OverlayFs.Append.
+func (m *MutableFs) AddLayer(fs afero.Fs) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replace(m.cur.Load().Append(fs))
+}
+
+// RemoveLayerAt removes the filesystem at index i, see OverlayFs.Filesystem.
+// Writable filesystems can't be removed. A removed filesystem isn't closed,
+// except that the reference to a RefCountedFs is released once the files opened
+// before the removal are closed.
+func (m *MutableFs) RemoveLayerAt(i int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ofs := m.cur.Load()
+	if i < 0 || i >= len(ofs.fss) {
+		return fmt.Errorf("overlayfs: remove layer: index %d out of range [0,%d)", i, len(ofs.fss))
+	}
+	if slices.Contains(ofs.writableLayers(), i) {
+		return fmt.Errorf("overlayfs: remove layer: layer %d is writable", i)
+	}
+	m.replace(ofs.withoutLayer(i))
+	return nil
+}
+
+// replace replaces the current snapshot with ofs, a copy of it.
+// The snapshots hold references to their RefCountedFs layers.
+func (m *MutableFs) replace(ofs *OverlayFs) {
+	ofs.retainLayers()
+	ofs.layerSet = m
+	m.refsMu.Lock()
+	old := m.cur.Swap(ofs)
+	m.refs[ofs] = 1
+	m.gen.Add(1)
+	m.refsMu.Unlock()
+	m.release(old)
+}
+
+func (m *MutableFs) generation() uint64 {
+	return m.gen.Load()
+}
+
+// acquire returns the current snapshot and its generation, taking a reference to it.
+func (m *MutableFs) acquire() (*OverlayFs, uint64) {
+	m.refsMu.Lock()
+	defer m.refsMu.Unlock()
+	ofs := m.cur.Load()
+	m.refs[ofs]++
+	return ofs, m.gen.Load()
+}
+
+// release releases a reference to the snapshot ofs.
+func (m *MutableFs) release(ofs *OverlayFs) error {
+	m.refsMu.Lock()
+	m.refs[ofs]--
+	n := m.refs[ofs]
+	if n <= 0 {
+		delete(m.refs, ofs)
+	}
+	m.refsMu.Unlock()
+	if n > 0 {
+		return nil
+	}
+	return ofs.releaseRefs()
+}
+
+// open opens a file with open in the current snapshot, which is kept until the file is closed.
+func (m *MutableFs) open(open func(ofs *OverlayFs) (afero.File, error)) (afero.File, error) {
+	ofs, gen := m.acquire()
+	f, err := open(ofs)
+	if err != nil {
+		m.release(ofs)
+		return nil, err
+	}
+	if d, ok := f.(*Dir); ok {
+		d.layerSet, d.snapshot, d.layerGen = m, ofs, gen
+		return d, nil
+	}
+	return &mutableFile{File: f, m: m, snapshot: ofs}, nil
+}
+
+// withoutLayer creates a shallow copy of the filesystem without the filesystem at index i.
+func (ofs OverlayFs) withoutLayer(i int) *OverlayFs {
+	ofs.fss = slices.Delete(slices.Clone(ofs.fss), i, i+1)
+	ofs.layers = slices.Delete(slices.Clone(ofs.layers), i, i+1)
+	ofs.writeRules = shiftWriteRules(ofs.writeRules, i+1, -1)
+	ofs.newInstance()
+	return &ofs
+}
+
+// Close releases the references the current snapshot holds to RefCountedFs layers,
+// once the files opened from it are closed.
+// Other filesystems aren't closed, as they're borrowed from the overlay Mutable was called on
+// or added by the caller.
+// Calling Close more than once has no effect.
+func (m *MutableFs) Close() error {
+	m.refsMu.Lock()
+	if m.closed {
+		m.refsMu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.refsMu.Unlock()
+	return m.release(m.cur.Load())
+}
+
+func (m *MutableFs) Name() string {
+	return m.cur.Load().Name()
+}
+
+func (m *MutableFs) Create(name string) (afero.File, error) {
+	return m.open(func(ofs *OverlayFs) (afero.File, error) { return ofs.Create(name) })
+}
+
+func (m *MutableFs) Mkdir(name string, perm os.FileMode) error {
+	return m.cur.Load().Mkdir(name, perm)
+}
+
+func (m *MutableFs) MkdirAll(path string, perm os.FileMode) error {
+	return m.cur.Load().MkdirAll(path, perm)
+}
+
+func (m *MutableFs) Open(name string) (afero.File, error) {
+	return m.open(func(ofs *OverlayFs) (afero.File, error) { return ofs.Open(name) })
+}
+
+func (m *MutableFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	return m.open(func(ofs *OverlayFs) (afero.File, error) { return ofs.OpenFile(name, flag, perm) })
+}
+
+func (m *MutableFs) Remove(name string) error {
+	return m.cur.Load().Remove(name)
+}
+
+func (m *MutableFs) RemoveAll(path string) error {
+	return m.cur.Load().RemoveAll(path)
+}
+
+func (m *MutableFs) Rename(oldname, newname string) error {
+	return m.cur.Load().Rename(oldname, newname)
+}
+
+func (m *MutableFs) Stat(name string) (os.FileInfo, error) {
+	return m.cur.Load().Stat(name)
+}
+
+func (m *MutableFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	return m.cur.Load().LstatIfPossible(name)
+}
+
+func (m *MutableFs) Chmod(name string, mode os.FileMode) error {
+	return m.cur.Load().Chmod(name, mode)
+}
+
+func (m *MutableFs) Chown(name string, uid, gid int) error {
+	return m.cur.Load().Chown(name, uid, gid)
+}
+
+func (m *MutableFs) Chtimes(name string, atime, mtime time.Time) error {
+	return m.cur.Load().Chtimes(name, atime, mtime)
+}
+
+// mutableFile is a file opened from a MutableFs snapshot, which is released when it's closed.
+type mutableFile struct {
+	afero.File
+	m        *MutableFs
+	snapshot *OverlayFs
+	once     sync.Once
+}
+
+func (f *mutableFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() {
+		if rerr := f.m.release(f.snapshot); err == nil {
+			err = rerr
+		}
+	})
+	return err
+}
+
+func (f *mutableFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if rdf, ok := f.File.(fs.ReadDirFile); ok {
+		return rdf.ReadDir(n)
+	}
+	fis, err := f.Readdir(n)
+	dirEntries := make([]fs.DirEntry, len(fis))
+	for i, fi := range fis {
+		dirEntries[i] = dirEntry{fi}
+	}
+	return dirEntries, err
+}
@@ -0,0 +1,156 @@
+package overlayfs
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestMutableFs(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{afero.NewMemMapFs(), basicFs("1", "1")}, FirstWritable: true})
+	m := ofs.Mutable()
+	c.Assert(readDirnames(c, m, "mydir"), qt.DeepEquals, []string{"f1-1.txt", "f2-1.txt"})
+
+	theme := NewRefCountedFs(basicFs("2", "2"))
+	m.AddLayer(theme)
+	c.Assert(readDirnames(c, m, "mydir"), qt.DeepEquals, []string{"f1-1.txt", "f2-1.txt", "f1-2.txt", "f2-2.txt"})
+	c.Assert(readFile(c, m, "mydir/f1-2.txt"), qt.Equals, "f1-2")
+	c.Assert(theme.Refs(), qt.Equals, 1)
+	c.Assert(ofs.NumFilesystems(), qt.Equals, 2)
+
+	c.Assert(m.RemoveLayerAt(0), qt.ErrorMatches, ".*layer 0 is writable")
+	c.Assert(m.RemoveLayerAt(3), qt.ErrorMatches, ".*index 3 out of range.*")
+	c.Assert(m.RemoveLayerAt(2), qt.IsNil)
+	c.Assert(theme.Refs(), qt.Equals, 0)
+	c.Assert(readDirnames(c, m, "mydir"), qt.DeepEquals, []string{"f1-1.txt", "f2-1.txt"})
+
+	c.Assert(afero.WriteFile(m, "mydir/new.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, m.Current().Filesystem(0), "mydir/new.txt"), qt.Equals, "new")
+}
+
+func TestMutableFsOpenFilesKeepSnapshot(t *testing.T) {
+	c := qt.New(t)
+
+	shared := &closeCountFs{Fs: basicFs("2", "2")}
+	theme := NewRefCountedFs(shared)
+	m := New(Options{Fss: []afero.Fs{basicFs("1", "1")}}).Mutable()
+	m.AddLayer(theme)
+	c.Assert(theme.Refs(), qt.Equals, 1)
+
+	f, err := m.Open("mydir/f1-2.txt")
+	c.Assert(err, qt.IsNil)
+	d, err := m.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.RemoveLayerAt(1), qt.IsNil)
+	c.Assert(theme.Refs(), qt.Equals, 1)
+	c.Assert(shared.closes, qt.Equals, 0)
+
+	b, err := io.ReadAll(f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "f1-2")
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(theme.Refs(), qt.Equals, 1)
+
+	c.Assert(d.Close(), qt.IsNil)
+	c.Assert(theme.Refs(), qt.Equals, 0)
+	c.Assert(shared.closes, qt.Equals, 1)
+
+	// Closing the MutableFs waits for the files opened from the current snapshot.
+	rfs := NewRefCountedFs(basicFs("3", "3"))
+	m.AddLayer(rfs)
+	f, err = m.Open("mydir/f1-3.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Close(), qt.IsNil)
+	c.Assert(m.Close(), qt.IsNil)
+	c.Assert(rfs.Refs(), qt.Equals, 1)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(rfs.Refs(), qt.Equals, 0)
+}
+
+func TestMutableFsStaleDir(t *testing.T) {
+	c := qt.New(t)
+
+	m := New(Options{Fss: []afero.Fs{basicFs("1", "1")}}).Mutable()
+	f, err := m.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	d := f.(*Dir)
+	names, err := d.Readdirnames(1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f1-1.txt"})
+
+	m.AddLayer(basicFs("2", "2"))
+	_, err = d.Readdirnames(-1)
+	c.Assert(err, qt.ErrorIs, ErrStaleHandle)
+	_, err = d.ReadDir(-1)
+	c.Assert(err, qt.ErrorIs, ErrStaleHandle)
+	_, err = d.Readdir(-1)
+	c.Assert(err, qt.ErrorIs, ErrStaleHandle)
+
+	// Files opened after the change see the new filesystems.
+	c.Assert(readDirnames(c, m, "mydir"), qt.DeepEquals, []string{"f1-1.txt", "f2-1.txt", "f1-2.txt", "f2-2.txt"})
+}
+
+func TestMutableFsRemergeStaleDirs(t *testing.T) {
+	c := qt.New(t)
+
+	rfs := NewRefCountedFs(basicFs("2", "2"))
+	m := New(Options{Fss: []afero.Fs{basicFs("1", "1")}, RemergeStaleDirs: true}).Mutable()
+	m.AddLayer(rfs)
+	f, err := m.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	names, err := f.Readdirnames(1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f1-1.txt"})
+
+	c.Assert(m.RemoveLayerAt(1), qt.IsNil)
+	c.Assert(rfs.Refs(), qt.Equals, 1)
+	names, err = f.Readdirnames(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f2-1.txt"})
+	// The Dir moved on to the current snapshot.
+	c.Assert(rfs.Refs(), qt.Equals, 0)
+
+	m.AddLayer(basicFs("3", "3"))
+	_, err = f.Readdirnames(-1)
+	c.Assert(err, qt.Equals, io.EOF)
+	c.Assert(f.Close(), qt.IsNil)
+
+	f, err = m.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	m.AddLayer(basicFs("4", "4"))
+	names, err = f.Readdirnames(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f1-1.txt", "f2-1.txt", "f1-3.txt", "f2-3.txt", "f1-4.txt", "f2-4.txt"})
+}
+
+func TestMutableFsConcurrent(t *testing.T) {
+	c := qt.New(t)
+
+	m := New(Options{Fss: []afero.Fs{basicFs("1", "1")}}).Mutable()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// Each read sees either one or two layers, never a partial state.
+				n := len(readDirnames(c, m, "mydir"))
+				if n != 2 && n != 4 {
+					c.Errorf("got %d entries", n)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		m.AddLayer(basicFs("2", "2"))
+		c.Assert(m.RemoveLayerAt(1), qt.IsNil)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,189 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs         = nameFs{}
+	_ afero.Lstater    = nameFs{}
+	_ afero.LinkReader = nameFs{}
+	_ afero.Linker     = nameFs{}
+)
+
+// nameFs maps or validates all names passed to a filesystem.
+type nameFs struct {
+	fs   afero.Fs
+	name func(op, name string) (string, error)
+
+	// errPath, if set, maps the paths in the errors returned by fs back to the names seen by the caller.
+	errPath func(path string) string
+}
+
+// keepName is a nameFs name func that passes names through unchanged.
+func keepName(op, name string) (string, error) {
+	return name, nil
+}
+
+// fixErr maps the paths in err using errPath.
+func (l nameFs) fixErr(err error) error {
+	if err == nil || l.errPath == nil {
+		return err
+	}
+	switch e := err.(type) {
+	case *fs.PathError:
+		return &fs.PathError{Op: e.Op, Path: l.errPath(e.Path), Err: e.Err}
+	case *os.LinkError:
+		return &os.LinkError{Op: e.Op, Old: l.errPath(e.Old), New: l.errPath(e.New), Err: e.Err}
+	}
+	return err
+}
+
+func (l nameFs) Name() string {
+	return l.fs.Name()
+}
+
+func (l nameFs) Create(name string) (afero.File, error) {
+	name, err := l.name("create", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.fs.Create(name)
+	return f, l.fixErr(err)
+}
+
+func (l nameFs) Mkdir(name string, perm os.FileMode) error {
+	name, err := l.name("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return l.fixErr(l.fs.Mkdir(name, perm))
+}
+
+func (l nameFs) MkdirAll(path string, perm os.FileMode) error {
+	path, err := l.name("mkdir", path)
+	if err != nil {
+		return err
+	}
+	return l.fixErr(l.fs.MkdirAll(path, perm))
+}
+
+func (l nameFs) Open(name string) (afero.File, error) {
+	name, err := l.name("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.fs.Open(name)
+	return f, l.fixErr(err)
+}
+
+func (l nameFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	name, err := l.name("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.fs.OpenFile(name, flag, perm)
+	return f, l.fixErr(err)
+}
+
+func (l nameFs) Remove(name string) error {
+	name, err := l.name("remove", name)
+	if err != nil {
+		return err
+	}
+	return l.fixErr(l.fs.Remove(name))
+}
+
+func (l nameFs) RemoveAll(path string) error {
+	path, err := l.name("remove", path)
+	if err != nil {
+		return err
+	}
+	return l.fixErr(l.fs.RemoveAll(path))
+}
+
+func (l nameFs) Rename(oldname, newname string) error {
+	oldname, err := l.name("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newname, err = l.name("rename", newname)
+	if err != nil {
+		return err
+	}
+	return l.fixErr(l.fs.Rename(oldname, newname))
+}
+
+func (l nameFs) Stat(name string) (os.FileInfo, error) {
+	name, err := l.name("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := l.fs.Stat(name)
+	return fi, l.fixErr(err)
+}
+
+func (l nameFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	name, err := l.name("lstat", name)
+	if err != nil {
+		return nil, false, err
+	}
+	if lfs, ok := l.fs.(afero.Lstater); ok {
+		fi, ok, err := lfs.LstatIfPossible(name)
+		return fi, ok, l.fixErr(err)
+	}
+	fi, err := l.fs.Stat(name)
+	return fi, false, l.fixErr(err)
+}
+
+func (l nameFs) ReadlinkIfPossible(name string) (string, error) {
+	name, err := l.name("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if lr, ok := l.fs.(afero.LinkReader); ok {
+		target, err := lr.ReadlinkIfPossible(name)
+		return target, l.fixErr(err)
+	}
+	return "", l.fixErr(&os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink})
+}
+
+// SymlinkIfPossible creates newname as a symbolic link to oldname, which is passed on as is.
+func (l nameFs) SymlinkIfPossible(oldname, newname string) error {
+	newname, err := l.name("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if linker, ok := l.fs.(afero.Linker); ok {
+		return l.fixErr(linker.SymlinkIfPossible(oldname, newname))
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+func (l nameFs) Chmod(name string, mode os.FileMode) error {
+	name, err := l.name("chmod", name)
+	if err != nil {
+		return err
+	}
+	return l.fixErr(l.fs.Chmod(name, mode))
+}
+
+func (l nameFs) Chown(name string, uid, gid int) error {
+	name, err := l.name("chown", name)
+	if err != nil {
+		return err
+	}
+	return l.fixErr(l.fs.Chown(name, uid, gid))
+}
+
+func (l nameFs) Chtimes(name string, atime, mtime time.Time) error {
+	name, err := l.name("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return l.fixErr(l.fs.Chtimes(name, atime, mtime))
+}
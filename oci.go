@@ -0,0 +1,359 @@
+package overlayfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// ociWhiteoutPrefix marks a file removed from the lower layers in an OCI image layer.
+	ociWhiteoutPrefix = ".wh."
+
+	// ociOpaqueWhiteout marks a directory whose entries in the lower layers are hidden.
+	ociOpaqueWhiteout = ".wh..wh..opq"
+)
+
+// WriteOCILayer writes the tree rooted at opts.Root in the writable filesystems,
+// see Options.FirstWritable, Options.WriteRules and Options.WriteFs, merged,
+// to w as a gzip compressed OCI image layer tarball.
+// The entry names are relative to opts.Root and slash separated.
+// Files can't be removed from the lower filesystems, so the layer has no whiteouts;
+// use WriteOCILayerDiff for that.
+func (ofs *OverlayFs) WriteOCILayer(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	if err := ofs.checkWritable("writeocilayer", opts.Root); err != nil {
+		return err
+	}
+	writable := ofs.writableLayers()
+	slices.Sort(writable)
+	upper := *ofs
+	upper.fss, upper.layers, upper.writeRules = nil, nil, nil
+	for _, i := range writable {
+		upper.fss = append(upper.fss, ofs.fss[i])
+		upper.layers = append(upper.layers, ofs.layers[i])
+	}
+	upper.newInstance()
+	gw := gzip.NewWriter(w)
+	if err := upper.WriteTar(ctx, gw, opts); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// WriteOCILayerDiff writes the changes from base to ofs in the trees rooted at opts.Root
+// to w as a gzip compressed OCI image layer tarball, so applying the layer on top of
+// base gives ofs.
+// New and changed files, compared by content, and all directories are written as is,
+// and files and directories removed are written as whiteouts, e.g. ".wh.name".
+func (ofs *OverlayFs) WriteOCILayerDiff(ctx context.Context, w io.Writer, base *OverlayFs, opts ExportOptions) error {
+	e := ofs.newExporter(ctx, opts)
+	be := base.newExporter(ctx, opts)
+	gw := gzip.NewWriter(w)
+	tw := newTarWriter(e, tar.NewWriter(gw))
+
+	addHeader := func(path string, fi fs.FileInfo, contentPath string) error {
+		rel, err := filepath.Rel(opts.Root, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		return tw.add(hdr, contentPath)
+	}
+
+	// Whiteouts for the entries removed.
+	err := be.walk(func(path string, d fs.DirEntry, err error) error {
+		if filepath.Clean(path) == filepath.Clean(opts.Root) || !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		if _, err := ofs.Stat(path); err == nil || !os.IsNotExist(err) {
+			return err
+		}
+		rel, err := filepath.Rel(opts.Root, path)
+		if err != nil {
+			return err
+		}
+		dir, name := filepath.Split(rel)
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(filepath.Join(dir, ociWhiteoutPrefix+name)),
+			Mode:     0o644,
+		}
+		if err := tw.add(hdr, ""); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	if err == nil {
+		err = e.walk(func(path string, d fs.DirEntry, err error) error {
+			if filepath.Clean(path) == filepath.Clean(opts.Root) || !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return addHeader(path, fi, path)
+			}
+			changed, err := e.changedFrom(be, path, fi)
+			if err != nil || !changed {
+				return err
+			}
+			return addHeader(path, fi, path)
+		})
+	}
+
+	if terr := tw.close(); err == nil {
+		err = terr
+	}
+	if gerr := gw.Close(); err == nil {
+		err = gerr
+	}
+	return err
+}
+
+// changedFrom reports whether the regular file path with info fi differs in content
+// from the file with the same path read by base.
+func (e *exporter) changedFrom(base *exporter, path string, fi fs.FileInfo) (bool, error) {
+	bfi, err := base.ofs.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if !bfi.Mode().IsRegular() || bfi.Size() != fi.Size() {
+		return true, nil
+	}
+	h, bh := sha256.New(), sha256.New()
+	if _, err := e.copyFileTo(h, path); err != nil {
+		return false, err
+	}
+	if _, err := base.copyFileTo(bh, path); err != nil {
+		return false, err
+	}
+	return !bytes.Equal(h.Sum(nil), bh.Sum(nil)), nil
+}
+
+// NewFromOCILayers creates a new OverlayFs from a stack of OCI image layer tarballs,
+// gzip compressed or not, ordered from the base layer up as in an image manifest.
+// Each layer is read into memory and added after any filesystems in opts.Fss,
+// with the top layer first, so e.g. a writable scratch filesystem can be put on top.
+// Whiteouts, including opaque whiteouts, hide the files in the layers below them.
+// Only directories and regular files, including hard links to them, are imported.
+func NewFromOCILayers(layers []io.Reader, opts Options) (*OverlayFs, error) {
+	fss := make([]afero.Fs, len(layers))
+	whiteouts := make([]ociWhiteouts, len(layers))
+	for i, r := range layers {
+		below := New(Options{Fss: stackOCILayers(fss[:i], whiteouts[:i])})
+		fs, wh, err := readOCILayer(r, below)
+		if err != nil {
+			return nil, err
+		}
+		fss[i], whiteouts[i] = fs, wh
+	}
+	opts.Fss = append(opts.Fss, stackOCILayers(fss, whiteouts)...)
+	return New(opts), nil
+}
+
+// stackOCILayers returns the layers in fss top down,
+// hiding the files whited out by the layers above.
+func stackOCILayers(fss []afero.Fs, whiteouts []ociWhiteouts) []afero.Fs {
+	stacked := make([]afero.Fs, 0, len(fss))
+	var hidden ociWhiteouts
+	for i := len(fss) - 1; i >= 0; i-- {
+		fs := fss[i]
+		if !hidden.isZero() {
+			fs = newWhiteoutFs(fs, hidden)
+		}
+		stacked = append(stacked, fs)
+		hidden = hidden.merge(whiteouts[i])
+	}
+	return stacked
+}
+
+// ociWhiteouts are the files and directories whited out by a layer.
+// The names are cleaned as in cleanScopePath.
+type ociWhiteouts struct {
+	// The removed files and directories.
+	removed map[string]bool
+
+	// The directories whose entries are removed.
+	opaque map[string]bool
+}
+
+func (w ociWhiteouts) isZero() bool {
+	return len(w.removed) == 0 && len(w.opaque) == 0
+}
+
+func (w ociWhiteouts) merge(other ociWhiteouts) ociWhiteouts {
+	merged := ociWhiteouts{removed: make(map[string]bool), opaque: make(map[string]bool)}
+	for _, m := range []ociWhiteouts{w, other} {
+		for name := range m.removed {
+			merged.removed[name] = true
+		}
+		for name := range m.opaque {
+			merged.opaque[name] = true
+		}
+	}
+	return merged
+}
+
+// hides reports whether name is whited out.
+func (w ociWhiteouts) hides(name string) bool {
+	if name == "." {
+		return false
+	}
+	if w.removed[name] {
+		return true
+	}
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if w.removed[dir] || w.opaque[dir] {
+			return true
+		}
+		if dir == "." {
+			return false
+		}
+	}
+}
+
+// newWhiteoutFs hides the files in fs whited out by the layers above.
+func newWhiteoutFs(fs afero.Fs, hidden ociWhiteouts) afero.Fs {
+	return whiteoutFs{
+		nameFs: nameFs{fs: fs, name: func(op, name string) (string, error) {
+			if hidden.hides(cleanScopePath(name)) {
+				return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+			}
+			return name, nil
+		}},
+		hidden: hidden,
+	}
+}
+
+// whiteoutFs is a layer read by NewFromOCILayers with whiteouts in the layers above.
+type whiteoutFs struct {
+	nameFs
+	hidden ociWhiteouts
+}
+
+func (w whiteoutFs) Open(name string) (afero.File, error) {
+	f, err := w.nameFs.Open(name)
+	return w.filter(f, name), err
+}
+
+func (w whiteoutFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := w.nameFs.OpenFile(name, flag, perm)
+	return w.filter(f, name), err
+}
+
+func (w whiteoutFs) filter(f afero.File, name string) afero.File {
+	if f == nil {
+		return nil
+	}
+	name = cleanScopePath(name)
+	return scopedDir{File: f, visible: func(entry string) bool {
+		return !w.hidden.hides(path.Join(name, entry))
+	}}
+}
+
+// readOCILayer reads an OCI image layer tarball into memory.
+// Hard links to files not in the layer are resolved in below.
+func readOCILayer(r io.Reader, below *OverlayFs) (afero.Fs, ociWhiteouts, error) {
+	wh := ociWhiteouts{removed: make(map[string]bool), opaque: make(map[string]bool)}
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, wh, err
+		}
+		defer gr.Close()
+		r = gr
+	} else {
+		r = br
+	}
+
+	fs := afero.NewMemMapFs()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, wh, err
+		}
+		name := cleanScopePath(hdr.Name)
+		if name == "." {
+			continue
+		}
+		dir, base := path.Split(name)
+		dir = cleanScopePath(dir)
+		if base == ociOpaqueWhiteout {
+			wh.opaque[dir] = true
+			continue
+		}
+		if removed, ok := strings.CutPrefix(base, ociWhiteoutPrefix); ok {
+			wh.removed[path.Join(dir, removed)] = true
+			continue
+		}
+
+		fi := hdr.FileInfo()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := fs.MkdirAll(name, fi.Mode().Perm()); err != nil {
+				return nil, wh, err
+			}
+		case tar.TypeReg, tar.TypeLink:
+			if err := fs.MkdirAll(dir, 0o755); err != nil {
+				return nil, wh, err
+			}
+			var content io.Reader = tr
+			if hdr.Typeflag == tar.TypeLink {
+				target := cleanScopePath(hdr.Linkname)
+				b, err := afero.ReadFile(fs, target)
+				if os.IsNotExist(err) {
+					b, err = afero.ReadFile(below, target)
+				}
+				if err != nil {
+					return nil, wh, err
+				}
+				content = bytes.NewReader(b)
+			}
+			if err := afero.WriteReader(fs, name, content); err != nil {
+				return nil, wh, err
+			}
+		default:
+			continue
+		}
+		if err := fs.Chmod(name, fi.Mode()); err != nil {
+			return nil, wh, err
+		}
+		if err := fs.Chtimes(name, hdr.ModTime, hdr.ModTime); err != nil {
+			return nil, wh, err
+		}
+	}
+	return fs, wh, nil
+}
@@ -0,0 +1,190 @@
+package overlayfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+// readTarGz returns the names and contents of the regular files in a gzip compressed tarball.
+func readTarGz(c *qt.C, b []byte) map[string]string {
+	c.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	c.Assert(err, qt.IsNil)
+	tr := tar.NewReader(gr)
+	m := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		content, err := io.ReadAll(tr)
+		c.Assert(err, qt.IsNil)
+		m[hdr.Name] = string(content)
+	}
+	return m
+}
+
+func TestWriteOCILayer(t *testing.T) {
+	c := qt.New(t)
+
+	upper := fsFromTxtTar(`
+-- app/config.json --
+{}
+`)
+	lower := fsFromTxtTar(`
+-- app/main.js --
+main
+`)
+	ofs := New(Options{Fss: []afero.Fs{upper, lower}, FirstWritable: true})
+
+	var buf bytes.Buffer
+	c.Assert(ofs.WriteOCILayer(context.Background(), &buf, ExportOptions{}), qt.IsNil)
+	c.Assert(readTarGz(c, buf.Bytes()), qt.DeepEquals, map[string]string{
+		"app/":            "",
+		"app/config.json": "{}",
+	})
+
+	ro := New(Options{Fss: []afero.Fs{upper}})
+	c.Assert(ro.WriteOCILayer(context.Background(), &buf, ExportOptions{}), qt.ErrorIs, ErrReadOnly)
+
+	// Files routed to other layers are included.
+	images := fsFromTxtTar(`
+-- app/logo.png --
+png
+`)
+	ofs = New(Options{Fss: []afero.Fs{upper, lower, images}, FirstWritable: true, WriteRules: []WriteRule{{Exts: []string{".png"}, Layer: 2}}})
+	buf.Reset()
+	c.Assert(ofs.WriteOCILayer(context.Background(), &buf, ExportOptions{}), qt.IsNil)
+	c.Assert(readTarGz(c, buf.Bytes()), qt.DeepEquals, map[string]string{
+		"app/":            "",
+		"app/config.json": "{}",
+		"app/logo.png":    "png",
+	})
+}
+
+func TestWriteOCILayerDiff(t *testing.T) {
+	c := qt.New(t)
+
+	base := New(Options{Fss: []afero.Fs{fsFromTxtTar(`
+-- site/index.html --
+index
+-- site/same.html --
+same
+-- site/removed.html --
+removed
+-- site/old/a.html --
+a
+-- site/old/b.html --
+b
+`)}})
+	target := New(Options{Fss: []afero.Fs{fsFromTxtTar(`
+-- site/index.html --
+INDEX
+-- site/same.html --
+same
+-- site/new/c.html --
+c
+`)}})
+
+	var buf bytes.Buffer
+	c.Assert(target.WriteOCILayerDiff(context.Background(), &buf, base, ExportOptions{Root: "site", Workers: 2}), qt.IsNil)
+	c.Assert(readTarGz(c, buf.Bytes()), qt.DeepEquals, map[string]string{
+		".wh.removed.html": "",
+		".wh.old":          "",
+		"index.html":       "INDEX",
+		"new/":             "",
+		"new/c.html":       "c",
+	})
+}
+
+// writeTar writes a tar with the given entries: names ending with a slash are directories,
+// and a "->" in the name makes a hard link.
+func writeTar(c *qt.C, entries ...string) io.Reader {
+	c.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		switch {
+		case strings.HasSuffix(entry, "/"):
+			c.Assert(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: entry, Mode: 0o755}), qt.IsNil)
+		case strings.Contains(entry, "->"):
+			name, target, _ := strings.Cut(entry, "->")
+			c.Assert(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target}), qt.IsNil)
+		default:
+			c.Assert(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: entry, Mode: 0o644, Size: int64(len(entry))}), qt.IsNil)
+			_, err := tw.Write([]byte(entry))
+			c.Assert(err, qt.IsNil)
+		}
+	}
+	c.Assert(tw.Close(), qt.IsNil)
+	return &buf
+}
+
+func TestNewFromOCILayers(t *testing.T) {
+	c := qt.New(t)
+
+	base := writeTar(c, "./etc/", "./etc/hosts", "./etc/passwd", "./usr/", "./usr/bin/tool", "./usr/lib/a.so", "./usr/lib/b.so", "./var/cache/x")
+	mid := writeTar(c, "etc/.wh.passwd", "usr/lib/.wh..wh..opq", "usr/lib/c.so", "usr/bin/tool2->usr/bin/tool", ".wh.var")
+	top := writeTar(c, "var/new", "etc/passwd")
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := io.Copy(gw, mid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(gw.Close(), qt.IsNil)
+
+	ofs, err := NewFromOCILayers([]io.Reader{base, &gz, top}, Options{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ofs.NumFilesystems(), qt.Equals, 3)
+
+	c.Assert(readDirnames(c, ofs, "etc"), qt.DeepEquals, []string{"passwd", "hosts"})
+	c.Assert(readFile(c, ofs, "etc/passwd"), qt.Equals, "etc/passwd")
+	c.Assert(readDirnames(c, ofs, "usr/lib"), qt.DeepEquals, []string{"c.so"})
+	_, err = ofs.Stat("usr/lib/a.so")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(readFile(c, ofs, "usr/bin/tool2"), qt.Equals, "./usr/bin/tool")
+	c.Assert(readDirnames(c, ofs, "var"), qt.DeepEquals, []string{"new"})
+	_, err = ofs.Stat("var/cache/x")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(readDirnames(c, ofs, ""), qt.DeepEquals, []string{"etc", "var", "usr"})
+}
+
+func TestOCILayerRoundTrip(t *testing.T) {
+	c := qt.New(t)
+
+	basefs := fsFromTxtTar(`
+-- index.html --
+index
+-- old/a.html --
+a
+`)
+	base := New(Options{Fss: []afero.Fs{basefs}})
+	target := New(Options{Fss: []afero.Fs{fsFromTxtTar(`
+-- index.html --
+INDEX
+-- new/b.html --
+b
+`)}})
+
+	var baseLayer, diff bytes.Buffer
+	c.Assert(base.WriteTar(context.Background(), &baseLayer, ExportOptions{}), qt.IsNil)
+	c.Assert(target.WriteOCILayerDiff(context.Background(), &diff, base, ExportOptions{}), qt.IsNil)
+
+	ofs, err := NewFromOCILayers([]io.Reader{&baseLayer, &diff}, Options{})
+	c.Assert(err, qt.IsNil)
+	m, err := ofs.ToMapFS("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.HasLen, 3)
+	c.Assert(string(m["index.html"].Data), qt.Equals, "INDEX")
+	c.Assert(string(m["new/b.html"].Data), qt.Equals, "b")
+}
@@ -0,0 +1,103 @@
+package overlayfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// OpenStrategy is how a file is read when opened, see Options.OpenStrategy.
+type OpenStrategy int
+
+const (
+	// OpenStream reads the file from its filesystem as it's read. This is the default.
+	OpenStream OpenStrategy = iota
+
+	// OpenBuffered reads the whole file into memory when opened, and closes it in its filesystem.
+	OpenBuffered
+)
+
+// BufferSmallFiles returns an Options.OpenStrategy buffering the files no larger than maxSize
+// with one of the extensions exts, e.g. ".html" and ".json", or of any extension if none are given.
+// Other files are streamed.
+func BufferSmallFiles(maxSize int64, exts ...string) func(name string, size int64) OpenStrategy {
+	return func(name string, size int64) OpenStrategy {
+		if size > maxSize {
+			return OpenStream
+		}
+		if len(exts) == 0 {
+			return OpenBuffered
+		}
+		ext := strings.TrimPrefix(filepath.Ext(name), ".")
+		for _, e := range exts {
+			if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+				return OpenBuffered
+			}
+		}
+		return OpenStream
+	}
+}
+
+// bufferFile reads f into memory and closes it.
+func (ofs *OverlayFs) bufferFile(f afero.File, fi os.FileInfo) (afero.File, error) {
+	defer f.Close()
+	b, err := ofs.readAll(f, fi)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedFile{Reader: bytes.NewReader(b), name: f.Name(), fi: fi}, nil
+}
+
+// bufferedFile is a read-only file read into memory, see OpenBuffered.
+type bufferedFile struct {
+	*bytes.Reader
+	name string
+	fi   os.FileInfo
+}
+
+func (f *bufferedFile) Name() string {
+	return f.name
+}
+
+func (f *bufferedFile) Stat() (os.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *bufferedFile) Close() error {
+	return nil
+}
+
+func (f *bufferedFile) Sync() error {
+	return nil
+}
+
+func (f *bufferedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, f.err("readdir", os.ErrInvalid)
+}
+
+func (f *bufferedFile) Readdirnames(n int) ([]string, error) {
+	return nil, f.err("readdirent", os.ErrInvalid)
+}
+
+func (f *bufferedFile) Write(p []byte) (int, error) {
+	return 0, f.err("write", os.ErrPermission)
+}
+
+func (f *bufferedFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, f.err("write", os.ErrPermission)
+}
+
+func (f *bufferedFile) WriteString(s string) (int, error) {
+	return 0, f.err("write", os.ErrPermission)
+}
+
+func (f *bufferedFile) Truncate(size int64) error {
+	return f.err("truncate", os.ErrPermission)
+}
+
+func (f *bufferedFile) err(op string, err error) error {
+	return &os.PathError{Op: op, Path: f.name, Err: err}
+}
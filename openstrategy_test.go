@@ -0,0 +1,50 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestOpenStrategy(t *testing.T) {
+	c := qt.New(t)
+
+	large := strings.Repeat("a", 100)
+	fs1 := fsFromTxtTar(`
+-- layouts/index.html --
+<html>
+-- static/video.mp4 --
+mp4
+-- static/large.html --
+` + large)
+	ofs := New(Options{Fss: []afero.Fs{fs1}, OpenStrategy: BufferSmallFiles(10, ".html", "json")})
+
+	f, err := ofs.Open("layouts/index.html")
+	c.Assert(err, qt.IsNil)
+	_, buffered := f.(*bufferedFile)
+	c.Assert(buffered, qt.IsTrue)
+	fi, err := f.Stat()
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Name(), qt.Equals, "index.html")
+	c.Assert(iotest.TestReader(f, []byte("<html>")), qt.IsNil)
+	_, err = f.Write([]byte("x"))
+	c.Assert(err, qt.ErrorIs, fs.ErrPermission)
+	c.Assert(f.Close(), qt.IsNil)
+
+	for _, name := range []string{"static/video.mp4", "static/large.html"} {
+		f, err := ofs.Open(name)
+		c.Assert(err, qt.IsNil)
+		_, buffered := f.(*bufferedFile)
+		c.Assert(buffered, qt.IsFalse, qt.Commentf(name))
+		f.Close()
+	}
+	c.Assert(readFile(c, ofs, "static/large.html"), qt.Equals, large)
+
+	all := BufferSmallFiles(10)
+	c.Assert(all("a.mp4", 10), qt.Equals, OpenBuffered)
+	c.Assert(all("a.mp4", 11), qt.Equals, OpenStream)
+}
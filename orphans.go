@@ -0,0 +1,40 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+// Orphans returns the files below root in the writable filesystems not claimed by expected,
+// e.g. stale build output not in the current build manifest, sorted by name.
+// The writable filesystems are the first filesystem and those targeted by Options.WriteRules;
+// lower filesystems are not looked at.
+// The result can be passed to RemoveBatch.
+func (ofs *OverlayFs) Orphans(root string, expected func(name string) bool) ([]string, error) {
+	if err := ofs.checkWritable("orphans", root); err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, i := range ofs.writableLayers() {
+		err := afero.Walk(ofs.layer(ofs.fss[i]), root, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				if path == root && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.IsDir() && !expected(path) {
+				orphans = append(orphans, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(orphans)
+	return orphans, nil
+}
@@ -0,0 +1,64 @@
+package overlayfs
+
+import (
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestOrphans(t *testing.T) {
+	c := qt.New(t)
+
+	public := fsFromTxtTar(`
+-- public/index.html --
+index
+-- public/old.html --
+old
+-- public/posts/p1.html --
+p1
+-- public/posts/p0.html --
+p0
+-- other/foo.txt --
+foo
+`)
+	images := fsFromTxtTar(`
+-- public/images/a.png --
+a
+-- public/images/stale.png --
+stale
+`)
+	lower := fsFromTxtTar(`
+-- public/theme.css --
+theme
+`)
+	ofs := New(Options{
+		Fss:           []afero.Fs{public, images, lower},
+		FirstWritable: true,
+		WriteRules:    []WriteRule{{Exts: []string{".png"}, Layer: 1}},
+	})
+
+	manifest := map[string]bool{
+		"public/index.html":    true,
+		"public/posts/p1.html": true,
+		"public/images/a.png":  true,
+	}
+	expected := func(name string) bool {
+		return manifest[filepath.ToSlash(name)]
+	}
+
+	orphans, err := ofs.Orphans("public", expected)
+	c.Assert(err, qt.IsNil)
+	for i, orphan := range orphans {
+		orphans[i] = filepath.ToSlash(orphan)
+	}
+	c.Assert(orphans, qt.DeepEquals, []string{"public/images/stale.png", "public/old.html", "public/posts/p0.html"})
+
+	orphans, err = ofs.Orphans("missing", expected)
+	c.Assert(err, qt.IsNil)
+	c.Assert(orphans, qt.HasLen, 0)
+
+	_, err = New(Options{Fss: []afero.Fs{public}}).Orphans("public", expected)
+	c.Assert(err, qt.ErrorIs, ErrReadOnly)
+}
@@ -2,11 +2,17 @@ package overlayfs
 
 import (
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	iofs "io/fs"
+	"log/slog"
 	"os"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spf13/afero"
 )
@@ -15,6 +21,8 @@ var (
 	_ FilesystemIterator = (*OverlayFs)(nil)
 	_ afero.Fs           = (*OverlayFs)(nil)
 	_ afero.Lstater      = (*OverlayFs)(nil)
+	_ afero.LinkReader   = (*OverlayFs)(nil)
+	_ afero.Linker       = (*OverlayFs)(nil)
 	_ afero.File         = (*Dir)(nil)
 	_ fs.ReadDirFile     = (*Dir)(nil)
 )
@@ -28,14 +36,249 @@ type FilesystemIterator interface {
 // Options for the OverlayFs.
 type Options struct {
 	// The filesystems to overlay ordered in priority from left to right.
+	// Wrap a filesystem in a Layer to give it a weight.
 	Fss []afero.Fs
 
 	// The OverlayFs is by default read-only, but you can nominate the first filesystem to be writable.
+	// With weighted layers, this is the first filesystem after ordering by weight.
 	FirstWritable bool
 
+	// WriteFs, if set, returns the filesystem to write name to, one of Fss, e.g. one
+	// filesystem for "cache" and another for "content". It makes the overlay writable
+	// and takes precedence over FirstWritable and WriteRules.
+	// Return an error, e.g. wrapping ErrReadOnly, to reject the write.
+	WriteFs func(name string) (afero.Fs, error)
+
+	// WriteRules, if set with FirstWritable, route writes to other filesystems than the first
+	// by path prefix or glob, file extension or media type. The first matching rule wins.
+	// Writes not matching any rule go to the first filesystem.
+	WriteRules []WriteRule
+
 	// The DirsMerger is used to merge the contents of two directories.
 	// If not provided, the defaultDirMerger is used.
 	DirsMerger DirsMerger
+
+	// MaxWalkDepth, if > 0, is the maximum number of directory levels below the root
+	// that WalkDir and MaterializeTo will descend into before failing with ErrLimitExceeded.
+	MaxWalkDepth int
+
+	// MaxWalkEntries, if > 0, is the maximum number of entries WalkDir and MaterializeTo
+	// will visit before failing with ErrLimitExceeded.
+	MaxWalkEntries int
+
+	// OrderedWalk, if set, makes WalkDirConcurrent call its WalkDirFunc sequentially
+	// in the same order as WalkDir, with the directories read concurrently ahead of the walk.
+	OrderedWalk bool
+
+	// RateLimiter, if set, limits the rate of the background operations, e.g. MaterializeTo and WriteTar
+	// unless ExportOptions.RateLimiter is set. Stat, Open and the other foreground operations
+	// are not limited, but the background operations wait while any of them are in flight.
+	RateLimiter *RateLimiter
+
+	// CopyBufferSize is the size of the buffers used when copying files.
+	// The buffers are pooled and shared between all overlays using the same size.
+	// Defaults to 32 KiB.
+	CopyBufferSize int
+
+	// DirEntryArena, if set, makes merged directories allocate the fs.DirEntry adapters
+	// for filesystems not implementing fs.ReadDirFile from a per-Dir arena that is
+	// reused when the Dir is closed.
+	// This reduces GC overhead for very large directories, but means that the
+	// entries returned from Dir.ReadDir must not be used after the Dir is closed.
+	// The entry names are not copied; they're owned by the FileInfo values
+	// returned from the filesystems.
+	DirEntryArena bool
+
+	// WindowsPaths, if set, applies Windows path semantics to all filesystems:
+	// both / and \ are accepted as path separators, names are matched case-insensitively
+	// and paths containing reserved device names (e.g. CON or NUL) fail with ErrReservedName.
+	// If DirsMerger is not set, directory entries differing only in case are merged.
+	WindowsPaths bool
+
+	// RejectRootEscapes, if set, makes all operations on afero.BasePathFs filesystems backed by
+	// the OS filesystem fail with ErrRootEscape if the path, with any symlinks resolved,
+	// is outside of the base path.
+	RejectRootEscapes bool
+
+	// MergedDirInfo, if set, makes Stat on a Dir opened from the overlay return the
+	// FileInfo of the first directory with the newest ModTime across all filesystems.
+	MergedDirInfo bool
+
+	// MergedDirInfoSize, if set with MergedDirInfo, makes the merged FileInfo report
+	// the total size of the merged directory entries.
+	MergedDirInfoSize bool
+
+	// OSDirSemantics, if set, makes Dir.ReadDir, Dir.Readdir and Dir.Readdirnames
+	// behave exactly like their os.File counterparts:
+	// with n > 0, io.EOF is returned with an empty slice at the end of the directory;
+	// with n <= 0, the remaining entries (possibly none) are returned with a nil error,
+	// also on repeated calls. The returned slices are never nil.
+	// By default, any read after the end of the directory has been reached returns io.EOF.
+	// The operations not supported on a Dir also return errors instead of panicking, see Strict.
+	OSDirSemantics bool
+
+	// RemergeStaleDirs, if set, makes a Dir whose filesystems have changed since it was opened
+	// merge the directory again from the current filesystems, continuing at the same offset
+	// in the new listing.
+	// By default, reading such a Dir returns an error matching ErrStaleHandle.
+	RemergeStaleDirs bool
+
+	// DeterministicOrder, if set, makes all iteration over the merged view independent of
+	// the order the filesystems return their directory entries in:
+	// directory entries are sorted by name after merging (also for directories found in a single filesystem),
+	// which makes WalkDir, MaterializeTo, WriteTar and ToMapFS visit them in lexical order,
+	// and WalkDirConcurrent behaves as if OrderedWalk was set.
+	DeterministicOrder bool
+
+	// RecoverPanics, if set, recovers panics in calls to the filesystems and the files they return,
+	// and returns them as a *LayerPanicError attributed to the layer that panicked.
+	RecoverPanics bool
+
+	// MaxConcurrentOps, if > 0, limits the number of operations running concurrently
+	// on the filesystems, including operations on the files they return except Close.
+	// This protects e.g. the file descriptors of OS filesystems from bursty callers.
+	// Operations exceeding the limit wait unless FailWhenBusy is set.
+	MaxConcurrentOps int
+
+	// FailWhenBusy makes operations exceeding MaxConcurrentOps fail with ErrBusy instead of waiting.
+	FailWhenBusy bool
+
+	// DedupLookups collapses concurrent lookups of the same name, e.g. from Stat and Open,
+	// into a single probe of the filesystems and shares the result.
+	// This reduces the load on slow or remote filesystems when many goroutines
+	// look up the same cold path at the same time.
+	DedupLookups bool
+
+	// TrackHandles tracks the files and directories opened through the overlay
+	// until closed, see OpenHandles. It's meant for finding handle leaks in tests,
+	// as it records a stack trace per handle.
+	TrackHandles bool
+
+	// IgnoreFile, if set, is the name of .gitignore style ignore files, e.g. ".gitignore",
+	// read from the merged view. Their rules hide matching entries from merged directory
+	// listings, and so from ReadDir, WalkDir and Glob, in the directory of the ignore file and below.
+	// Rules in ignore files closer to the entry take precedence, and the last matching rule
+	// in a file wins. Stat and Open of ignored names are not affected.
+	IgnoreFile string
+
+	// IgnorePatterns are ignore rules applied as if in an ignore file in the root,
+	// before any IgnoreFile found there.
+	IgnorePatterns []string
+
+	// Quota, if > 0, is the maximum total size in bytes of the files in the writable filesystems.
+	// Writes through the overlay that would exceed it fail with ErrQuotaExceeded.
+	Quota int64
+
+	// QuotaThresholds are percentages of Quota, e.g. 80 and 95.
+	// OnQuotaThreshold is called with the threshold when a write makes the usage cross one of them,
+	// so long-running servers can alert before writes start failing.
+	// It's called again if the usage drops below the threshold and crosses it again.
+	QuotaThresholds  []float64
+	OnQuotaThreshold func(pct float64)
+
+	// StatCache, if MaxEntries is set, caches the lookups of names in the filesystems,
+	// including names not found, until invalidated by a write through the overlay
+	// or OverlayFs.InvalidateCaches, or until their TTL expires.
+	// Use it for filesystems that are slow to stat and mostly not modified directly.
+	StatCache StatCacheOptions
+
+	// Cache, if set, is used for all of the overlay's caches instead of the built-in ones,
+	// e.g. to bound their total memory use or to share a cache between overlays.
+	// It also enables the stat cache; StatCache.MaxEntries and Policy are then
+	// ignored, but the TTLs apply.
+	Cache Cache
+
+	// LayerFingerprint, if set with Cache, returns a fingerprint identifying the contents of a
+	// read-only filesystem, e.g. "themes/mytheme@v1.2.0", or "" if it has none.
+	// Lookups in fingerprinted filesystems are cached by fingerprint and path, so
+	// overlays sharing the Cache and a layer, e.g. per-language site variants, only scan it once.
+	// The overlays must use the same layer options, e.g. RejectRootEscapes and limits.
+	LayerFingerprint func(fs afero.Fs) string
+
+	// Trash, if set, is where OverlayFs.Trash keeps the names removed until restored.
+	// It should not be one of Fss.
+	Trash afero.Fs
+
+	// DetectConflicts, if set, protects files read through the overlay against lost updates:
+	// if a file has changed underneath, e.g. written by another process, since it was last read
+	// or written through the overlay, opening it for writing writes to a name.conflict-<timestamp>
+	// sibling instead, and Close returns a *ConflictError.
+	// Changes are detected by modification time and size.
+	DetectConflicts bool
+
+	// HashOnWrite, if set, creates the hash computed over the content of the files written
+	// through the overlay, e.g. sha256.New, saving a re-read when generating manifests.
+	// The digest is passed to OnWriteDigest, if set, when the file is closed, and
+	// can be retrieved with OverlayFs.LastWriteDigest.
+	HashOnWrite   func() hash.Hash
+	OnWriteDigest func(name string, digest []byte)
+
+	// OnFileWritten, if set, is called with the name and size of a file created or modified
+	// through the overlay after it has been closed successfully, e.g. to trigger
+	// a minify or upload step without polling.
+	OnFileWritten func(name string, size int64)
+
+	// Whiteouts, if set, makes removing a name from the writable filesystem also hide it in
+	// the lower filesystems, by writing a marker file named as in OCI image layers, e.g. ".wh.name".
+	// A marker hides the name and anything below it in the filesystems after the one holding it.
+	// The markers themselves are hidden.
+	Whiteouts bool
+
+	// CopyUp, if set, copies a file or directory found only in a lower filesystem into the
+	// writable filesystem before modifying it with OpenFile, Chmod, Chown, Chtimes or Rename,
+	// as in Linux overlayfs, instead of operating on a new, empty file.
+	// Files opened with O_TRUNC are not copied.
+	CopyUp bool
+
+	// OnMiss, if set, is called to open name when it's not found in any of the filesystems,
+	// e.g. to generate thumbnails or compiled assets on demand.
+	// It should return an error matching fs.ErrNotExist if it can't provide name.
+	// Stat still reports name as not existing, unless persisted.
+	OnMiss func(name string) (afero.File, error)
+
+	// PersistMisses, if set with OnMiss and FirstWritable, writes the content returned
+	// by OnMiss to the writable filesystem, so it's found the next time.
+	PersistMisses bool
+
+	// RecordAccess, if set, counts the files opened, see AccessProfile and Warm.
+	RecordAccess bool
+
+	// ReadAhead, if > 0, is the size in bytes of the window read ahead in the background
+	// while a file larger than it is read sequentially, to stream large files from slow
+	// filesystems closer to their throughput.
+	ReadAhead int
+
+	// ReadAheadFs, if set with ReadAhead, limits read-ahead to the files in the filesystems
+	// it returns true for, e.g. the remote ones.
+	ReadAheadFs func(fs afero.Fs) bool
+
+	// OpenStrategy, if set, decides how a file of the given size is read when opened,
+	// e.g. buffering small templates in memory while streaming large media files.
+	// See BufferSmallFiles.
+	OpenStrategy func(name string, size int64) OpenStrategy
+
+	// MaxReadSize, if > 0, is the size in bytes of the largest file read into memory by
+	// ReadFile and OpenBuffered. Larger files fail with a *TooLargeError.
+	MaxReadSize int64
+
+	// DirCapacityHint, if set, returns the expected number of entries in the merged directory dir,
+	// e.g. from an index or a previous listing, to allocate room for them up front
+	// instead of growing repeatedly while merging huge directories.
+	DirCapacityHint func(dir string) int
+
+	// Strict, if set, makes the API panic free: the operations not supported on a Dir,
+	// e.g. Read and Write, return a *fs.PathError wrapping ErrNotSupported instead of panicking.
+	// The default, false, keeps the panics for compatibility.
+	// For a Dir built with DirBuilder, see DirBuilder.WithStrict.
+	Strict bool
+
+	// Name, if set, is returned by Name instead of "overlayfs" and added to the log records,
+	// which tells the overlays apart when an application composes many, e.g. "content-union".
+	Name string
+
+	// Logger, if set, receives log records about operational issues inside the overlay,
+	// e.g. watcher errors, dropped events and rejected paths.
+	Logger *slog.Logger
 }
 
 // OverlayFs is a filesystem that overlays multiple filesystems.
@@ -43,40 +286,287 @@ type Options struct {
 // For all operations, the filesystems are checked in order until found.
 // If a filesystem implementes FilesystemIterator, those filesystems will be checked before continuing.
 type OverlayFs struct {
-	fss []afero.Fs
-
-	mergeDirs     DirsMerger
-	firstWritable bool
+	name   string
+	fss    []afero.Fs
+	layers []layerInfo
+
+	mergeDirs          DirsMerger
+	firstWritable      bool
+	writeFs            func(name string) (afero.Fs, error)
+	writeRules         []WriteRule
+	maxWalkDepth       int
+	maxWalkEntries     int
+	orderedWalk        bool
+	rateLimiter        *RateLimiter
+	opLimiter          *opLimiter
+	lookups            *lookupGroup
+	copyBufferSize     int
+	dirEntryArena      bool
+	windowsPaths       bool
+	rejectRootEscapes  bool
+	mergedDirInfo      bool
+	mergedDirInfoSize  bool
+	osDirSemantics     bool
+	remergeStaleDirs   bool
+	recoverPanics      bool
+	deterministicOrder bool
+	strict             bool
+	dirCapacityHint    func(dir string) int
+	ignoreFile         string
+	ignorePatterns     []string
+	logger             *slog.Logger
+
+	// Files opened for writing, see SyncAll.
+	openFiles *openFiles
+
+	// See InvalidateCaches.
+	caches *caches
+
+	layerFingerprint func(fs afero.Fs) string
+	fingerprints     []string // Per filesystem, set in newInstance.
+
+	trash     afero.Fs
+	conflicts *conflicts // Set if DetectConflicts.
+	temps     *temps
+
+	writeDigests  *writeDigests // Set if HashOnWrite.
+	onFileWritten func(name string, size int64)
+	whiteouts     bool
+	copyUpEnabled bool
+	onMiss        func(name string) (afero.File, error)
+	persistMisses bool
+	access        *accessLog
+	readAhead     int
+	readAheadFs   func(fs afero.Fs) bool
+	openStrategy  func(name string, size int64) OpenStrategy
+	maxReadSize   int64
+
+	// Set if Options.Quota is set.
+	quota *quota
+
+	// Set if Options.TrackHandles is set.
+	handles *handleRegistry
+
+	// Set in Close. Nil in shallow copies, which borrow the filesystems, see Close.
+	closed *atomic.Bool
+
+	// Unique per instance, including shallow copies, see Dir.Key.
+	id uint64
+
+	// Set in AssertHermetic.
+	hermetic *hermeticCheck
+
+	// Set in the overlays acquired from a layerSet. Not shared by shallow copies.
+	layerSet layerSet
 }
 
 // New creates a new OverlayFs with the given options.
 func New(opts Options) *OverlayFs {
 	if opts.DirsMerger == nil {
-		opts.DirsMerger = defaultDirMerger
+		if opts.WindowsPaths {
+			opts.DirsMerger = caseInsensitiveDirMerger
+		} else {
+			opts.DirsMerger = defaultDirMerger
+		}
+	}
+	if opts.CopyBufferSize <= 0 {
+		opts.CopyBufferSize = defaultCopyBufferSize
+	}
+	if opts.DeterministicOrder {
+		opts.OrderedWalk = true
+	}
+	if opts.Logger == nil {
+		opts.Logger = discardLogger
+	}
+	if opts.Name != "" {
+		opts.Logger = opts.Logger.With("overlay", opts.Name)
+	}
+
+	fss, layers := addLayers(nil, nil, opts.Fss...)
+
+	var limiter *opLimiter
+	if opts.MaxConcurrentOps > 0 {
+		limiter = newOpLimiter(opts.MaxConcurrentOps, opts.FailWhenBusy)
+	}
+
+	var lookups *lookupGroup
+	if opts.DedupLookups {
+		lookups = newLookupGroup()
+	}
+
+	var handles *handleRegistry
+	if opts.TrackHandles {
+		handles = newHandleRegistry()
+	}
+
+	var q *quota
+	if opts.Quota > 0 {
+		q = newQuota(opts.Quota, opts.QuotaThresholds, opts.OnQuotaThreshold)
+	}
+
+	caches := newCaches(opts.Cache, opts.StatCache)
+
+	var digests *writeDigests
+	if opts.HashOnWrite != nil {
+		digests = newWriteDigests(opts.HashOnWrite, opts.OnWriteDigest)
+	}
+
+	var access *accessLog
+	if opts.RecordAccess {
+		access = newAccessLog()
+	}
+
+	var conflicts *conflicts
+	if opts.DetectConflicts {
+		conflicts = newConflicts()
 	}
 
-	return &OverlayFs{
-		fss:           opts.Fss,
-		mergeDirs:     opts.DirsMerger,
-		firstWritable: opts.FirstWritable,
+	ofs := &OverlayFs{
+		name:               opts.Name,
+		fss:                fss,
+		layers:             layers,
+		mergeDirs:          opts.DirsMerger,
+		firstWritable:      opts.FirstWritable,
+		writeFs:            opts.WriteFs,
+		writeRules:         opts.WriteRules,
+		maxWalkDepth:       opts.MaxWalkDepth,
+		maxWalkEntries:     opts.MaxWalkEntries,
+		orderedWalk:        opts.OrderedWalk,
+		rateLimiter:        opts.RateLimiter,
+		opLimiter:          limiter,
+		lookups:            lookups,
+		copyBufferSize:     opts.CopyBufferSize,
+		dirEntryArena:      opts.DirEntryArena,
+		windowsPaths:       opts.WindowsPaths,
+		rejectRootEscapes:  opts.RejectRootEscapes,
+		mergedDirInfo:      opts.MergedDirInfo,
+		mergedDirInfoSize:  opts.MergedDirInfoSize,
+		osDirSemantics:     opts.OSDirSemantics,
+		remergeStaleDirs:   opts.RemergeStaleDirs,
+		recoverPanics:      opts.RecoverPanics,
+		deterministicOrder: opts.DeterministicOrder,
+		strict:             opts.Strict,
+		dirCapacityHint:    opts.DirCapacityHint,
+		ignoreFile:         opts.IgnoreFile,
+		ignorePatterns:     opts.IgnorePatterns,
+		logger:             opts.Logger,
+		openFiles:          newOpenFiles(caches.invalidate),
+		caches:             caches,
+		layerFingerprint:   opts.LayerFingerprint,
+		trash:              opts.Trash,
+		conflicts:          conflicts,
+		temps:              newTemps(),
+		writeDigests:       digests,
+		onFileWritten:      opts.OnFileWritten,
+		whiteouts:          opts.Whiteouts,
+		copyUpEnabled:      opts.CopyUp,
+		onMiss:             opts.OnMiss,
+		persistMisses:      opts.PersistMisses,
+		access:             access,
+		readAhead:          opts.ReadAhead,
+		readAheadFs:        opts.ReadAheadFs,
+		openStrategy:       opts.OpenStrategy,
+		maxReadSize:        opts.MaxReadSize,
+		quota:              q,
+		handles:            handles,
 	}
+	ofs.newInstance()
+	ofs.retainLayers()
+	return ofs
+}
+
+// overlayIDs is the source of OverlayFs ids.
+var overlayIDs atomic.Uint64
+
+// newInstance initializes the state not shared with the OverlayFs ofs was copied from, if any.
+func (ofs *OverlayFs) newInstance() {
+	ofs.id = overlayIDs.Add(1)
+	ofs.fingerprints = ofs.fingerprintLayers()
+	ofs.closed = nil
+	ofs.layerSet = nil
 }
 
 // Append creates a shallow copy of the filesystem and appends the given filesystems to it.
+// Filesystems wrapped in a Layer are inserted by weight, see Layer.
 func (ofs OverlayFs) Append(fss ...afero.Fs) *OverlayFs {
-	ofs.fss = append(ofs.fss, fss...)
+	ofs.fss, ofs.layers = addLayers(ofs.fss, ofs.layers, fss...)
+	ofs.newInstance()
+	return &ofs
+}
+
+// Prepend creates a shallow copy of the filesystem and adds the given filesystems, in order,
+// before the filesystems of the same or a lower weight, see Layer.
+// The WriteRules are updated to keep writing to the same filesystems, but with
+// FirstWritable set, the first filesystem prepended becomes the writable one.
+func (ofs OverlayFs) Prepend(fss ...afero.Fs) *OverlayFs {
+	ofs.fss, ofs.layers = slices.Clone(ofs.fss), slices.Clone(ofs.layers)
+	for j := len(fss) - 1; j >= 0; j-- {
+		fs, info := newLayer(fss[j])
+		i := 0
+		for i < len(ofs.layers) && ofs.layers[i].weight > info.weight {
+			i++
+		}
+		ofs.insertLayer(i, fs, info)
+	}
+	ofs.newInstance()
 	return &ofs
 }
 
+// InsertLayer creates a shallow copy of the filesystem with fs inserted at index i,
+// see Filesystem. The filesystem takes the weight of the filesystem it's inserted before,
+// or after if i is at the end; the Weight of a Layer is ignored.
+// The WriteRules are updated to keep writing to the same filesystems.
+// It returns an error if i is out of range.
+func (ofs OverlayFs) InsertLayer(i int, fs afero.Fs) (*OverlayFs, error) {
+	if i < 0 || i > len(ofs.fss) {
+		return nil, fmt.Errorf("overlayfs: insert layer: index %d out of range [0,%d]", i, len(ofs.fss))
+	}
+	ofs.fss, ofs.layers = slices.Clone(ofs.fss), slices.Clone(ofs.layers)
+	fs, info := newLayer(fs)
+	info.weight = 0
+	if i < len(ofs.layers) {
+		info.weight = ofs.layers[i].weight
+	} else if i > 0 {
+		info.weight = ofs.layers[i-1].weight
+	}
+	ofs.insertLayer(i, fs, info)
+	ofs.newInstance()
+	return &ofs, nil
+}
+
+// ReplaceLayer creates a shallow copy of the filesystem with the filesystem at index i
+// replaced by fs, see Filesystem. The filesystem takes the weight of the one it replaces;
+// the Weight of a Layer is ignored.
+// It returns an error if i is out of range.
+func (ofs OverlayFs) ReplaceLayer(i int, fs afero.Fs) (*OverlayFs, error) {
+	if i < 0 || i >= len(ofs.fss) {
+		return nil, fmt.Errorf("overlayfs: replace layer: index %d out of range [0,%d)", i, len(ofs.fss))
+	}
+	ofs.fss, ofs.layers = slices.Clone(ofs.fss), slices.Clone(ofs.layers)
+	fs, info := newLayer(fs)
+	info.weight = ofs.layers[i].weight
+	ofs.fss[i], ofs.layers[i] = fs, info
+	ofs.newInstance()
+	return &ofs, nil
+}
+
+// insertLayer inserts fs at index i in the cloned filesystems of a copy.
+func (ofs *OverlayFs) insertLayer(i int, fs afero.Fs, info layerInfo) {
+	ofs.fss = slices.Insert(ofs.fss, i, fs)
+	ofs.layers = slices.Insert(ofs.layers, i, info)
+	ofs.writeRules = shiftWriteRules(ofs.writeRules, i, 1)
+}
+
 // WithDirsMerger creates a shallow copy of the filesystem and sets the DirsMerger.
 func (ofs OverlayFs) WithDirsMerger(d DirsMerger) *OverlayFs {
 	ofs.mergeDirs = d
+	ofs.newInstance()
 	return &ofs
 }
 
 // Filesystem returns filesystem with index i, nil if not found.
 func (ofs *OverlayFs) Filesystem(i int) afero.Fs {
-	if i >= len(ofs.fss) {
+	if i < 0 || i >= len(ofs.fss) {
 		return nil
 	}
 	return ofs.fss[i]
@@ -87,54 +577,87 @@ func (ofs *OverlayFs) NumFilesystems() int {
 	return len(ofs.fss)
 }
 
-// Name returns the name of this filesystem.
+// Name returns the name of this filesystem, see Options.Name.
 func (ofs *OverlayFs) Name() string {
+	if ofs.name != "" {
+		return ofs.name
+	}
 	return "overlayfs"
 }
 
 func (ofs *OverlayFs) collectDirs(name string, withFs func(fs afero.Fs)) error {
-	for _, fs := range ofs.fss {
-		if err := ofs.collectDirsRecursive(fs, name, withFs); err != nil {
-			return err
+	for i := range ofs.fss {
+		for _, fs := range ofs.layerDirs(i, name) {
+			withFs(ofs.layer(fs))
+		}
+		if ofs.whiteouts && ofs.whitedOut(i, name) {
+			break
 		}
 	}
 	return nil
 }
 
-func (ofs *OverlayFs) collectDirsRecursive(fs afero.Fs, name string, withFs func(fs afero.Fs)) error {
-	if fi, err := fs.Stat(name); err == nil && fi.IsDir() {
-		withFs(fs)
+// collectDirsRecursive appends the filesystems in fs with a directory name to dirs.
+func (ofs *OverlayFs) collectDirsRecursive(fs afero.Fs, name string, dirs []afero.Fs) []afero.Fs {
+	if fi, err := ofs.layer(fs).Stat(name); err == nil && fi.IsDir() {
+		dirs = append(dirs, fs)
 	}
 	if fsi, ok := fs.(FilesystemIterator); ok {
 		for i := 0; i < fsi.NumFilesystems(); i++ {
-			if err := ofs.collectDirsRecursive(fsi.Filesystem(i), name, withFs); err != nil {
-				return err
-			}
+			dirs = ofs.collectDirsRecursive(fsi.Filesystem(i), name, dirs)
 		}
 	}
-	return nil
+	return dirs
 }
 
 func (ofs *OverlayFs) stat(name string, lstatIfPossible bool) (afero.Fs, os.FileInfo, bool, error) {
-	for _, fs := range ofs.fss {
-		if fs2, fi, ok, err := ofs.statRecursive(fs, name, lstatIfPossible); err == nil || !os.IsNotExist(err) {
-			return fs2, fi, ok, err
+	key := lookupKey{ofs: ofs, name: name, lstatIfPossible: lstatIfPossible}
+	if ofs.caches.stat == nil {
+		return ofs.lookup(key)
+	}
+	return ofs.caches.statLookup(key, ofs.lookup)
+}
+
+// lookup looks up key in the filesystems, see Options.DedupLookups.
+func (ofs *OverlayFs) lookup(key lookupKey) (afero.Fs, os.FileInfo, bool, error) {
+	name, lstatIfPossible := key.name, key.lstatIfPossible
+	if ofs.lookups != nil {
+		return ofs.lookups.do(key, func() (afero.Fs, os.FileInfo, bool, error) {
+			return ofs.statLayers(name, lstatIfPossible)
+		})
+	}
+	return ofs.statLayers(name, lstatIfPossible)
+}
+
+func (ofs *OverlayFs) statLayers(name string, lstatIfPossible bool) (afero.Fs, os.FileInfo, bool, error) {
+	if ofs.whiteouts && isWhiteout(name) {
+		return nil, nil, false, os.ErrNotExist
+	}
+	for i := range ofs.fss {
+		if fs, fi, ok, err := ofs.statLayer(i, name, lstatIfPossible); err == nil || !os.IsNotExist(err) {
+			return fs, fi, ok, err
+		}
+		if ofs.whiteouts && ofs.whitedOut(i, name) {
+			break
 		}
 	}
 	return nil, nil, false, os.ErrNotExist
 }
 
+// statRecursive looks up name in fs and the filesystems nested in it, and returns the
+// unwrapped filesystem it was found in.
 func (ofs *OverlayFs) statRecursive(fs afero.Fs, name string, lstatIfPossible bool) (afero.Fs, os.FileInfo, bool, error) {
+	lfs := ofs.layer(fs)
 	if lstatIfPossible {
-		if lfs, ok := fs.(afero.Lstater); ok {
-			fi, ok, err := lfs.LstatIfPossible(name)
+		if lstater, ok := lfs.(afero.Lstater); ok {
+			fi, ok, err := lstater.LstatIfPossible(name)
 			if err == nil || !os.IsNotExist(err) {
 				return fs, fi, ok, err
 			}
-		} else if fi, err := fs.Stat(name); err == nil || !os.IsNotExist(err) {
+		} else if fi, err := lfs.Stat(name); err == nil || !os.IsNotExist(err) {
 			return fs, fi, false, err
 		}
-	} else if fi, err := fs.Stat(name); err == nil || !os.IsNotExist(err) {
+	} else if fi, err := lfs.Stat(name); err == nil || !os.IsNotExist(err) {
 		return fs, fi, false, err
 	}
 	if fsi, ok := fs.(FilesystemIterator); ok {
@@ -147,11 +670,52 @@ func (ofs *OverlayFs) statRecursive(fs afero.Fs, name string, lstatIfPossible bo
 	return nil, nil, false, os.ErrNotExist
 }
 
-func (ofs *OverlayFs) writeFs() afero.Fs {
-	if len(ofs.fss) == 0 {
-		panic("overlayfs: there are no filesystems to write to")
+// layer returns fs wrapped to apply the path semantics and checks configured in the overlay,
+// and long-path support for OS filesystems on Windows.
+func (ofs *OverlayFs) layer(fs afero.Fs) afero.Fs {
+	// Apply the other checks to the filesystem below the sub directory and scope.
+	var subDir string
+	if sfs, ok := fs.(subLayerFs); ok {
+		fs, subDir = sfs.fs, sfs.dir
+	}
+	var roots []string
+	if sfs, ok := fs.(scopedFs); ok {
+		fs, roots = sfs.fs, sfs.roots
+	}
+	wrapped := fs
+	if longPathsNeeded {
+		if _, ok := fs.(*afero.OsFs); ok {
+			wrapped = nameFs{fs: wrapped, name: func(op, name string) (string, error) {
+				return fixLongPath(name), nil
+			}}
+		}
+	}
+	if bfs, ok := fs.(*afero.BasePathFs); ok {
+		if ofs.rejectRootEscapes {
+			wrapped = newRootCheckFs(bfs, ofs.logger)
+		}
+		// Report the names seen by the caller in errors, not the paths below the base path.
+		wrapped = nameFs{fs: wrapped, name: keepName, errPath: basePathErrPath(bfs)}
 	}
-	return ofs.fss[0]
+	if ofs.hermetic != nil {
+		wrapped = ofs.hermetic.wrap(fs, wrapped)
+	}
+	if roots != nil {
+		wrapped = newScopedFs(wrapped, roots)
+	}
+	if subDir != "" {
+		wrapped = subNameFs(wrapped, subDir)
+	}
+	if ofs.windowsPaths {
+		wrapped = newWindowsFs(wrapped)
+	}
+	if ofs.opLimiter != nil {
+		wrapped = limitedFs{fs: wrapped, l: ofs.opLimiter}
+	}
+	if ofs.recoverPanics {
+		wrapped = recoverFs{fs: wrapped, layer: fs, logger: ofs.logger}
+	}
+	return wrapped
 }
 
 // DirsMerger is used to merge two directories.
@@ -173,6 +737,37 @@ var defaultDirMerger = func(lofi, bofi []fs.DirEntry) []fs.DirEntry {
 	return lofi
 }
 
+const defaultCopyBufferSize = 32 * 1024
+
+// copyBufferPools holds a *sync.Pool of *[]byte per buffer size.
+var copyBufferPools sync.Map
+
+func getCopyBuffer(size int) *[]byte {
+	if p, ok := copyBufferPools.Load(size); ok {
+		return p.(*sync.Pool).Get().(*[]byte)
+	}
+	p, _ := copyBufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() any {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return p.(*sync.Pool).Get().(*[]byte)
+}
+
+func releaseCopyBuffer(b *[]byte) {
+	if p, ok := copyBufferPools.Load(len(*b)); ok {
+		p.(*sync.Pool).Put(b)
+	}
+}
+
+// copyBuffer is like io.Copy, but uses a pooled buffer.
+func (ofs *OverlayFs) copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	b := getCopyBuffer(ofs.copyBufferSize)
+	defer releaseCopyBuffer(b)
+	return io.CopyBuffer(dst, src, *b)
+}
+
 var dirPool = &sync.Pool{
 	New: func() any {
 		return &Dir{}
@@ -187,6 +782,26 @@ func releaseDir(dir *Dir) {
 	dir.fss = dir.fss[:0]
 	dir.fis = dir.fis[:0]
 	dir.dirOpeners = dir.dirOpeners[:0]
+	for i := range dir.arena {
+		dir.arena[i] = dirEntry{}
+	}
+	dir.arena = dir.arena[:0]
+	dir.useArena = false
+	dir.mergedInfo = false
+	dir.mergedInfoSize = false
+	dir.loaded = false
+	dir.osSemantics = false
+	dir.layerSet = nil
+	dir.snapshot = nil
+	dir.layerGen = 0
+	dir.remerge = false
+	dir.sorted = false
+	dir.strict = false
+	dir.overlayID = 0
+	dir.gen = 0
+	dir.keep = nil
+	dir.whiteouts = false
+	dir.handles = nil
 	dir.info = nil
 	dir.offset = 0
 	dir.name = ""
@@ -196,6 +811,8 @@ func releaseDir(dir *Dir) {
 
 // OpenDir opens a new Dir with dirs to be merged by the given merge func.
 // If merge is nil, a default DirsMerger is used.
+// It's a shorthand for DirBuilder, which is easier to use correctly
+// and can build a Dir that doesn't panic, see DirBuilder.WithStrict.
 func OpenDir(
 	merge DirsMerger,
 	// Used to stat the directory.
@@ -203,21 +820,7 @@ func OpenDir(
 	// Used to open the directories to be merged.
 	dirOpeners ...func() (afero.File, error),
 ) (*Dir, error) {
-	if merge == nil {
-		merge = defaultDirMerger
-	}
-	if info == nil {
-		panic("overlayfs: info must not be nil")
-	}
-	if len(dirOpeners) == 0 {
-		panic("overlayfs: dirOpeners must not be empty")
-	}
-
-	dir := getDir()
-	dir.dirOpeners = dirOpeners
-	dir.info = info
-	dir.merge = merge
-	return dir, nil
+	return new(DirBuilder).WithMerger(merge).WithInfo(info).AddOpener(dirOpeners...).Build()
 }
 
 // Dir is an afero.File that represents list of directories that will be merged in Readdir and Readdirnames.
@@ -232,6 +835,44 @@ type Dir struct {
 
 	merge DirsMerger
 
+	// Used to allocate dirEntry adapters if useArena is set.
+	useArena bool
+	arena    []dirEntry
+
+	// Whether Stat should merge the FileInfo of all directories.
+	mergedInfo     bool
+	mergedInfoSize bool
+
+	// Whether to match the os.File EOF semantics.
+	osSemantics bool
+
+	// Set if the Dir was opened from a layerSet, with the overlay it was opened in
+	// and the generation of the layerSet at the time.
+	layerSet layerSet
+	snapshot *OverlayFs
+	layerGen uint64
+	remerge  bool
+
+	// Whether to sort the merged entries by name.
+	sorted bool
+
+	// Whether to return errors instead of panicking on unsupported operations.
+	strict bool
+
+	// The OverlayFs the Dir was opened from and its generation at the time, see Key.
+	overlayID uint64
+	gen       uint64
+
+	// If set, only entries for which keep returns true are listed, see Options.IgnoreFile.
+	keep func(fs.DirEntry) bool
+
+	// Whether to hide the entries whited out in a previous directory, see Options.Whiteouts.
+	whiteouts bool
+
+	// Set if the Dir is tracked, see Options.TrackHandles.
+	handles *handleRegistry
+
+	loaded bool
 	err    error
 	offset int
 	fis    []fs.DirEntry
@@ -243,6 +884,9 @@ type Dir struct {
 func (d *Dir) Readdir(n int) ([]os.FileInfo, error) {
 	dirEntries, err := d.ReadDir(n)
 	if err != nil {
+		if d.osSemantics {
+			return []os.FileInfo{}, err
+		}
 		return nil, err
 	}
 	fis := make([]os.FileInfo, len(dirEntries))
@@ -257,6 +901,12 @@ func (d *Dir) Readdir(n int) ([]os.FileInfo, error) {
 }
 
 // ReadDir implements fs.ReadDirFile.
+// By default, once the end of the directory has been reached, all subsequent calls
+// return io.EOF, including ReadDir(-1).
+// Set Options.OSDirSemantics to get the os.File behavior, where ReadDir(n <= 0)
+// returns an empty slice and a nil error on repeated calls, as expected by os.ReadDir style callers.
+// For a Dir whose filesystems have changed since it was opened, ReadDir returns an error
+// matching ErrStaleHandle, see Options.RemergeStaleDirs.
 func (d *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
 	if d.err != nil {
 		return nil, d.err
@@ -264,59 +914,39 @@ func (d *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
 	if d.isClosed() {
 		return nil, os.ErrClosed
 	}
-
-	if d.offset == 0 {
-		readDir := func(fs afero.Fs, f afero.File) error {
-			var err error
-			if f == nil {
-				f, err = fs.Open(d.name)
-				if err != nil {
-					return err
-				}
-			}
-			defer f.Close()
-
-			var dirEntries []iofs.DirEntry
-
-			if rdf, ok := f.(iofs.ReadDirFile); ok {
-				dirEntries, err = rdf.ReadDir(-1)
-				if err != nil {
-					return err
-				}
-			} else {
-				var fis []os.FileInfo
-				fis, err = f.Readdir(-1)
-				if err != nil {
-					return err
-				}
-				dirEntries = make([]iofs.DirEntry, len(fis))
-				for i, fi := range fis {
-					dirEntries[i] = dirEntry{fi}
-				}
-			}
-
-			d.fis = d.merge(d.fis, dirEntries)
-			return nil
+	if err := d.checkStale(); err != nil {
+		if d.osSemantics {
+			return []fs.DirEntry{}, err
 		}
+		return nil, err
+	}
 
-		for _, fs := range d.fss {
-			if err := readDir(fs, nil); err != nil {
-				return nil, err
-			}
-		}
-		for _, open := range d.dirOpeners {
-			f, err := open()
-			if err != nil {
-				return nil, err
-			}
-			if err := readDir(nil, f); err != nil {
-				return nil, err
-			}
+	if err := d.load(); err != nil {
+		if d.osSemantics {
+			return []fs.DirEntry{}, err
 		}
+		return nil, err
+	}
+	if d.offset > len(d.fis) {
+		// Merged again with fewer entries, see checkStale.
+		d.offset = len(d.fis)
 	}
 
 	fis := d.fis[d.offset:]
 
+	if d.osSemantics {
+		if n > 0 && len(fis) > n {
+			fis = fis[:n]
+		}
+		d.offset += len(fis)
+		fisc := make([]fs.DirEntry, len(fis))
+		copy(fisc, fis)
+		if n > 0 && len(fisc) == 0 {
+			return fisc, io.EOF
+		}
+		return fisc, nil
+	}
+
 	if n <= 0 {
 		d.err = io.EOF
 		if d.offset > 0 && len(fis) == 0 {
@@ -332,8 +962,8 @@ func (d *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
 		return nil, d.err
 	}
 
-	if n > len(d.fis) {
-		n = len(d.fis)
+	if n > len(fis) {
+		n = len(fis)
 	}
 
 	defer func() { d.offset += n }()
@@ -344,6 +974,69 @@ func (d *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
 	return fisc, nil
 }
 
+// grow makes room for n merged entries.
+func (d *Dir) grow(n int) {
+	d.fis = slices.Grow(d.fis[:0], n)
+	if d.useArena {
+		d.arena = slices.Grow(d.arena[:0], n)
+	}
+}
+
+// load reads and merges the directory entries, if not already done.
+func (d *Dir) load() error {
+	if d.loaded {
+		return nil
+	}
+
+	var hidden map[string]bool // The names whited out so far.
+	readDir := func(fs afero.Fs, f afero.File) error {
+		var err error
+		if f == nil {
+			f, err = fs.Open(d.name)
+			if err != nil {
+				return err
+			}
+		}
+		defer f.Close()
+
+		dirEntries, err := d.readDirEntries(f)
+		if err != nil {
+			return err
+		}
+		if d.whiteouts {
+			dirEntries = hideWhiteouts(dirEntries, &hidden)
+		}
+
+		d.fis = d.merge(d.fis, dirEntries)
+		return nil
+	}
+
+	for _, fs := range d.fss {
+		if err := readDir(fs, nil); err != nil {
+			d.fis = d.fis[:0]
+			return err
+		}
+	}
+	for _, open := range d.dirOpeners {
+		f, err := open()
+		if err == nil {
+			err = readDir(nil, f)
+		}
+		if err != nil {
+			d.fis = d.fis[:0]
+			return err
+		}
+	}
+	if d.keep != nil {
+		d.fis = slices.DeleteFunc(d.fis, func(fi fs.DirEntry) bool { return !d.keep(fi) })
+	}
+	if d.sorted {
+		sort.Slice(d.fis, func(i, j int) bool { return d.fis[i].Name() < d.fis[j].Name() })
+	}
+	d.loaded = true
+	return nil
+}
+
 // Readdirnames implements afero.File.Readdirnames.
 // If n > 0, Readdirnames returns at most n.
 func (d *Dir) Readdirnames(n int) ([]string, error) {
@@ -353,6 +1046,9 @@ func (d *Dir) Readdirnames(n int) ([]string, error) {
 
 	fis, err := d.ReadDir(n)
 	if err != nil {
+		if d.osSemantics {
+			return []string{}, err
+		}
 		return nil, err
 	}
 
@@ -371,15 +1067,80 @@ func (d *Dir) Stat() (os.FileInfo, error) {
 	if d.info != nil {
 		return d.info()
 	}
-	return d.fss[0].Stat(d.name)
+	if !d.mergedInfo {
+		return d.fss[0].Stat(d.name)
+	}
+	var fi mergedFileInfo
+	for i, fs := range d.fss {
+		fi2, err := fs.Stat(d.name)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			fi = mergedFileInfo{FileInfo: fi2, modTime: fi2.ModTime(), size: fi2.Size()}
+		} else if fi2.ModTime().After(fi.modTime) {
+			fi.modTime = fi2.ModTime()
+		}
+	}
+	if d.mergedInfoSize {
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+		fi.size = 0
+		for _, dirEntry := range d.fis {
+			if dirEntry.IsDir() {
+				continue
+			}
+			fi2, err := dirEntry.Info()
+			if err != nil {
+				return nil, err
+			}
+			fi.size += fi2.Size()
+		}
+	}
+	return fi, nil
+}
+
+// mergedFileInfo is the FileInfo of a directory merged from multiple filesystems.
+type mergedFileInfo struct {
+	os.FileInfo
+	modTime time.Time
+	size    int64
 }
 
+func (fi mergedFileInfo) ModTime() time.Time { return fi.modTime }
+
+func (fi mergedFileInfo) Size() int64 { return fi.size }
+
 // Close implements afero.File.Close.
 // Note that d must not be used after it is closed,
 // as the object may be reused.
+// Closing a Dir more than once returns os.ErrClosed.
 func (d *Dir) Close() error {
+	if d.isClosed() {
+		return os.ErrClosed
+	}
+	if d.handles != nil {
+		d.handles.remove(d)
+	}
+	var err error
+	if d.layerSet != nil {
+		err = d.layerSet.release(d.snapshot)
+	}
 	releaseDir(d)
-	return nil
+	return err
+}
+
+// Key returns an identifier for the directory listing, e.g. to cache a rendered listing by.
+// It's made of the directory name, the overlay it was opened from and the generation of that overlay,
+// which changes on writes through the overlay and on OverlayFs.InvalidateCaches.
+// Keys are only unique for Dirs opened from an OverlayFs.
+// Get the key before closing the Dir; Key returns an empty string for a closed Dir.
+func (d *Dir) Key() string {
+	if d.isClosed() {
+		return ""
+	}
+	return fmt.Sprintf("%s@%d.%d", d.name, d.overlayID, d.gen)
 }
 
 // Name implements afero.File.Name.
@@ -387,54 +1148,98 @@ func (d *Dir) Name() string {
 	return d.name
 }
 
-func (d *Dir) notSupported() string {
-	return fmt.Sprintf("operation not supported on directory %q", d.name)
+// notSupported panics, or returns an error wrapping err if the Dir is strict or has
+// os semantics, see Options.Strict and Options.OSDirSemantics.
+func (d *Dir) notSupported(op string, err error) error {
+	if !d.strict && !d.osSemantics {
+		panic(fmt.Sprintf("operation not supported on directory %q", d.name))
+	}
+	return &fs.PathError{Op: op, Path: d.name, Err: err}
 }
 
 // Read is not supported.
 func (d *Dir) Read(p []byte) (n int, err error) {
-	panic(d.notSupported())
+	return 0, d.notSupported("read", errIsDir)
 }
 
 // ReadAt is not supported.
 func (d *Dir) ReadAt(p []byte, off int64) (n int, err error) {
-	panic(d.notSupported())
+	return 0, d.notSupported("read", errIsDir)
 }
 
 // Seek is not supported.
 func (d *Dir) Seek(offset int64, whence int) (int64, error) {
-	panic(d.notSupported())
+	return 0, d.notSupported("seek", ErrNotSupported)
 }
 
 // Write is not supported.
 func (d *Dir) Write(p []byte) (n int, err error) {
-	panic(d.notSupported())
+	return 0, d.notSupported("write", ErrNotSupported)
 }
 
 // WriteAt is not supported.
 func (d *Dir) WriteAt(p []byte, off int64) (n int, err error) {
-	panic(d.notSupported())
+	return 0, d.notSupported("write", ErrNotSupported)
 }
 
 // Sync is not supported.
 func (d *Dir) Sync() error {
-	panic(d.notSupported())
+	return d.notSupported("sync", ErrNotSupported)
 }
 
 // Truncate is not supported.
 func (d *Dir) Truncate(size int64) error {
-	panic(d.notSupported())
+	return d.notSupported("truncate", ErrNotSupported)
 }
 
 // WriteString is not supported.
 func (d *Dir) WriteString(s string) (ret int, err error) {
-	panic(d.notSupported())
+	return 0, d.notSupported("write", ErrNotSupported)
+}
+
+func (d *Dir) readDirEntries(f afero.File) ([]fs.DirEntry, error) {
+	if !d.useArena {
+		return readDirEntries(f)
+	}
+	if rdf, ok := f.(iofs.ReadDirFile); ok {
+		return rdf.ReadDir(-1)
+	}
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	start := len(d.arena)
+	for _, fi := range fis {
+		d.arena = append(d.arena, dirEntry{fi})
+	}
+	dirEntries := make([]iofs.DirEntry, len(fis))
+	for i := range fis {
+		dirEntries[i] = &d.arena[start+i]
+	}
+	return dirEntries, nil
 }
 
 func (d *Dir) isClosed() bool {
 	return len(d.fss) == 0 && len(d.dirOpeners) == 0
 }
 
+// readDirEntries reads all the entries in the directory f,
+// using fs.ReadDirFile if implemented.
+func readDirEntries(f afero.File) ([]fs.DirEntry, error) {
+	if rdf, ok := f.(iofs.ReadDirFile); ok {
+		return rdf.ReadDir(-1)
+	}
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	dirEntries := make([]iofs.DirEntry, len(fis))
+	for i, fi := range fis {
+		dirEntries[i] = dirEntry{fi}
+	}
+	return dirEntries, nil
+}
+
 // dirEntry is an adapter from os.FileInfo to fs.DirEntry
 type dirEntry struct {
 	fs.FileInfo
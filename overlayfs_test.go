@@ -11,11 +11,13 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
 	"golang.org/x/tools/txtar"
 )
 
@@ -52,7 +54,8 @@ func TestEmpty(t *testing.T) {
 	c.Assert(ofs.NumFilesystems(), qt.Equals, 0)
 	_, err := ofs.Stat("mydir/notfound.txt")
 	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
-	c.Assert(func() { ofs.Create("mydir/foo.txt") }, qt.PanicMatches, "overlayfs: there are no filesystems to write to")
+	_, err = ofs.Create("mydir/foo.txt")
+	c.Assert(err, qt.ErrorIs, ErrNoWritableFilesystem)
 
 	ofs = ofs.Append(basicFs("1", "1"))
 	c.Assert(ofs.NumFilesystems(), qt.Equals, 1)
@@ -123,6 +126,7 @@ func TestFileystemIterator(t *testing.T) {
 	c.Assert(ofs.Filesystem(0), qt.Equals, fs1)
 	c.Assert(ofs.Filesystem(1), qt.Equals, fs2)
 	c.Assert(ofs.Filesystem(2), qt.IsNil)
+	c.Assert(ofs.Filesystem(-1), qt.IsNil)
 }
 
 func TestOpenDir(t *testing.T) {
@@ -153,6 +157,11 @@ func TestOpenDir(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 	c.Assert(fi.Name(), qt.Equals, "mydir")
 	c.Assert(dir.Close(), qt.IsNil)
+
+	_, err = OpenDir(nil, nil, func() (afero.File, error) { return fs1.Open("mydir") })
+	c.Assert(err, qt.ErrorIs, fs.ErrInvalid)
+	_, err = OpenDir(nil, info)
+	c.Assert(err, qt.ErrorIs, fs.ErrInvalid)
 }
 
 func TestReadOps(t *testing.T) {
@@ -204,6 +213,109 @@ func TestReadOpsErrors(t *testing.T) {
 	c.Assert(err, qt.ErrorIs, statErr)
 }
 
+func TestLstatIfPossibleSymlink(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "f.txt"), []byte("f"), 0o666), qt.IsNil)
+	if err := os.Symlink("f.txt", filepath.Join(dir, "link.txt")); err != nil {
+		c.Skip("symlinks not supported:", err)
+	}
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), afero.NewBasePathFs(afero.NewOsFs(), dir)}})
+
+	fi, ok, err := ofs.LstatIfPossible("link.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(fi.Mode()&os.ModeSymlink, qt.Not(qt.Equals), os.FileMode(0))
+	fi, err = ofs.Stat("link.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Mode().IsRegular(), qt.IsTrue)
+
+	// Not an OS filesystem.
+	_, ok, err = ofs.LstatIfPossible("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestReadlinkIfPossible(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "f.txt"), []byte("f"), 0o666), qt.IsNil)
+	if err := os.Symlink("f.txt", filepath.Join(dir, "link.txt")); err != nil {
+		c.Skip("symlinks not supported:", err)
+	}
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), afero.NewBasePathFs(afero.NewOsFs(), dir)}, RecoverPanics: true, MaxConcurrentOps: 2})
+
+	target, err := ofs.ReadlinkIfPossible("link.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(target, qt.Equals, "f.txt")
+	target, err = ofs.ReadOnlyView().(afero.LinkReader).ReadlinkIfPossible("link.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(target, qt.Equals, "f.txt")
+
+	_, err = ofs.ReadlinkIfPossible("f.txt")
+	c.Assert(err, qt.Not(qt.IsNil))
+	_, err = ofs.ReadlinkIfPossible("mydir/f1-1.txt")
+	c.Assert(err, qt.ErrorIs, afero.ErrNoReadlink)
+	_, err = ofs.ReadlinkIfPossible("missing.txt")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+}
+
+func TestSymlinkIfPossible(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "f.txt"), []byte("f"), 0o666), qt.IsNil)
+	ofs := New(Options{Fss: []afero.Fs{afero.NewBasePathFs(afero.NewOsFs(), dir), basicFs("1", "1")}, FirstWritable: true, Quota: 1 << 20})
+
+	if err := ofs.SymlinkIfPossible("f.txt", "link.txt"); err != nil {
+		c.Skip("symlinks not supported:", err)
+	}
+	fi, _, err := ofs.LstatIfPossible("link.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Mode()&os.ModeSymlink, qt.Not(qt.Equals), os.FileMode(0))
+	c.Assert(readFile(c, ofs, "link.txt"), qt.Equals, "f")
+
+	ofs = New(Options{Fss: []afero.Fs{basicFs("1", "1")}, FirstWritable: true})
+	c.Assert(ofs.SymlinkIfPossible("mydir/f1-1.txt", "link.txt"), qt.ErrorIs, afero.ErrNoSymlink)
+	ofs = New(Options{Fss: []afero.Fs{afero.NewBasePathFs(afero.NewOsFs(), dir)}})
+	c.Assert(ofs.SymlinkIfPossible("f.txt", "link2.txt"), qt.ErrorIs, fs.ErrPermission)
+	c.Assert(ofs.ReadOnlyView().(afero.Linker).SymlinkIfPossible("f.txt", "link2.txt"), qt.ErrorIs, ErrReadOnly)
+}
+
+func TestOnMiss(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int
+	onMiss := func(name string) (afero.File, error) {
+		calls++
+		if filepath.Ext(name) != ".png" {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		f := mem.NewFileHandle(mem.CreateFile(name))
+		if _, err := f.WriteString("thumbnail"); err != nil {
+			return nil, err
+		}
+		_, err := f.Seek(0, io.SeekStart)
+		return f, err
+	}
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1")}, OnMiss: onMiss})
+	c.Assert(readFile(c, ofs, "thumbs/a.png"), qt.Equals, "thumbnail")
+	c.Assert(readFile(c, ofs, "thumbs/a.png"), qt.Equals, "thumbnail")
+	c.Assert(calls, qt.Equals, 2)
+	_, err := ofs.Open("thumbs/a.txt")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+	c.Assert(calls, qt.Equals, 3)
+
+	calls = 0
+	fs1 := afero.NewMemMapFs()
+	ofs = New(Options{Fss: []afero.Fs{fs1, basicFs("1", "1")}, FirstWritable: true, OnMiss: onMiss, PersistMisses: true})
+	c.Assert(readFile(c, ofs, "thumbs/a.png"), qt.Equals, "thumbnail")
+	c.Assert(readFile(c, ofs, "thumbs/a.png"), qt.Equals, "thumbnail")
+	c.Assert(calls, qt.Equals, 1)
+	c.Assert(readFile(c, fs1, "thumbs/a.png"), qt.Equals, "thumbnail")
+}
+
 func TestOpenRecursive(t *testing.T) {
 	c := qt.New(t)
 	fs1, fs2 := basicFs("1", "1"), basicFs("1", "2")
@@ -371,6 +483,79 @@ func TestReadDir(t *testing.T) {
 	c.Assert(dirEntries[0].Name(), qt.Equals, "f1-1.txt")
 }
 
+func TestOverlayFsReadDir(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2"), basicFs("1", "3")}})
+
+	dirEntries, err := ofs.ReadDir("mydir")
+	c.Assert(err, qt.IsNil)
+	var names []string
+	for _, e := range dirEntries {
+		names = append(names, e.Name())
+	}
+	c.Assert(names, qt.DeepEquals, readDirnames(c, ofs, "mydir"))
+	c.Assert(names, qt.HasLen, 4)
+
+	_, err = ofs.ReadDir("notfound")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	_, err = ofs.ReadDir(filepath.FromSlash("mydir/f1-1.txt"))
+	c.Assert(err, qt.IsNotNil)
+}
+
+func TestReadDirArena(t *testing.T) {
+	c := qt.New(t)
+	fss := []afero.Fs{noReadDirFs{basicFs("1", "1")}, noReadDirFs{basicFs("2", "2")}, noReadDirFs{basicFs("1", "3")}}
+	ofs := New(Options{Fss: fss, DirEntryArena: true})
+
+	for i := 0; i < 3; i++ {
+		d, err := ofs.Open("mydir")
+		c.Assert(err, qt.IsNil)
+		dirEntries, err := d.(fs.ReadDirFile).ReadDir(-1)
+		c.Assert(err, qt.IsNil)
+		c.Assert(len(dirEntries), qt.Equals, 4)
+		c.Assert(dirEntries[0].Name(), qt.Equals, "f1-1.txt")
+		c.Assert(dirEntries[3].Name(), qt.Equals, "f2-2.txt")
+		c.Assert(dirEntries[3].IsDir(), qt.IsFalse)
+		fi, err := dirEntries[3].Info()
+		c.Assert(err, qt.IsNil)
+		c.Assert(fi.Size(), qt.Equals, int64(4))
+		c.Assert(d.(*Dir).arena, qt.HasLen, 6)
+		c.Assert(d.Close(), qt.IsNil)
+	}
+}
+
+// BenchmarkReadDirArena compares the allocations of reading a large merged
+// directory from filesystems not implementing fs.ReadDirFile with and without DirEntryArena.
+func BenchmarkReadDirArena(b *testing.B) {
+	createFs := func(fileID string) afero.Fs {
+		fs := afero.NewMemMapFs()
+		for i := 0; i < 1000; i++ {
+			if err := afero.WriteFile(fs, fmt.Sprintf("mydir/f%s-%d.txt", fileID, i), nil, 0o666); err != nil {
+				b.Fatal(err)
+			}
+		}
+		return noReadDirFs{fs}
+	}
+	fss := []afero.Fs{createFs("1"), createFs("2")}
+
+	for _, arena := range []bool{false, true} {
+		ofs := New(Options{Fss: fss, DirEntryArena: arena})
+		b.Run(fmt.Sprintf("arena=%t", arena), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d, err := ofs.Open("mydir")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := d.(fs.ReadDirFile).ReadDir(-1); err != nil {
+					b.Fatal(err)
+				}
+				d.Close()
+			}
+		})
+	}
+}
+
 func TestDirOps(t *testing.T) {
 	c := qt.New(t)
 	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")}})
@@ -398,6 +583,59 @@ func TestDirOps(t *testing.T) {
 	c.Assert(err, qt.ErrorIs, fs.ErrClosed)
 }
 
+func TestDirOpsStrict(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")}, Strict: true})
+
+	dir, err := ofs.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	defer dir.Close()
+
+	_, errRead := dir.Read(nil)
+	_, errReadAt := dir.ReadAt(nil, 21)
+	_, errSeek := dir.Seek(1, 2)
+	_, errWrite := dir.Write(nil)
+	_, errWriteAt := dir.WriteAt(nil, 21)
+	_, errWriteString := dir.WriteString("asdf")
+
+	for _, err := range []error{errRead, errReadAt, errSeek, errWrite, errWriteAt, errWriteString, dir.Sync(), dir.Truncate(0)} {
+		c.Assert(err, qt.ErrorIs, ErrNotSupported)
+		var perr *fs.PathError
+		c.Assert(errors.As(err, &perr), qt.IsTrue)
+		c.Assert(perr.Path, qt.Equals, "mydir")
+	}
+}
+
+func TestDirOpsOSSemantics(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")}, OSDirSemantics: true})
+
+	dir, err := ofs.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	_, err = dir.Read(make([]byte, 10))
+	c.Assert(err, qt.ErrorIs, syscall.EISDIR)
+	c.Assert(err, qt.ErrorIs, ErrNotSupported)
+	_, err = dir.ReadAt(make([]byte, 10), 0)
+	c.Assert(err, qt.ErrorIs, syscall.EISDIR)
+	_, err = dir.Write(nil)
+	c.Assert(err, qt.ErrorIs, ErrNotSupported)
+	c.Assert(dir.Close(), qt.IsNil)
+
+	_, err = ofs.ReadDir(filepath.FromSlash("mydir/f1-1.txt"))
+	c.Assert(err, qt.ErrorIs, syscall.ENOTDIR)
+
+	iofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")}}).IOFS()
+	_, err = fs.ReadFile(iofs, "mydir")
+	c.Assert(err, qt.ErrorIs, syscall.EISDIR)
+	_, err = iofs.ReadDir("mydir/f1-1.txt")
+	c.Assert(err, qt.ErrorIs, syscall.ENOTDIR)
+	f, err := iofs.Open("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	_, err = f.(fs.ReadDirFile).ReadDir(-1)
+	c.Assert(err, qt.ErrorIs, syscall.ENOTDIR)
+	c.Assert(f.Close(), qt.IsNil)
+}
+
 func readDirnames(c *qt.C, fs afero.Fs, name string) []string {
 	dir, err := fs.Open(name)
 	c.Assert(err, qt.IsNil)
@@ -440,6 +678,32 @@ func fsFromTxtTar(s string) afero.Fs {
 	return fs
 }
 
+// noReadDirFs wraps a filesystem so its files don't implement fs.ReadDirFile.
+type noReadDirFs struct {
+	afero.Fs
+}
+
+func (nfs noReadDirFs) Open(name string) (afero.File, error) {
+	f, err := nfs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return noReadDirFile{f}, nil
+}
+
+func (nfs noReadDirFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := nfs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return noReadDirFile{f}, nil
+}
+
+// noReadDirFile has only the methods of afero.File.
+type noReadDirFile struct {
+	afero.File
+}
+
 type testFs struct {
 	statErr error
 }
@@ -581,3 +845,346 @@ func BenchmarkOverlayFs(b *testing.B) {
 		f.Close()
 	})
 }
+
+func TestMergedDirInfo(t *testing.T) {
+	c := qt.New(t)
+	fs1, fs2 := basicFs("1", "1"), basicFs("2", "22")
+	oldTime, newTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(fs1.Chtimes("mydir", oldTime, oldTime), qt.IsNil)
+	c.Assert(fs2.Chtimes("mydir", newTime, newTime), qt.IsNil)
+
+	stat := func(ofs *OverlayFs) os.FileInfo {
+		dir, err := ofs.Open("mydir")
+		c.Assert(err, qt.IsNil)
+		defer dir.Close()
+		fi, err := dir.Stat()
+		c.Assert(err, qt.IsNil)
+		return fi
+	}
+
+	fi := stat(New(Options{Fss: []afero.Fs{fs1, fs2}}))
+	c.Assert(fi.ModTime(), qt.Equals, oldTime)
+
+	fi = stat(New(Options{Fss: []afero.Fs{fs1, fs2}, MergedDirInfo: true}))
+	c.Assert(fi.ModTime(), qt.Equals, newTime)
+	c.Assert(fi.Name(), qt.Equals, "mydir")
+	c.Assert(fi.IsDir(), qt.IsTrue)
+
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}, MergedDirInfo: true, MergedDirInfoSize: true})
+	fi = stat(ofs)
+	c.Assert(fi.Size(), qt.Equals, int64(4+4+5+5))
+
+	// Stat before ReadDir does not affect the entries read.
+	dir, err := ofs.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	_, err = dir.Stat()
+	c.Assert(err, qt.IsNil)
+	names, err := dir.Readdirnames(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.HasLen, 4)
+	c.Assert(dir.Close(), qt.IsNil)
+}
+
+func TestReaddirNRemaining(t *testing.T) {
+	c := qt.New(t)
+	// 6 files.
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2"), basicFs("3", "3")}})
+
+	d, _ := ofs.Open("mydir")
+	fis, err := d.Readdir(4)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fis, qt.HasLen, 4)
+	fis, err = d.Readdir(5)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fis, qt.HasLen, 2)
+	_, err = d.Readdir(5)
+	c.Assert(err, qt.ErrorIs, io.EOF)
+	c.Assert(d.Close(), qt.IsNil)
+}
+
+func TestOSDirSemantics(t *testing.T) {
+	c := qt.New(t)
+	// The OS directory has the same 6 files as the two layers combined.
+	osDir, layer1, layer2 := t.TempDir(), t.TempDir(), t.TempDir()
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("f%d.txt", i)
+		c.Assert(os.WriteFile(filepath.Join(osDir, name), nil, 0o666), qt.IsNil)
+		layer := layer1
+		if i%2 == 1 {
+			layer = layer2
+		}
+		c.Assert(os.WriteFile(filepath.Join(layer, name), nil, 0o666), qt.IsNil)
+	}
+	osFs := afero.NewOsFs()
+	ofs := New(Options{
+		Fss:            []afero.Fs{afero.NewBasePathFs(osFs, layer1), afero.NewBasePathFs(osFs, layer2)},
+		OSDirSemantics: true,
+	})
+
+	type result struct {
+		n     int
+		isNil bool
+		err   error
+	}
+
+	readers := map[string]func(f afero.File, n int) result{
+		"ReadDir": func(f afero.File, n int) result {
+			v, err := f.(fs.ReadDirFile).ReadDir(n)
+			return result{len(v), v == nil, err}
+		},
+		"Readdir": func(f afero.File, n int) result {
+			v, err := f.Readdir(n)
+			return result{len(v), v == nil, err}
+		},
+		"Readdirnames": func(f afero.File, n int) result {
+			v, err := f.Readdirnames(n)
+			return result{len(v), v == nil, err}
+		},
+	}
+
+	for _, seq := range [][]int{
+		{-1, -1, 1, 0},
+		{2, 2, 2, 2, 2, -1},
+		{4, 5, 5, -1, 1},
+		{1, -1, 0, 3},
+		{7, 1, 1},
+	} {
+		for name, read := range readers {
+			osf, err := os.Open(osDir)
+			c.Assert(err, qt.IsNil)
+			f, err := ofs.Open("/")
+			c.Assert(err, qt.IsNil)
+			_, isDir := f.(*Dir)
+			c.Assert(isDir, qt.IsTrue)
+			for i, n := range seq {
+				c.Assert(read(f, n), qt.Equals, read(osf, n), qt.Commentf("%s %v: call %d", name, seq, i))
+			}
+			c.Assert(osf.Close(), qt.IsNil)
+			c.Assert(f.Close(), qt.IsNil)
+		}
+	}
+}
+
+func TestReadDirAllRepeated(t *testing.T) {
+	c := qt.New(t)
+	fss := []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}
+
+	readDirAll := func(ofs *OverlayFs) (first, second []fs.DirEntry, err error) {
+		d, err := ofs.Open("mydir")
+		c.Assert(err, qt.IsNil)
+		defer d.Close()
+		first, err = d.(fs.ReadDirFile).ReadDir(-1)
+		c.Assert(err, qt.IsNil)
+		second, err = d.(fs.ReadDirFile).ReadDir(-1)
+		return
+	}
+
+	first, second, err := readDirAll(New(Options{Fss: fss}))
+	c.Assert(first, qt.HasLen, 4)
+	c.Assert(second, qt.IsNil)
+	c.Assert(err, qt.ErrorIs, io.EOF)
+
+	first, second, err = readDirAll(New(Options{Fss: fss, OSDirSemantics: true}))
+	c.Assert(first, qt.HasLen, 4)
+	c.Assert(second, qt.IsNotNil)
+	c.Assert(second, qt.HasLen, 0)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestDeterministicOrder(t *testing.T) {
+	c := qt.New(t)
+	fs1 := fsFromTxtTar(`
+-- mydir/c.txt --
+c
+-- mydir/sub/b.txt --
+b
+`)
+	fs2 := fsFromTxtTar(`
+-- mydir/b.txt --
+b
+-- mydir/a.txt --
+a
+-- mydir/sub/a.txt --
+a
+`)
+	reverse := func(lofi, bofi []fs.DirEntry) []fs.DirEntry {
+		return defaultDirMerger(bofi, lofi)
+	}
+
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}, DirsMerger: reverse})
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.DeepEquals, []string{"a.txt", "b.txt", "sub", "c.txt"})
+
+	ofs = New(Options{Fss: []afero.Fs{fs1, fs2}, DirsMerger: reverse, DeterministicOrder: true})
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.DeepEquals, []string{"a.txt", "b.txt", "c.txt", "sub"})
+
+	want := []string{"mydir", "mydir/a.txt", "mydir/b.txt", "mydir/c.txt", "mydir/sub", "mydir/sub/a.txt", "mydir/sub/b.txt"}
+	ofs = New(Options{Fss: []afero.Fs{fs1, fs2}, DeterministicOrder: true})
+	for _, workers := range []int{1, 4} {
+		var paths []string
+		err := ofs.WalkDirConcurrent("mydir", workers, func(path string, d fs.DirEntry, err error) error {
+			c.Assert(err, qt.IsNil)
+			paths = append(paths, filepath.ToSlash(path))
+			return nil
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(paths, qt.DeepEquals, want)
+	}
+
+	// A directory found in a single filesystem is also sorted.
+	fs3 := fsFromTxtTar(`
+-- mydir/other/b.txt --
+b
+`)
+	ofs = New(Options{Fss: []afero.Fs{fs3, ofs}, DeterministicOrder: true})
+	d, err := ofs.Open("mydir/other")
+	c.Assert(err, qt.IsNil)
+	_, isDir := d.(*Dir)
+	c.Assert(isDir, qt.IsTrue)
+	c.Assert(d.Close(), qt.IsNil)
+}
+
+func TestOpenPreferred(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := fsFromTxtTar(`
+-- content/post.md --
+post1
+-- content/other.nn.md --
+other.nn1
+`)
+	fs2 := fsFromTxtTar(`
+-- content/post.en.md --
+post.en2
+-- content/post.nb.md --
+post.nb2
+-- content/other.md --
+other2
+-- content/README --
+readme2
+`)
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+
+	open := func(name string, suffixes ...string) (string, string) {
+		c.Helper()
+		f, variant, err := ofs.OpenPreferred(name, suffixes)
+		c.Assert(err, qt.IsNil)
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		c.Assert(err, qt.IsNil)
+		return variant, string(b)
+	}
+
+	// The suffix preference wins over the filesystem order.
+	variant, content := open("content/post.md", "en", "nb")
+	c.Assert(variant, qt.Equals, "content/post.en.md")
+	c.Assert(content, qt.Equals, "post.en2")
+	variant, _ = open("content/post.md", ".nb", "en")
+	c.Assert(variant, qt.Equals, "content/post.nb.md")
+	variant, content = open("content/post.md", "de")
+	c.Assert(variant, qt.Equals, "content/post.md")
+	c.Assert(content, qt.Equals, "post1")
+	variant, _ = open("content/post.md", "", "en")
+	c.Assert(variant, qt.Equals, "content/post.md")
+	variant, content = open("content/other.md", "nn")
+	c.Assert(variant, qt.Equals, "content/other.nn.md")
+	c.Assert(content, qt.Equals, "other.nn1")
+	variant, content = open("content/README", "en")
+	c.Assert(variant, qt.Equals, "content/README")
+	c.Assert(content, qt.Equals, "readme2")
+
+	_, _, err := ofs.OpenPreferred("content/missing.md", []string{"en"})
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+
+	// The suffixes are not modified.
+	suffixes := []string{"en", "nb"}[:1]
+	_, _, err = ofs.OpenPreferred("content/post.md", suffixes)
+	c.Assert(err, qt.IsNil)
+	c.Assert(suffixes[:2], qt.DeepEquals, []string{"en", "nb"})
+}
+
+func TestFindUp(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := fsFromTxtTar(`
+-- config.toml --
+root
+-- a/b/c/file.txt --
+file
+-- a/b/config.toml/foo.txt --
+a directory
+`)
+	fs2 := fsFromTxtTar(`
+-- a/config.toml --
+a
+-- x/y/.gitignore --
+ignore
+`)
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+
+	found, err := ofs.FindUp("a/b/c", "config.toml")
+	c.Assert(err, qt.IsNil)
+	c.Assert(found, qt.Equals, filepath.FromSlash("a/config.toml"))
+	found, err = ofs.FindUp("a/b/c/file.txt", "config.toml")
+	c.Assert(err, qt.IsNil)
+	c.Assert(found, qt.Equals, filepath.FromSlash("a/config.toml"))
+	found, err = ofs.FindUp("x/y", "config.toml")
+	c.Assert(err, qt.IsNil)
+	c.Assert(found, qt.Equals, "config.toml")
+	found, err = ofs.FindUp("x/y", ".gitignore")
+	c.Assert(err, qt.IsNil)
+	c.Assert(found, qt.Equals, filepath.FromSlash("x/y/.gitignore"))
+
+	_, err = ofs.FindUp("a/b", ".gitignore")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	_, err = ofs.FindUp("missing", "config.toml")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+}
+
+func TestDirKey(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")}, FirstWritable: true})
+
+	key := func(ofs afero.Fs, name string) string {
+		c.Helper()
+		f, err := ofs.Open(name)
+		c.Assert(err, qt.IsNil)
+		dir := f.(*Dir)
+		key := dir.Key()
+		c.Assert(dir.Close(), qt.IsNil)
+		return key
+	}
+
+	k1 := key(ofs, "mydir")
+	c.Assert(k1, qt.Matches, `mydir@\d+\.\d+`)
+	c.Assert(key(ofs, "mydir"), qt.Equals, k1)
+	c.Assert(key(ofs.Append(basicFs("3", "1")), "mydir"), qt.Not(qt.Equals), k1)
+
+	c.Assert(afero.WriteFile(ofs, "mydir/new.txt", []byte("new"), 0o666), qt.IsNil)
+	k2 := key(ofs, "mydir")
+	c.Assert(k2, qt.Not(qt.Equals), k1)
+	ofs.InvalidateCaches()
+	c.Assert(key(ofs, "mydir"), qt.Not(qt.Equals), k2)
+}
+
+func TestDirCapacityHint(t *testing.T) {
+	c := qt.New(t)
+	var hinted []string
+	ofs := New(Options{
+		Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")},
+		DirCapacityHint: func(dir string) int {
+			hinted = append(hinted, dir)
+			return 1000
+		},
+	})
+
+	f, err := ofs.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	dir := f.(*Dir)
+	c.Assert(cap(dir.fis) >= 1000, qt.IsTrue)
+	names, err := dir.Readdirnames(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.HasLen, 4)
+	c.Assert(cap(dir.fis) >= 1000, qt.IsTrue)
+	c.Assert(dir.Close(), qt.IsNil)
+	c.Assert(hinted, qt.DeepEquals, []string{"mydir"})
+}
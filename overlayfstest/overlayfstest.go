@@ -0,0 +1,352 @@
+// Package overlayfstest implements support for testing overlayfs.OverlayFs configurations.
+package overlayfstest
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bep/overlayfs"
+	"github.com/spf13/afero"
+)
+
+// Config configures CheckEquivalence.
+type Config struct {
+	// Seed seeds the random layers and operations.
+	// It's logged on failure so the failing sequence can be reproduced.
+	Seed int64
+
+	// NumLayers is the number of filesystems to overlay. Defaults to 3.
+	NumLayers int
+
+	// NumFiles is the number of files created in each layer. Defaults to 20.
+	NumFiles int
+
+	// NumOps is the number of operations to apply. Defaults to 300.
+	NumOps int
+
+	// New creates the OverlayFs to test from fss, ordered in priority from left to right.
+	// If it allows writes, they must go to the first filesystem.
+	// Defaults to overlayfs.New with FirstWritable set.
+	New func(fss []afero.Fs) *overlayfs.OverlayFs
+}
+
+var (
+	dirNames  = []string{".", "a", "b", "a/c", "b/d", "a/c/e"}
+	fileNames = []string{"f1.txt", "f2.txt", "f3.txt", "f4.txt"}
+)
+
+// CheckEquivalence applies a random sequence of operations both to an OverlayFs and to
+// a reference MemMapFs holding the union of the same filesystems, and fails t if
+// the results differ.
+//
+// The reference is built by copying the filesystems into it in priority order,
+// where the first file found for a name wins and directories are merged.
+// It's rebuilt after every write, so removing a file from the first filesystem
+// uncovers any file with the same name below it.
+func CheckEquivalence(t testing.TB, cfg Config) {
+	t.Helper()
+	if cfg.NumLayers <= 0 {
+		cfg.NumLayers = 3
+	}
+	if cfg.NumFiles <= 0 {
+		cfg.NumFiles = 20
+	}
+	if cfg.NumOps <= 0 {
+		cfg.NumOps = 300
+	}
+	if cfg.New == nil {
+		cfg.New = func(fss []afero.Fs) *overlayfs.OverlayFs {
+			return overlayfs.New(overlayfs.Options{Fss: fss, FirstWritable: true})
+		}
+	}
+
+	r := rand.New(rand.NewSource(cfg.Seed))
+	fss := make([]afero.Fs, cfg.NumLayers)
+	for i := range fss {
+		fss[i] = afero.NewMemMapFs()
+		for j := 0; j < cfg.NumFiles; j++ {
+			name := randFile(r)
+			if err := afero.WriteFile(fss[i], name, []byte(fmt.Sprintf("layer%d:%s", i, name)), 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c := &checker{t: t, r: r, seed: cfg.Seed, ofs: cfg.New(fss), fss: fss}
+	c.flatten()
+
+	for c.op = 0; c.op < cfg.NumOps; c.op++ {
+		switch r.Intn(8) {
+		case 0:
+			c.checkStat(randName(r))
+		case 1:
+			c.checkReadFile(randFile(r))
+		case 2, 3:
+			c.checkReadDir(randDir(r))
+		case 4:
+			c.checkWalkDir(randDir(r))
+		case 5:
+			name := randFile(r)
+			c.write(func(fs afero.Fs) error {
+				if err := fs.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+					return err
+				}
+				return afero.WriteFile(fs, name, []byte(fmt.Sprintf("op%d:%s", c.op, name)), 0o666)
+			})
+		case 6:
+			name := randFile(r)
+			c.write(func(fs afero.Fs) error {
+				return fs.Remove(name)
+			})
+		case 7:
+			// Don't remove the root.
+			name := dirNames[1+r.Intn(len(dirNames)-1)]
+			c.write(func(fs afero.Fs) error {
+				return fs.RemoveAll(name)
+			})
+		}
+	}
+}
+
+func randDir(r *rand.Rand) string {
+	return dirNames[r.Intn(len(dirNames))]
+}
+
+func randFile(r *rand.Rand) string {
+	return filepath.Join(randDir(r), fileNames[r.Intn(len(fileNames))])
+}
+
+func randName(r *rand.Rand) string {
+	if r.Intn(2) == 0 {
+		return randDir(r)
+	}
+	return randFile(r)
+}
+
+type checker struct {
+	t    testing.TB
+	r    *rand.Rand
+	seed int64
+	op   int
+
+	ofs *overlayfs.OverlayFs
+	fss []afero.Fs
+	ref afero.Fs
+}
+
+func (c *checker) fatalf(format string, args ...any) {
+	c.t.Helper()
+	c.t.Fatalf("seed %d, op %d: %s", c.seed, c.op, fmt.Sprintf(format, args...))
+}
+
+// flatten rebuilds the reference filesystem from the layers.
+func (c *checker) flatten() {
+	c.ref = afero.NewMemMapFs()
+	for _, lfs := range c.fss {
+		err := afero.Walk(lfs, ".", func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return c.ref.MkdirAll(path, 0o777)
+			}
+			if _, err := c.ref.Stat(path); err == nil {
+				return nil
+			}
+			b, err := afero.ReadFile(lfs, path)
+			if err != nil {
+				return err
+			}
+			return afero.WriteFile(c.ref, path, b, 0o666)
+		})
+		if err != nil {
+			c.fatalf("flatten: %v", err)
+		}
+	}
+}
+
+// write applies fn to the overlay and rebuilds the reference.
+// Errors are ignored, as the result is checked by the read operations that follow.
+func (c *checker) write(fn func(fs afero.Fs) error) {
+	c.t.Helper()
+	fn(c.ofs)
+	c.flatten()
+}
+
+func (c *checker) checkStat(name string) {
+	c.t.Helper()
+	fi1, err1 := c.ofs.Stat(name)
+	fi2, err2 := c.ref.Stat(name)
+	if (err1 == nil) != (err2 == nil) {
+		c.fatalf("stat %s: got error %v, want %v", name, err1, err2)
+	}
+	if err1 != nil {
+		return
+	}
+	if fi1.IsDir() != fi2.IsDir() {
+		c.fatalf("stat %s: got IsDir %t, want %t", name, fi1.IsDir(), fi2.IsDir())
+	}
+	if !fi1.IsDir() && fi1.Size() != fi2.Size() {
+		c.fatalf("stat %s: got size %d, want %d", name, fi1.Size(), fi2.Size())
+	}
+}
+
+func (c *checker) checkReadFile(name string) {
+	c.t.Helper()
+	b1, err1 := afero.ReadFile(c.ofs, name)
+	b2, err2 := afero.ReadFile(c.ref, name)
+	if (err1 == nil) != (err2 == nil) {
+		c.fatalf("read %s: got error %v, want %v", name, err1, err2)
+	}
+	if string(b1) != string(b2) {
+		c.fatalf("read %s: got %q, want %q", name, b1, b2)
+	}
+}
+
+// checkReadDir reads name in chunks of random size, randomly switching
+// between ReadDir, Readdir and Readdirnames, which share the same offset.
+func (c *checker) checkReadDir(name string) {
+	c.t.Helper()
+	want, err := c.refEntries(name)
+	f, err1 := c.ofs.Open(name)
+	if (err == nil) != (err1 == nil) {
+		c.fatalf("open %s: got error %v, want %v", name, err1, err)
+	}
+	if err1 != nil {
+		return
+	}
+	defer f.Close()
+
+	var got []string
+loop:
+	for i := 0; ; i++ {
+		if i > len(want)+1 {
+			c.fatalf("readdir %s: no io.EOF after %d reads", name, i)
+		}
+		n := c.r.Intn(5) - 1
+		var (
+			names []string
+			err   error
+		)
+		switch c.r.Intn(3) {
+		case 0:
+			if d, ok := f.(fs.ReadDirFile); ok {
+				var entries []fs.DirEntry
+				entries, err = d.ReadDir(n)
+				for _, e := range entries {
+					names = append(names, e.Name())
+					c.checkEntry(name, e.Name(), e.IsDir())
+				}
+				break
+			}
+			fallthrough
+		case 1:
+			var fis []os.FileInfo
+			fis, err = f.Readdir(n)
+			for _, fi := range fis {
+				names = append(names, fi.Name())
+				c.checkEntry(name, fi.Name(), fi.IsDir())
+			}
+		case 2:
+			names, err = f.Readdirnames(n)
+		}
+		got = append(got, names...)
+		// By default, a merged Dir also returns io.EOF for n <= 0 at the end of the directory.
+		if err == io.EOF {
+			if len(names) != 0 {
+				c.fatalf("readdir %s: got %d entries with io.EOF", name, len(names))
+			}
+			break loop
+		}
+		if err != nil {
+			c.fatalf("readdir %s: %v", name, err)
+		}
+		if n <= 0 {
+			break loop
+		}
+	}
+
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		c.fatalf("readdir %s: got %v, want %v", name, got, want)
+	}
+}
+
+// checkEntry checks that the directory entry name in dir matches the reference.
+func (c *checker) checkEntry(dir, name string, isDir bool) {
+	c.t.Helper()
+	filename := filepath.Join(dir, name)
+	fi, err := c.ref.Stat(filename)
+	if err != nil {
+		c.fatalf("readdir %s: got unexpected entry %s", dir, name)
+	}
+	if fi.IsDir() != isDir {
+		c.fatalf("readdir %s: entry %s: got IsDir %t, want %t", dir, name, isDir, fi.IsDir())
+	}
+}
+
+func (c *checker) refEntries(name string) ([]string, error) {
+	f, err := c.ref.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *checker) checkWalkDir(root string) {
+	c.t.Helper()
+	var got, want []string
+	err1 := c.ofs.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		got = append(got, fmt.Sprintf("%s:%t", path, d.IsDir()))
+		return nil
+	})
+	err2 := afero.Walk(c.ref, root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		want = append(want, fmt.Sprintf("%s:%t", path, info.IsDir()))
+		return nil
+	})
+	if (err1 == nil) != (err2 == nil) {
+		c.fatalf("walk %s: got error %v, want %v", root, err1, err2)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		c.fatalf("walk %s: got %v, want %v", root, got, want)
+	}
+}
+
+// CheckOpenHandles fails t at the end of the test if any files or directories opened
+// through ofs are still open, listing where they were opened.
+// ofs must be created with overlayfs.Options.TrackHandles set.
+func CheckOpenHandles(t testing.TB, ofs *overlayfs.OverlayFs) {
+	t.Helper()
+	t.Cleanup(func() {
+		handles := ofs.OpenHandles()
+		if len(handles) == 0 {
+			return
+		}
+		var sb strings.Builder
+		for _, h := range handles {
+			fmt.Fprintf(&sb, "\n%s opened at:\n%s", h.Name, h.Stack)
+		}
+		t.Errorf("%d handles not closed:%s", len(handles), sb.String())
+	})
+}
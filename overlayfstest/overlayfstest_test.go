@@ -0,0 +1,92 @@
+package overlayfstest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bep/overlayfs"
+	"github.com/spf13/afero"
+)
+
+func TestCheckEquivalence(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts overlayfs.Options
+	}{
+		{"default", overlayfs.Options{}},
+		{"OSDirSemantics", overlayfs.Options{OSDirSemantics: true}},
+		{"DirEntryArena", overlayfs.Options{DirEntryArena: true}},
+		{"RecoverPanics", overlayfs.Options{RecoverPanics: true}},
+		{"DeterministicOrder", overlayfs.Options{DeterministicOrder: true}},
+		{"TrackHandles", overlayfs.Options{TrackHandles: true}},
+		{"MaxConcurrentOps", overlayfs.Options{MaxConcurrentOps: 1}},
+		{"DedupLookups", overlayfs.Options{DedupLookups: true}},
+		{"StatCache", overlayfs.Options{StatCache: overlayfs.StatCacheOptions{MaxEntries: 8}}},
+		{"StatCacheTinyLFU", overlayfs.Options{StatCache: overlayfs.StatCacheOptions{MaxEntries: 8, Policy: overlayfs.CachePolicyTinyLFU}}},
+	} {
+		for seed := int64(0); seed < 10; seed++ {
+			t.Run(fmt.Sprintf("%s/%d", test.name, seed), func(t *testing.T) {
+				CheckEquivalence(t, Config{
+					Seed: seed,
+					New: func(fss []afero.Fs) *overlayfs.OverlayFs {
+						opts := test.opts
+						opts.Fss = fss
+						opts.FirstWritable = true
+						ofs := overlayfs.New(opts)
+						if opts.TrackHandles {
+							CheckOpenHandles(t, ofs)
+						}
+						return ofs
+					},
+				})
+			})
+		}
+	}
+}
+
+// recordingTB records the errors and cleanups of a test.
+type recordingTB struct {
+	testing.TB
+	errors   []string
+	cleanups []func()
+}
+
+func (t *recordingTB) Helper() {}
+
+func (t *recordingTB) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingTB) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+func TestCheckOpenHandles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "a/b.txt", []byte("b"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	ofs := overlayfs.New(overlayfs.Options{Fss: []afero.Fs{fs, afero.NewMemMapFs()}, TrackHandles: true})
+
+	rt := &recordingTB{TB: t}
+	CheckOpenHandles(rt, ofs)
+	f, err := ofs.Open("a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ofs.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cleanup := range rt.cleanups {
+		cleanup()
+	}
+	if len(rt.errors) != 1 || !strings.Contains(rt.errors[0], "1 handles not closed:\na opened at:") || !strings.Contains(rt.errors[0], "TestCheckOpenHandles") {
+		t.Fatalf("unexpected errors: %q", rt.errors)
+	}
+	d.Close()
+}
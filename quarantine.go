@@ -0,0 +1,204 @@
+package overlayfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs      = (*QuarantineFs)(nil)
+	_ afero.Lstater = (*QuarantineFs)(nil)
+	_ afero.File    = quarantineDir{}
+)
+
+// QuarantineReason is the reason an entry was blocked by a QuarantineFs.
+type QuarantineReason int
+
+const (
+	// QuarantineSymlink is a symbolic link.
+	QuarantineSymlink QuarantineReason = iota + 1
+
+	// QuarantineDevice is a device file, named pipe, socket or other irregular file.
+	QuarantineDevice
+
+	// QuarantineSetuid is a file with the setuid or setgid bit set.
+	QuarantineSetuid
+
+	// QuarantineAbsolutePath is a name with a volume name, a UNC prefix or,
+	// for directory entries, a path separator.
+	QuarantineAbsolutePath
+)
+
+func (r QuarantineReason) String() string {
+	switch r {
+	case QuarantineSymlink:
+		return "symlink"
+	case QuarantineDevice:
+		return "device"
+	case QuarantineSetuid:
+		return "setuid"
+	case QuarantineAbsolutePath:
+		return "absolute path"
+	}
+	return fmt.Sprintf("QuarantineReason(%d)", int(r))
+}
+
+// QuarantinedEntry is an entry blocked by a QuarantineFs.
+type QuarantinedEntry struct {
+	Path   string
+	Reason QuarantineReason
+}
+
+// QuarantineFs wraps a filesystem from an untrusted source, e.g. an upload, and blocks
+// risky entries before they reach the merged view: symlinks, device files, files with
+// the setuid or setgid bit set and absolute path names.
+// Blocked entries, and anything below a blocked directory, behave as if they don't exist,
+// so a file with the same name in a lower layer is used instead.
+// Use Blocked to get a report of what was blocked.
+type QuarantineFs struct {
+	nameFs
+
+	mu      sync.Mutex
+	blocked map[string]QuarantineReason
+}
+
+// NewQuarantineFs creates a new QuarantineFs wrapping fs.
+func NewQuarantineFs(fs afero.Fs) *QuarantineFs {
+	q := &QuarantineFs{blocked: make(map[string]QuarantineReason)}
+	q.nameFs = nameFs{fs: fs, name: q.check}
+	return q
+}
+
+// Blocked returns the entries blocked so far, sorted by path.
+func (q *QuarantineFs) Blocked() []QuarantinedEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]QuarantinedEntry, 0, len(q.blocked))
+	for path, reason := range q.blocked {
+		entries = append(entries, QuarantinedEntry{Path: path, Reason: reason})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+func (q *QuarantineFs) Open(name string) (afero.File, error) {
+	f, err := q.nameFs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return quarantineDir{File: f, q: q, name: name}, nil
+}
+
+func (q *QuarantineFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := q.nameFs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return quarantineDir{File: f, q: q, name: name}, nil
+}
+
+func (q *QuarantineFs) block(name string, reason QuarantineReason) {
+	q.mu.Lock()
+	q.blocked[name] = reason
+	q.mu.Unlock()
+}
+
+// check returns a not found error if name or any of its parent directories is blocked.
+func (q *QuarantineFs) check(op, name string) (string, error) {
+	notFound := &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	if isAbsName(name) {
+		q.block(name, QuarantineAbsolutePath)
+		return "", notFound
+	}
+	clean := filepath.Clean(name)
+	for i := 1; i <= len(clean); i++ {
+		if i < len(clean) && !os.IsPathSeparator(clean[i]) {
+			continue
+		}
+		prefix := clean[:i]
+		fi, err := q.lstat(prefix)
+		if err != nil {
+			// Let the operation report the error.
+			break
+		}
+		if reason := quarantineReason(fi); reason != 0 {
+			q.block(prefix, reason)
+			return "", notFound
+		}
+	}
+	return name, nil
+}
+
+func (q *QuarantineFs) lstat(name string) (os.FileInfo, error) {
+	if lfs, ok := q.fs.(afero.Lstater); ok {
+		fi, _, err := lfs.LstatIfPossible(name)
+		return fi, err
+	}
+	return q.fs.Stat(name)
+}
+
+// quarantineReason returns the reason to block fi, or 0 if it's not risky.
+func quarantineReason(fi os.FileInfo) QuarantineReason {
+	mode := fi.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return QuarantineSymlink
+	case mode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket|os.ModeIrregular) != 0:
+		return QuarantineDevice
+	case mode&(os.ModeSetuid|os.ModeSetgid) != 0:
+		return QuarantineSetuid
+	}
+	if strings.ContainsAny(fi.Name(), `/\`) || isAbsName(fi.Name()) {
+		return QuarantineAbsolutePath
+	}
+	return 0
+}
+
+// isAbsName reports whether name starts with a volume name, e.g. C:, or a UNC prefix, on any OS.
+func isAbsName(name string) bool {
+	name = filepath.ToSlash(name)
+	if len(name) >= 2 && name[1] == ':' && ('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z') {
+		return true
+	}
+	return strings.HasPrefix(name, "//")
+}
+
+// quarantineDir is a file opened from a QuarantineFs. Its directory entries are filtered.
+type quarantineDir struct {
+	afero.File
+	q    *QuarantineFs
+	name string
+}
+
+func (d quarantineDir) Readdir(n int) ([]os.FileInfo, error) {
+	for {
+		fis, err := d.File.Readdir(n)
+		kept := fis[:0]
+		for _, fi := range fis {
+			if reason := quarantineReason(fi); reason != 0 {
+				d.q.block(filepath.Join(d.name, fi.Name()), reason)
+				continue
+			}
+			kept = append(kept, fi)
+		}
+		// Don't return an empty slice and a nil error for n > 0.
+		if len(kept) > 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
+
+func (d quarantineDir) Readdirnames(n int) ([]string, error) {
+	fis, err := d.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
@@ -0,0 +1,132 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestQuarantineFs(t *testing.T) {
+	c := qt.New(t)
+	upload := &modeFs{
+		Fs: fsFromTxtTar(`
+-- mydir/ok.txt --
+ok
+-- mydir/link.txt --
+link
+-- mydir/suid --
+suid
+-- mydir/dev --
+dev
+-- linkdir/f.txt --
+f
+`),
+		modes: map[string]os.FileMode{
+			"mydir/link.txt": os.ModeSymlink,
+			"mydir/suid":     os.ModeSetuid | 0o755,
+			"mydir/dev":      os.ModeDevice,
+			"linkdir":        os.ModeSymlink | os.ModeDir,
+		},
+	}
+	lower := fsFromTxtTar(`
+-- mydir/link.txt --
+lower
+`)
+	q := NewQuarantineFs(upload)
+	ofs := New(Options{Fss: []afero.Fs{q, lower}})
+
+	c.Assert(readFile(c, ofs, "mydir/ok.txt"), qt.Equals, "ok")
+	c.Assert(readFile(c, ofs, "mydir/link.txt"), qt.Equals, "lower")
+	for _, name := range []string{"mydir/suid", "mydir/dev", "linkdir/f.txt", `C:\mydir\ok.txt`, "//server/share/ok.txt"} {
+		_, err := ofs.Stat(name)
+		c.Assert(err, qt.ErrorIs, fs.ErrNotExist, qt.Commentf(name))
+	}
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.DeepEquals, []string{"ok.txt", "link.txt"})
+
+	c.Assert(q.Blocked(), qt.DeepEquals, []QuarantinedEntry{
+		{Path: "//server/share/ok.txt", Reason: QuarantineAbsolutePath},
+		{Path: `C:\mydir\ok.txt`, Reason: QuarantineAbsolutePath},
+		{Path: "linkdir", Reason: QuarantineSymlink},
+		{Path: filepath.FromSlash("mydir/dev"), Reason: QuarantineDevice},
+		{Path: filepath.FromSlash("mydir/link.txt"), Reason: QuarantineSymlink},
+		{Path: filepath.FromSlash("mydir/suid"), Reason: QuarantineSetuid},
+	})
+	c.Assert(QuarantineSetuid.String(), qt.Equals, "setuid")
+}
+
+// modeFs overrides the file mode of some of the files in a filesystem.
+type modeFs struct {
+	afero.Fs
+	modes map[string]os.FileMode
+}
+
+func (m *modeFs) patch(name string, fi os.FileInfo) os.FileInfo {
+	if mode, ok := m.modes[filepath.ToSlash(filepath.Clean(name))]; ok {
+		return modeFileInfo{FileInfo: fi, mode: mode}
+	}
+	return fi
+}
+
+func (m *modeFs) Stat(name string) (os.FileInfo, error) {
+	fi, err := m.Fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.patch(name, fi), nil
+}
+
+func (m *modeFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, err := m.Stat(name)
+	return fi, true, err
+}
+
+func (m *modeFs) Open(name string) (afero.File, error) {
+	f, err := m.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return modeFile{File: f, m: m, name: name}, nil
+}
+
+type modeFile struct {
+	afero.File
+	m    *modeFs
+	name string
+}
+
+func (f modeFile) Readdir(n int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(n)
+	for i, fi := range fis {
+		fis[i] = f.m.patch(filepath.Join(f.name, fi.Name()), fi)
+	}
+	return fis, err
+}
+
+type modeFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (fi modeFileInfo) Mode() os.FileMode { return fi.mode }
+func (fi modeFileInfo) IsDir() bool       { return fi.mode.IsDir() }
+
+func TestQuarantineFsOsSymlink(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "f.txt"), []byte("f"), 0o666), qt.IsNil)
+	if err := os.Symlink("/etc/passwd", filepath.Join(dir, "passwd")); err != nil {
+		c.Skip("symlinks not supported:", err)
+	}
+	q := NewQuarantineFs(afero.NewBasePathFs(afero.NewOsFs(), dir))
+	ofs := New(Options{Fss: []afero.Fs{q}})
+
+	c.Assert(readFile(c, ofs, "f.txt"), qt.Equals, "f")
+	_, err := ofs.Stat("passwd")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(readDirnames(c, ofs, ""), qt.DeepEquals, []string{"f.txt"})
+	c.Assert(q.Blocked(), qt.DeepEquals, []QuarantinedEntry{{Path: "passwd", Reason: QuarantineSymlink}})
+}
@@ -0,0 +1,262 @@
+package overlayfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs     = quotaFs{}
+	_ XattrFs      = quotaFs{}
+	_ afero.Linker = quotaFs{}
+	_ afero.File   = (*quotaFile)(nil)
+)
+
+// quota tracks the usage of the writable filesystems, see Options.Quota.
+// It's shared by the shallow copies of an OverlayFs.
+type quota struct {
+	limit       int64
+	thresholds  []float64
+	onThreshold func(pct float64)
+
+	mu sync.Mutex
+	// used is the total size of the files in the writable filesystems.
+	// If not known, it's recalculated on the next write and used holds the previous value.
+	used  int64
+	known bool
+}
+
+func newQuota(limit int64, thresholds []float64, onThreshold func(pct float64)) *quota {
+	thresholds = slices.Clone(thresholds)
+	slices.Sort(thresholds)
+	return &quota{limit: limit, thresholds: thresholds, onThreshold: onThreshold}
+}
+
+// QuotaUsage returns the total size in bytes of the files in the writable filesystems
+// and the limit set in Options.Quota, which is 0 if not set.
+func (ofs *OverlayFs) QuotaUsage() (used, limit int64, err error) {
+	if ofs.quota == nil {
+		return 0, 0, nil
+	}
+	q := ofs.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.load(ofs); err != nil {
+		return 0, 0, err
+	}
+	return q.used, q.limit, nil
+}
+
+// load calculates the usage, if not known. q.mu must be held.
+func (q *quota) load(ofs *OverlayFs) error {
+	if q.known {
+		return nil
+	}
+	var used int64
+	for _, i := range ofs.writableLayers() {
+		err := afero.Walk(ofs.layer(ofs.fss[i]), ".", func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.Mode().IsRegular() {
+				used += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	q.used, q.known = used, true
+	return nil
+}
+
+// reserve adds n bytes to the usage, failing with ErrQuotaExceeded if a positive n
+// would exceed the limit.
+func (q *quota) reserve(ofs *OverlayFs, op, name string, n int64) error {
+	q.mu.Lock()
+	if err := q.load(ofs); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	if n > 0 && q.used+n > q.limit {
+		q.mu.Unlock()
+		return &fs.PathError{Op: op, Path: name, Err: ErrQuotaExceeded}
+	}
+	q.addLocked(n)
+	return nil
+}
+
+// add adds n, which may be negative, to a known usage.
+func (q *quota) add(n int64) {
+	if n == 0 {
+		return
+	}
+	q.mu.Lock()
+	if !q.known {
+		q.mu.Unlock()
+		return
+	}
+	q.addLocked(n)
+}
+
+// addLocked adds n to the usage, unlocks q.mu and calls onThreshold for the thresholds crossed upwards.
+func (q *quota) addLocked(n int64) {
+	old := q.used
+	q.used += n
+	used := q.used
+	q.mu.Unlock()
+	if q.onThreshold == nil || n <= 0 {
+		return
+	}
+	for _, pct := range q.thresholds {
+		limit := float64(q.limit) * pct / 100
+		if float64(old) < limit && float64(used) >= limit {
+			q.onThreshold(pct)
+		}
+	}
+}
+
+// forget marks the usage as unknown, e.g. after a file has been removed.
+func (q *quota) forget() {
+	q.mu.Lock()
+	q.known = false
+	q.mu.Unlock()
+}
+
+// quotaFs accounts the writes to fs in a quota.
+type quotaFs struct {
+	afero.Fs
+	ofs *OverlayFs
+	q   *quota
+}
+
+func (qfs quotaFs) Create(name string) (afero.File, error) {
+	return qfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (qfs quotaFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	var size int64
+	if fi, err := qfs.Fs.Stat(name); err == nil && fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+	f, err := qfs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		qfs.q.add(-size)
+		size = 0
+	}
+	return &quotaFile{File: f, fs: qfs, name: name, size: size, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (qfs quotaFs) Remove(name string) error {
+	defer qfs.q.forget()
+	return qfs.Fs.Remove(name)
+}
+
+func (qfs quotaFs) RemoveAll(path string) error {
+	defer qfs.q.forget()
+	return qfs.Fs.RemoveAll(path)
+}
+
+func (qfs quotaFs) Rename(oldname, newname string) error {
+	// The new name may have replaced another file.
+	defer qfs.q.forget()
+	return qfs.Fs.Rename(oldname, newname)
+}
+
+func (qfs quotaFs) SymlinkIfPossible(oldname, newname string) error {
+	linker, ok := qfs.Fs.(afero.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+	}
+	return linker.SymlinkIfPossible(oldname, newname)
+}
+
+func (qfs quotaFs) GetXattr(name, attr string) ([]byte, error) {
+	xfs, ok := asXattrFs(qfs.Fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.GetXattr(name, attr)
+}
+
+func (qfs quotaFs) SetXattr(name, attr string, value []byte) error {
+	xfs, ok := asXattrFs(qfs.Fs)
+	if !ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.SetXattr(name, attr, value)
+}
+
+func (qfs quotaFs) ListXattr(name string) ([]string, error) {
+	xfs, ok := asXattrFs(qfs.Fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.ListXattr(name)
+}
+
+// quotaFile is a file opened from a quotaFs. Writes growing the file are accounted in the quota.
+type quotaFile struct {
+	afero.File
+	fs     quotaFs
+	name   string
+	size   int64
+	append bool
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	off := f.size
+	if !f.append {
+		var err error
+		if off, err = f.File.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+	return f.writeAt(p, off, func() (int, error) { return f.File.Write(p) })
+}
+
+func (f *quotaFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.writeAt(p, off, func() (int, error) { return f.File.WriteAt(p, off) })
+}
+
+func (f *quotaFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// writeAt reserves the growth of writing p at off before calling write,
+// and gives back what wasn't written.
+func (f *quotaFile) writeAt(p []byte, off int64, write func() (int, error)) (int, error) {
+	growth := max(0, off+int64(len(p))-f.size)
+	if err := f.fs.q.reserve(f.fs.ofs, "write", f.name, growth); err != nil {
+		return 0, err
+	}
+	n, err := write()
+	size := max(f.size, off+int64(n))
+	f.fs.q.add(size - f.size - growth)
+	f.size = size
+	return n, err
+}
+
+func (f *quotaFile) Truncate(size int64) error {
+	if err := f.fs.q.reserve(f.fs.ofs, "truncate", f.name, size-f.size); err != nil {
+		return err
+	}
+	if err := f.File.Truncate(size); err != nil {
+		f.fs.q.add(f.size - size)
+		return err
+	}
+	f.size = size
+	return nil
+}
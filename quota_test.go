@@ -0,0 +1,83 @@
+package overlayfs
+
+import (
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestQuota(t *testing.T) {
+	c := qt.New(t)
+
+	upper := fsFromTxtTar(`
+-- a.txt --
+0123456789
+`)
+	lower := fsFromTxtTar(`
+-- big.txt --
+not counted, not in the writable filesystem
+`)
+	var crossed []float64
+	ofs := New(Options{
+		Fss:              []afero.Fs{upper, lower},
+		FirstWritable:    true,
+		Quota:            100,
+		QuotaThresholds:  []float64{90, 50},
+		OnQuotaThreshold: func(pct float64) { crossed = append(crossed, pct) },
+	})
+
+	used, limit, err := ofs.QuotaUsage()
+	c.Assert(err, qt.IsNil)
+	c.Assert(used, qt.Equals, int64(10))
+	c.Assert(limit, qt.Equals, int64(100))
+
+	f, err := ofs.Create("b.txt")
+	c.Assert(err, qt.IsNil)
+	_, err = f.Write(make([]byte, 30))
+	c.Assert(err, qt.IsNil)
+	c.Assert(crossed, qt.IsNil)
+	// Overwriting doesn't grow the file.
+	_, err = f.WriteAt(make([]byte, 10), 0)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteAt(make([]byte, 20), 30)
+	c.Assert(err, qt.IsNil)
+	c.Assert(crossed, qt.DeepEquals, []float64{50})
+	_, err = f.WriteAt(make([]byte, 40), 50)
+	c.Assert(err, qt.IsNil)
+	c.Assert(crossed, qt.DeepEquals, []float64{50, 90})
+	_, err = f.WriteAt(make([]byte, 1), 90)
+	c.Assert(errors.Is(err, ErrQuotaExceeded), qt.IsTrue)
+	c.Assert(f.Close(), qt.IsNil)
+
+	used, _, err = ofs.QuotaUsage()
+	c.Assert(err, qt.IsNil)
+	c.Assert(used, qt.Equals, int64(100))
+
+	// Truncating and removing files frees space, and the thresholds can be crossed again.
+	f, err = ofs.Create("b.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Truncate(45), qt.IsNil)
+	c.Assert(crossed, qt.DeepEquals, []float64{50, 90, 50})
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(ofs.Remove("a.txt"), qt.IsNil)
+	used, _, err = ofs.QuotaUsage()
+	c.Assert(err, qt.IsNil)
+	c.Assert(used, qt.Equals, int64(45))
+
+	c.Assert(afero.WriteFile(ofs, "c.txt", make([]byte, 56), 0o666), qt.ErrorMatches, ".*quota exceeded")
+	// A write crossing several thresholds reports them all.
+	c.Assert(afero.WriteFile(ofs, "c.txt", make([]byte, 55), 0o666), qt.IsNil)
+	c.Assert(crossed, qt.DeepEquals, []float64{50, 90, 50, 50, 90})
+}
+
+func TestQuotaNotSet(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1")}, FirstWritable: true})
+	used, limit, err := ofs.QuotaUsage()
+	c.Assert(err, qt.IsNil)
+	c.Assert(used, qt.Equals, int64(0))
+	c.Assert(limit, qt.Equals, int64(0))
+}
@@ -0,0 +1,195 @@
+package overlayfs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Priority is the priority class of an operation waiting on a RateLimiter.
+type Priority int
+
+const (
+	// PriorityForeground is the default priority, used for interactive operations such as Stat and Open.
+	// Foreground operations are never limited.
+	PriorityForeground Priority = iota
+
+	// PriorityBackground is the default priority for bulk operations such as MaterializeTo and WriteTar.
+	// Background operations are limited, and yield to the foreground operations in flight
+	// on an overlay using the same RateLimiter, see Options.RateLimiter.
+	PriorityBackground
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx with the given priority.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFromContext(ctx context.Context) (Priority, bool) {
+	p, ok := ctx.Value(priorityKey{}).(Priority)
+	return p, ok
+}
+
+// RateLimiter limits the rate of bytes read and operations performed in the background,
+// so background work doesn't starve the foreground operations, see Priority.
+// A RateLimiter may be shared between operations and overlays.
+type RateLimiter struct {
+	mu    sync.Mutex
+	bytes *tokenBucket
+	ops   *tokenBucket
+
+	// Number of foreground operations currently in flight,
+	// and a channel closed when that number drops to zero.
+	foreground     int
+	foregroundIdle chan struct{}
+}
+
+// NewRateLimiter creates a new RateLimiter allowing bytesPerSec bytes and opsPerSec operations per second.
+// A rate <= 0 means no limit.
+func NewRateLimiter(bytesPerSec int64, opsPerSec float64) *RateLimiter {
+	return &RateLimiter{
+		bytes: newTokenBucket(float64(bytesPerSec)),
+		ops:   newTokenBucket(opsPerSec),
+	}
+}
+
+// WaitOp blocks until an operation is allowed or ctx is done.
+// Foreground operations, the default priority of ctx, are always allowed.
+// A nil RateLimiter allows all operations.
+func (l *RateLimiter) WaitOp(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	return l.wait(ctx, l.ops, 1)
+}
+
+// WaitBytes blocks until n bytes are allowed or ctx is done.
+// Foreground operations, the default priority of ctx, are always allowed.
+// A nil RateLimiter allows all bytes.
+func (l *RateLimiter) WaitBytes(ctx context.Context, n int) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	return l.wait(ctx, l.bytes, float64(n))
+}
+
+func (l *RateLimiter) wait(ctx context.Context, b *tokenBucket, n float64) error {
+	if b == nil {
+		return ctx.Err()
+	}
+	if p, _ := priorityFromContext(ctx); p != PriorityBackground {
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	// Yield to the foreground operations in flight.
+	for l.foreground > 0 {
+		idle := l.foregroundIdle
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle:
+		}
+		l.mu.Lock()
+	}
+	d := b.reserve(time.Now(), n)
+	l.mu.Unlock()
+	return sleep(ctx, d)
+}
+
+// beginForeground marks a foreground operation as in flight until the returned func is called,
+// making the background operations wait.
+func (l *RateLimiter) beginForeground() func() {
+	if l == nil {
+		return func() {}
+	}
+	l.mu.Lock()
+	l.foreground++
+	if l.foreground == 1 {
+		l.foregroundIdle = make(chan struct{})
+	}
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		l.foreground--
+		if l.foreground == 0 {
+			close(l.foregroundIdle)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// reader returns a reader that waits for l.WaitBytes after each read.
+func (l *RateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || l.bytes == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, l: l, r: r}
+}
+
+type rateLimitedReader struct {
+	ctx context.Context
+	l   *RateLimiter
+	r   io.Reader
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.WaitBytes(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// tokenBucket is a token bucket holding up to one second worth of tokens.
+// A reservation larger than the available tokens puts the bucket in debt,
+// and the caller must wait for the debt to be paid back.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate}
+}
+
+// reserve takes n tokens from the bucket and returns how long to wait before they're available.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
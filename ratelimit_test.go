@@ -0,0 +1,91 @@
+package overlayfs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestTokenBucket(t *testing.T) {
+	c := qt.New(t)
+	b := newTokenBucket(10)
+	now := time.Now()
+
+	c.Assert(b.reserve(now, 5), qt.Equals, time.Duration(0))
+	c.Assert(b.reserve(now, 5), qt.Equals, time.Duration(0))
+	c.Assert(b.reserve(now, 5), qt.Equals, 500*time.Millisecond)
+	now = now.Add(time.Second)
+	c.Assert(b.reserve(now, 5), qt.Equals, time.Duration(0))
+	now = now.Add(time.Hour)
+	c.Assert(b.reserve(now, 10), qt.Equals, time.Duration(0))
+	c.Assert(b.reserve(now, 20), qt.Equals, 2*time.Second)
+
+	c.Assert(newTokenBucket(0), qt.IsNil)
+}
+
+func TestRateLimiterPriority(t *testing.T) {
+	c := qt.New(t)
+	l := NewRateLimiter(0, 10)
+	ctx := context.Background()
+	bgCtx := WithPriority(ctx, PriorityBackground)
+
+	// Drain the bucket.
+	for i := 0; i < 10; i++ {
+		c.Assert(l.WaitOp(bgCtx), qt.IsNil)
+	}
+
+	// Foreground operations are not limited.
+	for i := 0; i < 100; i++ {
+		c.Assert(l.WaitOp(ctx), qt.IsNil)
+	}
+
+	// Background operations wait while a foreground operation is in flight.
+	done := l.beginForeground()
+	waitCtx, cancel := context.WithTimeout(bgCtx, 30*time.Millisecond)
+	defer cancel()
+	c.Assert(l.WaitOp(waitCtx), qt.ErrorIs, context.DeadlineExceeded)
+
+	// The background operation should not have taken any tokens.
+	l.mu.Lock()
+	tokens := l.ops.tokens
+	l.mu.Unlock()
+	c.Assert(tokens > -0.5, qt.IsTrue)
+
+	done()
+	c.Assert(l.WaitOp(bgCtx), qt.IsNil)
+}
+
+func TestRateLimiterForeground(t *testing.T) {
+	c := qt.New(t)
+	l := NewRateLimiter(1, 1)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1")}, RateLimiter: l})
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+	}
+	c.Assert(time.Since(start) < time.Second, qt.IsTrue)
+	l.mu.Lock()
+	foreground := l.foreground
+	l.mu.Unlock()
+	c.Assert(foreground, qt.Equals, 0)
+}
+
+func TestRateLimiterExport(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}})
+
+	var buf bytes.Buffer
+	opts := ExportOptions{Root: "mydir", RateLimiter: NewRateLimiter(0, 1000)}
+	c.Assert(ofs.WriteTar(context.Background(), &buf, opts), qt.IsNil)
+	c.Assert(readTar(c, &buf), qt.HasLen, 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	opts = ExportOptions{Root: "mydir", RateLimiter: NewRateLimiter(1, 0)}
+	c.Assert(ofs.MaterializeTo(ctx, afero.NewMemMapFs(), opts), qt.ErrorIs, context.DeadlineExceeded)
+}
@@ -0,0 +1,179 @@
+package overlayfs
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// readAheadFile reads ahead of sequential reads in the background, see Options.ReadAhead.
+// The read-ahead is stopped by any other operation that depends on or moves the file offset,
+// and started again on the next sequential read.
+type readAheadFile struct {
+	afero.File
+	window int
+
+	off        int64 // The offset of the next Read.
+	sequential int   // The number of sequential reads since the last reposition.
+	ra         *readAhead
+	buf        []byte // The unread part of the last chunk read ahead.
+}
+
+type readAhead struct {
+	chunks chan readAheadChunk
+	stop   chan struct{}
+	done   chan struct{}
+	err    error // Sticky error from the last chunk.
+}
+
+type readAheadChunk struct {
+	b   []byte
+	err error
+}
+
+func newReadAheadFile(f afero.File, window int) *readAheadFile {
+	return &readAheadFile{File: f, window: window}
+}
+
+func (f *readAheadFile) Read(p []byte) (int, error) {
+	if f.ra == nil {
+		f.sequential++
+		if f.sequential < 2 {
+			n, err := f.File.Read(p)
+			f.off += int64(n)
+			return n, err
+		}
+		f.start()
+	}
+	if len(f.buf) == 0 {
+		if f.ra.err != nil {
+			return 0, f.ra.err
+		}
+		c, ok := <-f.ra.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		f.buf, f.ra.err = c.b, c.err
+		if len(f.buf) == 0 {
+			return 0, f.ra.err
+		}
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	f.off += int64(n)
+	return n, nil
+}
+
+// start starts reading ahead from the file offset in chunks of half the window,
+// so one chunk is read while the other is consumed.
+func (f *readAheadFile) start() {
+	ra := &readAhead{
+		chunks: make(chan readAheadChunk, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	f.ra = ra
+	size := max(f.window/2, 1)
+	go func() {
+		defer close(ra.done)
+		defer close(ra.chunks)
+		for {
+			b := make([]byte, size)
+			n, err := io.ReadFull(f.File, b)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			select {
+			case ra.chunks <- readAheadChunk{b: b[:n], err: err}:
+			case <-ra.stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// stopReadAhead stops the read-ahead, if running, and moves the file offset back to
+// the offset of the next Read.
+func (f *readAheadFile) stopReadAhead() error {
+	f.sequential = 0
+	if f.ra == nil {
+		return nil
+	}
+	close(f.ra.stop)
+	<-f.ra.done
+	f.ra, f.buf = nil, nil
+	_, err := f.File.Seek(f.off, io.SeekStart)
+	return err
+}
+
+func (f *readAheadFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.stopReadAhead(); err != nil {
+		return 0, err
+	}
+	n, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.off = n
+	}
+	return n, err
+}
+
+func (f *readAheadFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.stopReadAhead(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *readAheadFile) Write(p []byte) (int, error) {
+	if err := f.stopReadAhead(); err != nil {
+		return 0, err
+	}
+	n, err := f.File.Write(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *readAheadFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *readAheadFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.stopReadAhead(); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *readAheadFile) Truncate(size int64) error {
+	if err := f.stopReadAhead(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *readAheadFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.stopReadAhead(); err != nil {
+		return nil, err
+	}
+	return f.File.Readdir(count)
+}
+
+func (f *readAheadFile) Readdirnames(n int) ([]string, error) {
+	if err := f.stopReadAhead(); err != nil {
+		return nil, err
+	}
+	return f.File.Readdirnames(n)
+}
+
+func (f *readAheadFile) Close() error {
+	if f.ra != nil {
+		close(f.ra.stop)
+		<-f.ra.done
+		f.ra = nil
+	}
+	return f.File.Close()
+}
@@ -0,0 +1,60 @@
+package overlayfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestReadAhead(t *testing.T) {
+	c := qt.New(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	fs1 := afero.NewMemMapFs()
+	c.Assert(afero.WriteFile(fs1, "large.bin", content, 0o666), qt.IsNil)
+	c.Assert(afero.WriteFile(fs1, "small.txt", []byte("small"), 0o666), qt.IsNil)
+
+	ofs := New(Options{Fss: []afero.Fs{fs1}, ReadAhead: 1000})
+
+	f, err := ofs.Open("large.bin")
+	c.Assert(err, qt.IsNil)
+	_, ok := f.(*readAheadFile)
+	c.Assert(ok, qt.IsTrue)
+	// ioFile adds the EOF on short reads that MemMapFs's ReadAt lacks.
+	c.Assert(iotest.TestReader(ioFile{f}, content), qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+
+	f, err = ofs.Open("large.bin")
+	c.Assert(err, qt.IsNil)
+	b, err := io.ReadAll(iotest.HalfReader(f))
+	c.Assert(err, qt.IsNil)
+	c.Assert(b, qt.DeepEquals, content)
+	c.Assert(f.Close(), qt.IsNil)
+
+	// Closed while reading ahead.
+	f, err = ofs.Open("large.bin")
+	c.Assert(err, qt.IsNil)
+	p := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		_, err = f.Read(p)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(f.Close(), qt.IsNil)
+
+	f, err = ofs.Open("small.txt")
+	c.Assert(err, qt.IsNil)
+	_, ok = f.(*readAheadFile)
+	c.Assert(ok, qt.IsFalse)
+	f.Close()
+
+	ofs = New(Options{Fss: []afero.Fs{fs1}, ReadAhead: 1000, ReadAheadFs: func(afero.Fs) bool { return false }})
+	f, err = ofs.Open("large.bin")
+	c.Assert(err, qt.IsNil)
+	_, ok = f.(*readAheadFile)
+	c.Assert(ok, qt.IsFalse)
+	f.Close()
+}
@@ -0,0 +1,252 @@
+package overlayfs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs         = readOnlyView{}
+	_ afero.Lstater    = readOnlyView{}
+	_ afero.LinkReader = readOnlyView{}
+	_ afero.Linker     = readOnlyView{}
+	_ XattrFs          = readOnlyView{}
+	_ afero.File       = readOnlyFile{}
+	_ fs.ReadDirFile   = readOnlyFile{}
+)
+
+// ReadOnlyView returns a view of the merged filesystem that forwards reads to ofs
+// and rejects all writes, including writes to the files it returns, with ErrReadOnly.
+// No layers are copied, so changes made through ofs are visible in the view.
+// It's meant for handing the merged view to untrusted code, e.g. plugins,
+// which can't get at ofs through it.
+// See RestrictedView for further restrictions.
+func (ofs *OverlayFs) ReadOnlyView() afero.Fs {
+	return ofs.RestrictedView(ViewOptions{})
+}
+
+// ViewOptions are the capabilities of a view returned by RestrictedView.
+// The zero value gives the capabilities of ReadOnlyView.
+type ViewOptions struct {
+	// NoList, if set, makes listing directories fail with fs.ErrPermission,
+	// so the view can't be walked and only known names can be read.
+	NoList bool
+
+	// Roots, if set, limits the view to the trees below these roots, e.g. "data/myplugin".
+	// Other names don't exist in the view, see Layer.Only.
+	Roots []string
+
+	// RateLimiter, if set, limits the operations on the view and the bytes read from its files.
+	// They run with PriorityBackground.
+	RateLimiter *RateLimiter
+}
+
+// RestrictedView is ReadOnlyView with the capabilities restricted by opts,
+// e.g. to sandbox the filesystem access of an extension.
+// Views are cheap, so create one per extension.
+func (ofs *OverlayFs) RestrictedView(opts ViewOptions) afero.Fs {
+	var v afero.Fs = readOnlyView{ofs: ofs, noList: opts.NoList, rl: opts.RateLimiter}
+	if len(opts.Roots) > 0 {
+		v = newScopedFs(v, opts.Roots)
+	}
+	return v
+}
+
+type readOnlyView struct {
+	ofs    *OverlayFs
+	noList bool
+	rl     *RateLimiter
+}
+
+func readOnlyErr(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: ErrReadOnly}
+}
+
+func (v readOnlyView) Name() string {
+	return v.ofs.Name()
+}
+
+// viewCtx is the context of the operations on a view, which are limited as background operations.
+var viewCtx = WithPriority(context.Background(), PriorityBackground)
+
+// wait waits for the RateLimiter, if set, to allow an operation.
+func (v readOnlyView) wait() error {
+	return v.rl.WaitOp(viewCtx)
+}
+
+func (v readOnlyView) Open(name string) (afero.File, error) {
+	if err := v.wait(); err != nil {
+		return nil, err
+	}
+	f, err := v.ofs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyFile{File: f, noList: v.noList, rl: v.rl}, nil
+}
+
+func (v readOnlyView) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, readOnlyErr("open", name)
+	}
+	return v.Open(name)
+}
+
+func (v readOnlyView) Stat(name string) (os.FileInfo, error) {
+	if err := v.wait(); err != nil {
+		return nil, err
+	}
+	return v.ofs.Stat(name)
+}
+
+func (v readOnlyView) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if err := v.wait(); err != nil {
+		return nil, false, err
+	}
+	return v.ofs.LstatIfPossible(name)
+}
+
+func (v readOnlyView) ReadlinkIfPossible(name string) (string, error) {
+	if err := v.wait(); err != nil {
+		return "", err
+	}
+	return v.ofs.ReadlinkIfPossible(name)
+}
+
+func (v readOnlyView) GetXattr(name, attr string) ([]byte, error) {
+	if err := v.wait(); err != nil {
+		return nil, err
+	}
+	return v.ofs.GetXattr(name, attr)
+}
+
+func (v readOnlyView) ListXattr(name string) ([]string, error) {
+	if err := v.wait(); err != nil {
+		return nil, err
+	}
+	return v.ofs.ListXattr(name)
+}
+
+func (v readOnlyView) SetXattr(name, attr string, value []byte) error {
+	return readOnlyErr("setxattr", name)
+}
+
+func (v readOnlyView) Create(name string) (afero.File, error) {
+	return nil, readOnlyErr("create", name)
+}
+
+func (v readOnlyView) Mkdir(name string, perm os.FileMode) error {
+	return readOnlyErr("mkdir", name)
+}
+
+func (v readOnlyView) MkdirAll(path string, perm os.FileMode) error {
+	return readOnlyErr("mkdir", path)
+}
+
+func (v readOnlyView) Remove(name string) error {
+	return readOnlyErr("remove", name)
+}
+
+func (v readOnlyView) RemoveAll(path string) error {
+	return readOnlyErr("removeall", path)
+}
+
+func (v readOnlyView) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrReadOnly}
+}
+
+func (v readOnlyView) SymlinkIfPossible(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrReadOnly}
+}
+
+func (v readOnlyView) Chmod(name string, mode os.FileMode) error {
+	return readOnlyErr("chmod", name)
+}
+
+func (v readOnlyView) Chown(name string, uid, gid int) error {
+	return readOnlyErr("chown", name)
+}
+
+func (v readOnlyView) Chtimes(name string, atime, mtime time.Time) error {
+	return readOnlyErr("chtimes", name)
+}
+
+// readOnlyFile is a file opened from a readOnlyView.
+type readOnlyFile struct {
+	afero.File
+	noList bool
+	rl     *RateLimiter
+}
+
+func (f readOnlyFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	return f.waitBytes(n, err)
+}
+
+func (f readOnlyFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	return f.waitBytes(n, err)
+}
+
+// waitBytes waits for the RateLimiter, if set, to allow the n bytes read.
+func (f readOnlyFile) waitBytes(n int, err error) (int, error) {
+	if n > 0 {
+		if werr := f.rl.WaitBytes(viewCtx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (f readOnlyFile) listErr() error {
+	return &fs.PathError{Op: "readdir", Path: f.Name(), Err: fs.ErrPermission}
+}
+
+func (f readOnlyFile) Readdir(n int) ([]os.FileInfo, error) {
+	if f.noList {
+		return nil, f.listErr()
+	}
+	return f.File.Readdir(n)
+}
+
+func (f readOnlyFile) Readdirnames(n int) ([]string, error) {
+	if f.noList {
+		return nil, f.listErr()
+	}
+	return f.File.Readdirnames(n)
+}
+
+func (f readOnlyFile) Write(p []byte) (int, error) {
+	return 0, readOnlyErr("write", f.Name())
+}
+
+func (f readOnlyFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, readOnlyErr("write", f.Name())
+}
+
+func (f readOnlyFile) WriteString(s string) (int, error) {
+	return 0, readOnlyErr("write", f.Name())
+}
+
+func (f readOnlyFile) Truncate(size int64) error {
+	return readOnlyErr("truncate", f.Name())
+}
+
+func (f readOnlyFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.noList {
+		return nil, f.listErr()
+	}
+	if rdf, ok := f.File.(fs.ReadDirFile); ok {
+		return rdf.ReadDir(n)
+	}
+	fis, err := f.Readdir(n)
+	dirEntries := make([]fs.DirEntry, len(fis))
+	for i, fi := range fis {
+		dirEntries[i] = dirEntry{fi}
+	}
+	return dirEntries, err
+}
@@ -0,0 +1,109 @@
+package overlayfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestReadOnlyView(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}, FirstWritable: true})
+	view := ofs.ReadOnlyView()
+
+	c.Assert(readFile(c, view, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+	c.Assert(readDirnames(c, view, "mydir"), qt.DeepEquals, readDirnames(c, ofs, "mydir"))
+	_, err := view.Stat("mydir/f2-2.txt")
+	c.Assert(err, qt.IsNil)
+
+	// Changes made through the overlay are visible in the view.
+	c.Assert(afero.WriteFile(ofs, "mydir/new.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, view, "mydir/new.txt"), qt.Equals, "new")
+
+	f, err := view.Open("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	_, errWrite := f.Write([]byte("a"))
+	_, errWriteAt := f.WriteAt([]byte("a"), 0)
+	_, errWriteString := f.WriteString("a")
+	errTruncate := f.Truncate(0)
+	c.Assert(f.Close(), qt.IsNil)
+	_, errOpen := view.OpenFile("mydir/f1-1.txt", os.O_RDWR, 0o666)
+	_, errCreate := view.Create("mydir/new2.txt")
+
+	for name, err := range map[string]error{
+		"write":       errWrite,
+		"writeat":     errWriteAt,
+		"writestring": errWriteString,
+		"truncate":    errTruncate,
+		"open":        errOpen,
+		"create":      errCreate,
+		"chmod":       view.Chmod("mydir/f1-1.txt", 0o666),
+		"chown":       view.Chown("mydir/f1-1.txt", 1, 1),
+		"chtimes":     view.Chtimes("mydir/f1-1.txt", time.Now(), time.Now()),
+		"mkdir":       view.Mkdir("mydir/newdir", 0o777),
+		"mkdirall":    view.MkdirAll("mydir/newdir/sub", 0o777),
+		"remove":      view.Remove("mydir/f1-1.txt"),
+		"removeall":   view.RemoveAll("mydir"),
+		"rename":      view.Rename("mydir/f1-1.txt", "mydir/f1-2.txt"),
+		"setxattr":    view.(XattrFs).SetXattr("mydir/f1-1.txt", "user.a", nil),
+	} {
+		c.Assert(err, qt.ErrorIs, ErrReadOnly, qt.Commentf(name))
+		c.Assert(err, qt.ErrorIs, fs.ErrPermission, qt.Commentf(name))
+	}
+	c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+
+	// The overlay can't be reached through the view.
+	_, ok := view.(*OverlayFs)
+	c.Assert(ok, qt.IsFalse)
+	_, ok = view.(io.Closer)
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestRestrictedView(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}, FirstWritable: true})
+	c.Assert(afero.WriteFile(ofs, "other/secret.txt", []byte("secret"), 0o666), qt.IsNil)
+
+	c.Run("Roots", func(c *qt.C) {
+		view := ofs.RestrictedView(ViewOptions{Roots: []string{"mydir"}})
+		c.Assert(readFile(c, view, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+		c.Assert(readDirnames(c, view, "/"), qt.DeepEquals, []string{"mydir"})
+		_, err := view.Open("other/secret.txt")
+		c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+		// Still read-only.
+		c.Assert(view.Remove("mydir/f1-1.txt"), qt.ErrorIs, ErrReadOnly)
+	})
+
+	c.Run("NoList", func(c *qt.C) {
+		view := ofs.RestrictedView(ViewOptions{NoList: true})
+		c.Assert(readFile(c, view, "other/secret.txt"), qt.Equals, "secret")
+		f, err := view.Open("mydir")
+		c.Assert(err, qt.IsNil)
+		defer f.Close()
+		_, err = f.Readdirnames(-1)
+		c.Assert(err, qt.ErrorIs, fs.ErrPermission)
+		_, err = f.(fs.ReadDirFile).ReadDir(-1)
+		c.Assert(err, qt.ErrorIs, fs.ErrPermission)
+		c.Assert(afero.Walk(view, "mydir", func(path string, info fs.FileInfo, err error) error {
+			return err
+		}), qt.ErrorIs, fs.ErrPermission)
+	})
+
+	c.Run("RateLimiter", func(c *qt.C) {
+		l := NewRateLimiter(100, 100)
+		view := ofs.RestrictedView(ViewOptions{RateLimiter: l})
+		c.Assert(readFile(c, view, "other/secret.txt"), qt.Equals, "secret")
+		l.mu.Lock()
+		ops, bytes := l.ops.tokens, l.bytes.tokens
+		l.mu.Unlock()
+		c.Assert(ops < 99.5, qt.IsTrue, qt.Commentf("%v", ops))
+		c.Assert(bytes < 95, qt.IsTrue, qt.Commentf("%v", bytes))
+	})
+}
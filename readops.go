@@ -1,7 +1,11 @@
 package overlayfs
 
 import (
+	"io/fs"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/spf13/afero"
 )
@@ -9,6 +13,7 @@ import (
 // Stat returns a FileInfo describing the named file, or an error, if any
 // happens.
 func (ofs *OverlayFs) Stat(name string) (os.FileInfo, error) {
+	defer ofs.foregroundOp()()
 	_, fi, _, err := ofs.stat(name, false)
 	return fi, err
 }
@@ -16,16 +21,125 @@ func (ofs *OverlayFs) Stat(name string) (os.FileInfo, error) {
 // LstatIfPossible will call Lstat if the filesystem iself is, or it delegates to, the os filesystem.
 // Else it will call Stat.
 func (ofs *OverlayFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
-	_, fi, ok, err := ofs.stat(name, false)
+	defer ofs.foregroundOp()()
+	_, fi, ok, err := ofs.stat(name, true)
 	return fi, ok, err
 }
 
+// ReadlinkIfPossible returns the target of the symbolic link name in the first filesystem
+// containing it, if that filesystem supports reading links, e.g. the os filesystem.
+func (ofs *OverlayFs) ReadlinkIfPossible(name string) (string, error) {
+	defer ofs.foregroundOp()()
+	fs, _, _, err := ofs.stat(name, true)
+	if err != nil {
+		return "", err
+	}
+	if lr, ok := fs.(afero.LinkReader); ok {
+		return lr.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
 // Open opens a file, returning it or an error, if any happens.
 // If name is a directory, a *Dir is returned representing all directories matching name.
 // Note that a *Dir must not be used after it's closed.
 func (ofs *OverlayFs) Open(name string) (afero.File, error) {
+	defer ofs.foregroundOp()()
+	return ofs.trackOpen(name)(ofs.open(name, ofs.dirEntryArena))
+}
+
+// ReadDir reads the merged directory name and returns its entries in the order
+// returned by the DirsMerger, without the caller having to open and close a *Dir.
+func (ofs *OverlayFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	defer ofs.foregroundOp()()
+	return ofs.readDir(name)
+}
+
+// OpenPreferred opens the most preferred variant of name found in the overlay,
+// returning the file and the name of the variant opened.
+// The variants are name with each of suffixes inserted before the extension, in order
+// of preference, followed by name itself, e.g. post.en.md and post.md for post.md and "en".
+// An empty suffix stands for name itself.
+// The result is the same as trying to open each variant in turn, but the filesystems
+// are probed in one pass, skipping variants less preferred than one already found.
+func (ofs *OverlayFs) OpenPreferred(name string, suffixes []string) (afero.File, string, error) {
+	defer ofs.foregroundOp()()
+	variants := preferredVariants(name, suffixes)
+	best := len(variants)
+	for _, fs := range ofs.fss {
+		for i := 0; i < best; i++ {
+			if _, _, _, err := ofs.statRecursive(fs, variants[i], false); err == nil || !os.IsNotExist(err) {
+				best = i
+				break
+			}
+		}
+		if best == 0 {
+			break
+		}
+	}
+	if best == len(variants) {
+		return nil, "", &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	variant := variants[best]
+	f, err := ofs.trackOpen(variant)(ofs.open(variant, ofs.dirEntryArena))
+	return f, variant, err
+}
+
+// FindUp looks for a file named filename in start and then its parent directories in the
+// merged view, and returns the path of the nearest one found, e.g. a config.toml.
+// If start is a file, the search starts in its directory.
+// Directories named filename are skipped.
+func (ofs *OverlayFs) FindUp(start, filename string) (string, error) {
+	defer ofs.foregroundOp()()
+	dir := filepath.Clean(start)
+	if _, fi, _, err := ofs.stat(dir, false); err != nil {
+		return "", err
+	} else if !fi.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	for {
+		name := filepath.Join(dir, filename)
+		if _, fi, _, err := ofs.stat(name, false); err == nil && !fi.IsDir() {
+			return name, nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", &os.PathError{Op: "findup", Path: filepath.Join(start, filename), Err: os.ErrNotExist}
+		}
+		dir = parent
+	}
+}
+
+// preferredVariants returns the variants of name to try in OpenPreferred.
+func preferredVariants(name string, suffixes []string) []string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	variants := make([]string, 0, len(suffixes)+1)
+	for i := 0; i <= len(suffixes); i++ {
+		var suffix string
+		if i < len(suffixes) {
+			suffix = strings.Trim(suffixes[i], ".")
+		}
+		variant := name
+		if suffix != "" {
+			variant = base + "." + suffix + ext
+		}
+		if !slices.Contains(variants, variant) {
+			variants = append(variants, variant)
+		}
+	}
+	return variants
+}
+
+// open opens name, allocating the directory entries of a merged Dir from its arena if useArena is set.
+func (ofs *OverlayFs) open(name string, useArena bool) (afero.File, error) {
 	fs, fi, _, err := ofs.stat(name, false)
 	if err != nil {
+		if ofs.onMiss != nil && os.IsNotExist(err) {
+			return ofs.openMiss(name)
+		}
 		return nil, err
 	}
 
@@ -33,28 +147,95 @@ func (ofs *OverlayFs) Open(name string) (afero.File, error) {
 		dir := getDir()
 		dir.name = name
 		dir.merge = ofs.mergeDirs
+		dir.useArena = useArena
+		dir.mergedInfo = ofs.mergedDirInfo
+		dir.mergedInfoSize = ofs.mergedDirInfoSize
+		dir.osSemantics = ofs.osDirSemantics
+		dir.remerge = ofs.remergeStaleDirs
+		dir.sorted = ofs.deterministicOrder
+		dir.strict = ofs.strict
+		dir.overlayID = ofs.id
+		dir.gen = ofs.caches.generation()
+		dir.keep = ofs.ignoreFilter(name)
+		dir.whiteouts = ofs.whiteouts
 		if err := ofs.collectDirs(name, func(fs afero.Fs) {
 			dir.fss = append(dir.fss, fs)
 		}); err != nil {
-			dir.Close()
+			releaseDir(dir)
 			return nil, err
 		}
 
 		if len(dir.fss) == 0 {
 			// They mave been deleted.
-			dir.Close()
+			releaseDir(dir)
 			return nil, os.ErrNotExist
 		}
 
-		if len(dir.fss) == 1 {
+		if len(dir.fss) == 1 && !dir.sorted && dir.keep == nil && !dir.whiteouts && ofs.layerSet == nil {
 			// Optimize for the common case.
 			d, err := dir.fss[0].Open(name)
-			dir.Close()
+			releaseDir(dir)
 			return d, err
 		}
 
+		if ofs.dirCapacityHint != nil {
+			dir.grow(ofs.dirCapacityHint(name))
+		}
+
 		return dir, nil
 	}
 
-	return fs.Open(name)
+	if ofs.conflicts != nil {
+		ofs.conflicts.seen(name, fi)
+	}
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if ofs.access != nil {
+		ofs.access.record(name)
+	}
+	if ofs.openStrategy != nil && ofs.openStrategy(name, fi.Size()) == OpenBuffered {
+		return ofs.bufferFile(f, fi)
+	}
+	if ofs.readAhead > 0 && fi.Size() > int64(ofs.readAhead) && (ofs.readAheadFs == nil || ofs.readAheadFs(fs)) {
+		f = newReadAheadFile(f, ofs.readAhead)
+	}
+	return f, nil
+}
+
+// foregroundOp marks a foreground operation as in flight in the RateLimiter, if set,
+// until the returned func is called. Foreground operations don't wait for the RateLimiter,
+// but the background operations using it wait for them to finish.
+func (ofs *OverlayFs) foregroundOp() func() {
+	return ofs.rateLimiter.beginForeground()
+}
+
+// openMiss opens name with Options.OnMiss, persisting it if Options.PersistMisses is set.
+func (ofs *OverlayFs) openMiss(name string) (afero.File, error) {
+	f, err := ofs.onMiss(name)
+	if err != nil || !ofs.persistMisses || !ofs.writable() {
+		return f, err
+	}
+	defer f.Close()
+	wfs, err := ofs.writeFsFor("open", name)
+	if err != nil {
+		return nil, err
+	}
+	defer ofs.caches.invalidate()
+	if err := wfs.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+		return nil, err
+	}
+	out, err := wfs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ofs.copyBuffer(out, f); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	return wfs.Open(name)
 }
@@ -0,0 +1,63 @@
+package overlayfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// TooLargeError is returned when reading a file larger than Options.MaxReadSize into memory.
+type TooLargeError struct {
+	Name string
+	Size int64 // The size of the file, or the number of bytes read if it grew while reading.
+	Max  int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("%s: %s: %d bytes (max %d)", e.Name, ErrTooLarge, e.Size, e.Max)
+}
+
+func (e *TooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// ReadFile reads the named file, like afero.ReadFile, failing with a *TooLargeError
+// for files larger than Options.MaxReadSize.
+func (ofs *OverlayFs) ReadFile(name string) ([]byte, error) {
+	f, err := ofs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	return ofs.readAll(f, fi)
+}
+
+// readAll reads f, described by fi, into memory, checking Options.MaxReadSize.
+func (ofs *OverlayFs) readAll(f afero.File, fi os.FileInfo) ([]byte, error) {
+	var r io.Reader = f
+	if ofs.maxReadSize > 0 {
+		if fi.Size() > ofs.maxReadSize {
+			return nil, &TooLargeError{Name: f.Name(), Size: fi.Size(), Max: ofs.maxReadSize}
+		}
+		// The file may have grown since it was stat'ed.
+		r = io.LimitReader(f, ofs.maxReadSize+1)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, fi.Size()+bytes.MinRead))
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	if ofs.maxReadSize > 0 && int64(buf.Len()) > ofs.maxReadSize {
+		return nil, &TooLargeError{Name: f.Name(), Size: int64(buf.Len()), Max: ofs.maxReadSize}
+	}
+	return buf.Bytes(), nil
+}
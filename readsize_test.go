@@ -0,0 +1,45 @@
+package overlayfs
+
+import (
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestMaxReadSize(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := fsFromTxtTar(`
+-- small.html --
+small
+-- large.html --
+0123456789
+`)
+	ofs := New(Options{Fss: []afero.Fs{fs1}, MaxReadSize: 5, OpenStrategy: BufferSmallFiles(100)})
+
+	b, err := ofs.ReadFile("small.html")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "small")
+
+	_, err = ofs.ReadFile("large.html")
+	c.Assert(err, qt.ErrorIs, ErrTooLarge)
+	var terr *TooLargeError
+	c.Assert(errors.As(err, &terr), qt.IsTrue)
+	c.Assert(terr.Size, qt.Equals, int64(10))
+	c.Assert(terr.Max, qt.Equals, int64(5))
+
+	_, err = ofs.Open("large.html")
+	c.Assert(err, qt.ErrorIs, ErrTooLarge)
+	_, err = ofs.IOFS().ReadFile("large.html")
+	c.Assert(err, qt.ErrorIs, ErrTooLarge)
+
+	// Streaming is not limited.
+	ofs = New(Options{Fss: []afero.Fs{fs1}, MaxReadSize: 5})
+	c.Assert(readFile(c, ofs, "large.html"), qt.Equals, "0123456789")
+
+	b, err = New(Options{Fss: []afero.Fs{fs1}}).ReadFile("large.html")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "0123456789")
+}
@@ -0,0 +1,258 @@
+package overlayfs
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs         = recoverFs{}
+	_ afero.Lstater    = recoverFs{}
+	_ afero.LinkReader = recoverFs{}
+	_ afero.Linker     = recoverFs{}
+	_ XattrFs          = recoverFs{}
+	_ afero.File       = recoverFile{}
+)
+
+// LayerPanicError is returned when Options.RecoverPanics is set and a layer panics.
+// It matches ErrLayerPanic and, if the panic value is an error, that error.
+type LayerPanicError struct {
+	// Layer is the filesystem that panicked.
+	Layer afero.Fs
+	Op    string
+	Path  string
+
+	// Value is the value passed to panic.
+	Value any
+
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *LayerPanicError) Error() string {
+	return fmt.Sprintf("%s %s: layer %q panicked: %v", e.Op, e.Path, e.Layer.Name(), e.Value)
+}
+
+func (e *LayerPanicError) Is(target error) bool {
+	return target == ErrLayerPanic
+}
+
+func (e *LayerPanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// recoverFs converts panics in fs and the files it returns into a *LayerPanicError.
+type recoverFs struct {
+	fs     afero.Fs
+	layer  afero.Fs
+	logger *slog.Logger
+}
+
+// recover must be deferred directly.
+func (r recoverFs) recover(op, name string, err *error) {
+	if v := recover(); v != nil {
+		perr := &LayerPanicError{Layer: r.layer, Op: op, Path: name, Value: v, Stack: debug.Stack()}
+		r.logger.Warn("recovered panic in layer", "layer", r.layer.Name(), "op", op, "path", name, "panic", v)
+		*err = perr
+	}
+}
+
+func (r recoverFs) file(f afero.File, name string) afero.File {
+	if f == nil {
+		return nil
+	}
+	return recoverFile{File: f, r: r, name: name}
+}
+
+func (r recoverFs) Name() string {
+	return r.fs.Name()
+}
+
+func (r recoverFs) Create(name string) (f afero.File, err error) {
+	defer r.recover("create", name, &err)
+	f, err = r.fs.Create(name)
+	return r.file(f, name), err
+}
+
+func (r recoverFs) Mkdir(name string, perm os.FileMode) (err error) {
+	defer r.recover("mkdir", name, &err)
+	return r.fs.Mkdir(name, perm)
+}
+
+func (r recoverFs) MkdirAll(path string, perm os.FileMode) (err error) {
+	defer r.recover("mkdir", path, &err)
+	return r.fs.MkdirAll(path, perm)
+}
+
+func (r recoverFs) Open(name string) (f afero.File, err error) {
+	defer r.recover("open", name, &err)
+	f, err = r.fs.Open(name)
+	return r.file(f, name), err
+}
+
+func (r recoverFs) OpenFile(name string, flag int, perm os.FileMode) (f afero.File, err error) {
+	defer r.recover("open", name, &err)
+	f, err = r.fs.OpenFile(name, flag, perm)
+	return r.file(f, name), err
+}
+
+func (r recoverFs) Remove(name string) (err error) {
+	defer r.recover("remove", name, &err)
+	return r.fs.Remove(name)
+}
+
+func (r recoverFs) RemoveAll(path string) (err error) {
+	defer r.recover("removeall", path, &err)
+	return r.fs.RemoveAll(path)
+}
+
+func (r recoverFs) Rename(oldname, newname string) (err error) {
+	defer r.recover("rename", oldname, &err)
+	return r.fs.Rename(oldname, newname)
+}
+
+func (r recoverFs) Stat(name string) (fi os.FileInfo, err error) {
+	defer r.recover("stat", name, &err)
+	return r.fs.Stat(name)
+}
+
+func (r recoverFs) LstatIfPossible(name string) (fi os.FileInfo, ok bool, err error) {
+	defer r.recover("lstat", name, &err)
+	if lfs, ok := r.fs.(afero.Lstater); ok {
+		return lfs.LstatIfPossible(name)
+	}
+	fi, err = r.fs.Stat(name)
+	return fi, false, err
+}
+
+func (r recoverFs) ReadlinkIfPossible(name string) (target string, err error) {
+	defer r.recover("readlink", name, &err)
+	if lr, ok := r.fs.(afero.LinkReader); ok {
+		return lr.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+func (r recoverFs) SymlinkIfPossible(oldname, newname string) (err error) {
+	defer r.recover("symlink", newname, &err)
+	if linker, ok := r.fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+func (r recoverFs) Chmod(name string, mode os.FileMode) (err error) {
+	defer r.recover("chmod", name, &err)
+	return r.fs.Chmod(name, mode)
+}
+
+func (r recoverFs) Chown(name string, uid, gid int) (err error) {
+	defer r.recover("chown", name, &err)
+	return r.fs.Chown(name, uid, gid)
+}
+
+func (r recoverFs) Chtimes(name string, atime, mtime time.Time) (err error) {
+	defer r.recover("chtimes", name, &err)
+	return r.fs.Chtimes(name, atime, mtime)
+}
+
+func (r recoverFs) GetXattr(name, attr string) (b []byte, err error) {
+	defer r.recover("getxattr", name, &err)
+	xfs, ok := asXattrFs(r.fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.GetXattr(name, attr)
+}
+
+func (r recoverFs) SetXattr(name, attr string, value []byte) (err error) {
+	defer r.recover("setxattr", name, &err)
+	xfs, ok := asXattrFs(r.fs)
+	if !ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.SetXattr(name, attr, value)
+}
+
+func (r recoverFs) ListXattr(name string) (attrs []string, err error) {
+	defer r.recover("listxattr", name, &err)
+	xfs, ok := asXattrFs(r.fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.ListXattr(name)
+}
+
+// recoverFile converts panics in a file returned by a recoverFs into a *LayerPanicError.
+type recoverFile struct {
+	afero.File
+	r    recoverFs
+	name string
+}
+
+func (f recoverFile) Close() (err error) {
+	defer f.r.recover("close", f.name, &err)
+	return f.File.Close()
+}
+
+func (f recoverFile) Read(p []byte) (n int, err error) {
+	defer f.r.recover("read", f.name, &err)
+	return f.File.Read(p)
+}
+
+func (f recoverFile) ReadAt(p []byte, off int64) (n int, err error) {
+	defer f.r.recover("read", f.name, &err)
+	return f.File.ReadAt(p, off)
+}
+
+func (f recoverFile) Seek(offset int64, whence int) (n int64, err error) {
+	defer f.r.recover("seek", f.name, &err)
+	return f.File.Seek(offset, whence)
+}
+
+func (f recoverFile) Write(p []byte) (n int, err error) {
+	defer f.r.recover("write", f.name, &err)
+	return f.File.Write(p)
+}
+
+func (f recoverFile) WriteAt(p []byte, off int64) (n int, err error) {
+	defer f.r.recover("write", f.name, &err)
+	return f.File.WriteAt(p, off)
+}
+
+func (f recoverFile) WriteString(s string) (n int, err error) {
+	defer f.r.recover("write", f.name, &err)
+	return f.File.WriteString(s)
+}
+
+func (f recoverFile) Readdir(count int) (fis []os.FileInfo, err error) {
+	defer f.r.recover("readdir", f.name, &err)
+	return f.File.Readdir(count)
+}
+
+func (f recoverFile) Readdirnames(n int) (names []string, err error) {
+	defer f.r.recover("readdir", f.name, &err)
+	return f.File.Readdirnames(n)
+}
+
+func (f recoverFile) Stat() (fi os.FileInfo, err error) {
+	defer f.r.recover("stat", f.name, &err)
+	return f.File.Stat()
+}
+
+func (f recoverFile) Sync() (err error) {
+	defer f.r.recover("sync", f.name, &err)
+	return f.File.Sync()
+}
+
+func (f recoverFile) Truncate(size int64) (err error) {
+	defer f.r.recover("truncate", f.name, &err)
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,88 @@
+package overlayfs
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	c := qt.New(t)
+
+	panicErr := errors.New("boom")
+	fs1 := &panicFs{Fs: basicFs("1", "1"), panics: map[string]any{"open": "open failed", "readdir": panicErr}}
+	fs2 := basicFs("2", "1")
+
+	var logBuf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logBuf, nil))
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}, RecoverPanics: true, Logger: logger})
+
+	_, err := ofs.Open("mydir/f1-1.txt")
+	c.Assert(err, qt.ErrorIs, ErrLayerPanic)
+	var perr *LayerPanicError
+	c.Assert(errors.As(err, &perr), qt.IsTrue)
+	c.Assert(perr.Layer, qt.Equals, afero.Fs(fs1))
+	c.Assert(perr.Op, qt.Equals, "open")
+	c.Assert(perr.Path, qt.Equals, "mydir/f1-1.txt")
+	c.Assert(perr.Value, qt.Equals, "open failed")
+	c.Assert(perr.Stack, qt.Not(qt.HasLen), 0)
+	c.Assert(err, qt.ErrorMatches, `open mydir/f1-1.txt: layer "MemMapFS" panicked: open failed`)
+	c.Assert(logBuf.String(), qt.Contains, "recovered panic in layer")
+
+	delete(fs1.panics, "open")
+	d, err := ofs.Open("mydir")
+	c.Assert(err, qt.IsNil)
+	_, err = d.Readdir(-1)
+	c.Assert(err, qt.ErrorIs, ErrLayerPanic)
+	c.Assert(err, qt.ErrorIs, panicErr)
+	c.Assert(errors.As(err, &perr), qt.IsTrue)
+	c.Assert(perr.Op, qt.Equals, "readdir")
+	c.Assert(d.Close(), qt.IsNil)
+
+	// Files from layers that don't panic work as before.
+	c.Assert(readFile(c, ofs, "mydir/f2-1.txt"), qt.Equals, "f2-1")
+
+	ofs = New(Options{Fss: []afero.Fs{fs1, fs2}})
+	c.Assert(func() { readDirnames(c, ofs, "mydir") }, qt.PanicMatches, "boom")
+}
+
+// panicFs panics with the value in panics for the ops open, stat and readdir.
+type panicFs struct {
+	afero.Fs
+	panics map[string]any
+}
+
+func (fs *panicFs) maybePanic(op string) {
+	if v, ok := fs.panics[op]; ok {
+		panic(v)
+	}
+}
+
+func (fs *panicFs) Open(name string) (afero.File, error) {
+	fs.maybePanic("open")
+	f, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &panicFile{File: f, fs: fs}, nil
+}
+
+func (fs *panicFs) Stat(name string) (os.FileInfo, error) {
+	fs.maybePanic("stat")
+	return fs.Fs.Stat(name)
+}
+
+type panicFile struct {
+	afero.File
+	fs *panicFs
+}
+
+func (f *panicFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.fs.maybePanic("readdir")
+	return f.File.Readdir(count)
+}
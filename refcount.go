@@ -0,0 +1,176 @@
+package overlayfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs         = (*RefCountedFs)(nil)
+	_ afero.Lstater    = (*RefCountedFs)(nil)
+	_ afero.LinkReader = (*RefCountedFs)(nil)
+	_ afero.Linker     = (*RefCountedFs)(nil)
+	_ XattrFs          = (*RefCountedFs)(nil)
+	_ io.Closer        = (*RefCountedFs)(nil)
+)
+
+// RefCountedFs wraps a closable filesystem shared between multiple overlays.
+// Every OverlayFs created with it by New holds a reference to it, and OverlayFs.Close
+// releases that reference. Shallow copies, e.g. from Append, borrow the filesystems of
+// the overlay they were copied from and hold no references.
+// The wrapped filesystem is closed when the last reference is released.
+type RefCountedFs struct {
+	afero.Fs
+
+	mu     sync.Mutex
+	refs   int
+	closed bool
+}
+
+// NewRefCountedFs creates a new RefCountedFs wrapping fs.
+// If fs doesn't implement io.Closer, closing it is a no-op.
+func NewRefCountedFs(fs afero.Fs) *RefCountedFs {
+	return &RefCountedFs{Fs: fs}
+}
+
+// Refs returns the number of references held.
+func (r *RefCountedFs) Refs() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refs
+}
+
+func (r *RefCountedFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if lfs, ok := r.Fs.(afero.Lstater); ok {
+		return lfs.LstatIfPossible(name)
+	}
+	fi, err := r.Fs.Stat(name)
+	return fi, false, err
+}
+
+func (r *RefCountedFs) ReadlinkIfPossible(name string) (string, error) {
+	if lr, ok := r.Fs.(afero.LinkReader); ok {
+		return lr.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+func (r *RefCountedFs) SymlinkIfPossible(oldname, newname string) error {
+	if linker, ok := r.Fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+func (r *RefCountedFs) GetXattr(name, attr string) ([]byte, error) {
+	xfs, ok := asXattrFs(r.Fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.GetXattr(name, attr)
+}
+
+func (r *RefCountedFs) SetXattr(name, attr string, value []byte) error {
+	xfs, ok := asXattrFs(r.Fs)
+	if !ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.SetXattr(name, attr, value)
+}
+
+func (r *RefCountedFs) ListXattr(name string) ([]string, error) {
+	xfs, ok := asXattrFs(r.Fs)
+	if !ok {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.ListXattr(name)
+}
+
+func (r *RefCountedFs) retain() {
+	r.mu.Lock()
+	r.refs++
+	r.mu.Unlock()
+}
+
+// Close releases a reference, and closes the wrapped filesystem if none remain.
+func (r *RefCountedFs) Close() error {
+	r.mu.Lock()
+	if r.refs > 0 {
+		r.refs--
+	}
+	if r.refs > 0 || r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.mu.Unlock()
+	if c, ok := r.Fs.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// retainLayers takes a reference to all RefCountedFs layers for an ofs owning its filesystems,
+// see Close.
+func (ofs *OverlayFs) retainLayers() {
+	ofs.closed = new(atomic.Bool)
+	for _, fs := range ofs.fss {
+		if r, ok := unwrapScoped(fs).(*RefCountedFs); ok {
+			r.retain()
+		}
+	}
+}
+
+// Close closes all filesystems in an overlay created by New implementing io.Closer.
+// A RefCountedFs is only closed when the last overlay referencing it is closed.
+// Shallow copies, e.g. from Append, Sub or WithDirsMerger, borrow the filesystems of the
+// overlay they were copied from, so Close on a copy has no effect; this includes filesystems
+// added to the copy, which are left to the caller to close.
+// Calling Close more than once has no effect.
+func (ofs *OverlayFs) Close() error {
+	if ofs.closed == nil || !ofs.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	var errs []error
+	for _, fs := range ofs.fss {
+		if c, ok := unwrapScoped(fs).(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// releaseRefs releases the references ofs holds to RefCountedFs layers without closing
+// the other layers, which are still used by the copy replacing ofs, see MutableFs.
+func (ofs *OverlayFs) releaseRefs() error {
+	if ofs.closed == nil || !ofs.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	var errs []error
+	for _, fs := range ofs.fss {
+		if r, ok := unwrapScoped(fs).(*RefCountedFs); ok {
+			if err := r.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func unwrapScoped(fs afero.Fs) afero.Fs {
+	if sfs, ok := fs.(subLayerFs); ok {
+		fs = sfs.fs
+	}
+	if sfs, ok := fs.(scopedFs); ok {
+		return sfs.fs
+	}
+	return fs
+}
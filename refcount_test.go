@@ -0,0 +1,57 @@
+package overlayfs
+
+import (
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+// closeCountFs counts its Close calls.
+type closeCountFs struct {
+	afero.Fs
+	closes int
+	err    error
+}
+
+func (fs *closeCountFs) Close() error {
+	fs.closes++
+	return fs.err
+}
+
+func TestRefCountedFs(t *testing.T) {
+	c := qt.New(t)
+
+	shared := &closeCountFs{Fs: basicFs("1", "1")}
+	rfs := NewRefCountedFs(shared)
+	own1, own2 := &closeCountFs{Fs: afero.NewMemMapFs()}, &closeCountFs{Fs: afero.NewMemMapFs()}
+
+	ofs1 := New(Options{Fss: []afero.Fs{own1, rfs}})
+	ofs2 := New(Options{Fss: []afero.Fs{own2, Layer{Fs: rfs, Only: []string{"mydir"}}}})
+	c.Assert(rfs.Refs(), qt.Equals, 2)
+
+	// Shallow copies borrow the filesystems.
+	ofs3 := ofs2.WithDirsMerger(defaultDirMerger)
+	ofs2.Append(afero.NewMemMapFs())
+	c.Assert(rfs.Refs(), qt.Equals, 2)
+	c.Assert(ofs3.Close(), qt.IsNil)
+	c.Assert(own2.closes, qt.Equals, 0)
+	c.Assert(readFile(c, ofs2, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+
+	c.Assert(ofs1.Close(), qt.IsNil)
+	c.Assert(ofs1.Close(), qt.IsNil)
+	c.Assert(own1.closes, qt.Equals, 1)
+	c.Assert(rfs.Refs(), qt.Equals, 1)
+	c.Assert(shared.closes, qt.Equals, 0)
+
+	shared.err = errors.New("close failed")
+	c.Assert(ofs2.Close(), qt.ErrorIs, shared.err)
+	c.Assert(shared.closes, qt.Equals, 1)
+	c.Assert(own2.closes, qt.Equals, 1)
+	c.Assert(rfs.Refs(), qt.Equals, 0)
+
+	// Closing the overlay that closed it already has no effect.
+	c.Assert(ofs2.Close(), qt.IsNil)
+	c.Assert(shared.closes, qt.Equals, 1)
+}
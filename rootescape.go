@@ -0,0 +1,112 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// maxSymlinks is the maximum number of symlinks followed when resolving a path.
+const maxSymlinks = 255
+
+func newRootCheckFs(bfs *afero.BasePathFs, logger *slog.Logger) afero.Fs {
+	return nameFs{fs: bfs, name: func(op, name string) (string, error) {
+		if err := checkRootEscape(bfs, name); err != nil {
+			if err == ErrRootEscape {
+				logger.Warn("overlayfs: rejected path escaping filesystem root", "op", op, "path", name)
+			}
+			return "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		return name, nil
+	}}
+}
+
+// checkRootEscape returns ErrRootEscape if name in bfs resolves to a location outside of bfs' base path.
+// Base paths that don't exist on the OS filesystem are not checked.
+func checkRootEscape(bfs *afero.BasePathFs, name string) error {
+	realPath, err := bfs.RealPath(name)
+	if err != nil {
+		return err
+	}
+	root, err := bfs.RealPath("")
+	if err != nil {
+		return err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		// Not backed by the OS filesystem.
+		return nil
+	}
+	resolved, err := resolveSymlinks(realPath, 0)
+	if err != nil {
+		return err
+	}
+	if !isWithin(root, resolved) {
+		return ErrRootEscape
+	}
+	return nil
+}
+
+// basePathErrPath returns a nameFs errPath func that trims the base path of bfs
+// from paths below it, e.g. /base/mydir/f.txt becomes /mydir/f.txt as returned by BasePathFile.Name.
+func basePathErrPath(bfs *afero.BasePathFs) func(string) string {
+	base, err := bfs.RealPath("")
+	if err != nil {
+		return func(path string) string { return path }
+	}
+	return func(path string) string {
+		rel, err := filepath.Rel(base, path)
+		if err != nil || !isWithin(base, path) {
+			return path
+		}
+		if rel == "." {
+			return string(filepath.Separator)
+		}
+		return string(filepath.Separator) + rel
+	}
+}
+
+// isWithin reports whether name is root or a path below root.
+func isWithin(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveSymlinks is like filepath.EvalSymlinks, but also resolves paths that
+// do not exist (yet), including dangling symlinks.
+func resolveSymlinks(name string, depth int) (string, error) {
+	if depth > maxSymlinks {
+		return "", errors.New("too many levels of symbolic links")
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if fi, err := os.Lstat(name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(name)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		return resolveSymlinks(target, depth+1)
+	}
+	dir := filepath.Dir(name)
+	if dir == name {
+		return name, nil
+	}
+	resolved, err = resolveSymlinks(dir, depth)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, filepath.Base(name)), nil
+}
@@ -0,0 +1,51 @@
+package overlayfs
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestRejectRootEscapes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks")
+	}
+	c := qt.New(t)
+	dir := t.TempDir()
+	layerDir := filepath.Join(dir, "layer")
+	c.Assert(os.MkdirAll(filepath.Join(layerDir, "sub"), 0o777), qt.IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "outside"), 0o777), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "outside", "secret.txt"), []byte("secret"), 0o666), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(layerDir, "sub", "public.txt"), []byte("public"), 0o666), qt.IsNil)
+	c.Assert(os.Symlink("../outside", filepath.Join(layerDir, "escape")), qt.IsNil)
+	c.Assert(os.Symlink(filepath.Join(dir, "outside", "new.txt"), filepath.Join(layerDir, "dangling")), qt.IsNil)
+	c.Assert(os.Symlink("sub", filepath.Join(layerDir, "inside")), qt.IsNil)
+
+	layer := afero.NewBasePathFs(afero.NewOsFs(), layerDir)
+	var logBuf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logBuf, nil))
+	ofs := New(Options{Fss: []afero.Fs{layer, basicFs("1", "1")}, FirstWritable: true, RejectRootEscapes: true, Logger: logger})
+
+	c.Assert(readFile(c, ofs, "inside/public.txt"), qt.Equals, "public")
+	_, err := ofs.Stat("escape/secret.txt")
+	c.Assert(err, qt.ErrorIs, ErrRootEscape)
+	_, err = ofs.Open("escape/secret.txt")
+	c.Assert(err, qt.ErrorIs, ErrRootEscape)
+	c.Assert(logBuf.String(), qt.Contains, `level=WARN msg="overlayfs: rejected path escaping filesystem root" op=stat path=escape/secret.txt`)
+	_, err = ofs.Create("dangling")
+	c.Assert(err, qt.ErrorIs, ErrRootEscape)
+	_, err = os.Stat(filepath.Join(dir, "outside", "new.txt"))
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	// Layers not backed by the OS filesystem are not affected.
+	c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+
+	ofs = New(Options{Fss: []afero.Fs{layer}})
+	c.Assert(readFile(c, ofs, "escape/secret.txt"), qt.Equals, "secret")
+}
@@ -0,0 +1,367 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var _ afero.File = (*sniffFile)(nil)
+
+// WriteRule routes writes matching all of its criteria to the filesystem with index Layer,
+// see Options.WriteRules.
+type WriteRule struct {
+	// Prefix, if set, matches names in or below this directory, e.g. "static/images".
+	Prefix string
+
+	// Glob, if set, matches names where the name or one of its parent directories
+	// matches this slash separated pattern, see path.Match, e.g. "assets/*/generated".
+	Glob string
+
+	// Exts, if set, matches names with one of these file extensions, e.g. ".png".
+	// They're matched case-insensitively, with or without the leading dot.
+	Exts []string
+
+	// ContentTypes, if set, matches files with one of these media types, e.g. "text/html",
+	// or a wildcard for all media types of a type, e.g. "image/*".
+	// The media type is looked up from the file extension. If that's unknown or generic, the media type
+	// of a new file is detected from its first 512 bytes, and the file is not created until
+	// those have been written or the file is closed.
+	ContentTypes []string
+
+	// Layer is the index of the filesystem to write to.
+	Layer int
+}
+
+// match reports whether name with media type ctype matches r.
+// If ctype is needed but empty, needSniff is true.
+func (r WriteRule) match(name, ctype string) (match, needSniff bool) {
+	if r.Prefix != "" {
+		prefix := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(r.Prefix, "/")))
+		slashed := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(name, "/")))
+		if slashed != prefix && !strings.HasPrefix(slashed, prefix+"/") {
+			return false, false
+		}
+	}
+	if r.Glob != "" && !matchGlobOrParent(r.Glob, name) {
+		return false, false
+	}
+	if len(r.Exts) > 0 {
+		ext := strings.TrimPrefix(filepath.Ext(name), ".")
+		var found bool
+		for _, e := range r.Exts {
+			if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, false
+		}
+	}
+	if len(r.ContentTypes) > 0 {
+		if ctype == "" {
+			return false, true
+		}
+		mediaType, _, _ := strings.Cut(ctype, ";")
+		mediaType = strings.TrimSpace(mediaType)
+		for _, ct := range r.ContentTypes {
+			if t, ok := strings.CutSuffix(ct, "/*"); ok {
+				if strings.HasPrefix(mediaType, t+"/") {
+					return true, false
+				}
+			} else if strings.EqualFold(ct, mediaType) {
+				return true, false
+			}
+		}
+		return false, false
+	}
+	return true, false
+}
+
+// matchGlobOrParent reports whether name or one of its parent directories matches pattern.
+func matchGlobOrParent(pattern, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	slashed := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(name, "/")))
+	for slashed != "." && slashed != "/" {
+		if ok, _ := path.Match(pattern, slashed); ok {
+			return true
+		}
+		slashed = path.Dir(slashed)
+	}
+	return false
+}
+
+// route returns the index of the filesystem to write name with media type ctype to.
+// If sniff is set and a rule before the first matching rule depends on an unknown media type,
+// needSniff is true. If sniff is not set, such rules don't match.
+func (ofs *OverlayFs) route(name, ctype string, sniff bool) (layer int, needSniff bool) {
+	for _, r := range ofs.writeRules {
+		match, needSniff := r.match(name, ctype)
+		if needSniff && sniff {
+			return 0, true
+		}
+		if match {
+			return r.Layer, false
+		}
+	}
+	return 0, false
+}
+
+// routeName is route with the media type looked up from the extension of name.
+// The generic application/octet-stream is treated as unknown.
+func (ofs *OverlayFs) routeName(name string, sniff bool) (layer int, needSniff bool) {
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if ctype == "application/octet-stream" {
+		ctype = ""
+	}
+	return ofs.route(name, ctype, sniff)
+}
+
+// writeTarget returns the index of the filesystem to apply the write operation op on name to,
+// selected by Options.WriteFs, or else by the WriteRules, see route.
+func (ofs *OverlayFs) writeTarget(op, name string, sniff bool) (layer int, needSniff bool, err error) {
+	if ofs.writeFs == nil {
+		layer, needSniff = ofs.routeName(name, sniff)
+		return layer, needSniff, nil
+	}
+	wfs, err := ofs.writeFs(name)
+	if err != nil {
+		return 0, false, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	for i, lfs := range ofs.fss {
+		if lfs == wfs || unwrapScoped(lfs) == wfs {
+			return i, false, nil
+		}
+	}
+	return 0, false, &fs.PathError{Op: op, Path: name, Err: ErrNoWritableFilesystem}
+}
+
+// writeFsFor returns the filesystem to apply the write operation op on name to.
+func (ofs *OverlayFs) writeFsFor(op, name string) (afero.Fs, error) {
+	layer, _, err := ofs.writeTarget(op, name, false)
+	if err != nil {
+		return nil, err
+	}
+	return ofs.writeLayer(op, name, layer)
+}
+
+// writable reports whether writes are allowed, see Options.FirstWritable and Options.WriteFs.
+func (ofs *OverlayFs) writable() bool {
+	return ofs.firstWritable || ofs.writeFs != nil
+}
+
+// writableLayers returns the indexes of the filesystems writes can be routed to.
+// With Options.WriteFs, that's any of them.
+func (ofs *OverlayFs) writableLayers() []int {
+	if !ofs.writable() || len(ofs.fss) == 0 {
+		return nil
+	}
+	if ofs.writeFs != nil {
+		layers := make([]int, len(ofs.fss))
+		for i := range layers {
+			layers[i] = i
+		}
+		return layers
+	}
+	layers := []int{0}
+	for _, r := range ofs.writeRules {
+		if r.Layer > 0 && r.Layer < len(ofs.fss) && !slices.Contains(layers, r.Layer) {
+			layers = append(layers, r.Layer)
+		}
+	}
+	return layers
+}
+
+// writeLayer returns the filesystem at index layer to apply the write operation op on name to.
+// It invalidates the caches, and so must the caller once the write is done, as a lookup
+// running concurrently with the write may cache the result from before it.
+// Files opened for writing invalidate the caches when closed, see openFiles.
+func (ofs *OverlayFs) writeLayer(op, name string, layer int) (afero.Fs, error) {
+	if err := ofs.checkWritable(op, name); err != nil {
+		return nil, err
+	}
+	if layer < 0 || layer >= len(ofs.fss) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: ErrNoWritableFilesystem}
+	}
+	ofs.caches.invalidate()
+	wfs := ofs.layer(ofs.fss[layer])
+	if ofs.quota != nil {
+		wfs = quotaFs{Fs: wfs, ofs: ofs, q: ofs.quota}
+	}
+	return wfs, nil
+}
+
+// openFileForWrite opens name for writing in the filesystem selected by Options.WriteFs or the WriteRules.
+func (ofs *OverlayFs) openFileForWrite(op, name string, flag int, perm os.FileMode) (afero.File, error) {
+	layer, needSniff, err := ofs.writeTarget(op, name, flag&os.O_CREATE != 0)
+	if err != nil {
+		return nil, err
+	}
+	if needSniff {
+		if err := ofs.checkWritable(op, name); err != nil {
+			return nil, err
+		}
+		return ofs.openFiles.track(&sniffFile{ofs: ofs, op: op, name: name, flag: flag, perm: perm}, nil)
+	}
+	wfs, err := ofs.writeLayer(op, name, layer)
+	if err != nil {
+		return nil, err
+	}
+	return ofs.openFiles.track(ofs.openInLayer(wfs, op, name, flag, perm))
+}
+
+// openInLayer opens name for writing in the writable filesystem wfs selected for it,
+// copying it up first and detecting conflicts if enabled, see Options.CopyUp and Options.DetectConflicts.
+func (ofs *OverlayFs) openInLayer(wfs afero.Fs, op, name string, flag int, perm os.FileMode) (afero.File, error) {
+	if ofs.copyUpEnabled && flag&os.O_TRUNC == 0 {
+		if err := ofs.copyUp(wfs, name); err != nil {
+			return nil, err
+		}
+	}
+	if ofs.conflicts != nil {
+		return ofs.openFileChecked(wfs, op, name, flag, perm)
+	}
+	if op == "create" {
+		return wfs.Create(name)
+	}
+	return wfs.OpenFile(name, flag, perm)
+}
+
+// sniffLen is the number of bytes used by http.DetectContentType.
+const sniffLen = 512
+
+// sniffFile buffers the first sniffLen bytes written to a new file to detect its
+// media type, and creates the file in the filesystem selected by the WriteRules
+// when the bytes have been written or the file is otherwise used.
+type sniffFile struct {
+	ofs  *OverlayFs
+	op   string
+	name string
+	flag int
+	perm os.FileMode
+
+	buf []byte
+	f   afero.File
+	err error
+}
+
+// open creates the file, if not already done.
+func (f *sniffFile) open() error {
+	if f.f != nil || f.err != nil {
+		return f.err
+	}
+	layer, _ := f.ofs.route(f.name, http.DetectContentType(f.buf), false)
+	wfs, err := f.ofs.writeLayer(f.op, f.name, layer)
+	if err == nil {
+		f.f, err = f.ofs.openInLayer(wfs, f.op, f.name, f.flag, f.perm)
+	}
+	if err == nil && len(f.buf) > 0 {
+		_, err = f.f.Write(f.buf)
+	}
+	f.buf = nil
+	f.err = err
+	return err
+}
+
+func (f *sniffFile) Name() string {
+	return f.name
+}
+
+func (f *sniffFile) Write(p []byte) (int, error) {
+	if f.f == nil && f.err == nil {
+		f.buf = append(f.buf, p...)
+		if len(f.buf) < sniffLen {
+			return len(p), nil
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.f.Write(p)
+}
+
+func (f *sniffFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *sniffFile) Close() error {
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.f.Close()
+}
+
+func (f *sniffFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.f.Read(p)
+}
+
+func (f *sniffFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.f.ReadAt(p, off)
+}
+
+func (f *sniffFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.f.Seek(offset, whence)
+}
+
+func (f *sniffFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.f.WriteAt(p, off)
+}
+
+func (f *sniffFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f.f.Readdir(count)
+}
+
+func (f *sniffFile) Readdirnames(n int) ([]string, error) {
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f.f.Readdirnames(n)
+}
+
+func (f *sniffFile) Stat() (os.FileInfo, error) {
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f.f.Stat()
+}
+
+func (f *sniffFile) Sync() error {
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.f.Sync()
+}
+
+func (f *sniffFile) Truncate(size int64) error {
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.f.Truncate(size)
+}
@@ -0,0 +1,198 @@
+package overlayfs
+
+import (
+	"bytes"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestWriteRules(t *testing.T) {
+	c := qt.New(t)
+
+	disk, blobs, static := afero.NewMemMapFs(), afero.NewMemMapFs(), afero.NewMemMapFs()
+	ofs := New(Options{
+		Fss:           []afero.Fs{disk, blobs, static},
+		FirstWritable: true,
+		WriteRules: []WriteRule{
+			{Prefix: "static", Layer: 2},
+			{Exts: []string{"PNG", ".jpg"}, Layer: 1},
+			{ContentTypes: []string{"image/*"}, Layer: 1},
+		},
+	})
+
+	exists := func(fs afero.Fs, name string) bool {
+		ok, err := afero.Exists(fs, name)
+		c.Assert(err, qt.IsNil)
+		return ok
+	}
+
+	c.Run("Prefix", func(c *qt.C) {
+		c.Assert(afero.WriteFile(ofs, "static/css/main.css", []byte("body{}"), 0o666), qt.IsNil)
+		c.Assert(exists(static, "static/css/main.css"), qt.IsTrue)
+		c.Assert(exists(disk, "static/css/main.css"), qt.IsFalse)
+		c.Assert(afero.WriteFile(ofs, "staticfoo.txt", []byte("foo"), 0o666), qt.IsNil)
+		c.Assert(exists(disk, "staticfoo.txt"), qt.IsTrue)
+	})
+
+	c.Run("Ext", func(c *qt.C) {
+		c.Assert(afero.WriteFile(ofs, "a.png", []byte("png"), 0o666), qt.IsNil)
+		c.Assert(exists(blobs, "a.png"), qt.IsTrue)
+		c.Assert(readFile(c, ofs, "a.png"), qt.Equals, "png")
+		c.Assert(ofs.Remove("a.png"), qt.IsNil)
+		c.Assert(exists(blobs, "a.png"), qt.IsFalse)
+	})
+
+	c.Run("ContentType by extension", func(c *qt.C) {
+		c.Assert(afero.WriteFile(ofs, "b.gif", []byte("gif"), 0o666), qt.IsNil)
+		c.Assert(exists(blobs, "b.gif"), qt.IsTrue)
+		c.Assert(afero.WriteFile(ofs, "index.html", []byte("<html></html>"), 0o666), qt.IsNil)
+		c.Assert(exists(disk, "index.html"), qt.IsTrue)
+	})
+
+	c.Run("ContentType sniffed", func(c *qt.C) {
+		png := "\x89PNG\r\n\x1a\n" + "rest of image"
+		c.Assert(afero.WriteFile(ofs, "img.bin", []byte(png), 0o666), qt.IsNil)
+		c.Assert(exists(blobs, "img.bin"), qt.IsTrue)
+		c.Assert(readFile(c, ofs, "img.bin"), qt.Equals, png)
+
+		c.Assert(afero.WriteFile(ofs, "text.bin", []byte("just text"), 0o666), qt.IsNil)
+		c.Assert(exists(disk, "text.bin"), qt.IsTrue)
+
+		f, err := ofs.Create("empty.bin")
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.Close(), qt.IsNil)
+		c.Assert(exists(disk, "empty.bin"), qt.IsTrue)
+	})
+
+	c.Run("Rename", func(c *qt.C) {
+		c.Assert(afero.WriteFile(ofs, "c.jpg", []byte("jpg"), 0o666), qt.IsNil)
+		c.Assert(ofs.Rename("c.jpg", "d.jpg"), qt.IsNil)
+		c.Assert(exists(blobs, "d.jpg"), qt.IsTrue)
+		// Renamed across filesystems by copying.
+		c.Assert(ofs.Rename("d.jpg", "d.txt"), qt.IsNil)
+		c.Assert(exists(blobs, "d.jpg"), qt.IsFalse)
+		c.Assert(exists(disk, "d.txt"), qt.IsTrue)
+		c.Assert(readFile(c, ofs, "d.txt"), qt.Equals, "jpg")
+		c.Assert(ofs.Rename("nope.jpg", "d.txt"), qt.ErrorIs, fs.ErrNotExist)
+	})
+
+	c.Run("Read-only", func(c *qt.C) {
+		ro := New(Options{Fss: []afero.Fs{disk, blobs}, WriteRules: []WriteRule{{Exts: []string{".png"}, Layer: 1}}})
+		_, err := ro.Create("e.png")
+		c.Assert(err, qt.ErrorIs, ErrReadOnly)
+	})
+
+	c.Run("Invalid layer", func(c *qt.C) {
+		bad := New(Options{Fss: []afero.Fs{disk}, FirstWritable: true, WriteRules: []WriteRule{{Exts: []string{".png"}, Layer: 1}}})
+		_, err := bad.Create("e.png")
+		c.Assert(err, qt.ErrorIs, ErrNoWritableFilesystem)
+	})
+}
+
+func TestWriteRulesGlob(t *testing.T) {
+	c := qt.New(t)
+
+	content, generated := afero.NewMemMapFs(), afero.NewMemMapFs()
+	ofs := New(Options{
+		Fss:           []afero.Fs{content, generated},
+		FirstWritable: true,
+		WriteRules:    []WriteRule{{Glob: "assets/*/gen", Layer: 1}},
+	})
+
+	c.Assert(ofs.MkdirAll(filepath.FromSlash("assets/css/gen/min"), 0o777), qt.IsNil)
+	c.Assert(afero.WriteFile(ofs, filepath.FromSlash("assets/css/gen/min/main.css"), []byte("body{}"), 0o666), qt.IsNil)
+	c.Assert(afero.WriteFile(ofs, filepath.FromSlash("assets/css/main.css"), []byte("src"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, generated, "assets/css/gen/min/main.css"), qt.Equals, "body{}")
+	c.Assert(readFile(c, content, "assets/css/main.css"), qt.Equals, "src")
+	_, err := content.Stat(filepath.FromSlash("assets/css/gen"))
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+
+	c.Assert(ofs.Rename(filepath.FromSlash("assets/css/gen/min/main.css"), filepath.FromSlash("assets/css/gen/main.css")), qt.IsNil)
+	c.Assert(readFile(c, generated, "assets/css/gen/main.css"), qt.Equals, "body{}")
+	c.Assert(ofs.RemoveAll(filepath.FromSlash("assets/css/gen")), qt.IsNil)
+	_, err = generated.Stat(filepath.FromSlash("assets/css/gen"))
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+
+	sub, err := ofs.Sub("assets/js")
+	c.Assert(err, qt.IsNil)
+	c.Assert(afero.WriteFile(sub, filepath.FromSlash("gen/app.js"), []byte("js"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, generated, "assets/js/gen/app.js"), qt.Equals, "js")
+
+	for _, test := range []struct {
+		pattern, dir, rebased string
+		ok                    bool
+	}{
+		{"assets/*/gen", "assets/js", "gen", true},
+		{"assets/*/gen", "assets/js/gen/min", "", true},
+		{"assets/*", "assets/js", "", true},
+		{"assets/*/gen", "content", "", false},
+	} {
+		rebased, ok := rebaseGlob(test.pattern, test.dir)
+		c.Assert(ok, qt.Equals, test.ok, qt.Commentf(test.dir))
+		c.Assert(rebased, qt.Equals, test.rebased)
+	}
+}
+
+func TestRenameStrategyLogged(t *testing.T) {
+	c := qt.New(t)
+
+	var buf bytes.Buffer
+	disk, blobs := afero.NewMemMapFs(), afero.NewMemMapFs()
+	ofs := New(Options{
+		Fss:           []afero.Fs{disk, blobs},
+		FirstWritable: true,
+		WriteRules:    []WriteRule{{Exts: []string{".jpg"}, Layer: 1}},
+		Logger:        slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	c.Assert(afero.WriteFile(ofs, "a.txt", []byte("a"), 0o666), qt.IsNil)
+	c.Assert(ofs.Rename("a.txt", "b.txt"), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, "strategy=native")
+	buf.Reset()
+	c.Assert(ofs.Rename("b.txt", "b.jpg"), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, "strategy=copy")
+	c.Assert(readFile(c, blobs, "b.jpg"), qt.Equals, "a")
+}
+
+func TestWriteFs(t *testing.T) {
+	c := qt.New(t)
+
+	cache, content, theme := afero.NewMemMapFs(), afero.NewMemMapFs(), basicFs("1", "1")
+	ofs := New(Options{
+		Fss: []afero.Fs{cache, Layer{Fs: content, Label: "content"}, theme},
+		WriteFs: func(name string) (afero.Fs, error) {
+			switch {
+			case strings.HasPrefix(filepath.ToSlash(name), "cache/"):
+				return cache, nil
+			case strings.HasPrefix(filepath.ToSlash(name), "content/"):
+				return content, nil
+			case strings.HasPrefix(filepath.ToSlash(name), "other/"):
+				return afero.NewMemMapFs(), nil
+			}
+			return nil, ErrReadOnly
+		},
+	})
+
+	c.Assert(afero.WriteFile(ofs, filepath.FromSlash("cache/a.txt"), []byte("a"), 0o666), qt.IsNil)
+	c.Assert(afero.WriteFile(ofs, filepath.FromSlash("content/b.txt"), []byte("b"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, cache, "cache/a.txt"), qt.Equals, "a")
+	c.Assert(readFile(c, content, "content/b.txt"), qt.Equals, "b")
+	c.Assert(readFile(c, ofs, "content/b.txt"), qt.Equals, "b")
+
+	c.Assert(afero.WriteFile(ofs, "mydir/c.txt", nil, 0o666), qt.ErrorIs, ErrReadOnly)
+	c.Assert(afero.WriteFile(ofs, filepath.FromSlash("other/c.txt"), nil, 0o666), qt.ErrorIs, ErrNoWritableFilesystem)
+
+	// Renamed across filesystems by copying.
+	c.Assert(ofs.Rename(filepath.FromSlash("cache/a.txt"), filepath.FromSlash("content/a.txt")), qt.IsNil)
+	c.Assert(readFile(c, content, "content/a.txt"), qt.Equals, "a")
+
+	sub, err := ofs.Sub("content")
+	c.Assert(err, qt.IsNil)
+	c.Assert(afero.WriteFile(sub, "d.txt", []byte("d"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, content, "content/d.txt"), qt.Equals, "d")
+}
@@ -0,0 +1,134 @@
+package overlayfs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs   = scopedFs{}
+	_ afero.File = scopedDir{}
+)
+
+// scopedFs limits a filesystem to the trees below a set of roots, see Layer.Only.
+// The directories leading up to the roots are also visible, but list only entries leading to a root.
+type scopedFs struct {
+	nameFs
+	roots scopeRoots
+}
+
+func newScopedFs(fs afero.Fs, only []string) scopedFs {
+	roots := make(scopeRoots, len(only))
+	for i, root := range only {
+		roots[i] = cleanScopePath(root)
+	}
+	return scopedFs{
+		nameFs: nameFs{fs: fs, name: func(op, name string) (string, error) {
+			if !roots.visible(cleanScopePath(name)) {
+				return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+			}
+			return name, nil
+		}},
+		roots: roots,
+	}
+}
+
+// cleanScopePath returns name cleaned, slash separated and relative to the filesystem root.
+func cleanScopePath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// scopeRoots are the cleaned roots of a scopedFs.
+type scopeRoots []string
+
+// inside reports whether name is a root or below one.
+func (r scopeRoots) inside(name string) bool {
+	for _, root := range r {
+		if root == "." || name == root || strings.HasPrefix(name, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether name is inside a root or a directory leading up to one.
+func (r scopeRoots) visible(name string) bool {
+	if name == "." || r.inside(name) {
+		return true
+	}
+	for _, root := range r {
+		if strings.HasPrefix(root, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s scopedFs) Open(name string) (afero.File, error) {
+	f, err := s.nameFs.Open(name)
+	return s.filter(f, name), err
+}
+
+func (s scopedFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := s.nameFs.OpenFile(name, flag, perm)
+	return s.filter(f, name), err
+}
+
+// filter wraps f to filter its directory entries if name is outside of the roots.
+func (s scopedFs) filter(f afero.File, name string) afero.File {
+	if f == nil {
+		return nil
+	}
+	name = cleanScopePath(name)
+	if s.roots.inside(name) {
+		return f
+	}
+	return scopedDir{File: f, visible: func(entry string) bool {
+		return s.roots.visible(path.Join(name, entry))
+	}}
+}
+
+// scopedDir is a directory leading up to the roots of a scopedFs.
+type scopedDir struct {
+	afero.File
+	visible func(entry string) bool
+}
+
+func (d scopedDir) Readdir(n int) ([]os.FileInfo, error) {
+	for {
+		fis, err := d.File.Readdir(n)
+		kept := fis[:0]
+		for _, fi := range fis {
+			if d.visible(fi.Name()) {
+				kept = append(kept, fi)
+			}
+		}
+		// Don't return an empty slice and a nil error for n > 0.
+		if len(kept) > 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
+
+func (d scopedDir) Readdirnames(n int) ([]string, error) {
+	for {
+		names, err := d.File.Readdirnames(n)
+		kept := names[:0]
+		for _, name := range names {
+			if d.visible(name) {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) > 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
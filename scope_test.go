@@ -0,0 +1,106 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"sort"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestLayerOnly(t *testing.T) {
+	c := qt.New(t)
+	module := fsFromTxtTar(`
+-- README.md --
+module readme
+-- layouts/index.html --
+module index
+-- layouts/partials/p.html --
+module partial
+-- static/css/main.css --
+main.css
+-- content/post.md --
+module post
+-- assets/deep/js/main.js --
+main.js
+-- assets/deep/other.txt --
+other
+`)
+	project := fsFromTxtTar(`
+-- README.md --
+project readme
+-- content/about.md --
+about
+`)
+	ofs := New(Options{Fss: []afero.Fs{
+		project,
+		Layer{Fs: module, Only: []string{"layouts/", "static", "/assets/deep/js"}},
+	}})
+
+	c.Assert(readFile(c, ofs, "README.md"), qt.Equals, "project readme")
+	c.Assert(readFile(c, ofs, "layouts/index.html"), qt.Equals, "module index")
+	c.Assert(readFile(c, ofs, "layouts/partials/p.html"), qt.Equals, "module partial")
+	c.Assert(readFile(c, ofs, "static/css/main.css"), qt.Equals, "main.css")
+	c.Assert(readFile(c, ofs, "assets/deep/js/main.js"), qt.Equals, "main.js")
+
+	for _, name := range []string{"content/post.md", "assets/deep/other.txt", "layouts/../content/post.md"} {
+		_, err := ofs.Stat(name)
+		c.Assert(err, qt.ErrorIs, fs.ErrNotExist, qt.Commentf(name))
+	}
+
+	names := readDirnames(c, ofs, "")
+	sort.Strings(names)
+	c.Assert(names, qt.DeepEquals, []string{"README.md", "assets", "content", "layouts", "static"})
+	c.Assert(readDirnames(c, ofs, "content"), qt.DeepEquals, []string{"about.md"})
+	c.Assert(readDirnames(c, ofs, "assets/deep"), qt.DeepEquals, []string{"js"})
+
+	var paths []string
+	c.Assert(ofs.WalkDir("assets", func(path string, d fs.DirEntry, err error) error {
+		c.Assert(err, qt.IsNil)
+		paths = append(paths, path)
+		return nil
+	}), qt.IsNil)
+	c.Assert(paths, qt.DeepEquals, []string{"assets", "assets/deep", "assets/deep/js", "assets/deep/js/main.js"})
+
+	// Writes outside of the roots are rejected.
+	wofs := New(Options{Fss: []afero.Fs{Layer{Fs: afero.NewMemMapFs(), Only: []string{"static"}}}, FirstWritable: true})
+	c.Assert(afero.WriteFile(wofs, "static/f.txt", []byte("f"), 0o666), qt.IsNil)
+	c.Assert(afero.WriteFile(wofs, "content/f.txt", []byte("f"), 0o666), qt.ErrorIs, fs.ErrNotExist)
+
+	// Nested overlays don't leak the hidden files.
+	outer := New(Options{Fss: []afero.Fs{afero.NewMemMapFs(), ofs}})
+	_, err := outer.Stat("content/post.md")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+
+	// Combined with WindowsPaths.
+	ofs = New(Options{Fss: []afero.Fs{Layer{Fs: module, Only: []string{"layouts"}}}, WindowsPaths: true})
+	c.Assert(readFile(c, ofs, `Layouts\Index.html`), qt.Equals, "module index")
+	_, err = ofs.Stat(`Content\post.md`)
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+}
+
+func TestScopeRoots(t *testing.T) {
+	c := qt.New(t)
+	r := scopeRoots{"a/b", "c"}
+	for _, test := range []struct {
+		name            string
+		inside, visible bool
+	}{
+		{".", false, true},
+		{"a", false, true},
+		{"a/b", true, true},
+		{"a/b/c.txt", true, true},
+		{"a/bc", false, false},
+		{"a/c", false, false},
+		{"c", true, true},
+		{"c/d/e", true, true},
+		{"d", false, false},
+	} {
+		c.Assert(r.inside(test.name), qt.Equals, test.inside, qt.Commentf(test.name))
+		c.Assert(r.visible(test.name), qt.Equals, test.visible, qt.Commentf(test.name))
+	}
+	c.Assert(cleanScopePath("/a//b/"), qt.Equals, "a/b")
+	c.Assert(cleanScopePath(""), qt.Equals, ".")
+	c.Assert(cleanScopePath("../a"), qt.Equals, "a")
+}
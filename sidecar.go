@@ -0,0 +1,69 @@
+package overlayfs
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// SidecarSpec describes the sidecar files to look for, see Sidecars.
+type SidecarSpec struct {
+	// Suffixes are appended to the file name, e.g. ".meta" for foo.jpg.meta.
+	Suffixes []string
+
+	// Ancestors are file names looked up in the file's directory and then its parent
+	// directories, nearest first, e.g. "LICENSE".
+	Ancestors []string
+}
+
+// Sidecar is a sidecar file found by Sidecars.
+type Sidecar struct {
+	// Kind is the entry in SidecarSpec.Suffixes or SidecarSpec.Ancestors found.
+	Kind string
+
+	// Path is the path of the sidecar file.
+	Path string
+
+	fs afero.Fs
+}
+
+// Open opens the sidecar file in the filesystem it was found in.
+// Opening Path in the overlay may give a file with the same path in a higher filesystem.
+func (s Sidecar) Open() (afero.File, error) {
+	return s.fs.Open(s.Path)
+}
+
+// Sidecars returns the sidecar files of name described by spec, looked up in the
+// filesystem name is found in, and not in the overlay, so an asset and its metadata
+// or license always come from the same filesystem.
+// The sidecars are returned in the order of spec, suffixes first; those not found are left out.
+func (ofs *OverlayFs) Sidecars(name string, spec SidecarSpec) ([]Sidecar, error) {
+	defer ofs.foregroundOp()()
+	lfs, _, _, err := ofs.stat(name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var sidecars []Sidecar
+	isFile := func(name string) bool {
+		fi, err := lfs.Stat(name)
+		return err == nil && fi.Mode().IsRegular()
+	}
+	for _, suffix := range spec.Suffixes {
+		if p := name + suffix; isFile(p) {
+			sidecars = append(sidecars, Sidecar{Kind: suffix, Path: p, fs: lfs})
+		}
+	}
+	for _, ancestor := range spec.Ancestors {
+		for dir := filepath.Dir(filepath.Clean(name)); ; dir = filepath.Dir(dir) {
+			if p := filepath.Join(dir, ancestor); isFile(p) {
+				sidecars = append(sidecars, Sidecar{Kind: ancestor, Path: p, fs: lfs})
+				break
+			}
+			if parent := filepath.Dir(dir); parent == dir {
+				break
+			}
+		}
+	}
+	return sidecars, nil
+}
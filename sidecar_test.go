@@ -0,0 +1,67 @@
+package overlayfs
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestSidecars(t *testing.T) {
+	c := qt.New(t)
+
+	project := fsFromTxtTar(`
+-- assets/images/logo.png --
+project logo
+-- assets/images/logo.png.meta --
+project meta
+-- assets/images/photo.jpg.meta --
+project photo meta
+-- LICENSE --
+project license
+`)
+	theme := fsFromTxtTar(`
+-- assets/images/photo.jpg --
+theme photo
+-- assets/images/photo.jpg.meta --
+theme photo meta
+-- assets/LICENSE --
+theme license
+`)
+	ofs := New(Options{Fss: []afero.Fs{project, theme}})
+	spec := SidecarSpec{Suffixes: []string{".meta", ".xmp"}, Ancestors: []string{"LICENSE", "NOTICE"}}
+
+	read := func(sidecars []Sidecar) map[string]string {
+		c.Helper()
+		m := make(map[string]string)
+		for _, s := range sidecars {
+			f, err := s.Open()
+			c.Assert(err, qt.IsNil)
+			b, err := io.ReadAll(f)
+			c.Assert(err, qt.IsNil)
+			f.Close()
+			m[s.Kind+" "+filepath.ToSlash(s.Path)] = string(b)
+		}
+		return m
+	}
+
+	sidecars, err := ofs.Sidecars("assets/images/logo.png", spec)
+	c.Assert(err, qt.IsNil)
+	c.Assert(read(sidecars), qt.DeepEquals, map[string]string{
+		".meta assets/images/logo.png.meta": "project meta",
+		"LICENSE LICENSE":                   "project license",
+	})
+
+	// The photo comes from the theme, and so do its sidecars.
+	sidecars, err = ofs.Sidecars("assets/images/photo.jpg", spec)
+	c.Assert(err, qt.IsNil)
+	c.Assert(read(sidecars), qt.DeepEquals, map[string]string{
+		".meta assets/images/photo.jpg.meta": "theme photo meta",
+		"LICENSE assets/LICENSE":             "theme license",
+	})
+
+	_, err = ofs.Sidecars("assets/images/missing.png", spec)
+	c.Assert(err, qt.IsNotNil)
+}
@@ -0,0 +1,62 @@
+package overlayfs
+
+import (
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// lookupGroup collapses concurrent identical lookups into one, see Options.DedupLookups.
+// It's shared by the shallow copies of an OverlayFs, which are told apart in the key.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[lookupKey]*lookupCall
+}
+
+type lookupKey struct {
+	ofs             *OverlayFs
+	name            string
+	lstatIfPossible bool
+}
+
+type lookupCall struct {
+	wg   sync.WaitGroup
+	dups int
+
+	fs  afero.Fs
+	fi  os.FileInfo
+	ok  bool
+	err error
+}
+
+func newLookupGroup() *lookupGroup {
+	return &lookupGroup{calls: make(map[lookupKey]*lookupCall)}
+}
+
+// do runs fn for key, or waits for and returns the result of a call to fn for key already in flight.
+func (g *lookupGroup) do(key lookupKey, fn func() (afero.Fs, os.FileInfo, bool, error)) (afero.Fs, os.FileInfo, bool, error) {
+	g.mu.Lock()
+	if c, found := g.calls[key]; found {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.fs, c.fi, c.ok, c.err
+	}
+	c := &lookupCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	// Returned to the waiters if fn panics.
+	c.err = &os.PathError{Op: "stat", Path: key.name, Err: ErrLayerPanic}
+	c.fs, c.fi, c.ok, c.err = fn()
+	return c.fs, c.fi, c.ok, c.err
+}
@@ -0,0 +1,61 @@
+package overlayfs
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestDedupLookups(t *testing.T) {
+	c := qt.New(t)
+
+	bfs := newBlockingFs(basicFs("1", "1"))
+	ofs := New(Options{Fss: []afero.Fs{basicFs("2", "1"), bfs}, DedupLookups: true})
+	bfs.armed.Store(true)
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				fi, err := ofs.Stat("mydir/f1-1.txt")
+				c.Check(err, qt.IsNil)
+				c.Check(fi.Name(), qt.Equals, "f1-1.txt")
+			} else {
+				c.Check(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+			}
+		}(i)
+	}
+	<-bfs.started
+
+	// Wait for the others to join the lookup in flight.
+	dups := func() int {
+		ofs.lookups.mu.Lock()
+		defer ofs.lookups.mu.Unlock()
+		for _, call := range ofs.lookups.calls {
+			return call.dups
+		}
+		return 0
+	}
+	for dups() < n-1 {
+		runtime.Gosched()
+	}
+
+	close(bfs.unblock)
+	wg.Wait()
+	c.Assert(len(bfs.started), qt.Equals, 0)
+	c.Assert(ofs.lookups.calls, qt.HasLen, 0)
+
+	// Shallow copies with other filesystems don't share lookups.
+	bfs.armed.Store(false)
+	ofs2 := ofs.Append(basicFs("3", "1"))
+	_, err := ofs2.Stat("mydir/f1-3.txt")
+	c.Assert(err, qt.IsNil)
+	_, err = ofs.Stat("mydir/f1-3.txt")
+	c.Assert(err, qt.IsNotNil)
+}
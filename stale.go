@@ -0,0 +1,54 @@
+package overlayfs
+
+import (
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// layerSet is a set of filesystems that can change while files opened from it are in use.
+// Each change bumps its generation.
+type layerSet interface {
+	// generation returns the current generation.
+	generation() uint64
+
+	// acquire returns an overlay with the current filesystems and the generation,
+	// which is kept until released.
+	acquire() (*OverlayFs, uint64)
+
+	// release releases an overlay returned from acquire.
+	release(ofs *OverlayFs) error
+}
+
+// checkStale checks whether the filesystems of the layerSet d was opened from have changed,
+// merging the directory again from the current ones if d.remerge is set.
+func (d *Dir) checkStale() error {
+	if d.layerSet == nil || d.layerSet.generation() == d.layerGen {
+		return nil
+	}
+	if !d.remerge {
+		return &os.PathError{Op: "readdir", Path: d.name, Err: ErrStaleHandle}
+	}
+	ofs, gen := d.layerSet.acquire()
+	var fss []afero.Fs
+	err := ofs.collectDirs(d.name, func(fs afero.Fs) {
+		fss = append(fss, fs)
+	})
+	if err == nil && len(fss) == 0 {
+		err = &os.PathError{Op: "readdir", Path: d.name, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		d.layerSet.release(ofs)
+		return err
+	}
+	d.layerSet.release(d.snapshot)
+	d.snapshot, d.layerGen = ofs, gen
+	d.fss = append(d.fss[:0], fss...)
+	d.fis = d.fis[:0]
+	for i := range d.arena {
+		d.arena[i] = dirEntry{}
+	}
+	d.arena = d.arena[:0]
+	d.loaded = false
+	return nil
+}
@@ -0,0 +1,116 @@
+package overlayfs
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+// testLayerSet is a layerSet whose filesystems are replaced with set.
+type testLayerSet struct {
+	mu   sync.Mutex
+	cur  *OverlayFs
+	gen  uint64
+	refs map[*OverlayFs]int
+}
+
+func newTestLayerSet(ofs *OverlayFs) *testLayerSet {
+	s := &testLayerSet{refs: make(map[*OverlayFs]int)}
+	s.set(ofs)
+	return s
+}
+
+func (s *testLayerSet) set(ofs *OverlayFs) {
+	ofs.layerSet = s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur = ofs
+	s.gen++
+}
+
+func (s *testLayerSet) generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen
+}
+
+func (s *testLayerSet) acquire() (*OverlayFs, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs[s.cur]++
+	return s.cur, s.gen
+}
+
+func (s *testLayerSet) release(ofs *OverlayFs) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs[ofs]--
+	if s.refs[ofs] <= 0 {
+		delete(s.refs, ofs)
+	}
+	return nil
+}
+
+func (s *testLayerSet) openDir(c *qt.C, name string) *Dir {
+	ofs, gen := s.acquire()
+	f, err := ofs.Open(name)
+	c.Assert(err, qt.IsNil)
+	d := f.(*Dir)
+	d.layerSet, d.snapshot, d.layerGen = s, ofs, gen
+	return d
+}
+
+func TestStaleDir(t *testing.T) {
+	c := qt.New(t)
+
+	s := newTestLayerSet(New(Options{Fss: []afero.Fs{basicFs("1", "1")}}))
+	d := s.openDir(c, "mydir")
+	names, err := d.Readdirnames(1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f1-1.txt"})
+
+	s.set(s.cur.Append(basicFs("2", "2")))
+	_, err = d.Readdirnames(-1)
+	c.Assert(err, qt.ErrorIs, ErrStaleHandle)
+	_, err = d.ReadDir(-1)
+	c.Assert(err, qt.ErrorIs, ErrStaleHandle)
+	_, err = d.Readdir(-1)
+	c.Assert(err, qt.ErrorIs, ErrStaleHandle)
+
+	c.Assert(d.Close(), qt.IsNil)
+	c.Assert(s.refs, qt.HasLen, 0)
+}
+
+func TestRemergeStaleDirs(t *testing.T) {
+	c := qt.New(t)
+
+	ofs1 := New(Options{Fss: []afero.Fs{basicFs("1", "1")}, RemergeStaleDirs: true})
+	ofs2 := ofs1.Append(basicFs("2", "2"))
+	s := newTestLayerSet(ofs2)
+	d := s.openDir(c, "mydir")
+	names, err := d.Readdirnames(1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f1-1.txt"})
+
+	s.set(ofs1)
+	names, err = d.Readdirnames(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f2-1.txt"})
+	// The Dir moved on to the current filesystems.
+	c.Assert(s.refs, qt.DeepEquals, map[*OverlayFs]int{ofs1: 1})
+
+	s.set(ofs1.Append(basicFs("3", "3")))
+	_, err = d.Readdirnames(-1)
+	c.Assert(err, qt.Equals, io.EOF)
+	c.Assert(d.Close(), qt.IsNil)
+
+	d = s.openDir(c, "mydir")
+	defer d.Close()
+	s.set(s.cur.Append(basicFs("4", "4")))
+	names, err = d.Readdirnames(-1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"f1-1.txt", "f2-1.txt", "f1-3.txt", "f2-3.txt", "f1-4.txt", "f2-4.txt"})
+}
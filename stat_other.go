@@ -0,0 +1,16 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package overlayfs
+
+import "io/fs"
+
+// fileOwner returns the owner and group of fi, if available.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// fileID returns the inode number of fi, if available.
+func fileID(fi fs.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,239 @@
+package overlayfs
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CachePolicy decides which entries a cache keeps when it's full.
+type CachePolicy int
+
+const (
+	// CachePolicyLRU evicts the least recently used entry to make room for a new one.
+	CachePolicyLRU CachePolicy = iota
+
+	// CachePolicyTinyLFU only admits a new entry if it's been looked up more often
+	// recently than the least recently used entry, which it then evicts.
+	// This keeps frequently used entries cached when scans of rarely used names
+	// would otherwise flush them out.
+	CachePolicyTinyLFU
+)
+
+func (p CachePolicy) String() string {
+	switch p {
+	case CachePolicyLRU:
+		return "LRU"
+	case CachePolicyTinyLFU:
+		return "TinyLFU"
+	}
+	return fmt.Sprintf("CachePolicy(%d)", int(p))
+}
+
+// StatCacheOptions configures the stat cache, see Options.StatCache.
+type StatCacheOptions struct {
+	// MaxEntries is the maximum number of names cached. The cache is enabled if > 0.
+	MaxEntries int
+
+	// Policy is the admission and eviction policy. The default is CachePolicyLRU.
+	Policy CachePolicy
+
+	// TTL, if > 0, is how long a lookup is cached. The default is until invalidated.
+	TTL time.Duration
+
+	// PrefixTTL overrides TTL for the names in or below a directory, e.g. "static"
+	// cached until invalidated (0) and "content" for a second.
+	// The longest matching prefix wins. A negative TTL disables caching for the prefix.
+	PrefixTTL map[string]time.Duration
+
+	// StaleWhileRevalidate, if > 0, is how long after its TTL an entry is still
+	// returned while it's looked up again in the background, keeping the latency
+	// flat for slow filesystems. Only one revalidation per name runs at a time.
+	StaleWhileRevalidate time.Duration
+}
+
+// CacheStats are the counters of a cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// Entries is the number of entries currently cached.
+	Entries int
+}
+
+// StatCacheStats returns the counters of the stat cache, see Options.StatCache.
+// The cache is shared by the shallow copies of an OverlayFs.
+// Evictions and Entries are only counted by the built-in cache, not an Options.Cache.
+func (ofs *OverlayFs) StatCacheStats() CacheStats {
+	c := ofs.caches
+	if c.stat == nil {
+		return CacheStats{}
+	}
+	var stats CacheStats
+	if sc, ok := c.stat.(*statCache); ok {
+		stats = sc.stats()
+	}
+	stats.Hits = c.hits.Load()
+	stats.Misses = c.misses.Load()
+	return stats
+}
+
+// statCache is the built-in stat cache, bounded to MaxEntries.
+type statCache struct {
+	maxEntries int
+	sketch     *frequencySketch // Set for CachePolicyTinyLFU.
+
+	mu        sync.Mutex
+	ll        *list.List
+	items     map[string]*list.Element
+	evictions uint64
+}
+
+type statCacheItem struct {
+	key   string
+	value any
+}
+
+func newStatCache(opts StatCacheOptions) *statCache {
+	c := &statCache{
+		maxEntries: opts.MaxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+	if opts.Policy == CachePolicyTinyLFU {
+		c.sketch = newFrequencySketch(opts.MaxEntries)
+	}
+	return c
+}
+
+func newStatTTLs(opts StatCacheOptions) statTTLs {
+	t := statTTLs{ttl: opts.TTL}
+	for prefix, ttl := range opts.PrefixTTL {
+		t.prefixes = append(t.prefixes, prefixTTL{prefix: cleanScopePath(prefix), ttl: ttl})
+	}
+	sort.Slice(t.prefixes, func(i, j int) bool { return len(t.prefixes[i].prefix) > len(t.prefixes[j].prefix) })
+	return t
+}
+
+func (c *statCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sketch != nil {
+		c.sketch.add(key)
+	}
+	el, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*statCacheItem).value, true
+}
+
+func (c *statCache) Set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.items[key]; found {
+		el.Value.(*statCacheItem).value = value
+		c.ll.MoveToFront(el)
+		return
+	}
+	if c.ll.Len() >= c.maxEntries {
+		victim := c.ll.Back()
+		if c.sketch != nil && c.sketch.estimate(key) <= c.sketch.estimate(victim.Value.(*statCacheItem).key) {
+			return
+		}
+		c.remove(victim)
+		c.evictions++
+	}
+	c.items[key] = c.ll.PushFront(&statCacheItem{key: key, value: value})
+}
+
+func (c *statCache) Delete(key string) {
+	c.mu.Lock()
+	if el, found := c.items[key]; found {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+}
+
+func (c *statCache) Clear() {
+	c.mu.Lock()
+	c.ll.Init()
+	clear(c.items)
+	c.mu.Unlock()
+}
+
+func (c *statCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*statCacheItem).key)
+}
+
+func (c *statCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Evictions: c.evictions, Entries: c.ll.Len()}
+}
+
+// frequencySketch is a count-min sketch estimating how often names have been looked up recently.
+// The counters are halved periodically so old lookups fade out.
+type frequencySketch struct {
+	seed     maphash.Seed
+	counters [4][]uint8
+	mask     uint64
+	adds     int
+	resetAt  int
+}
+
+func newFrequencySketch(maxEntries int) *frequencySketch {
+	width := 64
+	for width < 4*maxEntries {
+		width *= 2
+	}
+	s := &frequencySketch{seed: maphash.MakeSeed(), mask: uint64(width - 1), resetAt: 10 * maxEntries}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// index returns the counter index for row i of hash h.
+// Each row remixes h (splitmix64) so names rarely collide in all rows.
+func (s *frequencySketch) index(h uint64, i int) uint64 {
+	h += uint64(i+1) * 0x9e3779b97f4a7c15
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	return (h ^ h>>31) & s.mask
+}
+
+func (s *frequencySketch) add(name string) {
+	h := maphash.String(s.seed, name)
+	for i := range s.counters {
+		if idx := s.index(h, i); s.counters[i][idx] < 15 {
+			s.counters[i][idx]++
+		}
+	}
+	s.adds++
+	if s.adds >= s.resetAt {
+		for i := range s.counters {
+			for j := range s.counters[i] {
+				s.counters[i][j] /= 2
+			}
+		}
+		s.adds /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(name string) uint8 {
+	h := maphash.String(s.seed, name)
+	min := uint8(15)
+	for i := range s.counters {
+		if v := s.counters[i][s.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
@@ -0,0 +1,241 @@
+package overlayfs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestStatCache(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := basicFs("1", "1")
+	ofs := New(Options{Fss: []afero.Fs{fs1, basicFs("2", "2")}, FirstWritable: true, StatCache: StatCacheOptions{MaxEntries: 10}})
+
+	stat := func(name string) error {
+		_, err := ofs.Stat(name)
+		return err
+	}
+
+	c.Assert(stat("mydir/f1-1.txt"), qt.IsNil)
+	c.Assert(stat("mydir/f1-1.txt"), qt.IsNil)
+	c.Assert(stat("mydir/missing.txt"), qt.Not(qt.IsNil))
+	c.Assert(stat("mydir/missing.txt"), qt.Not(qt.IsNil))
+	c.Assert(ofs.StatCacheStats(), qt.DeepEquals, CacheStats{Hits: 2, Misses: 2, Entries: 2})
+
+	// Changes made directly to the filesystems aren't seen until invalidated.
+	c.Assert(afero.WriteFile(fs1, "mydir/missing.txt", []byte("x"), 0o666), qt.IsNil)
+	c.Assert(stat("mydir/missing.txt"), qt.Not(qt.IsNil))
+	ofs.InvalidateCaches()
+	c.Assert(stat("mydir/missing.txt"), qt.IsNil)
+
+	// Writes through the overlay invalidate the cache.
+	c.Assert(ofs.Remove("mydir/missing.txt"), qt.IsNil)
+	c.Assert(stat("mydir/missing.txt"), qt.Not(qt.IsNil))
+	c.Assert(ofs.StatCacheStats().Entries, qt.Equals, 1)
+
+	c.Assert(New(Options{}).StatCacheStats(), qt.Equals, CacheStats{})
+}
+
+func TestStatCacheConcurrentWrites(t *testing.T) {
+	c := qt.New(t)
+
+	hfs := &beforeWriteFs{Fs: afero.NewMemMapFs()}
+	ofs := New(Options{Fss: []afero.Fs{hfs}, FirstWritable: true, StatCache: StatCacheOptions{MaxEntries: 10}})
+
+	// A lookup during a write must not be cached past the write.
+	hfs.before = func() {
+		_, err := ofs.Stat("mydir")
+		c.Check(err, qt.ErrorIs, os.ErrNotExist)
+	}
+	c.Assert(ofs.Mkdir("mydir", 0o777), qt.IsNil)
+	_, err := ofs.Stat("mydir")
+	c.Assert(err, qt.IsNil)
+
+	hfs.before = func() {
+		_, err := ofs.Stat("mydir")
+		c.Check(err, qt.IsNil)
+	}
+	c.Assert(ofs.Remove("mydir"), qt.IsNil)
+	_, err = ofs.Stat("mydir")
+	c.Assert(err, qt.ErrorIs, os.ErrNotExist)
+
+	// Concurrent lookups.
+	hfs.before = nil
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					ofs.Stat("mydir")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		c.Assert(ofs.Mkdir("mydir", 0o777), qt.IsNil)
+		_, err := ofs.Stat("mydir")
+		c.Assert(err, qt.IsNil)
+		c.Assert(ofs.Remove("mydir"), qt.IsNil)
+		_, err = ofs.Stat("mydir")
+		c.Assert(err, qt.ErrorIs, os.ErrNotExist)
+	}
+	close(done)
+	wg.Wait()
+}
+
+// beforeWriteFs calls before, if set, before each Mkdir and Remove.
+type beforeWriteFs struct {
+	afero.Fs
+	before func()
+}
+
+func (bfs *beforeWriteFs) Mkdir(name string, perm os.FileMode) error {
+	if bfs.before != nil {
+		bfs.before()
+	}
+	return bfs.Fs.Mkdir(name, perm)
+}
+
+func (bfs *beforeWriteFs) Remove(name string) error {
+	if bfs.before != nil {
+		bfs.before()
+	}
+	return bfs.Fs.Remove(name)
+}
+
+func TestStatCacheTTL(t *testing.T) {
+	c := qt.New(t)
+
+	now := time.Now()
+	cs := newCaches(nil, StatCacheOptions{
+		MaxEntries: 10,
+		TTL:        time.Minute,
+		PrefixTTL: map[string]time.Duration{
+			"static":         0,
+			"content":        time.Second,
+			"content/drafts": -1,
+		},
+	})
+	cs.now = func() time.Time { return now }
+
+	ofs := New(Options{})
+	cached := func(name string) bool {
+		found := true
+		cs.statLookup(lookupKey{ofs: ofs, name: name}, func(lookupKey) (afero.Fs, os.FileInfo, bool, error) {
+			found = false
+			return nil, nil, false, nil
+		})
+		return found
+	}
+
+	for _, name := range []string{"static/a.css", "content/a.md", "content/drafts/b.md", "layouts/c.html"} {
+		c.Assert(cached(name), qt.IsFalse, qt.Commentf(name))
+	}
+	now = now.Add(500 * time.Millisecond)
+	c.Assert(cached("static/a.css"), qt.IsTrue)
+	c.Assert(cached("content/a.md"), qt.IsTrue)
+	c.Assert(cached("content/drafts/b.md"), qt.IsFalse)
+	c.Assert(cached("layouts/c.html"), qt.IsTrue)
+
+	now = now.Add(2 * time.Second)
+	c.Assert(cached("static/a.css"), qt.IsTrue)
+	c.Assert(cached("content/a.md"), qt.IsFalse)
+	c.Assert(cached("layouts/c.html"), qt.IsTrue)
+
+	now = now.Add(time.Hour)
+	c.Assert(cached("static/a.css"), qt.IsTrue)
+	c.Assert(cached("layouts/c.html"), qt.IsFalse)
+}
+
+func TestStatCacheStaleWhileRevalidate(t *testing.T) {
+	c := qt.New(t)
+
+	now := time.Now()
+	cs := newCaches(nil, StatCacheOptions{MaxEntries: 10, TTL: time.Second, StaleWhileRevalidate: time.Second})
+	cs.now = func() time.Time { return now }
+
+	ofs := New(Options{})
+	var lookups int
+	stat := func() bool {
+		_, _, ok, _ := cs.statLookup(lookupKey{ofs: ofs, name: "a.txt"}, func(lookupKey) (afero.Fs, os.FileInfo, bool, error) {
+			lookups++
+			return nil, nil, lookups > 1, nil
+		})
+		cs.revalidateWg.Wait()
+		return ok
+	}
+
+	c.Assert(stat(), qt.IsFalse)
+	c.Assert(lookups, qt.Equals, 1)
+
+	// Stale: the old result is returned and revalidated in the background.
+	now = now.Add(1500 * time.Millisecond)
+	c.Assert(stat(), qt.IsFalse)
+	c.Assert(lookups, qt.Equals, 2)
+	c.Assert(stat(), qt.IsTrue)
+	c.Assert(lookups, qt.Equals, 2)
+
+	// Past the stale window: looked up again before returning.
+	now = now.Add(3 * time.Second)
+	lookups = 0
+	c.Assert(stat(), qt.IsFalse)
+	c.Assert(lookups, qt.Equals, 1)
+	c.Assert(cs.misses.Load(), qt.Equals, uint64(2))
+}
+
+func TestStatCachePolicy(t *testing.T) {
+	c := qt.New(t)
+
+	for _, policy := range []CachePolicy{CachePolicyLRU, CachePolicyTinyLFU} {
+		c.Run(policy.String(), func(c *qt.C) {
+			sc := newStatCache(StatCacheOptions{MaxEntries: 3, Policy: policy})
+			lookup := func(name string) bool {
+				_, found := sc.Get(name)
+				if !found {
+					sc.Set(name, true)
+				}
+				return found
+			}
+
+			// Make the first three names hot.
+			for i := 0; i < 5; i++ {
+				for _, name := range []string{"a", "b", "c"} {
+					lookup(name)
+				}
+			}
+			// Scan a range of names used once.
+			for i := 0; i < 10; i++ {
+				lookup(fmt.Sprintf("scan%d", i))
+			}
+
+			var hot int
+			for _, name := range []string{"a", "b", "c"} {
+				if lookup(name) {
+					hot++
+				}
+			}
+			stats := sc.stats()
+			c.Assert(stats.Entries, qt.Equals, 3)
+			if policy == CachePolicyLRU {
+				c.Assert(hot, qt.Equals, 0)
+				c.Assert(stats.Evictions > 0, qt.IsTrue)
+			} else {
+				c.Assert(hot, qt.Equals, 3)
+				c.Assert(stats.Evictions, qt.Equals, uint64(0))
+			}
+		})
+	}
+	c.Assert(CachePolicy(42).String(), qt.Equals, "CachePolicy(42)")
+}
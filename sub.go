@@ -0,0 +1,135 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var _ afero.Fs = subLayerFs{}
+
+// Sub returns an overlay of the filesystems in ofs rooted at dir, like fs.Sub,
+// with the same options. Filesystems without the directory dir are left out,
+// except the writable ones. WriteRules are rebased to dir; rules with a Prefix or Glob outside of it are dropped.
+// Options.WriteFs is called with the names in ofs.
+// Errors report the names relative to dir seen by the caller, not the names in ofs.
+func (ofs *OverlayFs) Sub(dir string) (*OverlayFs, error) {
+	slashed := strings.Trim(filepath.ToSlash(dir), "/")
+	if slashed == "" {
+		slashed = "."
+	}
+	if !fs.ValidPath(slashed) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	if slashed == "." {
+		return ofs, nil
+	}
+
+	sub := *ofs
+	sub.fss, sub.layers = nil, nil
+	writable := ofs.writableLayers()
+	indexes := make(map[int]int)
+	for i, lfs := range ofs.fss {
+		if !slices.Contains(writable, i) {
+			if fi, err := ofs.layer(lfs).Stat(filepath.FromSlash(slashed)); err != nil || !fi.IsDir() {
+				continue
+			}
+		}
+		indexes[i] = len(sub.fss)
+		sub.fss = append(sub.fss, newSubLayerFs(lfs, slashed))
+		sub.layers = append(sub.layers, ofs.layers[i])
+	}
+
+	if ofs.writeFs != nil {
+		sub.writeFs = func(name string) (afero.Fs, error) {
+			return ofs.writeFs(filepath.Join(filepath.FromSlash(slashed), filepath.FromSlash(cleanScopePath(name))))
+		}
+	}
+
+	sub.writeRules = nil
+	for _, r := range ofs.writeRules {
+		j, found := indexes[r.Layer]
+		if !found {
+			continue
+		}
+		if r.Prefix != "" {
+			prefix := cleanScopePath(r.Prefix)
+			switch {
+			case prefix == "." || slashed == prefix || strings.HasPrefix(slashed, prefix+"/"):
+				r.Prefix = ""
+			case strings.HasPrefix(prefix, slashed+"/"):
+				r.Prefix = prefix[len(slashed)+1:]
+			default:
+				continue
+			}
+		}
+		if r.Glob != "" {
+			glob, ok := rebaseGlob(r.Glob, slashed)
+			if !ok {
+				continue
+			}
+			r.Glob = glob
+		}
+		r.Layer = j
+		sub.writeRules = append(sub.writeRules, r)
+	}
+
+	sub.newInstance()
+	return &sub, nil
+}
+
+// rebaseGlob returns the WriteRule.Glob pattern for the names below the slash separated dir.
+// An empty pattern matches all of them. If ok is false, the pattern matches none of them.
+func rebaseGlob(pattern, dir string) (rebased string, ok bool) {
+	gsegs := strings.Split(strings.Trim(pattern, "/"), "/")
+	dsegs := strings.Split(dir, "/")
+	for i, seg := range dsegs {
+		if i == len(gsegs) {
+			return "", true
+		}
+		if match, _ := path.Match(gsegs[i], seg); !match {
+			return "", false
+		}
+	}
+	return strings.Join(gsegs[len(dsegs):], "/"), true
+}
+
+// subLayerFs is a filesystem rooted at dir, see OverlayFs.Sub.
+type subLayerFs struct {
+	nameFs
+	dir string // Slash separated.
+}
+
+func newSubLayerFs(fs afero.Fs, dir string) subLayerFs {
+	if sfs, ok := fs.(subLayerFs); ok {
+		fs, dir = sfs.fs, path.Join(sfs.dir, dir)
+	}
+	return subLayerFs{nameFs: subNameFs(fs, dir), dir: dir}
+}
+
+// subNameFs returns fs with the names joined with dir, and the paths in errors relative to it.
+func subNameFs(fs afero.Fs, dir string) nameFs {
+	dir = filepath.FromSlash(dir)
+	return nameFs{
+		fs: fs,
+		name: func(op, name string) (string, error) {
+			// Names can't escape dir.
+			return filepath.Join(dir, filepath.FromSlash(cleanScopePath(name))), nil
+		},
+		errPath: func(path string) string {
+			// The paths may have a leading separator, e.g. from a BasePathFs layer.
+			rel := strings.TrimLeft(path, `/\`)
+			if rel == dir {
+				return "."
+			}
+			if rel, found := strings.CutPrefix(rel, dir+string(filepath.Separator)); found {
+				return rel
+			}
+			return path
+		},
+	}
+}
@@ -0,0 +1,113 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestSub(t *testing.T) {
+	c := qt.New(t)
+
+	mem := afero.NewMemMapFs()
+	c.Assert(afero.WriteFile(mem, "/srv/site/mydir/nested/a.txt", []byte("a"), 0o666), qt.IsNil)
+	mounted := afero.NewBasePathFs(mem, "/srv/site")
+	ofs := New(Options{Fss: []afero.Fs{mounted, basicFs("1", "1")}, FirstWritable: true})
+
+	sub, err := ofs.Sub("mydir")
+	c.Assert(err, qt.IsNil)
+	c.Assert(readFile(c, sub, "f1-1.txt"), qt.Equals, "f1-1")
+	c.Assert(readDirnames(c, sub, "/"), qt.DeepEquals, readDirnames(c, ofs, "mydir"))
+
+	nested, err := sub.Sub("nested")
+	c.Assert(err, qt.IsNil)
+	c.Assert(readFile(c, nested, "a.txt"), qt.Equals, "a")
+	// Names can't escape the sub directory.
+	c.Assert(readFile(c, nested, "../../a.txt"), qt.Equals, "a")
+
+	pathOf := func(err error) string {
+		c.Helper()
+		var perr *fs.PathError
+		c.Assert(errors.As(err, &perr), qt.IsTrue, qt.Commentf("%v", err))
+		c.Assert(strings.Contains(err.Error(), "srv"), qt.IsFalse, qt.Commentf("%v", err))
+		return perr.Path
+	}
+
+	// Errors from the mounted layer report the caller's names.
+	c.Assert(pathOf(ofs.Remove("mydir/missing.txt")), qt.Equals, filepath.FromSlash("/mydir/missing.txt"))
+	c.Assert(pathOf(sub.Remove("missing.txt")), qt.Equals, "missing.txt")
+	c.Assert(pathOf(nested.Remove("missing.txt")), qt.Equals, "missing.txt")
+	c.Assert(pathOf(nested.Chmod("sub/missing.txt", 0o666)), qt.Equals, filepath.FromSlash("sub/missing.txt"))
+	_, err = nested.Stat("missing.txt")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(strings.Contains(err.Error(), "mydir"), qt.IsFalse, qt.Commentf("%v", err))
+
+	c.Assert(afero.WriteFile(nested, "b.txt", []byte("b"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, mem, "/srv/site/mydir/nested/b.txt"), qt.Equals, "b")
+
+	same, err := ofs.Sub(".")
+	c.Assert(err, qt.IsNil)
+	c.Assert(same, qt.Equals, ofs)
+	_, err = ofs.Sub("../mydir")
+	c.Assert(err, qt.ErrorIs, fs.ErrInvalid)
+}
+
+func TestSubLayers(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := fsFromTxtTar(`
+-- other/a.txt --
+1
+`)
+	fs2 := fsFromTxtTar(`
+-- content/a.txt --
+2
+-- content/posts/b.txt --
+2
+`)
+	fs3 := fsFromTxtTar(`
+-- content/c.txt --
+3
+-- layouts/l.html --
+3
+`)
+	ofs := New(Options{
+		Fss:           []afero.Fs{fs1, fs2, fs3},
+		FirstWritable: true,
+		WriteRules: []WriteRule{
+			{Prefix: "content/posts", Layer: 1},
+			{Prefix: "layouts", Layer: 2},
+			{Exts: []string{".png"}, Layer: 2},
+		},
+	})
+
+	sub, err := ofs.Sub("content")
+	c.Assert(err, qt.IsNil)
+	// The writable filesystem is kept.
+	c.Assert(sub.NumFilesystems(), qt.Equals, 3)
+	c.Assert(readDirnames(c, sub, "."), qt.DeepEquals, []string{"a.txt", "posts", "c.txt"})
+	c.Assert(sub.writeRules, qt.DeepEquals, []WriteRule{
+		{Prefix: "posts", Layer: 1},
+		{Exts: []string{".png"}, Layer: 2},
+	})
+
+	c.Assert(afero.WriteFile(sub, "posts/new.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, fs2, "content/posts/new.txt"), qt.Equals, "new")
+	c.Assert(afero.WriteFile(sub, "d.txt", []byte("d"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, fs1, "content/d.txt"), qt.Equals, "d")
+
+	ro := New(Options{Fss: []afero.Fs{fs1, fs2, fs3}})
+	sub, err = ro.Sub("content/posts")
+	c.Assert(err, qt.IsNil)
+	c.Assert(sub.NumFilesystems(), qt.Equals, 1)
+	nested, err := ro.Sub("content")
+	c.Assert(err, qt.IsNil)
+	nested, err = nested.Sub("posts")
+	c.Assert(err, qt.IsNil)
+	c.Assert(readDirnames(c, nested, "."), qt.DeepEquals, readDirnames(c, sub, "."))
+}
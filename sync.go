@@ -0,0 +1,100 @@
+package overlayfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ Syncer     = (*OverlayFs)(nil)
+	_ afero.File = (*syncFile)(nil)
+)
+
+// Syncer is implemented by filesystems that buffer writes, e.g. caching or journaling layers.
+// SyncAll flushes the buffered writes to their final destination.
+type Syncer interface {
+	SyncAll(ctx context.Context) error
+}
+
+// SyncAll calls Sync on all files opened for writing through the overlay and not yet closed,
+// then calls SyncAll on all filesystems implementing Syncer.
+// Use it to get a durability point, e.g. before publishing build output.
+// It continues on errors and returns all of them joined.
+func (ofs *OverlayFs) SyncAll(ctx context.Context) error {
+	var errs []error
+	for _, f := range ofs.openFiles.list() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// The file may have been closed after we listed it.
+		if err := f.File.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	for _, fs := range ofs.fss {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if s, ok := unwrapScoped(fs).(Syncer); ok {
+			if err := s.SyncAll(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// openFiles is the set of files opened for writing and not yet closed.
+// It's shared by the shallow copies of an OverlayFs.
+type openFiles struct {
+	mu    sync.Mutex
+	files map[*syncFile]struct{}
+
+	// Called when a file is closed.
+	closed func()
+}
+
+func newOpenFiles(closed func()) *openFiles {
+	return &openFiles{files: make(map[*syncFile]struct{}), closed: closed}
+}
+
+// track returns f registered until closed.
+func (o *openFiles) track(f afero.File, err error) (afero.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	sf := &syncFile{File: f, open: o}
+	o.mu.Lock()
+	o.files[sf] = struct{}{}
+	o.mu.Unlock()
+	return sf, nil
+}
+
+func (o *openFiles) list() []*syncFile {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	files := make([]*syncFile, 0, len(o.files))
+	for f := range o.files {
+		files = append(files, f)
+	}
+	return files
+}
+
+// syncFile is a file opened for writing, registered in openFiles until closed.
+type syncFile struct {
+	afero.File
+	open *openFiles
+}
+
+func (f *syncFile) Close() error {
+	f.open.mu.Lock()
+	delete(f.open.files, f)
+	f.open.mu.Unlock()
+	err := f.File.Close()
+	f.open.closed()
+	return err
+}
@@ -0,0 +1,93 @@
+package overlayfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+// syncCountFs counts the Sync calls on its files and its own SyncAll calls.
+type syncCountFs struct {
+	afero.Fs
+	fileSyncs atomic.Int32
+	syncAlls  atomic.Int32
+	err       error
+}
+
+func (fs *syncCountFs) Create(name string) (afero.File, error) {
+	f, err := fs.Fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return syncCountFile{File: f, fs: fs}, nil
+}
+
+func (fs *syncCountFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return syncCountFile{File: f, fs: fs}, nil
+}
+
+func (fs *syncCountFs) SyncAll(ctx context.Context) error {
+	fs.syncAlls.Add(1)
+	return fs.err
+}
+
+type syncCountFile struct {
+	afero.File
+	fs *syncCountFs
+}
+
+func (f syncCountFile) Sync() error {
+	f.fs.fileSyncs.Add(1)
+	return f.File.Sync()
+}
+
+func TestSyncAll(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	upper := &syncCountFs{Fs: afero.NewMemMapFs()}
+	lower := &syncCountFs{Fs: afero.NewMemMapFs()}
+	ofs := New(Options{Fss: []afero.Fs{upper, Layer{Fs: lower, Only: []string{"static"}}}, FirstWritable: true})
+
+	f1, err := ofs.Create("a.txt")
+	c.Assert(err, qt.IsNil)
+	f2, err := ofs.OpenFile("b.txt", os.O_CREATE|os.O_WRONLY, 0o666)
+	c.Assert(err, qt.IsNil)
+	f3, err := ofs.Create("c.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f3.Close(), qt.IsNil)
+
+	// Shallow copies share the open files.
+	c.Assert(ofs.Append(afero.NewMemMapFs()).SyncAll(ctx), qt.IsNil)
+	c.Assert(upper.fileSyncs.Load(), qt.Equals, int32(2))
+	c.Assert(upper.syncAlls.Load(), qt.Equals, int32(1))
+	c.Assert(lower.syncAlls.Load(), qt.Equals, int32(1))
+
+	c.Assert(f1.Close(), qt.IsNil)
+	c.Assert(f2.Close(), qt.IsNil)
+	c.Assert(ofs.SyncAll(ctx), qt.IsNil)
+	c.Assert(upper.fileSyncs.Load(), qt.Equals, int32(2))
+
+	c.Run("Errors", func(c *qt.C) {
+		errFlush := errors.New("flush failed")
+		lower.err = errFlush
+		defer func() { lower.err = nil }()
+		c.Assert(ofs.SyncAll(ctx), qt.ErrorIs, errFlush)
+		c.Assert(upper.syncAlls.Load(), qt.Equals, int32(3))
+	})
+
+	c.Run("Canceled", func(c *qt.C) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		c.Assert(ofs.SyncAll(ctx), qt.ErrorIs, context.Canceled)
+	})
+}
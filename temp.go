@@ -0,0 +1,102 @@
+package overlayfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// CreateTemp creates name like Create, and removes it from the writable filesystem
+// when ttl has passed, e.g. for preview artifacts.
+// Expired files are removed by ReapExpired, or periodically by ReapTemps.
+// Creating name again with CreateTemp extends its lifetime; writing it otherwise does not.
+func (ofs *OverlayFs) CreateTemp(name string, ttl time.Duration) (afero.File, error) {
+	if ttl <= 0 {
+		return nil, &fs.PathError{Op: "createtemp", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := ofs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	ofs.temps.add(name, ttl)
+	return f, nil
+}
+
+// ReapExpired removes the files created with CreateTemp whose ttl has passed,
+// and returns their names, sorted.
+// Files already removed are skipped.
+func (ofs *OverlayFs) ReapExpired() ([]string, error) {
+	var (
+		reaped []string
+		errs   []error
+	)
+	for _, name := range ofs.temps.expired() {
+		if err := ofs.Remove(name); err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		reaped = append(reaped, name)
+	}
+	return reaped, errors.Join(errs...)
+}
+
+// ReapTemps calls ReapExpired every interval until ctx is done.
+// Errors are logged. It's meant to be run in its own goroutine.
+func (ofs *OverlayFs) ReapTemps(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := ofs.ReapExpired(); err != nil {
+				ofs.logger.Warn("failed to reap expired temporary files", "error", err)
+			}
+		}
+	}
+}
+
+// temps tracks the expiration of the files created with CreateTemp.
+// It's shared by the shallow copies of an OverlayFs.
+type temps struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newTemps() *temps {
+	return &temps{now: time.Now, expires: make(map[string]time.Time)}
+}
+
+func (t *temps) add(name string, ttl time.Duration) {
+	t.mu.Lock()
+	t.expires[filepath.Clean(name)] = t.now().Add(ttl)
+	t.mu.Unlock()
+}
+
+// expired removes and returns the expired names, sorted.
+func (t *temps) expired() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var names []string
+	for name, expires := range t.expires {
+		if !now.Before(expires) {
+			names = append(names, name)
+			delete(t.expires, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,75 @@
+package overlayfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestCreateTemp(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "1")}, FirstWritable: true})
+	now := time.Now()
+	ofs.temps.now = func() time.Time { return now }
+
+	for _, name := range []string{"preview/a.html", "preview/b.html", "preview/c.html"} {
+		f, err := ofs.CreateTemp(name, time.Minute)
+		c.Assert(err, qt.IsNil)
+		_, err = f.WriteString(name)
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.Close(), qt.IsNil)
+	}
+	f, err := ofs.CreateTemp("preview/d.html", time.Hour)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(ofs.Remove("preview/c.html"), qt.IsNil)
+
+	reaped, err := ofs.ReapExpired()
+	c.Assert(err, qt.IsNil)
+	c.Assert(reaped, qt.HasLen, 0)
+
+	now = now.Add(time.Minute)
+	f, err = ofs.CreateTemp("preview/b.html", time.Minute)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	reaped, err = ofs.ReapExpired()
+	c.Assert(err, qt.IsNil)
+	c.Assert(reaped, qt.DeepEquals, []string{filepath.FromSlash("preview/a.html")})
+	c.Assert(readDirnames(c, ofs, "preview"), qt.DeepEquals, []string{"b.html", "d.html"})
+
+	_, err = ofs.CreateTemp("preview/e.html", 0)
+	c.Assert(errors.Is(err, fs.ErrInvalid), qt.IsTrue)
+	_, err = New(Options{Fss: []afero.Fs{basicFs("1", "1")}}).CreateTemp("preview/e.html", time.Minute)
+	c.Assert(errors.Is(err, ErrReadOnly), qt.IsTrue)
+}
+
+func TestReapTemps(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1")}, FirstWritable: true})
+	f, err := ofs.CreateTemp("preview/a.html", time.Millisecond)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ofs.ReapTemps(ctx, time.Millisecond)
+		close(done)
+	}()
+	for {
+		if _, err := ofs.Stat("preview/a.html"); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
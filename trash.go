@@ -0,0 +1,127 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// Trash removes name, a file or a directory, from the overlay and keeps it in Options.Trash,
+// so it can be brought back with Restore, e.g. to undo deletes in an editor.
+// A name trashed earlier is replaced.
+// Only names in the writable filesystems can be trashed; if name also exists in a lower
+// filesystem, it's hidden with a whiteout if Options.Whiteouts is set, else Trash fails
+// with ErrNotSupported.
+func (ofs *OverlayFs) Trash(name string) error {
+	if ofs.trash == nil {
+		return &fs.PathError{Op: "trash", Path: name, Err: ErrNotSupported}
+	}
+	layer, _, err := ofs.writeTarget("trash", name, false)
+	if err != nil {
+		return err
+	}
+	wfs, err := ofs.writeLayer("trash", name, layer)
+	if err != nil {
+		return err
+	}
+	defer ofs.caches.invalidate()
+	if _, err := wfs.Stat(name); err != nil {
+		return err
+	}
+	for i := range ofs.fss {
+		if i == layer || ofs.whiteouts {
+			continue
+		}
+		if _, _, _, err := ofs.statLayer(i, name, false); err == nil {
+			return &fs.PathError{Op: "trash", Path: name, Err: ErrNotSupported}
+		}
+	}
+	if err := ofs.trash.RemoveAll(name); err != nil {
+		return err
+	}
+	if err := ofs.copyTree(ofs.trash, wfs, name); err != nil {
+		return err
+	}
+	if ofs.whiteouts {
+		return ofs.removeWhiteout("trash", wfs, name, true)
+	}
+	return wfs.RemoveAll(name)
+}
+
+// Restore moves name back from Options.Trash into the overlay, see Trash.
+// It fails with fs.ErrExist if name has been created again since.
+func (ofs *OverlayFs) Restore(name string) error {
+	if ofs.trash == nil {
+		return &fs.PathError{Op: "restore", Path: name, Err: ErrNotSupported}
+	}
+	if _, err := ofs.trash.Stat(name); err != nil {
+		return err
+	}
+	if _, _, _, err := ofs.stat(name, false); err == nil {
+		return &fs.PathError{Op: "restore", Path: name, Err: fs.ErrExist}
+	}
+	wfs, err := ofs.writeFsFor("restore", name)
+	if err != nil {
+		return err
+	}
+	defer ofs.caches.invalidate()
+	if err := ofs.copyTree(wfs, ofs.trash, name); err != nil {
+		return err
+	}
+	if ofs.whiteouts {
+		// Let the lower filesystems show through again, as before Trash.
+		if err := wfs.Remove(whiteoutName(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return ofs.trash.RemoveAll(name)
+}
+
+// copyTree copies name, a file or a directory, from src to dst, creating its parent directories.
+func (ofs *OverlayFs) copyTree(dst, src afero.Fs, name string) error {
+	return ofs.copyTreeAs(dst, src, name, name)
+}
+
+// copyTreeAs copies the file or directory tree srcName in src to dstName in dst.
+func (ofs *OverlayFs) copyTreeAs(dst, src afero.Fs, srcName, dstName string) error {
+	if err := dst.MkdirAll(filepath.Dir(dstName), 0o777); err != nil {
+		return err
+	}
+	return afero.Walk(src, srcName, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcName, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstName, rel)
+		if fi.IsDir() {
+			return dst.MkdirAll(target, fi.Mode().Perm())
+		}
+		return ofs.copyFileAs(dst, src, path, target, fi.Mode().Perm())
+	})
+}
+
+func (ofs *OverlayFs) copyFile(dst, src afero.Fs, name string, perm os.FileMode) error {
+	return ofs.copyFileAs(dst, src, name, name, perm)
+}
+
+func (ofs *OverlayFs) copyFileAs(dst, src afero.Fs, srcName, dstName string, perm os.FileMode) error {
+	in, err := src.Open(srcName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.OpenFile(dstName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := ofs.copyBuffer(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,49 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestTrash(t *testing.T) {
+	c := qt.New(t)
+
+	fs1, trash := basicFs("1", "1"), afero.NewMemMapFs()
+	ofs := New(Options{Fss: []afero.Fs{fs1, basicFs("2", "2")}, FirstWritable: true, Trash: trash})
+
+	c.Assert(ofs.Trash("mydir/f1-1.txt"), qt.IsNil)
+	_, err := ofs.Stat("mydir/f1-1.txt")
+	c.Assert(errors.Is(err, fs.ErrNotExist), qt.IsTrue)
+	c.Assert(readFile(c, trash, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+
+	// Trash again after recreating it.
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-1.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(errors.Is(ofs.Restore("mydir/f1-1.txt"), fs.ErrExist), qt.IsTrue)
+	c.Assert(ofs.Trash("mydir/f1-1.txt"), qt.IsNil)
+	c.Assert(readFile(c, trash, "mydir/f1-1.txt"), qt.Equals, "new")
+	c.Assert(ofs.Restore("mydir/f1-1.txt"), qt.IsNil)
+	c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "new")
+	_, err = trash.Stat("mydir/f1-1.txt")
+	c.Assert(errors.Is(err, fs.ErrNotExist), qt.IsTrue)
+
+	// Directories.
+	c.Assert(afero.WriteFile(ofs, "newdir/sub/a.txt", []byte("a"), 0o666), qt.IsNil)
+	c.Assert(ofs.Trash("newdir"), qt.IsNil)
+	_, err = ofs.Stat("newdir")
+	c.Assert(errors.Is(err, fs.ErrNotExist), qt.IsTrue)
+	c.Assert(ofs.Restore("newdir"), qt.IsNil)
+	c.Assert(readFile(c, ofs, "newdir/sub/a.txt"), qt.Equals, "a")
+
+	// Only in a lower filesystem, or shadowing one.
+	c.Assert(errors.Is(ofs.Trash("mydir/f1-2.txt"), fs.ErrNotExist), qt.IsTrue)
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-2.txt", []byte("upper"), 0o666), qt.IsNil)
+	c.Assert(errors.Is(ofs.Trash("mydir/f1-2.txt"), ErrNotSupported), qt.IsTrue)
+	c.Assert(errors.Is(ofs.Restore("mydir/missing.txt"), fs.ErrNotExist), qt.IsTrue)
+
+	c.Assert(errors.Is(New(Options{Fss: []afero.Fs{fs1}, FirstWritable: true}).Trash("mydir/f2-1.txt"), ErrNotSupported), qt.IsTrue)
+	c.Assert(errors.Is(New(Options{Fss: []afero.Fs{fs1}, Trash: trash}).Trash("mydir/f2-1.txt"), ErrReadOnly), qt.IsTrue)
+}
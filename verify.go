@@ -0,0 +1,153 @@
+package overlayfs
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// LayerLimits are policy limits for the files in a Layer, e.g. a user-supplied upper layer.
+// The zero value has no limits.
+type LayerLimits struct {
+	// MaxFileSize, if > 0, is the maximum size in bytes of a file.
+	MaxFileSize int64
+
+	// MaxFiles, if > 0, is the maximum number of files.
+	MaxFiles int
+
+	// ForbiddenExts are file extensions not allowed, e.g. ".exe".
+	// They're matched case-insensitively, with or without the leading dot.
+	ForbiddenExts []string
+}
+
+func (l LayerLimits) isZero() bool {
+	return l.MaxFileSize <= 0 && l.MaxFiles <= 0 && len(l.ForbiddenExts) == 0
+}
+
+// ViolationKind is the kind of limit violated.
+type ViolationKind int
+
+const (
+	// ViolationFileSize is a file larger than LayerLimits.MaxFileSize.
+	ViolationFileSize ViolationKind = iota + 1
+
+	// ViolationFileCount is a layer with more files than LayerLimits.MaxFiles.
+	ViolationFileCount
+
+	// ViolationExt is a file with an extension in LayerLimits.ForbiddenExts.
+	ViolationExt
+)
+
+func (k ViolationKind) String() string {
+	switch k {
+	case ViolationFileSize:
+		return "file size"
+	case ViolationFileCount:
+		return "file count"
+	case ViolationExt:
+		return "forbidden extension"
+	}
+	return fmt.Sprintf("ViolationKind(%d)", int(k))
+}
+
+// Violation is a violation of a LayerLimits.
+type Violation struct {
+	// Layer is the index of the filesystem in the overlay.
+	Layer int
+	Kind  ViolationKind
+
+	// Path is the offending file.
+	// For ViolationFileCount, it's the first file above the limit.
+	Path string
+
+	// Limit and Value are the limit and the value found, e.g. the file size.
+	// They're not set for ViolationExt.
+	Limit, Value int64
+}
+
+func (v Violation) String() string {
+	if v.Kind == ViolationExt {
+		return fmt.Sprintf("layer %d: %s: %s", v.Layer, v.Path, v.Kind)
+	}
+	return fmt.Sprintf("layer %d: %s: %s %d exceeds limit %d", v.Layer, v.Path, v.Kind, v.Value, v.Limit)
+}
+
+// ValidationError is returned by Verify when one or more layers violate their limits.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Violations) == 1 {
+		return e.Violations[0].String()
+	}
+	return fmt.Sprintf("%s (and %d more violations)", e.Violations[0], len(e.Violations)-1)
+}
+
+// Verify checks the files in all layers with LayerLimits set, see Layer.Limits.
+// It returns a *ValidationError listing all violations found, if any.
+func (ofs *OverlayFs) Verify(ctx context.Context) error {
+	var violations []Violation
+	for i, fs := range ofs.fss {
+		limits := ofs.layers[i].limits
+		if limits.isZero() {
+			continue
+		}
+		vs, err := ofs.verifyLayer(ctx, i, ofs.layer(fs), limits)
+		if err != nil {
+			return err
+		}
+		violations = append(violations, vs...)
+	}
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func (ofs *OverlayFs) verifyLayer(ctx context.Context, layer int, lfs afero.Fs, limits LayerLimits) ([]Violation, error) {
+	exts := make(map[string]bool)
+	for _, ext := range limits.ForbiddenExts {
+		exts[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+
+	var (
+		violations []Violation
+		files      int
+	)
+	err := afero.Walk(lfs, ".", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		files++
+		if limits.MaxFiles > 0 && files == limits.MaxFiles+1 {
+			violations = append(violations, Violation{Layer: layer, Kind: ViolationFileCount, Path: path, Limit: int64(limits.MaxFiles)})
+		}
+		if limits.MaxFileSize > 0 && info.Size() > limits.MaxFileSize {
+			violations = append(violations, Violation{Layer: layer, Kind: ViolationFileSize, Path: path, Limit: limits.MaxFileSize, Value: info.Size()})
+		}
+		if ext := filepath.Ext(path); ext != "" && exts[strings.ToLower(ext[1:])] {
+			violations = append(violations, Violation{Layer: layer, Kind: ViolationExt, Path: path})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range violations {
+		if violations[i].Kind == ViolationFileCount {
+			violations[i].Value = int64(files)
+		}
+	}
+	return violations, nil
+}
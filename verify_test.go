@@ -0,0 +1,56 @@
+package overlayfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestVerify(t *testing.T) {
+	c := qt.New(t)
+	upper := fsFromTxtTar(`
+-- a.txt --
+a
+-- big.txt --
+0123456789
+-- sub/run.EXE --
+x
+-- sub/ok.txt --
+ok
+`)
+	lower := fsFromTxtTar(`
+-- lower.exe --
+0123456789
+`)
+
+	ofs := New(Options{Fss: []afero.Fs{upper, lower}})
+	c.Assert(ofs.Verify(context.Background()), qt.IsNil)
+
+	ofs = New(Options{Fss: []afero.Fs{
+		Layer{Fs: upper, Limits: LayerLimits{MaxFileSize: 5, MaxFiles: 3, ForbiddenExts: []string{"exe", ".sh"}}},
+		lower,
+	}})
+	err := ofs.Verify(context.Background())
+	var verr *ValidationError
+	c.Assert(errors.As(err, &verr), qt.IsTrue)
+	c.Assert(verr.Violations, qt.DeepEquals, []Violation{
+		{Layer: 0, Kind: ViolationFileSize, Path: "big.txt", Limit: 5, Value: 10},
+		{Layer: 0, Kind: ViolationFileCount, Path: "sub/run.EXE", Limit: 3, Value: 4},
+		{Layer: 0, Kind: ViolationExt, Path: "sub/run.EXE"},
+	})
+	c.Assert(err, qt.ErrorMatches, `layer 0: big.txt: file size 10 exceeds limit 5 \(and 2 more violations\)`)
+	c.Assert(verr.Violations[2].String(), qt.Equals, "layer 0: sub/run.EXE: forbidden extension")
+
+	// The limits follow the layer when ordered by weight.
+	ofs = New(Options{Fss: []afero.Fs{upper, Layer{Fs: lower, Weight: 1, Limits: LayerLimits{ForbiddenExts: []string{"exe"}}}}})
+	err = ofs.Verify(context.Background())
+	c.Assert(errors.As(err, &verr), qt.IsTrue)
+	c.Assert(verr.Violations, qt.DeepEquals, []Violation{{Layer: 0, Kind: ViolationExt, Path: "lower.exe"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(ofs.Verify(ctx), qt.ErrorIs, context.Canceled)
+}
@@ -0,0 +1,409 @@
+package overlayfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// LimitExceededError describes which limit was exceeded and where.
+type LimitExceededError struct {
+	// Limit is the name of the limit, either "depth" or "entries".
+	Limit string
+
+	// Max is the configured limit.
+	Max int
+
+	// Path is the path being visited when the limit was exceeded.
+	Path string
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("overlayfs: %s: %s %s (max %d)", e.Path, e.Limit, ErrLimitExceeded, e.Max)
+}
+
+// Is reports whether target is ErrLimitExceeded.
+func (e *LimitExceededError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// WalkDir walks the merged file tree rooted at root, calling fn for each file or
+// directory in the tree, including root.
+// It has the same semantics as fs.WalkDir, but each directory is read once
+// with its entries merged across all filesystems.
+// The entries in a directory are walked in the order returned by the DirsMerger.
+func (ofs *OverlayFs) WalkDir(root string, fn fs.WalkDirFunc) error {
+	w := &walker{ofs: ofs, fn: fn, readDir: ofs.readDirAt}
+	_, fi, _, err := ofs.stat(root, false)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = w.walkDir(root, fs.FileInfoToDirEntry(fi), 0)
+	}
+	if err == filepath.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+type walker struct {
+	ofs     *OverlayFs
+	fn      fs.WalkDirFunc
+	readDir func(name string, depth int) ([]fs.DirEntry, error)
+
+	// skip, if set, is called with each directory that won't be read.
+	skip func(name string)
+
+	mu      sync.Mutex
+	entries int
+}
+
+func (w *walker) checkLimits(path string, depth int) error {
+	if w.ofs.maxWalkDepth > 0 && depth > w.ofs.maxWalkDepth {
+		return &LimitExceededError{Limit: "depth", Max: w.ofs.maxWalkDepth, Path: path}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.entries++
+	if w.ofs.maxWalkEntries > 0 && w.entries > w.ofs.maxWalkEntries {
+		return &LimitExceededError{Limit: "entries", Max: w.ofs.maxWalkEntries, Path: path}
+	}
+	return nil
+}
+
+func (w *walker) walkDir(path string, d fs.DirEntry, depth int) error {
+	if err := w.checkLimits(path, depth); err != nil {
+		return err
+	}
+
+	if err := w.fn(path, d, nil); err != nil || !d.IsDir() {
+		if d.IsDir() && w.skip != nil {
+			w.skip(path)
+		}
+		if err == filepath.SkipDir && d.IsDir() {
+			// Successfully skipped directory.
+			err = nil
+		}
+		return err
+	}
+
+	dirEntries, err := w.readDir(path, depth)
+	if err != nil {
+		// Second call, to report ReadDir error.
+		err = w.fn(path, d, err)
+		if err != nil {
+			if err == filepath.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for i, dirEntry := range dirEntries {
+		if err := w.walkDir(filepath.Join(path, dirEntry.Name()), dirEntry, depth+1); err != nil {
+			if err == filepath.SkipDir {
+				w.skipDirs(path, dirEntries[i+1:])
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// skipDirs calls skip for the directories in dirEntries, which won't be read.
+func (w *walker) skipDirs(path string, dirEntries []fs.DirEntry) {
+	if w.skip == nil {
+		return
+	}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			w.skip(filepath.Join(path, dirEntry.Name()))
+		}
+	}
+}
+
+// WalkDirConcurrent is like WalkDir, but reads sibling directories concurrently
+// using up to workers goroutines.
+// Each directory is still read once with its entries merged across all filesystems.
+//
+// By default, fn may be called concurrently and in any order, except that a
+// directory is always visited before its entries.
+// If Options.OrderedWalk is set, fn is called sequentially in the same order as WalkDir.
+func (ofs *OverlayFs) WalkDirConcurrent(root string, workers int, fn fs.WalkDirFunc) error {
+	if workers <= 1 {
+		return ofs.WalkDir(root, fn)
+	}
+
+	if ofs.orderedWalk {
+		p := newDirPrefetcher(ofs, workers)
+		defer p.stop()
+		w := &walker{ofs: ofs, fn: fn, readDir: p.readDir, skip: p.skip}
+		_, fi, _, err := ofs.stat(root, false)
+		if err != nil {
+			err = fn(root, nil, err)
+		} else {
+			err = w.walkDir(root, fs.FileInfoToDirEntry(fi), 0)
+		}
+		if err == filepath.SkipDir || err == fs.SkipAll {
+			return nil
+		}
+		return err
+	}
+
+	w := &concurrentWalker{
+		walker: &walker{ofs: ofs, fn: fn, readDir: ofs.readDirAt},
+		sem:    make(chan struct{}, workers),
+	}
+
+	_, fi, _, err := ofs.stat(root, false)
+	if err != nil {
+		err = fn(root, nil, err)
+		if err == filepath.SkipDir || err == fs.SkipAll {
+			return nil
+		}
+		return err
+	}
+	d := fs.FileInfoToDirEntry(fi)
+	if err := w.checkLimits(root, 0); err != nil {
+		return err
+	}
+	if err := fn(root, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir || err == fs.SkipAll {
+			err = nil
+		}
+		return err
+	}
+
+	w.walkDirAsync(root, d, 0)
+	w.wg.Wait()
+
+	if err := w.firstErr(); err != fs.SkipAll {
+		return err
+	}
+	return nil
+}
+
+// concurrentWalker walks each directory in its own goroutine, limited by sem.
+// A directory is walked in the current goroutine when no slot is free.
+type concurrentWalker struct {
+	*walker
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	errMu sync.Mutex
+	err   error
+}
+
+func (w *concurrentWalker) walkDirAsync(path string, d fs.DirEntry, depth int) {
+	select {
+	case w.sem <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			defer func() { <-w.sem }()
+			w.walkDirSync(path, d, depth)
+		}()
+	default:
+		w.walkDirSync(path, d, depth)
+	}
+}
+
+func (w *concurrentWalker) walkDirSync(path string, d fs.DirEntry, depth int) {
+	if w.firstErr() != nil {
+		return
+	}
+	if err := w.walkEntries(path, d, depth); err != nil {
+		w.errMu.Lock()
+		if w.err == nil {
+			w.err = err
+		}
+		w.errMu.Unlock()
+	}
+}
+
+// walkEntries visits the entries in the directory path,
+// walking each sub directory with walkDirAsync.
+// fs.SkipAll is returned as is, and stops the walk as any other error.
+func (w *concurrentWalker) walkEntries(path string, d fs.DirEntry, depth int) error {
+	dirEntries, err := w.readDir(path, depth)
+	if err != nil {
+		err = w.fn(path, d, err)
+		if err == filepath.SkipDir {
+			err = nil
+		}
+		return err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if w.firstErr() != nil {
+			return nil
+		}
+		filename := filepath.Join(path, dirEntry.Name())
+		if err := w.checkLimits(filename, depth+1); err != nil {
+			return err
+		}
+		if err := w.fn(filename, dirEntry, nil); err != nil {
+			if err == filepath.SkipDir {
+				if dirEntry.IsDir() {
+					continue
+				}
+				break
+			}
+			return err
+		}
+		if dirEntry.IsDir() {
+			w.walkDirAsync(filename, dirEntry, depth+1)
+		}
+	}
+	return nil
+}
+
+func (w *concurrentWalker) firstErr() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	return w.err
+}
+
+// dirPrefetcher reads the sub directories of each directory read
+// ahead of a sequential walk, using a fixed number of workers.
+// The directory the walk is most likely to read next is prefetched first.
+type dirPrefetcher struct {
+	ofs *OverlayFs
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []string // A stack of the directories to prefetch.
+	dirs    map[string]*prefetchedDir
+	stopped bool
+}
+
+type prefetchedDir struct {
+	started    bool
+	done       chan struct{}
+	dirEntries []fs.DirEntry
+	err        error
+}
+
+func newDirPrefetcher(ofs *OverlayFs, workers int) *dirPrefetcher {
+	p := &dirPrefetcher{ofs: ofs, dirs: make(map[string]*prefetchedDir)}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *dirPrefetcher) work() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for len(p.pending) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			p.mu.Unlock()
+			return
+		}
+		name := p.pending[len(p.pending)-1]
+		p.pending = p.pending[:len(p.pending)-1]
+		d, found := p.dirs[name]
+		if !found || d.started {
+			// Skipped or already read by the walk.
+			p.mu.Unlock()
+			continue
+		}
+		d.started = true
+		p.mu.Unlock()
+
+		d.dirEntries, d.err = p.ofs.readDir(name)
+		close(d.done)
+	}
+}
+
+// stop cancels the pending prefetches and waits for the running ones.
+func (p *dirPrefetcher) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	p.wg.Wait()
+}
+
+// skip cancels the prefetch of name, which won't be read.
+func (p *dirPrefetcher) skip(name string) {
+	p.mu.Lock()
+	delete(p.dirs, name)
+	p.mu.Unlock()
+}
+
+func (p *dirPrefetcher) readDir(name string, depth int) ([]fs.DirEntry, error) {
+	p.mu.Lock()
+	d, found := p.dirs[name]
+	delete(p.dirs, name)
+	started := found && d.started
+	if found {
+		d.started = true
+	}
+	p.mu.Unlock()
+
+	var (
+		dirEntries []fs.DirEntry
+		err        error
+	)
+	if started {
+		<-d.done
+		dirEntries, err = d.dirEntries, d.err
+	} else {
+		dirEntries, err = p.ofs.readDir(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.ofs.maxWalkDepth > 0 && depth+1 > p.ofs.maxWalkDepth {
+		// The walk stops before reading the sub directories.
+		return dirEntries, nil
+	}
+
+	p.mu.Lock()
+	var added bool
+	for i := len(dirEntries) - 1; i >= 0; i-- {
+		if dirEntry := dirEntries[i]; dirEntry.IsDir() {
+			sub := filepath.Join(name, dirEntry.Name())
+			p.dirs[sub] = &prefetchedDir{done: make(chan struct{})}
+			p.pending = append(p.pending, sub)
+			added = true
+		}
+	}
+	p.mu.Unlock()
+	if added {
+		p.cond.Broadcast()
+	}
+
+	return dirEntries, nil
+}
+
+// readDir reads the merged entries of the named directory.
+// The entries are used after the directory is closed, so they can't be allocated from its arena.
+func (ofs *OverlayFs) readDir(name string) ([]fs.DirEntry, error) {
+	f, err := ofs.open(name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, ok := f.(*Dir); !ok {
+		if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+			return nil, notDirError(name)
+		}
+	}
+	return readDirEntries(f)
+}
+
+// readDirAt is readDir with the signature used by walker.
+func (ofs *OverlayFs) readDirAt(name string, depth int) ([]fs.DirEntry, error) {
+	return ofs.readDir(name)
+}
@@ -0,0 +1,293 @@
+package overlayfs
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestWalkDir(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("1", "2"), basicFs("2", "2")}})
+
+	var paths []string
+	err := ofs.WalkDir("mydir", func(path string, d fs.DirEntry, err error) error {
+		c.Assert(err, qt.IsNil)
+		paths = append(paths, filepath.ToSlash(path))
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(paths, qt.DeepEquals, []string{"mydir", "mydir/f1-1.txt", "mydir/f2-1.txt", "mydir/f1-2.txt", "mydir/f2-2.txt"})
+
+	err = ofs.WalkDir("notfound", func(path string, d fs.DirEntry, err error) error {
+		return err
+	})
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+}
+
+func TestWalkDirSkipAll(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}, OrderedWalk: true})
+
+	for _, workers := range []int{1, 4} {
+		for _, stop := range []string{"mydir", "mydir/f2-1.txt"} {
+			var (
+				mu    sync.Mutex
+				paths []string
+			)
+			err := ofs.WalkDirConcurrent("mydir", workers, func(path string, d fs.DirEntry, err error) error {
+				c.Assert(err, qt.IsNil)
+				mu.Lock()
+				defer mu.Unlock()
+				paths = append(paths, filepath.ToSlash(path))
+				if filepath.ToSlash(path) == stop {
+					return fs.SkipAll
+				}
+				return nil
+			})
+			c.Assert(err, qt.IsNil)
+			c.Assert(paths[len(paths)-1], qt.Equals, stop)
+		}
+	}
+
+	// Concurrent, unordered.
+	ofs = New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}})
+	var visited atomic.Int32
+	err := ofs.WalkDirConcurrent("", 4, func(path string, d fs.DirEntry, err error) error {
+		visited.Add(1)
+		if filepath.ToSlash(path) == "mydir" {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(visited.Load() < 6, qt.IsTrue)
+}
+
+func TestWalkDirStats(t *testing.T) {
+	c := qt.New(t)
+
+	stats := func(files int) int32 {
+		fs1, fs2 := &statCountingFs{Fs: afero.NewMemMapFs()}, &statCountingFs{Fs: afero.NewMemMapFs()}
+		for i := 0; i < files; i++ {
+			c.Assert(afero.WriteFile(fs1, fmt.Sprintf("a/b/f%d.txt", i), nil, 0o666), qt.IsNil)
+			c.Assert(afero.WriteFile(fs2, fmt.Sprintf("a/g%d.txt", i), nil, 0o666), qt.IsNil)
+		}
+		ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+		var visited int
+		c.Assert(ofs.WalkDir("a", func(path string, d fs.DirEntry, err error) error {
+			visited++
+			return err
+		}), qt.IsNil)
+		c.Assert(visited, qt.Equals, 2+2*files)
+		return fs1.stats.Load() + fs2.stats.Load()
+	}
+
+	// The directories are read once across the filesystems, the files are not stat'ed.
+	c.Assert(stats(100), qt.Equals, stats(1))
+}
+
+func TestWalkDirDirEntryArena(t *testing.T) {
+	c := qt.New(t)
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("1", "2"), basicFs("2", "2")}, DirEntryArena: true})
+
+	var paths []string
+	err := ofs.WalkDir("mydir", func(path string, d fs.DirEntry, err error) error {
+		c.Assert(err, qt.IsNil)
+		paths = append(paths, filepath.ToSlash(path))
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(paths, qt.DeepEquals, []string{"mydir", "mydir/f1-1.txt", "mydir/f2-1.txt", "mydir/f1-2.txt", "mydir/f2-2.txt"})
+}
+
+func TestWalkDirLimits(t *testing.T) {
+	c := qt.New(t)
+	fs1 := fsFromTxtTar(`
+-- a/b/c/d/f.txt --
+f
+-- a/f1.txt --
+f1
+-- a/f2.txt --
+f2
+`)
+
+	walk := func(ofs *OverlayFs) error {
+		return ofs.WalkDir("a", func(path string, d fs.DirEntry, err error) error {
+			return err
+		})
+	}
+
+	c.Assert(walk(New(Options{Fss: []afero.Fs{fs1}})), qt.IsNil)
+	c.Assert(walk(New(Options{Fss: []afero.Fs{fs1}, MaxWalkDepth: 4})), qt.IsNil)
+
+	err := walk(New(Options{Fss: []afero.Fs{fs1}, MaxWalkDepth: 3}))
+	c.Assert(err, qt.ErrorIs, ErrLimitExceeded)
+	var lerr *LimitExceededError
+	c.Assert(err, qt.ErrorAs, &lerr)
+	c.Assert(lerr.Limit, qt.Equals, "depth")
+	c.Assert(filepath.ToSlash(lerr.Path), qt.Equals, "a/b/c/d/f.txt")
+
+	err = walk(New(Options{Fss: []afero.Fs{fs1}, MaxWalkEntries: 5}))
+	c.Assert(err, qt.ErrorIs, ErrLimitExceeded)
+	c.Assert(err, qt.ErrorAs, &lerr)
+	c.Assert(lerr.Limit, qt.Equals, "entries")
+
+	err = New(Options{Fss: []afero.Fs{fs1}, MaxWalkEntries: 2}).MaterializeTo(context.Background(), afero.NewMemMapFs(), ExportOptions{Root: "a"})
+	c.Assert(err, qt.ErrorIs, ErrLimitExceeded)
+}
+
+func TestWalkDirConcurrent(t *testing.T) {
+	c := qt.New(t)
+	createFs := func(fileID string) afero.Fs {
+		fs := afero.NewMemMapFs()
+		for i := 0; i < 30; i++ {
+			c.Assert(afero.WriteFile(fs, fmt.Sprintf("root/d%d/e%d/f%s-%d.txt", i%4, i%3, fileID, i), []byte("foo"), 0o666), qt.IsNil)
+		}
+		return fs
+	}
+	fss := []afero.Fs{createFs("1"), createFs("2"), createFs("1")}
+
+	walk := func(ofs *OverlayFs, workers int, skip string) []string {
+		var (
+			mu    sync.Mutex
+			paths []string
+		)
+		err := ofs.WalkDirConcurrent("root", workers, func(path string, d fs.DirEntry, err error) error {
+			c.Assert(err, qt.IsNil)
+			path = filepath.ToSlash(path)
+			if path == skip {
+				return filepath.SkipDir
+			}
+			mu.Lock()
+			paths = append(paths, path)
+			mu.Unlock()
+			return nil
+		})
+		c.Assert(err, qt.IsNil)
+		return paths
+	}
+
+	ofs := New(Options{Fss: fss})
+	want := walk(ofs, 1, "")
+	c.Assert(want, qt.HasLen, 77)
+
+	got := walk(ofs, 4, "")
+	c.Assert(got, qt.Not(qt.DeepEquals), want)
+	sort.Strings(got)
+	wantSorted := append([]string(nil), want...)
+	sort.Strings(wantSorted)
+	c.Assert(got, qt.DeepEquals, wantSorted)
+
+	c.Assert(walk(ofs, 4, "root/d1"), qt.HasLen, 77-20)
+
+	ofsOrdered := New(Options{Fss: fss, OrderedWalk: true})
+	for i := 0; i < 5; i++ {
+		c.Assert(walk(ofsOrdered, 4, ""), qt.DeepEquals, want)
+	}
+	c.Assert(walk(ofsOrdered, 4, "root/d1"), qt.HasLen, 77-20)
+
+	err := New(Options{Fss: fss, MaxWalkEntries: 20}).WalkDirConcurrent("root", 4, func(path string, d fs.DirEntry, err error) error {
+		return err
+	})
+	c.Assert(err, qt.ErrorIs, ErrLimitExceeded)
+}
+
+func TestWalkDirConcurrentGoroutines(t *testing.T) {
+	c := qt.New(t)
+	fs1 := afero.NewMemMapFs()
+	for i := 0; i < 200; i++ {
+		c.Assert(afero.WriteFile(fs1, fmt.Sprintf("root/d%d/f.txt", i), nil, 0o666), qt.IsNil)
+	}
+
+	const workers = 4
+	for _, ordered := range []bool{false, true} {
+		ofs := New(Options{Fss: []afero.Fs{fs1}, OrderedWalk: ordered})
+		base := runtime.NumGoroutine()
+		var max atomic.Int64
+		err := ofs.WalkDirConcurrent("root", workers, func(path string, d fs.DirEntry, err error) error {
+			for n := int64(runtime.NumGoroutine()); ; {
+				if m := max.Load(); n <= m || max.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			return err
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(max.Load() <= int64(base+workers), qt.IsTrue, qt.Commentf("ordered=%t: %d goroutines, started with %d", ordered, max.Load(), base))
+	}
+}
+
+type openRecordingFs struct {
+	afero.Fs
+	opened sync.Map
+}
+
+func (fs *openRecordingFs) Open(name string) (afero.File, error) {
+	fs.opened.Store(filepath.ToSlash(name), true)
+	return fs.Fs.Open(name)
+}
+
+func (fs *openRecordingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fs.opened.Store(filepath.ToSlash(name), true)
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func TestWalkDirPrefetch(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("MaxWalkDepth", func(c *qt.C) {
+		fs1 := &openRecordingFs{Fs: fsFromTxtTar(`
+-- a/b/c/d/f.txt --
+f
+`)}
+		ofs := New(Options{Fss: []afero.Fs{fs1}, OrderedWalk: true, MaxWalkDepth: 1})
+		err := ofs.WalkDirConcurrent("a", 4, func(path string, d fs.DirEntry, err error) error {
+			return err
+		})
+		c.Assert(err, qt.ErrorIs, ErrLimitExceeded)
+		_, found := fs1.opened.Load("a/b")
+		c.Assert(found, qt.IsTrue)
+		_, found = fs1.opened.Load("a/b/c")
+		c.Assert(found, qt.IsFalse)
+	})
+
+	c.Run("SkipDir", func(c *qt.C) {
+		fs1 := afero.NewMemMapFs()
+		for i := 0; i < 4; i++ {
+			c.Assert(afero.WriteFile(fs1, fmt.Sprintf("root/d%d/a.txt", i), nil, 0o666), qt.IsNil)
+			for j := 0; j < 3; j++ {
+				c.Assert(afero.WriteFile(fs1, fmt.Sprintf("root/d%d/e%d/f.txt", i, j), nil, 0o666), qt.IsNil)
+			}
+		}
+		ofs := New(Options{Fss: []afero.Fs{fs1}})
+
+		// No workers, so nothing is read before the walk gets to it.
+		p := newDirPrefetcher(ofs, 0)
+		defer p.stop()
+		var visited int
+		w := &walker{ofs: ofs, readDir: p.readDir, skip: p.skip, fn: func(path string, d fs.DirEntry, err error) error {
+			visited++
+			switch filepath.ToSlash(path) {
+			case "root/d1", "root/d2/a.txt":
+				return filepath.SkipDir
+			}
+			return err
+		}}
+		fi, err := ofs.Stat("root")
+		c.Assert(err, qt.IsNil)
+		c.Assert(w.walkDir("root", fs.FileInfoToDirEntry(fi), 0), qt.IsNil)
+		c.Assert(visited, qt.Equals, 1+2*(1+1+3*2)+1+2)
+		c.Assert(p.dirs, qt.HasLen, 0)
+	})
+}
@@ -0,0 +1,166 @@
+package overlayfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessCount is the number of times a file was opened, see AccessProfile.
+type AccessCount struct {
+	Name  string
+	Count uint64
+}
+
+// AccessProfile is the files opened, most frequently opened first.
+type AccessProfile []AccessCount
+
+// AccessProfile returns the files opened since New, see Options.RecordAccess.
+// It's shared by the shallow copies of an OverlayFs.
+func (ofs *OverlayFs) AccessProfile() AccessProfile {
+	if ofs.access == nil {
+		return nil
+	}
+	return ofs.access.profile()
+}
+
+// WriteTo writes p in a line based text format, one "count name" per line.
+func (p AccessProfile) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, c := range p {
+		m, err := fmt.Fprintf(bw, "%d %s\n", c.Count, c.Name)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// ReadAccessProfile reads a profile written by AccessProfile.WriteTo.
+func ReadAccessProfile(r io.Reader) (AccessProfile, error) {
+	var p AccessProfile
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		if sc.Text() == "" {
+			continue
+		}
+		count, name, found := strings.Cut(sc.Text(), " ")
+		n, err := strconv.ParseUint(count, 10, 64)
+		if !found || err != nil || name == "" {
+			return nil, fmt.Errorf("access profile: invalid line %d: %q", line, sc.Text())
+		}
+		p = append(p, AccessCount{Name: name, Count: n})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	p.sort()
+	return p, nil
+}
+
+func (p AccessProfile) sort() {
+	sort.SliceStable(p, func(i, j int) bool {
+		if p[i].Count != p[j].Count {
+			return p[i].Count > p[j].Count
+		}
+		return p[i].Name < p[j].Name
+	})
+}
+
+// WarmOptions is the budget for Warm. A zero value is no limit.
+type WarmOptions struct {
+	// MaxDuration is how long to spend preloading.
+	MaxDuration time.Duration
+
+	// MaxBytes is the number of bytes to read. Files that don't fit are skipped.
+	MaxBytes int64
+}
+
+// WarmStats is what Warm preloaded.
+type WarmStats struct {
+	Files int
+	Bytes int64
+}
+
+// Warm preloads the files in profile, most frequently accessed first, within the budget in opts,
+// e.g. with the profile of a previous run.
+// The files are looked up, filling the stat cache, and read, filling any caches of the filesystems.
+// Files no longer found are skipped.
+func (ofs *OverlayFs) Warm(profile AccessProfile, opts WarmOptions) (WarmStats, error) {
+	var stats WarmStats
+	profile = append(AccessProfile(nil), profile...)
+	profile.sort()
+
+	var deadline time.Time
+	if opts.MaxDuration > 0 {
+		deadline = ofs.caches.now().Add(opts.MaxDuration)
+	}
+	for _, c := range profile {
+		if !deadline.IsZero() && !ofs.caches.now().Before(deadline) {
+			break
+		}
+		if opts.MaxBytes > 0 && stats.Bytes >= opts.MaxBytes {
+			break
+		}
+		fi, err := ofs.Stat(c.Name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return stats, err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if opts.MaxBytes > 0 && stats.Bytes+fi.Size() > opts.MaxBytes {
+			continue
+		}
+		f, err := ofs.Open(c.Name)
+		if err != nil {
+			return stats, err
+		}
+		n, err := ofs.copyBuffer(io.Discard, f)
+		f.Close()
+		stats.Bytes += n
+		if err != nil {
+			return stats, err
+		}
+		stats.Files++
+	}
+	return stats, nil
+}
+
+// accessLog counts the files opened, see Options.RecordAccess.
+type accessLog struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newAccessLog() *accessLog {
+	return &accessLog{counts: make(map[string]uint64)}
+}
+
+func (l *accessLog) record(name string) {
+	l.mu.Lock()
+	l.counts[name]++
+	l.mu.Unlock()
+}
+
+func (l *accessLog) profile() AccessProfile {
+	l.mu.Lock()
+	p := make(AccessProfile, 0, len(l.counts))
+	for name, count := range l.counts {
+		p = append(p, AccessCount{Name: name, Count: count})
+	}
+	l.mu.Unlock()
+	p.sort()
+	return p
+}
@@ -0,0 +1,56 @@
+package overlayfs
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestAccessProfile(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}, RecordAccess: true})
+	f1, f2 := filepath.FromSlash("mydir/f1-1.txt"), filepath.FromSlash("mydir/f2-2.txt")
+	for _, name := range []string{f1, f2, f2, "mydir", "nope.txt"} {
+		if f, err := ofs.Open(name); err == nil {
+			f.Close()
+		}
+	}
+	p := ofs.AccessProfile()
+	c.Assert(p, qt.DeepEquals, AccessProfile{{Name: f2, Count: 2}, {Name: f1, Count: 1}})
+
+	var buf bytes.Buffer
+	_, err := p.WriteTo(&buf)
+	c.Assert(err, qt.IsNil)
+	p2, err := ReadAccessProfile(&buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p2, qt.DeepEquals, p)
+
+	_, err = ReadAccessProfile(bytes.NewBufferString("x mydir/a.txt\n"))
+	c.Assert(err, qt.ErrorMatches, `access profile: invalid line 1.*`)
+
+	c.Assert(New(Options{}).AccessProfile(), qt.IsNil)
+}
+
+func TestWarm(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}})
+	profile := AccessProfile{
+		{Name: "mydir/f1-1.txt", Count: 1},
+		{Name: "mydir/f2-2.txt", Count: 5},
+		{Name: "mydir/gone.txt", Count: 3},
+		{Name: "mydir", Count: 2},
+	}
+
+	stats, err := ofs.Warm(profile, WarmOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats, qt.Equals, WarmStats{Files: 2, Bytes: 8})
+
+	stats, err = ofs.Warm(profile, WarmOptions{MaxBytes: 6})
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats, qt.Equals, WarmStats{Files: 1, Bytes: 4})
+}
@@ -0,0 +1,692 @@
+package overlayfs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op describes a set of file operations.
+type Op uint8
+
+const (
+	// Create is a file or directory being created.
+	Create Op = 1 << iota
+
+	// Write is a file being written to.
+	Write
+
+	// Remove is a file or directory being removed.
+	Remove
+
+	// Chmod is a change to the file mode.
+	Chmod
+
+	// Rename is a file being renamed, see Event.OldName.
+	Rename
+)
+
+func (op Op) String() string {
+	var names []string
+	for _, v := range []struct {
+		op   Op
+		name string
+	}{{Create, "CREATE"}, {Write, "WRITE"}, {Remove, "REMOVE"}, {Chmod, "CHMOD"}, {Rename, "RENAME"}} {
+		if op&v.op != 0 {
+			names = append(names, v.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Event describes a change to a file or directory in one of the filesystems.
+type Event struct {
+	// Name is the path of the file in the overlay.
+	Name string
+
+	// Op is the operation(s) that triggered the event.
+	Op Op
+
+	// Layer is the index of the filesystem where the change happened.
+	Layer int
+
+	// OldName is the previous path of a renamed file.
+	OldName string
+
+	// IsDir reports whether the event is for a directory.
+	IsDir bool
+}
+
+// NotifyFs is implemented by filesystems that can report their own changes,
+// e.g. backed by inotify. Filesystems not implementing NotifyFs are polled.
+type NotifyFs interface {
+	// Notify sends events for changes below root to events until ctx is done.
+	// The Layer field in the events is set by the caller.
+	Notify(ctx context.Context, root string, events chan<- Event) error
+}
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// Root is the directory in the overlay to watch.
+	Root string
+
+	// PollInterval is the interval between scans of filesystems not implementing NotifyFs.
+	// Defaults to 1 second.
+	PollInterval time.Duration
+
+	// Debounce, if > 0, holds back events until no new events for the same path
+	// have been received for the given duration, coalescing them into one event.
+	// A file created and then removed within the window is not reported.
+	Debounce time.Duration
+
+	// DebounceByDir, if set with Debounce, coalesces events per directory,
+	// reporting one event named by the directory with the combined operations.
+	DebounceByDir bool
+
+	// IncludeShadowed, if set, reports all changes as is.
+	// By default, changes to files shadowed by a file in a higher filesystem are
+	// not reported, as the merged view did not change. A shadowing file being removed
+	// is reported as a Write from the filesystem of the file that became visible, and a
+	// file created on top of a visible file is reported as a Write.
+	IncludeShadowed bool
+
+	// DetectRenames, if set, reports a file removed and a file with the same identity
+	// created in the same filesystem as one Rename event.
+	// Files are identified by inode number where available, else by size and SHA-256 hash;
+	// empty files without an inode number are never matched.
+	// Filesystems implementing NotifyFs need to report their own Rename events.
+	DetectRenames bool
+
+	// RenameWindow is how long removed files are held back waiting for a matching
+	// created file when DetectRenames is set.
+	// By default, only files removed and created between two scans are matched.
+	RenameWindow time.Duration
+
+	// Filter, if set, selects the events to report.
+	Filter *WatchFilter
+
+	// Buffer is the number of events buffered for a slow consumer.
+	// Defaults to 100.
+	Buffer int
+
+	// SlowConsumer decides what happens when the buffer is full.
+	SlowConsumer SlowConsumerPolicy
+}
+
+// WatchFilter selects the events reported by a Watcher.
+// All of the set criteria must match.
+type WatchFilter struct {
+	// Globs are filepath.Match patterns matched against the event Name or OldName.
+	// Patterns without a path separator are matched against the base name.
+	Globs []string
+
+	// Ops, if set, selects events with at least one of the given operations.
+	Ops Op
+
+	// DirsOnly selects events for directories.
+	DirsOnly bool
+
+	// FilesOnly selects events for files.
+	FilesOnly bool
+}
+
+func (f *WatchFilter) validate() error {
+	for _, pattern := range f.Globs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("overlayfs: invalid glob %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (f *WatchFilter) match(e Event) bool {
+	if f == nil {
+		return true
+	}
+	if f.Ops != 0 && e.Op&f.Ops == 0 {
+		return false
+	}
+	if (f.DirsOnly && !e.IsDir) || (f.FilesOnly && e.IsDir) {
+		return false
+	}
+	if len(f.Globs) == 0 {
+		return true
+	}
+	for _, pattern := range f.Globs {
+		if f.matchGlob(pattern, e.Name) || (e.OldName != "" && f.matchGlob(pattern, e.OldName)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *WatchFilter) matchGlob(pattern, name string) bool {
+	if !strings.ContainsRune(pattern, filepath.Separator) {
+		name = filepath.Base(name)
+	}
+	matched, _ := filepath.Match(pattern, name)
+	return matched
+}
+
+// SlowConsumerPolicy decides what happens when a Watcher's buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerBlock blocks delivery to all Watchers sharing the WatchHub
+	// until there is room in the buffer.
+	SlowConsumerBlock SlowConsumerPolicy = iota
+
+	// SlowConsumerDrop drops the events that don't fit in the buffer,
+	// see Watcher.Dropped.
+	SlowConsumerDrop
+)
+
+// WatchHub shares one set of filesystem watchers between multiple Watchers.
+type WatchHub struct {
+	ofs    *OverlayFs
+	opts   WatchOptions
+	raw    chan Event
+	errors chan error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+// NewWatchHub starts watching the tree rooted at opts.Root in all filesystems.
+// Only the Root, PollInterval, DetectRenames and RenameWindow options are used;
+// the other options are set per Watcher.
+// Each top level filesystem is watched separately; a filesystem implementing
+// FilesystemIterator is watched as one.
+// Changes made before NewWatchHub returns are not reported.
+// The WatchHub must be closed when done.
+func (ofs *OverlayFs) NewWatchHub(opts WatchOptions) (*WatchHub, error) {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &WatchHub{
+		ofs:      ofs,
+		opts:     opts,
+		raw:      make(chan Event, 100),
+		errors:   make(chan error, 10),
+		ctx:      ctx,
+		cancel:   cancel,
+		watchers: make(map[*Watcher]struct{}),
+	}
+
+	var pollers []*poller
+	for i, fs := range ofs.fss {
+		if _, ok := fs.(NotifyFs); ok {
+			continue
+		}
+		p := &poller{
+			fs:            ofs.layer(fs),
+			layer:         i,
+			root:          opts.Root,
+			detectRenames: opts.DetectRenames,
+			renameWindow:  opts.RenameWindow,
+			removed:       make(map[string]removedFile),
+		}
+		m, err := p.scan()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		p.manifest = m
+		pollers = append(pollers, p)
+	}
+	for i, fs := range ofs.fss {
+		if nfs, ok := fs.(NotifyFs); ok {
+			h.notify(i, nfs)
+		}
+	}
+	for _, p := range pollers {
+		h.poll(p)
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.dispatch()
+	}()
+
+	return h, nil
+}
+
+// Watch starts a new Watcher receiving the changes seen by the hub.
+// If opts.Root is set, only changes below it are reported.
+// The Watcher must be closed when done; closing it does not affect other Watchers.
+func (h *WatchHub) Watch(opts WatchOptions) (*Watcher, error) {
+	if opts.Filter != nil {
+		if err := opts.Filter.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = 100
+	}
+	ctx, cancel := context.WithCancel(h.ctx)
+	w := &Watcher{
+		hub:    h,
+		opts:   opts,
+		events: make(chan Event),
+		errors: make(chan error, 10),
+		raw:    make(chan Event, opts.Buffer),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	w.Events, w.Errors = w.events, w.errors
+
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.run()
+	}()
+
+	return w, nil
+}
+
+// Close stops the hub and all of its Watchers.
+func (h *WatchHub) Close() error {
+	h.mu.Lock()
+	watchers := make([]*Watcher, 0, len(h.watchers))
+	for w := range h.watchers {
+		watchers = append(watchers, w)
+	}
+	h.mu.Unlock()
+	for _, w := range watchers {
+		w.Close()
+	}
+	h.cancel()
+	h.wg.Wait()
+	return nil
+}
+
+// dispatch delivers the events and errors from the filesystems to all Watchers.
+func (h *WatchHub) dispatch() {
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case e := <-h.raw:
+			h.mu.Lock()
+			for w := range h.watchers {
+				w.deliver(e)
+			}
+			h.mu.Unlock()
+		case err := <-h.errors:
+			h.mu.Lock()
+			for w := range h.watchers {
+				select {
+				case w.errors <- err:
+				default:
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *WatchHub) remove(w *Watcher) {
+	h.mu.Lock()
+	delete(h.watchers, w)
+	h.mu.Unlock()
+}
+
+func (h *WatchHub) sendErr(err error) {
+	h.ofs.logger.Warn("overlayfs: watch error", "root", h.opts.Root, "err", err)
+	select {
+	case <-h.ctx.Done():
+	case h.errors <- err:
+	}
+}
+
+func (h *WatchHub) sendRaw(e Event) {
+	select {
+	case <-h.ctx.Done():
+	case h.raw <- e:
+	}
+}
+
+func (h *WatchHub) notify(layer int, nfs NotifyFs) {
+	events := make(chan Event)
+	h.wg.Add(2)
+	go func() {
+		defer h.wg.Done()
+		if err := nfs.Notify(h.ctx, h.opts.Root, events); err != nil && h.ctx.Err() == nil {
+			h.sendErr(err)
+		}
+	}()
+	go func() {
+		defer h.wg.Done()
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case e := <-events:
+				e.Layer = layer
+				h.sendRaw(e)
+			}
+		}
+	}()
+}
+
+func (h *WatchHub) poll(p *poller) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		ticker := time.NewTicker(h.opts.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			events, err := p.poll()
+			if err != nil {
+				h.sendErr(err)
+				continue
+			}
+			for _, e := range events {
+				h.sendRaw(e)
+			}
+		}
+	}()
+}
+
+// Watcher reports changes in the filesystems of an overlay.
+type Watcher struct {
+	// Events receives the changes.
+	Events <-chan Event
+
+	// Errors receives any errors watching the filesystems.
+	Errors <-chan error
+
+	hub     *WatchHub
+	ownsHub bool
+	opts    WatchOptions
+	events  chan Event
+	errors  chan error
+	raw     chan Event
+	dropped int64
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Watch starts watching the tree rooted at opts.Root in all filesystems.
+// It's a shorthand for a WatchHub with one Watcher, see NewWatchHub.
+// The Watcher must be closed when done.
+func (ofs *OverlayFs) Watch(opts WatchOptions) (*Watcher, error) {
+	if opts.Filter != nil {
+		if err := opts.Filter.validate(); err != nil {
+			return nil, err
+		}
+	}
+	h, err := ofs.NewWatchHub(opts)
+	if err != nil {
+		return nil, err
+	}
+	w, err := h.Watch(opts)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	w.ownsHub = true
+	return w, nil
+}
+
+// Dropped returns the number of events dropped because of SlowConsumerDrop.
+func (w *Watcher) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+// Close stops the Watcher and closes its channels.
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		// Cancel first to unblock any delivery to this Watcher.
+		w.cancel()
+		w.hub.remove(w)
+		w.wg.Wait()
+		close(w.events)
+		close(w.errors)
+		if w.ownsHub {
+			w.hub.Close()
+		}
+	})
+	return nil
+}
+
+// deliver queues e for the Watcher according to its SlowConsumerPolicy.
+func (w *Watcher) deliver(e Event) {
+	if w.opts.Root != "" && !isWithin(w.opts.Root, e.Name) && (e.OldName == "" || !isWithin(w.opts.Root, e.OldName)) {
+		return
+	}
+	if w.opts.SlowConsumer == SlowConsumerDrop {
+		select {
+		case w.raw <- e:
+		default:
+			if atomic.AddInt64(&w.dropped, 1) == 1 {
+				w.hub.ofs.logger.Warn("overlayfs: watcher buffer full, dropping events", "buffer", w.opts.Buffer)
+			}
+		}
+		return
+	}
+	select {
+	case <-w.ctx.Done():
+	case w.raw <- e:
+	}
+}
+
+// run forwards the events from the hub to the Events channel.
+func (w *Watcher) run() {
+	if w.opts.Debounce <= 0 {
+		for {
+			select {
+			case <-w.ctx.Done():
+				return
+			case e := <-w.raw:
+				for _, e := range w.merged(e) {
+					if w.opts.Filter.match(e) {
+						w.send(e)
+					}
+				}
+			}
+		}
+	}
+
+	d := newDebouncer(w.opts.Debounce, w.opts.DebounceByDir)
+	var (
+		timer  *time.Timer
+		timerC <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case e := <-w.raw:
+			for _, e := range w.merged(e) {
+				if w.opts.Filter.match(e) {
+					d.add(e, time.Now())
+				}
+			}
+		case <-timerC:
+			for _, e := range d.flush(time.Now()) {
+				w.send(e)
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if deadline, ok := d.next(); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			timerC = timer.C
+		} else {
+			timer, timerC = nil, nil
+		}
+	}
+}
+
+// merged translates e into the changes seen in the merged view, if any.
+func (w *Watcher) merged(e Event) []Event {
+	if w.opts.IncludeShadowed {
+		return []Event{e}
+	}
+	if e.Op&Rename != 0 {
+		removed, removedOK := w.mergedOne(Event{Name: e.OldName, Op: Remove, Layer: e.Layer, IsDir: e.IsDir})
+		created, createdOK := w.mergedOne(Event{Name: e.Name, Op: Create, Layer: e.Layer, IsDir: e.IsDir})
+		if removedOK && createdOK && removed.Op == Remove && created.Op == Create {
+			return []Event{e}
+		}
+		var events []Event
+		if removedOK {
+			events = append(events, removed)
+		}
+		if createdOK {
+			events = append(events, created)
+		}
+		return events
+	}
+	if e, ok := w.mergedOne(e); ok {
+		return []Event{e}
+	}
+	return nil
+}
+
+func (w *Watcher) mergedOne(e Event) (Event, bool) {
+	if w.layerOf(e.Name, 0, e.Layer) != -1 {
+		// Shadowed.
+		return e, false
+	}
+	lower := w.layerOf(e.Name, e.Layer+1, len(w.hub.ofs.fss))
+	if lower == -1 {
+		return e, true
+	}
+	if e.Op&Remove != 0 {
+		if e.Op&Create != 0 {
+			// Replaced.
+			return e, true
+		}
+		// The lower file became visible.
+		return Event{Name: e.Name, Op: Write, Layer: lower, IsDir: e.IsDir}, true
+	}
+	if e.Op&Create != 0 {
+		// Shadowing a lower file.
+		e.Op = e.Op&^Create | Write
+	}
+	return e, true
+}
+
+// layerOf returns the index of the first filesystem in [from, to) containing name, or -1.
+func (w *Watcher) layerOf(name string, from, to int) int {
+	ofs := w.hub.ofs
+	for i := from; i < to; i++ {
+		if _, _, _, err := ofs.statRecursive(ofs.fss[i], name, false); err == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+func (w *Watcher) send(e Event) {
+	select {
+	case <-w.ctx.Done():
+	case w.events <- e:
+	}
+}
+
+// debouncer coalesces events per path or directory.
+type debouncer struct {
+	delay time.Duration
+	byDir bool
+
+	seq     int
+	pending map[string]*pendingEvent
+}
+
+type pendingEvent struct {
+	Event
+	seq      int
+	deadline time.Time
+}
+
+func newDebouncer(delay time.Duration, byDir bool) *debouncer {
+	return &debouncer{delay: delay, byDir: byDir, pending: make(map[string]*pendingEvent)}
+}
+
+func (d *debouncer) add(e Event, now time.Time) {
+	key := e.Name
+	if d.byDir {
+		key = filepath.Dir(e.Name)
+		e.Name, e.OldName, e.IsDir = key, "", true
+	}
+	p, found := d.pending[key]
+	if !found {
+		d.seq++
+		d.pending[key] = &pendingEvent{Event: e, seq: d.seq, deadline: now.Add(d.delay)}
+		return
+	}
+	if !d.byDir && p.Op&Create != 0 && p.Op&Remove == 0 && e.Op&Remove != 0 {
+		// Created and removed again.
+		delete(d.pending, key)
+		return
+	}
+	p.Op |= e.Op
+	p.Layer = e.Layer
+	if e.OldName != "" {
+		p.OldName = e.OldName
+	}
+	p.deadline = now.Add(d.delay)
+}
+
+// flush returns the events due at now in the order they were first received.
+func (d *debouncer) flush(now time.Time) []Event {
+	var due []*pendingEvent
+	for key, p := range d.pending {
+		if !p.deadline.After(now) {
+			due = append(due, p)
+			delete(d.pending, key)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].seq < due[j].seq })
+	events := make([]Event, len(due))
+	for i, p := range due {
+		events[i] = p.Event
+	}
+	return events
+}
+
+// next returns the earliest deadline of the pending events, if any.
+func (d *debouncer) next() (time.Time, bool) {
+	var (
+		deadline time.Time
+		found    bool
+	)
+	for _, p := range d.pending {
+		if !found || p.deadline.Before(deadline) {
+			deadline, found = p.deadline, true
+		}
+	}
+	return deadline, found
+}
@@ -0,0 +1,300 @@
+package overlayfs
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestWatchPoll(t *testing.T) {
+	c := qt.New(t)
+	fs1, fs2 := basicFs("1", "1"), basicFs("2", "2")
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+
+	w, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	c.Assert(afero.WriteFile(fs2, "mydir/new.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/new.txt", Op: Create, Layer: 1})
+
+	c.Assert(afero.WriteFile(fs1, "mydir/f1-1.txt", []byte("changed"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f1-1.txt", Op: Write, Layer: 0})
+
+	c.Assert(fs1.Chmod("mydir/f2-1.txt", 0o600), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f2-1.txt", Op: Chmod, Layer: 0})
+
+	c.Assert(fs2.Remove("mydir/new.txt"), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/new.txt", Op: Remove, Layer: 1})
+
+	// Root created after Watch started.
+	w2, err := ofs.Watch(WatchOptions{Root: "newdir", PollInterval: 10 * time.Millisecond})
+	c.Assert(err, qt.IsNil)
+	defer w2.Close()
+	c.Assert(afero.WriteFile(fs2, "newdir/f.txt", []byte("f"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, w2).Op, qt.Equals, Create)
+}
+
+type notifyFs struct {
+	afero.Fs
+	events chan Event
+}
+
+func (n *notifyFs) Notify(ctx context.Context, root string, events chan<- Event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-n.events:
+			events <- e
+		}
+	}
+}
+
+func TestWatchNotifyFs(t *testing.T) {
+	c := qt.New(t)
+	nfs := &notifyFs{Fs: basicFs("1", "1"), events: make(chan Event)}
+	ofs := New(Options{Fss: []afero.Fs{basicFs("2", "2"), nfs}})
+
+	w, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond})
+	c.Assert(err, qt.IsNil)
+
+	nfs.events <- Event{Name: "mydir/f1-1.txt", Op: Write}
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f1-1.txt", Op: Write, Layer: 1})
+	c.Assert(w.Close(), qt.IsNil)
+	_, ok := <-w.Events
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestOpString(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(Create.String(), qt.Equals, "CREATE")
+	c.Assert((Remove | Create).String(), qt.Equals, "CREATE|REMOVE")
+}
+
+func nextEvent(c *qt.C, w *Watcher) Event {
+	c.Helper()
+	select {
+	case e := <-w.Events:
+		return e
+	case err := <-w.Errors:
+		c.Fatal(err)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for event")
+	}
+	return Event{}
+}
+
+func TestDebouncer(t *testing.T) {
+	c := qt.New(t)
+	t0 := time.Now()
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+
+	d := newDebouncer(100*time.Millisecond, false)
+	d.add(Event{Name: "a/f1.txt", Op: Write}, at(0))
+	d.add(Event{Name: "a/f2.txt", Op: Create}, at(10))
+	d.add(Event{Name: "a/f1.txt", Op: Write}, at(50))
+	d.add(Event{Name: "a/f2.txt", Op: Write}, at(60))
+	d.add(Event{Name: "a/f3.txt", Op: Create}, at(70))
+	d.add(Event{Name: "a/f3.txt", Op: Remove}, at(80))
+	next, ok := d.next()
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(next, qt.Equals, at(150))
+	c.Assert(d.flush(at(149)), qt.HasLen, 0)
+	c.Assert(d.flush(at(150)), qt.DeepEquals, []Event{{Name: "a/f1.txt", Op: Write}})
+	c.Assert(d.flush(at(200)), qt.DeepEquals, []Event{{Name: "a/f2.txt", Op: Create | Write}})
+	_, ok = d.next()
+	c.Assert(ok, qt.IsFalse)
+
+	d = newDebouncer(100*time.Millisecond, true)
+	d.add(Event{Name: "a/f1.txt", Op: Write}, at(0))
+	d.add(Event{Name: "b/f1.txt", Op: Remove}, at(0))
+	d.add(Event{Name: "a/f2.txt", Op: Create, Layer: 1}, at(10))
+	c.Assert(d.flush(at(200)), qt.DeepEquals, []Event{{Name: "a", Op: Create | Write, Layer: 1, IsDir: true}, {Name: "b", Op: Remove, IsDir: true}})
+}
+
+func TestWatchDebounce(t *testing.T) {
+	c := qt.New(t)
+	fs1 := basicFs("1", "1")
+	ofs := New(Options{Fss: []afero.Fs{fs1, basicFs("2", "2")}})
+
+	w, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 5 * time.Millisecond, Debounce: 200 * time.Millisecond})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		c.Assert(afero.WriteFile(fs1, "mydir/f1-1.txt", []byte(strings.Repeat("x", i+10)), 0o666), qt.IsNil)
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f1-1.txt", Op: Write})
+	select {
+	case e := <-w.Events:
+		c.Fatalf("unexpected event %v", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestWatchShadowed(t *testing.T) {
+	c := qt.New(t)
+	fs1, fs2 := basicFs("1", "1"), basicFs("1", "2")
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+
+	w, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	// Shadowed by fs1.
+	c.Assert(afero.WriteFile(fs2, "mydir/f1-1.txt", []byte("changed"), 0o666), qt.IsNil)
+	time.Sleep(50 * time.Millisecond)
+	// Shadowing fs1 removed, the fs2 version becomes visible.
+	c.Assert(fs1.Remove("mydir/f1-1.txt"), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f1-1.txt", Op: Write, Layer: 1})
+
+	// Created on top of the visible fs2 version.
+	c.Assert(afero.WriteFile(fs1, "mydir/f1-1.txt", []byte("back"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f1-1.txt", Op: Write, Layer: 0})
+
+	c.Assert(afero.WriteFile(fs2, "mydir/f2-1.txt", []byte("shadowed"), 0o666), qt.IsNil)
+	c.Assert(afero.WriteFile(fs2, "mydir/f3.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f3.txt", Op: Create, Layer: 1})
+
+	wAll, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond, IncludeShadowed: true})
+	c.Assert(err, qt.IsNil)
+	defer wAll.Close()
+	c.Assert(afero.WriteFile(fs2, "mydir/f1-1.txt", []byte("changed again"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, wAll), qt.Equals, Event{Name: "mydir/f1-1.txt", Op: Write, Layer: 1})
+}
+
+func TestWatchRename(t *testing.T) {
+	c := qt.New(t)
+	fs1, fs2 := basicFs("1", "1"), afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+	c.Assert(fs2.Mkdir("mydir", 0o777), qt.IsNil)
+	c.Assert(afero.WriteFile(fs2, "mydir/os.txt", []byte("os"), 0o666), qt.IsNil)
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+
+	w, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond, DetectRenames: true})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	// Matched by hash.
+	c.Assert(fs1.Rename("mydir/f1-1.txt", "mydir/f3-1.txt"), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f3-1.txt", Op: Rename, OldName: "mydir/f1-1.txt"})
+
+	// Matched by inode.
+	c.Assert(fs2.Rename("mydir/os.txt", "mydir/os2.txt"), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/os2.txt", Op: Rename, Layer: 1, OldName: "mydir/os.txt"})
+
+	// Not the same file.
+	c.Assert(fs1.Remove("mydir/f3-1.txt"), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f3-1.txt", Op: Remove})
+	time.Sleep(30 * time.Millisecond)
+	c.Assert(afero.WriteFile(fs1, "mydir/f4-1.txt", []byte("f1-1"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f4-1.txt", Op: Create})
+
+	wWindow, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond, DetectRenames: true, RenameWindow: time.Second})
+	c.Assert(err, qt.IsNil)
+	defer wWindow.Close()
+	c.Assert(fs1.Remove("mydir/f4-1.txt"), qt.IsNil)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(afero.WriteFile(fs1, "mydir/f5-1.txt", []byte("f1-1"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, wWindow), qt.Equals, Event{Name: "mydir/f5-1.txt", Op: Rename, OldName: "mydir/f4-1.txt"})
+
+	// Empty files all have the same hash, so they're not matched by it.
+	c.Assert(afero.WriteFile(fs1, "mydir/empty1.txt", nil, 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, wWindow), qt.Equals, Event{Name: "mydir/empty1.txt", Op: Create})
+	c.Assert(fs1.Remove("mydir/empty1.txt"), qt.IsNil)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(afero.WriteFile(fs1, "mydir/empty2.txt", nil, 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, wWindow), qt.Equals, Event{Name: "mydir/empty2.txt", Op: Create})
+}
+
+func TestWatchRenameShadowed(t *testing.T) {
+	c := qt.New(t)
+	fs1, fs2 := basicFs("1", "1"), basicFs("2", "2")
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}})
+
+	w, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond, DetectRenames: true})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	// Renamed to a path shadowed by fs1; seen as a remove in the merged view.
+	c.Assert(fs2.Rename("mydir/f1-2.txt", "mydir/f1-1.txt"), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/f1-2.txt", Op: Remove, Layer: 1})
+}
+
+func TestWatchFilter(t *testing.T) {
+	c := qt.New(t)
+	fs1 := basicFs("1", "1")
+	ofs := New(Options{Fss: []afero.Fs{fs1}})
+
+	_, err := ofs.Watch(WatchOptions{Root: "mydir", Filter: &WatchFilter{Globs: []string{"["}}})
+	c.Assert(err, qt.ErrorMatches, `overlayfs: invalid glob.*`)
+
+	w, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond, Filter: &WatchFilter{Globs: []string{"*.md"}, Ops: Create | Write}})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	c.Assert(afero.WriteFile(fs1, "mydir/f3.txt", []byte("txt"), 0o666), qt.IsNil)
+	c.Assert(afero.WriteFile(fs1, "mydir/sub/f4.md", []byte("md"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/sub/f4.md", Op: Create})
+	c.Assert(fs1.Remove("mydir/sub/f4.md"), qt.IsNil)
+	c.Assert(afero.WriteFile(fs1, "mydir/sub/f5.md", []byte("md"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, w), qt.Equals, Event{Name: "mydir/sub/f5.md", Op: Create})
+
+	wDirs, err := ofs.Watch(WatchOptions{Root: "mydir", PollInterval: 10 * time.Millisecond, Filter: &WatchFilter{DirsOnly: true}})
+	c.Assert(err, qt.IsNil)
+	defer wDirs.Close()
+	c.Assert(afero.WriteFile(fs1, "mydir/sub2/f6.txt", []byte("txt"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, wDirs), qt.Equals, Event{Name: "mydir/sub2", Op: Create, IsDir: true})
+	c.Assert(fs1.RemoveAll("mydir/sub2"), qt.IsNil)
+	c.Assert(nextEvent(c, wDirs), qt.Equals, Event{Name: "mydir/sub2", Op: Remove, IsDir: true})
+
+	f := &WatchFilter{Globs: []string{"mydir/*/f?.txt"}}
+	c.Assert(f.match(Event{Name: "mydir/sub/f1.txt"}), qt.IsTrue)
+	c.Assert(f.match(Event{Name: "mydir/f1.txt"}), qt.IsFalse)
+	c.Assert(f.match(Event{Name: "other/f.txt", OldName: "mydir/sub/f1.txt"}), qt.IsTrue)
+}
+
+func TestWatchHub(t *testing.T) {
+	c := qt.New(t)
+	fs1 := basicFs("1", "1")
+	ofs := New(Options{Fss: []afero.Fs{fs1, basicFs("2", "2")}})
+
+	h, err := ofs.NewWatchHub(WatchOptions{PollInterval: 10 * time.Millisecond})
+	c.Assert(err, qt.IsNil)
+	defer h.Close()
+
+	all, err := h.Watch(WatchOptions{})
+	c.Assert(err, qt.IsNil)
+	md, err := h.Watch(WatchOptions{Filter: &WatchFilter{Globs: []string{"*.md"}}})
+	c.Assert(err, qt.IsNil)
+	sub, err := h.Watch(WatchOptions{Root: "sub"})
+	c.Assert(err, qt.IsNil)
+	slow, err := h.Watch(WatchOptions{Buffer: 1, SlowConsumer: SlowConsumerDrop})
+	c.Assert(err, qt.IsNil)
+	defer slow.Close()
+
+	c.Assert(afero.WriteFile(fs1, "mydir/f.md", []byte("md"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, all), qt.Equals, Event{Name: "mydir/f.md", Op: Create})
+	c.Assert(nextEvent(c, md), qt.Equals, Event{Name: "mydir/f.md", Op: Create})
+
+	// Closing one Watcher does not affect the others.
+	c.Assert(md.Close(), qt.IsNil)
+	c.Assert(afero.WriteFile(fs1, "sub/f.txt", []byte("txt"), 0o666), qt.IsNil)
+	c.Assert(nextEvent(c, all), qt.Equals, Event{Name: "sub", Op: Create, IsDir: true})
+	c.Assert(nextEvent(c, all), qt.Equals, Event{Name: "sub/f.txt", Op: Create})
+	c.Assert(nextEvent(c, sub), qt.Equals, Event{Name: "sub", Op: Create, IsDir: true})
+	c.Assert(nextEvent(c, sub), qt.Equals, Event{Name: "sub/f.txt", Op: Create})
+
+	// The slow Watcher was never read from.
+	c.Assert(slow.Dropped() > 0, qt.IsTrue)
+
+	c.Assert(h.Close(), qt.IsNil)
+	_, ok := <-all.Events
+	c.Assert(ok, qt.IsFalse)
+	c.Assert(all.Close(), qt.IsNil)
+}
@@ -0,0 +1,178 @@
+package overlayfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// poller detects changes in a filesystem by comparing manifests of its files.
+type poller struct {
+	fs       afero.Fs
+	layer    int
+	root     string
+	manifest map[string]fileState
+
+	detectRenames bool
+	renameWindow  time.Duration
+
+	// Files removed, waiting for a matching created file.
+	removed map[string]removedFile
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+
+	// Set if detectRenames is enabled.
+	ino  uint64
+	hash string
+}
+
+type removedFile struct {
+	fileState
+	at time.Time
+}
+
+// sameFile reports whether s and other identify the same file.
+func (s fileState) sameFile(other fileState) bool {
+	if s.mode.Type() != other.mode.Type() {
+		return false
+	}
+	if s.ino != 0 || other.ino != 0 {
+		return s.ino == other.ino
+	}
+	// All empty files have the same hash, so they can't be told apart.
+	return s.mode.IsRegular() && s.size > 0 && s.size == other.size && s.hash == other.hash
+}
+
+func (p *poller) scan() (map[string]fileState, error) {
+	m := make(map[string]fileState)
+	err := afero.Walk(p.fs, p.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The root does not exist in this filesystem (yet),
+				// or the file was removed while walking.
+				return nil
+			}
+			return err
+		}
+		s := fileState{size: fi.Size(), modTime: fi.ModTime(), mode: fi.Mode()}
+		if p.detectRenames {
+			if ino, ok := fileID(fi); ok {
+				s.ino = ino
+			} else if s.mode.IsRegular() {
+				if old, found := p.manifest[path]; found && old.size == s.size && old.modTime.Equal(s.modTime) {
+					s.hash = old.hash
+				} else if s.hash, err = p.hashFile(path); err != nil {
+					if os.IsNotExist(err) {
+						return nil
+					}
+					return err
+				}
+			}
+		}
+		m[path] = s
+		return nil
+	})
+	return m, err
+}
+
+func (p *poller) hashFile(name string) (string, error) {
+	f, err := p.fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// poll scans the filesystem and returns the changes since the previous scan, sorted by name.
+func (p *poller) poll() ([]Event, error) {
+	m, err := p.scan()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var (
+		events  []Event
+		created []string
+	)
+	for name, s := range m {
+		old, found := p.manifest[name]
+		var op Op
+		switch {
+		case !found:
+			op = Create
+		case old.mode.IsDir() != s.mode.IsDir():
+			// Replaced.
+			op = Remove | Create
+		default:
+			if !s.mode.IsDir() && (old.size != s.size || !old.modTime.Equal(s.modTime)) {
+				op |= Write
+			}
+			if old.mode != s.mode {
+				op |= Chmod
+			}
+		}
+		if op == Create && p.detectRenames {
+			created = append(created, name)
+			continue
+		}
+		if op != 0 {
+			events = append(events, Event{Name: name, Op: op, Layer: p.layer, IsDir: s.mode.IsDir()})
+		}
+	}
+	for name, s := range p.manifest {
+		if _, found := m[name]; !found {
+			if p.detectRenames {
+				p.removed[name] = removedFile{fileState: s, at: now}
+				continue
+			}
+			events = append(events, Event{Name: name, Op: Remove, Layer: p.layer, IsDir: s.mode.IsDir()})
+		}
+	}
+
+	if p.detectRenames {
+		sort.Strings(created)
+		removed := make([]string, 0, len(p.removed))
+		for name := range p.removed {
+			removed = append(removed, name)
+		}
+		sort.Strings(removed)
+		for _, name := range created {
+			op := Create
+			var oldName string
+			for i, r := range removed {
+				if r != "" && p.removed[r].sameFile(m[name]) {
+					op, oldName = Rename, r
+					delete(p.removed, r)
+					removed[i] = ""
+					break
+				}
+			}
+			events = append(events, Event{Name: name, Op: op, Layer: p.layer, OldName: oldName, IsDir: m[name].mode.IsDir()})
+		}
+		for name, r := range p.removed {
+			if !now.Before(r.at.Add(p.renameWindow)) {
+				events = append(events, Event{Name: name, Op: Remove, Layer: p.layer, IsDir: r.mode.IsDir()})
+				delete(p.removed, name)
+			}
+		}
+	}
+
+	p.manifest = m
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events, nil
+}
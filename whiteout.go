@@ -0,0 +1,125 @@
+package overlayfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+// Whiteouts are marker files named as in OCI image layers, e.g. ".wh.name" for name.
+// A whiteout in a filesystem hides name, and anything below it, in the filesystems after it.
+
+// isWhiteout reports whether name is a whiteout marker.
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ociWhiteoutPrefix)
+}
+
+// whiteoutName returns the name of the whiteout marker for name.
+func whiteoutName(name string) string {
+	dir, base := filepath.Split(filepath.Clean(name))
+	return filepath.Join(dir, ociWhiteoutPrefix+base)
+}
+
+// whitedOut reports whether the filesystem at index i has a whiteout for name or any of its parents.
+func (ofs *OverlayFs) whitedOut(i int, name string) bool {
+	if i == len(ofs.fss)-1 {
+		// Nothing to hide.
+		return false
+	}
+	for name = filepath.Clean(name); name != "." && name != string(filepath.Separator); name = filepath.Dir(name) {
+		if _, _, _, err := ofs.statLayer(i, whiteoutName(name), false); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// removeWhiteout removes name from wfs, the filesystem at index layer, and writes a whiteout
+// for it if it's still found in the other filesystems.
+// If all is set, name is removed with RemoveAll.
+func (ofs *OverlayFs) removeWhiteout(op string, wfs afero.Fs, name string, all bool) error {
+	defer ofs.caches.invalidate()
+	_, fi, _, err := ofs.statLayers(name, true)
+	if err != nil {
+		if all && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if all {
+		err = wfs.RemoveAll(name)
+	} else {
+		if fi.IsDir() {
+			if empty, err := ofs.isEmptyDir(name); err != nil {
+				return err
+			} else if !empty {
+				return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+		if err = wfs.Remove(name); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return ofs.whiteout(wfs, name)
+}
+
+// whiteout writes a whiteout for name to wfs if name is found in the overlay.
+func (ofs *OverlayFs) whiteout(wfs afero.Fs, name string) error {
+	if _, _, _, err := ofs.statLayers(name, true); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	wh := whiteoutName(name)
+	if err := wfs.MkdirAll(filepath.Dir(wh), 0o777); err != nil {
+		return err
+	}
+	f, err := wfs.Create(wh)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (ofs *OverlayFs) isEmptyDir(name string) (bool, error) {
+	f, err := ofs.open(name, false)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return len(names) == 0, nil
+}
+
+// hideWhiteouts removes the entries in hidden and the whiteout markers from entries,
+// and adds the names whited out by the markers to hidden.
+func hideWhiteouts(entries []fs.DirEntry, hidden *map[string]bool) []fs.DirEntry {
+	var whitedOut []string
+	entries = slices.DeleteFunc(entries, func(e fs.DirEntry) bool {
+		if name, ok := strings.CutPrefix(e.Name(), ociWhiteoutPrefix); ok {
+			whitedOut = append(whitedOut, name)
+			return true
+		}
+		return (*hidden)[e.Name()]
+	})
+	for _, name := range whitedOut {
+		if *hidden == nil {
+			*hidden = make(map[string]bool)
+		}
+		(*hidden)[name] = true
+	}
+	return entries
+}
@@ -0,0 +1,87 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestWhiteouts(t *testing.T) {
+	c := qt.New(t)
+
+	fs1 := basicFs("1", "1")
+	ofs := New(Options{Fss: []afero.Fs{fs1, basicFs("2", "2")}, FirstWritable: true, Whiteouts: true})
+	notExist := func(name string) {
+		c.Helper()
+		_, err := ofs.Stat(name)
+		c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	}
+
+	// Only in the lower filesystem.
+	c.Assert(ofs.Remove("mydir/f1-2.txt"), qt.IsNil)
+	notExist("mydir/f1-2.txt")
+	_, err := fs1.Stat(filepath.FromSlash("mydir/.wh.f1-2.txt"))
+	c.Assert(err, qt.IsNil)
+	notExist("mydir/.wh.f1-2.txt")
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.DeepEquals, []string{"f1-1.txt", "f2-1.txt", "f2-2.txt"})
+	c.Assert(ofs.Remove("mydir/f1-2.txt"), qt.ErrorIs, fs.ErrNotExist)
+
+	// Recreated.
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-2.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(readFile(c, ofs, "mydir/f1-2.txt"), qt.Equals, "new")
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.HasLen, 4)
+
+	// In both.
+	c.Assert(ofs.Remove("mydir/f2-1.txt"), qt.IsNil)
+	notExist("mydir/f2-1.txt")
+	// Only in the writable filesystem: no whiteout needed.
+	c.Assert(afero.WriteFile(ofs, "mydir/new.txt", []byte("new"), 0o666), qt.IsNil)
+	c.Assert(ofs.Remove("mydir/new.txt"), qt.IsNil)
+	_, err = fs1.Stat(filepath.FromSlash("mydir/.wh.new.txt"))
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+
+	// Directories.
+	c.Assert(ofs.Remove("mydir"), qt.Not(qt.IsNil))
+	c.Assert(ofs.RemoveAll("mydir"), qt.IsNil)
+	notExist("mydir")
+	notExist("mydir/f2-2.txt")
+	c.Assert(readDirnames(c, ofs, ""), qt.HasLen, 0)
+	c.Assert(ofs.RemoveAll("mydir"), qt.IsNil)
+
+	// A directory created again hides the old content.
+	c.Assert(afero.WriteFile(ofs, "mydir/a.txt", []byte("a"), 0o666), qt.IsNil)
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.DeepEquals, []string{"a.txt"})
+	notExist("mydir/f2-2.txt")
+}
+
+func TestWhiteoutsRename(t *testing.T) {
+	c := qt.New(t)
+
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}, FirstWritable: true, Whiteouts: true})
+	c.Assert(afero.WriteFile(ofs, "mydir/f2-2.txt", []byte("upper"), 0o666), qt.IsNil)
+	c.Assert(ofs.Rename("mydir/f2-2.txt", "mydir/renamed.txt"), qt.IsNil)
+	_, err := ofs.Stat("mydir/f2-2.txt")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(readFile(c, ofs, "mydir/renamed.txt"), qt.Equals, "upper")
+}
+
+func TestWhiteoutsTrash(t *testing.T) {
+	c := qt.New(t)
+
+	trash := afero.NewMemMapFs()
+	ofs := New(Options{Fss: []afero.Fs{basicFs("1", "1"), basicFs("2", "2")}, FirstWritable: true, Whiteouts: true, Trash: trash})
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-2.txt", []byte("upper"), 0o666), qt.IsNil)
+	c.Assert(ofs.Trash("mydir/f1-2.txt"), qt.IsNil)
+	_, err := ofs.Stat("mydir/f1-2.txt")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+	c.Assert(ofs.Restore("mydir/f1-2.txt"), qt.IsNil)
+	c.Assert(readFile(c, ofs, "mydir/f1-2.txt"), qt.Equals, "upper")
+
+	c.Assert(ofs.Trash("mydir"), qt.IsNil)
+	c.Assert(readDirnames(c, ofs, ""), qt.HasLen, 0)
+	c.Assert(ofs.Restore("mydir"), qt.IsNil)
+	c.Assert(readDirnames(c, ofs, "mydir"), qt.DeepEquals, []string{"f1-1.txt", "f1-2.txt", "f2-1.txt", "f2-2.txt"})
+}
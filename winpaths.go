@@ -0,0 +1,168 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ afero.Fs      = (*windowsFs)(nil)
+	_ afero.Lstater = (*windowsFs)(nil)
+	_ XattrFs       = (*windowsFs)(nil)
+)
+
+// isReservedName reports whether the path element elem is a reserved Windows device name.
+// Windows ignores any extension and trailing spaces, so "nul.txt" and "NUL " are also reserved.
+func isReservedName(elem string) bool {
+	if i := strings.IndexByte(elem, '.'); i >= 0 {
+		elem = elem[:i]
+	}
+	elem = strings.ToUpper(strings.TrimRight(elem, " "))
+	switch elem {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	if len(elem) == 4 && (strings.HasPrefix(elem, "COM") || strings.HasPrefix(elem, "LPT")) {
+		return elem[3] >= '1' && elem[3] <= '9'
+	}
+	return false
+}
+
+// windowsFs applies Windows path semantics to a filesystem:
+// both / and \ are path separators, reserved device names are rejected
+// and names are matched case-insensitively.
+type windowsFs struct {
+	nameFs
+}
+
+func newWindowsFs(fs afero.Fs) *windowsFs {
+	w := &windowsFs{nameFs: nameFs{fs: fs}}
+	w.name = w.resolve
+	return w
+}
+
+// resolve normalizes name and resolves it case-insensitively to an existing path in w.fs.
+// Any trailing path elements not found are kept as is.
+func (w *windowsFs) resolve(op, name string) (string, error) {
+	name = filepath.FromSlash(strings.ReplaceAll(name, `\`, "/"))
+	elems := strings.Split(name, string(filepath.Separator))
+	for _, elem := range elems {
+		if isReservedName(elem) {
+			return "", &fs.PathError{Op: op, Path: name, Err: ErrReservedName}
+		}
+	}
+
+	if _, err := w.fs.Stat(name); err == nil {
+		// Fast path.
+		return name, nil
+	}
+
+	var resolved string
+	if strings.HasPrefix(name, string(filepath.Separator)) {
+		resolved = string(filepath.Separator)
+	}
+	for i, elem := range elems {
+		if elem == "" || elem == "." {
+			continue
+		}
+		if elem == ".." {
+			resolved = filepath.Join(resolved, elem)
+			continue
+		}
+		candidate := filepath.Join(resolved, elem)
+		if _, err := w.fs.Stat(candidate); err == nil {
+			resolved = candidate
+			continue
+		}
+		match, found, err := w.lookup(resolved, elem)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if !found {
+			return filepath.Join(append([]string{resolved}, elems[i:]...)...), nil
+		}
+		resolved = filepath.Join(resolved, match)
+	}
+	return resolved, nil
+}
+
+// lookup finds the entry in dir matching elem case-insensitively.
+// It returns ErrAmbiguous if more than one entry matches, e.g. File.txt and FILE.txt
+// in a case-sensitive filesystem.
+func (w *windowsFs) lookup(dir, elem string) (string, bool, error) {
+	if dir == "" {
+		dir = "."
+	}
+	f, err := w.fs.Open(dir)
+	if err != nil {
+		return "", false, nil
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return "", false, nil
+	}
+	var match string
+	for _, name := range names {
+		if strings.EqualFold(name, elem) {
+			if match != "" {
+				return "", false, ErrAmbiguous
+			}
+			match = name
+		}
+	}
+	return match, match != "", nil
+}
+
+func (w *windowsFs) GetXattr(name, attr string) ([]byte, error) {
+	xfs, name, err := w.xattrFs("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xfs.GetXattr(name, attr)
+}
+
+func (w *windowsFs) SetXattr(name, attr string, value []byte) error {
+	xfs, name, err := w.xattrFs("setxattr", name)
+	if err != nil {
+		return err
+	}
+	return xfs.SetXattr(name, attr, value)
+}
+
+func (w *windowsFs) ListXattr(name string) ([]string, error) {
+	xfs, name, err := w.xattrFs("listxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xfs.ListXattr(name)
+}
+
+func (w *windowsFs) xattrFs(op, name string) (XattrFs, string, error) {
+	xfs, ok := asXattrFs(w.fs)
+	if !ok {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: ErrXattrNotSupported}
+	}
+	name, err := w.resolve(op, name)
+	return xfs, name, err
+}
+
+// caseInsensitiveDirMerger is the default DirsMerger when Options.WindowsPaths is set.
+var caseInsensitiveDirMerger = func(lofi, bofi []fs.DirEntry) []fs.DirEntry {
+	for _, bofi := range bofi {
+		var found bool
+		for _, lofi := range lofi {
+			if strings.EqualFold(bofi.Name(), lofi.Name()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			lofi = append(lofi, bofi)
+		}
+	}
+	return lofi
+}
@@ -0,0 +1,68 @@
+package overlayfs
+
+import (
+	"sort"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestWindowsPaths(t *testing.T) {
+	c := qt.New(t)
+	fs1 := fsFromTxtTar(`
+-- MyDir/File.txt --
+fs1
+`)
+	fs2 := fsFromTxtTar(`
+-- mydir/file.TXT --
+fs2
+-- mydir/other.txt --
+other
+`)
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}, FirstWritable: true, WindowsPaths: true})
+
+	c.Assert(readFile(c, ofs, `mydir\FILE.txt`), qt.Equals, "fs1")
+	c.Assert(readFile(c, ofs, "MYDIR/Other.TXT"), qt.Equals, "other")
+	_, err := ofs.Stat("mydir/none.txt")
+	c.Assert(err, qt.ErrorIs, afero.ErrFileNotFound)
+
+	names := readDirnames(c, ofs, "MYDIR")
+	sort.Strings(names)
+	c.Assert(names, qt.DeepEquals, []string{"File.txt", "other.txt"})
+
+	for _, name := range []string{"mydir/con", `mydir\NUL.txt`, "lpt1/file.txt", "mydir/Com9 .txt"} {
+		_, err := ofs.Stat(name)
+		c.Assert(err, qt.ErrorIs, ErrReservedName, qt.Commentf(name))
+	}
+	_, err = ofs.Create("mydir/aux")
+	c.Assert(err, qt.ErrorIs, ErrReservedName)
+
+	// Writes resolve existing directories in the writable filesystem.
+	f, err := ofs.Create(`MYDIR\new.txt`)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	_, err = fs1.Stat("MyDir/new.txt")
+	c.Assert(err, qt.IsNil)
+
+	// Names only differing in case can't be told apart.
+	c.Assert(afero.WriteFile(fs2, "mydir/OTHER.txt", []byte("OTHER"), 0o666), qt.IsNil)
+	_, err = ofs.Stat("mydir/Other.txt")
+	c.Assert(err, qt.ErrorIs, ErrAmbiguous)
+	c.Assert(readFile(c, ofs, "mydir/OTHER.txt"), qt.Equals, "OTHER")
+
+	// Not enabled.
+	ofs = New(Options{Fss: []afero.Fs{fs1, fs2}})
+	_, err = ofs.Stat("mydir/FILE.txt")
+	c.Assert(err, qt.ErrorIs, afero.ErrFileNotFound)
+}
+
+func TestIsReservedName(t *testing.T) {
+	c := qt.New(t)
+	for _, name := range []string{"CON", "con", "Nul.txt", "COM1", "lpt9.tar.gz", "AUX "} {
+		c.Assert(isReservedName(name), qt.IsTrue, qt.Commentf(name))
+	}
+	for _, name := range []string{"CONSOLE", "COM0", "COM", "LPT10", "file.con", ""} {
+		c.Assert(isReservedName(name), qt.IsFalse, qt.Commentf(name))
+	}
+}
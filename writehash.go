@@ -0,0 +1,131 @@
+package overlayfs
+
+import (
+	"hash"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// LastWriteDigest returns the digest of the content last written to name through the overlay,
+// see Options.HashOnWrite.
+// It's not found if the file wasn't written from the start in one sequential pass,
+// e.g. opened with O_APPEND or written with WriteAt.
+// It's not updated by other operations, e.g. Rename and Remove.
+func (ofs *OverlayFs) LastWriteDigest(name string) ([]byte, bool) {
+	if ofs.writeDigests == nil {
+		return nil, false
+	}
+	return ofs.writeDigests.get(name)
+}
+
+// writeDigests holds the digests computed by the files written with Options.HashOnWrite.
+// It's shared by the shallow copies of an OverlayFs.
+type writeDigests struct {
+	newHash  func() hash.Hash
+	onDigest func(name string, digest []byte)
+
+	mu      sync.Mutex
+	digests map[string][]byte
+}
+
+func newWriteDigests(newHash func() hash.Hash, onDigest func(name string, digest []byte)) *writeDigests {
+	return &writeDigests{newHash: newHash, onDigest: onDigest, digests: make(map[string][]byte)}
+}
+
+func (d *writeDigests) get(name string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	digest, found := d.digests[filepath.Clean(name)]
+	return digest, found
+}
+
+func (d *writeDigests) set(name string, digest []byte) {
+	d.mu.Lock()
+	if digest == nil {
+		delete(d.digests, filepath.Clean(name))
+	} else {
+		d.digests[filepath.Clean(name)] = digest
+	}
+	d.mu.Unlock()
+	if digest != nil && d.onDigest != nil {
+		d.onDigest(name, digest)
+	}
+}
+
+// hashOnWrite wraps the files opened for writing with flag in a file hashing the content written,
+// if Options.HashOnWrite is set.
+func (ofs *OverlayFs) hashOnWrite(name string, flag int) func(afero.File, error) (afero.File, error) {
+	return func(f afero.File, err error) (afero.File, error) {
+		if err != nil || ofs.writeDigests == nil {
+			return f, err
+		}
+		hf := &hashFile{File: f, d: ofs.writeDigests, name: name}
+		// The content is only known if the file starts out empty.
+		if flag&(os.O_TRUNC|os.O_EXCL) != 0 && flag&os.O_APPEND == 0 {
+			hf.h = ofs.writeDigests.newHash()
+		}
+		return hf, nil
+	}
+}
+
+// hashFile hashes the content written sequentially.
+type hashFile struct {
+	afero.File
+	d    *writeDigests
+	name string
+	h    hash.Hash // Nil if the content written isn't known.
+
+	off     int64 // The file offset.
+	written int64 // The number of bytes hashed.
+}
+
+func (f *hashFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if f.h != nil {
+		if f.off == f.written {
+			f.h.Write(p[:n])
+			f.written += int64(n)
+		} else {
+			f.h = nil
+		}
+	}
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *hashFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *hashFile) WriteAt(p []byte, off int64) (int, error) {
+	f.h = nil
+	return f.File.WriteAt(p, off)
+}
+
+func (f *hashFile) Seek(offset int64, whence int) (int64, error) {
+	off, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.off = off
+	}
+	return off, err
+}
+
+func (f *hashFile) Truncate(size int64) error {
+	f.h = nil
+	return f.File.Truncate(size)
+}
+
+func (f *hashFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		var digest []byte
+		if f.h != nil {
+			digest = f.h.Sum(nil)
+		}
+		f.d.set(f.name, digest)
+	}
+	return err
+}
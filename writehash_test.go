@@ -0,0 +1,75 @@
+package overlayfs
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestHashOnWrite(t *testing.T) {
+	c := qt.New(t)
+
+	var names []string
+	ofs := New(Options{
+		Fss:           []afero.Fs{basicFs("1", "1")},
+		FirstWritable: true,
+		HashOnWrite:   sha256.New,
+		OnWriteDigest: func(name string, digest []byte) { names = append(names, name) },
+	})
+	sum := func(s string) []byte {
+		h := sha256.Sum256([]byte(s))
+		return h[:]
+	}
+
+	c.Assert(afero.WriteFile(ofs, "a.txt", []byte("hello world"), 0o666), qt.IsNil)
+	digest, found := ofs.LastWriteDigest("a.txt")
+	c.Assert(found, qt.IsTrue)
+	c.Assert(digest, qt.DeepEquals, sum("hello world"))
+
+	f, err := ofs.Create("b.txt")
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString("hello ")
+	c.Assert(err, qt.IsNil)
+	_, err = io.WriteString(f, "world")
+	c.Assert(err, qt.IsNil)
+	// Seeking back and forth is fine.
+	_, err = f.Seek(0, io.SeekStart)
+	c.Assert(err, qt.IsNil)
+	_, err = f.Seek(0, io.SeekEnd)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	digest, found = ofs.LastWriteDigest("b.txt")
+	c.Assert(found, qt.IsTrue)
+	c.Assert(digest, qt.DeepEquals, sum("hello world"))
+	c.Assert(names, qt.DeepEquals, []string{"a.txt", "b.txt"})
+
+	// Not written sequentially from the start.
+	f, err = ofs.OpenFile("a.txt", os.O_WRONLY|os.O_APPEND, 0o666)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString("!")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	_, found = ofs.LastWriteDigest("a.txt")
+	c.Assert(found, qt.IsFalse)
+
+	f, err = ofs.Create("b.txt")
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString("hello")
+	c.Assert(err, qt.IsNil)
+	_, err = f.Seek(0, io.SeekStart)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString("J")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	_, found = ofs.LastWriteDigest("b.txt")
+	c.Assert(found, qt.IsFalse)
+	c.Assert(readFile(c, ofs, "b.txt"), qt.Equals, "Jello")
+	c.Assert(names, qt.HasLen, 2)
+
+	_, found = New(Options{}).LastWriteDigest("a.txt")
+	c.Assert(found, qt.IsFalse)
+}
@@ -9,88 +9,166 @@ import (
 
 // Chmod changes the mode of the named file to mode.
 func (ofs *OverlayFs) Chmod(name string, mode os.FileMode) error {
-	if !ofs.firstWritable {
-		return os.ErrPermission
+	wfs, err := ofs.writeFsForCopyUp("chmod", name)
+	if err != nil {
+		return err
 	}
-	return ofs.writeFs().Chmod(name, mode)
+	defer ofs.caches.invalidate()
+	return wfs.Chmod(name, mode)
 }
 
 // Chown changes the uid and gid of the named file.
 func (ofs *OverlayFs) Chown(name string, uid, gid int) error {
-	if !ofs.firstWritable {
-		return os.ErrPermission
+	wfs, err := ofs.writeFsForCopyUp("chown", name)
+	if err != nil {
+		return err
 	}
-	return ofs.writeFs().Chown(name, uid, gid)
+	defer ofs.caches.invalidate()
+	return wfs.Chown(name, uid, gid)
 }
 
 // Chtimes changes the access and modification times of the named file
 func (ofs *OverlayFs) Chtimes(name string, atime, mtime time.Time) error {
-	if !ofs.firstWritable {
-		return os.ErrPermission
+	wfs, err := ofs.writeFsForCopyUp("chtimes", name)
+	if err != nil {
+		return err
 	}
-	return ofs.writeFs().Chtimes(name, atime, mtime)
+	defer ofs.caches.invalidate()
+	return wfs.Chtimes(name, atime, mtime)
 }
 
 // Mkdir creates a directory in the filesystem, return an error if any
 // happens.
 func (ofs *OverlayFs) Mkdir(name string, perm os.FileMode) error {
-	if !ofs.firstWritable {
-		return os.ErrPermission
+	wfs, err := ofs.writeFsFor("mkdir", name)
+	if err != nil {
+		return err
 	}
-	return ofs.writeFs().Mkdir(name, perm)
+	defer ofs.caches.invalidate()
+	return wfs.Mkdir(name, perm)
 }
 
 // MkdirAll creates a directory path and all parents that does not exist
 // yet.
 func (ofs *OverlayFs) MkdirAll(path string, perm os.FileMode) error {
-	if !ofs.firstWritable {
-		return os.ErrPermission
+	wfs, err := ofs.writeFsFor("mkdir", path)
+	if err != nil {
+		return err
 	}
-	return ofs.writeFs().MkdirAll(path, perm)
+	defer ofs.caches.invalidate()
+	return wfs.MkdirAll(path, perm)
 }
 
 // OpenFile opens a file using the given flags and the given mode.
 func (ofs *OverlayFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
 	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
-		if !ofs.firstWritable {
-			return nil, os.ErrPermission
-		}
-		return ofs.writeFs().OpenFile(name, flag, perm)
+		return ofs.trackOpen(name)(ofs.onWritten(name, flag)(ofs.hashOnWrite(name, flag)(ofs.openFileForWrite("open", name, flag, perm))))
 	}
-	return ofs.Open(name)
+	defer ofs.foregroundOp()()
+	return ofs.trackOpen(name)(ofs.open(name, ofs.dirEntryArena))
 }
 
 // Remove removes a file identified by name, returning an error, if any
 // happens.
 func (ofs *OverlayFs) Remove(name string) error {
-	if !ofs.firstWritable {
-		return os.ErrPermission
+	wfs, err := ofs.writeFsFor("remove", name)
+	if err != nil {
+		return err
+	}
+	defer ofs.caches.invalidate()
+	if ofs.whiteouts {
+		return ofs.removeWhiteout("remove", wfs, name, false)
 	}
-	return ofs.writeFs().Remove(name)
+	return wfs.Remove(name)
 }
 
 // RemoveAll removes a directory path and any children it contains. It
 // does not fail if the path does not exist (return nil).
 func (ofs *OverlayFs) RemoveAll(path string) error {
-	if !ofs.firstWritable {
-		return os.ErrPermission
+	wfs, err := ofs.writeFsFor("removeall", path)
+	if err != nil {
+		return err
+	}
+	defer ofs.caches.invalidate()
+	if ofs.whiteouts {
+		return ofs.removeWhiteout("removeall", wfs, path, true)
 	}
-	return ofs.writeFs().RemoveAll(path)
+	return wfs.RemoveAll(path)
 }
 
 // Rename renames a file.
+// If Options.WriteFs or WriteRules route oldname and newname to different filesystems,
+// which can't rename between them, it's copied and then removed, which isn't atomic.
+// The strategy used is logged at debug level, see Options.Logger.
 func (ofs *OverlayFs) Rename(oldname, newname string) error {
-	if !ofs.firstWritable {
-		return os.ErrPermission
+	wfs, err := ofs.writeFsForCopyUp("rename", oldname)
+	if err != nil {
+		return err
 	}
-	return ofs.writeFs().Rename(oldname, newname)
+	defer ofs.caches.invalidate()
+	if len(ofs.writeRules) > 0 || ofs.writeFs != nil {
+		oldLayer, _, err := ofs.writeTarget("rename", oldname, false)
+		if err != nil {
+			return err
+		}
+		newLayer, _, err := ofs.writeTarget("rename", newname, false)
+		if err != nil {
+			return err
+		}
+		if oldLayer != newLayer {
+			return ofs.renameAcross(wfs, oldname, newname, newLayer)
+		}
+	}
+	ofs.logger.Debug("overlayfs: rename", "old", oldname, "new", newname, "strategy", "native")
+	if err := wfs.Rename(oldname, newname); err != nil || !ofs.whiteouts {
+		return err
+	}
+	return ofs.whiteout(wfs, oldname)
+}
+
+// renameAcross renames oldname in wfs to newname in the filesystem at index newLayer,
+// which can't be done natively, by copying and then removing it.
+func (ofs *OverlayFs) renameAcross(wfs afero.Fs, oldname, newname string, newLayer int) error {
+	ofs.logger.Debug("overlayfs: rename", "old", oldname, "new", newname, "strategy", "copy")
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if _, err := wfs.Stat(oldname); err != nil {
+		return linkErr(err)
+	}
+	dst, err := ofs.writeLayer("rename", newname, newLayer)
+	if err != nil {
+		return err
+	}
+	if err := ofs.copyTreeAs(dst, wfs, oldname, newname); err != nil {
+		return linkErr(err)
+	}
+	if err := wfs.RemoveAll(oldname); err != nil {
+		return linkErr(err)
+	}
+	if !ofs.whiteouts {
+		return nil
+	}
+	return ofs.whiteout(wfs, oldname)
+}
+
+// SymlinkIfPossible creates newname as a symbolic link to oldname in the writable filesystem,
+// if it supports symbolic links, e.g. the os filesystem.
+func (ofs *OverlayFs) SymlinkIfPossible(oldname, newname string) error {
+	wfs, err := ofs.writeFsFor("symlink", newname)
+	if err != nil {
+		return err
+	}
+	defer ofs.caches.invalidate()
+	if linker, ok := wfs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
 }
 
 // Create creates a file in the filesystem, returning the file and an
 // error, if any happens.
 func (ofs *OverlayFs) Create(name string) (afero.File, error) {
-	if !ofs.firstWritable {
-		return nil, os.ErrPermission
-	}
-	return ofs.writeFs().Create(name)
+	const flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	return ofs.trackOpen(name)(ofs.onWritten(name, flag)(ofs.hashOnWrite(name, flag)(ofs.openFileForWrite("create", name, flag, 0o666))))
 }
@@ -0,0 +1,61 @@
+package overlayfs
+
+import (
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// onWritten wraps the files opened for writing with flag to call Options.OnFileWritten
+// when closed, if set.
+func (ofs *OverlayFs) onWritten(name string, flag int) func(afero.File, error) (afero.File, error) {
+	return func(f afero.File, err error) (afero.File, error) {
+		if err != nil || ofs.onFileWritten == nil {
+			return f, err
+		}
+		return &writtenFile{File: f, name: name, fn: ofs.onFileWritten, modified: flag&(os.O_CREATE|os.O_TRUNC) != 0}, nil
+	}
+}
+
+// writtenFile calls fn on Close if it was created or modified.
+type writtenFile struct {
+	afero.File
+	name     string
+	fn       func(name string, size int64)
+	modified bool
+}
+
+func (f *writtenFile) Write(p []byte) (int, error) {
+	f.modified = true
+	return f.File.Write(p)
+}
+
+func (f *writtenFile) WriteAt(p []byte, off int64) (int, error) {
+	f.modified = true
+	return f.File.WriteAt(p, off)
+}
+
+func (f *writtenFile) WriteString(s string) (int, error) {
+	f.modified = true
+	return f.File.WriteString(s)
+}
+
+func (f *writtenFile) Truncate(size int64) error {
+	f.modified = true
+	return f.File.Truncate(size)
+}
+
+func (f *writtenFile) Close() error {
+	if !f.modified {
+		return f.File.Close()
+	}
+	var size int64
+	if fi, err := f.File.Stat(); err == nil {
+		size = fi.Size()
+	}
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	f.fn(f.name, size)
+	return nil
+}
@@ -0,0 +1,56 @@
+package overlayfs
+
+import (
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestOnFileWritten(t *testing.T) {
+	c := qt.New(t)
+
+	type written struct {
+		Name string
+		Size int64
+	}
+	var got []written
+	ofs := New(Options{
+		Fss:           []afero.Fs{basicFs("1", "1")},
+		FirstWritable: true,
+		OnFileWritten: func(name string, size int64) { got = append(got, written{name, size}) },
+	})
+
+	c.Assert(afero.WriteFile(ofs, "a.txt", []byte("hello"), 0o666), qt.IsNil)
+	f, err := ofs.Create("empty.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(got, qt.DeepEquals, []written{{"a.txt", 5}, {"empty.txt", 0}})
+
+	// Opened for writing, but not modified.
+	f, err = ofs.OpenFile("a.txt", os.O_WRONLY, 0o666)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(got, qt.HasLen, 2)
+
+	f, err = ofs.OpenFile("a.txt", os.O_WRONLY|os.O_APPEND, 0o666)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString(" world")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(got[2], qt.Equals, written{"a.txt", 11})
+
+	// Not called for failed closes.
+	c.Assert(readFile(c, New(Options{Fss: []afero.Fs{ofs}}), "a.txt"), qt.Equals, "hello world")
+	ofs = New(Options{
+		Fss:             []afero.Fs{basicFs("1", "1")},
+		FirstWritable:   true,
+		DetectConflicts: true,
+		OnFileWritten:   func(name string, size int64) { got = append(got, written{name, size}) },
+	})
+	c.Assert(readFile(c, ofs, "mydir/f1-1.txt"), qt.Equals, "f1-1")
+	c.Assert(afero.WriteFile(ofs.Filesystem(0), "mydir/f1-1.txt", []byte("changed"), 0o666), qt.IsNil)
+	c.Assert(afero.WriteFile(ofs, "mydir/f1-1.txt", []byte("mine"), 0o666), qt.ErrorIs, ErrConflict)
+	c.Assert(got, qt.HasLen, 3)
+}
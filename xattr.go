@@ -0,0 +1,254 @@
+package overlayfs
+
+import (
+	"io/fs"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ XattrFs = (*XattrMapFs)(nil)
+	_ XattrFs = nameFs{}
+)
+
+// XattrFs is implemented by filesystems supporting extended attributes.
+type XattrFs interface {
+	// GetXattr returns the value of the extended attribute attr of the named file.
+	GetXattr(name, attr string) ([]byte, error)
+
+	// SetXattr sets the value of the extended attribute attr of the named file.
+	SetXattr(name, attr string, value []byte) error
+
+	// ListXattr returns the names of the extended attributes of the named file.
+	ListXattr(name string) ([]string, error)
+}
+
+// GetXattr returns the value of the extended attribute attr of the named file,
+// read from the first filesystem containing the file.
+func (ofs *OverlayFs) GetXattr(name, attr string) ([]byte, error) {
+	xfs, err := ofs.xattrFsFor(name, "getxattr")
+	if err != nil {
+		return nil, err
+	}
+	return xfs.GetXattr(name, attr)
+}
+
+// ListXattr returns the names of the extended attributes of the named file,
+// read from the first filesystem containing the file.
+func (ofs *OverlayFs) ListXattr(name string) ([]string, error) {
+	xfs, err := ofs.xattrFsFor(name, "listxattr")
+	if err != nil {
+		return nil, err
+	}
+	return xfs.ListXattr(name)
+}
+
+// SetXattr sets the value of the extended attribute attr of the named file in the writable filesystem.
+func (ofs *OverlayFs) SetXattr(name, attr string, value []byte) error {
+	wfs, err := ofs.writeFsFor("setxattr", name)
+	if err != nil {
+		return err
+	}
+	defer ofs.caches.invalidate()
+	xfs, ok := asXattrFs(wfs)
+	if !ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs.SetXattr(name, attr, value)
+}
+
+func (ofs *OverlayFs) xattrFsFor(name, op string) (XattrFs, error) {
+	fs2, _, _, err := ofs.stat(name, false)
+	if err != nil {
+		return nil, err
+	}
+	xfs, ok := asXattrFs(fs2)
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: ErrXattrNotSupported}
+	}
+	return xfs, nil
+}
+
+func asXattrFs(fs afero.Fs) (XattrFs, bool) {
+	switch v := fs.(type) {
+	case XattrFs:
+		return v, true
+	case *afero.OsFs:
+		return osXattrFs{}, osXattrSupported
+	case *afero.BasePathFs:
+		if osXattrSupported && onOsFs(v) {
+			// Use the real paths on the OS filesystem, but report the names seen by the caller in errors.
+			return nameFs{fs: &afero.OsFs{}, name: func(op, name string) (string, error) {
+				return v.RealPath(name)
+			}, errPath: basePathErrPath(v)}, true
+		}
+	}
+	return nil, false
+}
+
+// onOsFs reports whether bfs is backed by the OS filesystem.
+func onOsFs(bfs *afero.BasePathFs) bool {
+	f, err := bfs.Open(string(filepath.Separator))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	bf, ok := f.(*afero.BasePathFile)
+	if !ok {
+		return false
+	}
+	_, ok = bf.File.(*os.File)
+	return ok
+}
+
+func (l nameFs) GetXattr(name, attr string) ([]byte, error) {
+	name, err := l.name("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	xfs, ok := asXattrFs(l.fs)
+	if !ok {
+		return nil, &iofs.PathError{Op: "getxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	v, err := xfs.GetXattr(name, attr)
+	return v, l.fixErr(err)
+}
+
+func (l nameFs) SetXattr(name, attr string, value []byte) error {
+	name, err := l.name("setxattr", name)
+	if err != nil {
+		return err
+	}
+	xfs, ok := asXattrFs(l.fs)
+	if !ok {
+		return &iofs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	return l.fixErr(xfs.SetXattr(name, attr, value))
+}
+
+func (l nameFs) ListXattr(name string) ([]string, error) {
+	name, err := l.name("listxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	xfs, ok := asXattrFs(l.fs)
+	if !ok {
+		return nil, &iofs.PathError{Op: "listxattr", Path: name, Err: ErrXattrNotSupported}
+	}
+	attrs, err := xfs.ListXattr(name)
+	return attrs, l.fixErr(err)
+}
+
+// XattrMapFs adds extended attribute support to a filesystem by
+// keeping the attributes in memory.
+type XattrMapFs struct {
+	afero.Fs
+
+	mu     sync.RWMutex
+	xattrs map[string]map[string][]byte
+}
+
+// NewXattrMapFs creates a new XattrMapFs wrapping fs.
+func NewXattrMapFs(fs afero.Fs) *XattrMapFs {
+	return &XattrMapFs{Fs: fs, xattrs: make(map[string]map[string][]byte)}
+}
+
+// GetXattr implements XattrFs.
+func (x *XattrMapFs) GetXattr(name, attr string) ([]byte, error) {
+	if _, err := x.Stat(name); err != nil {
+		return nil, err
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	v, found := x.xattrs[x.key(name)][attr]
+	if !found {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// SetXattr implements XattrFs.
+func (x *XattrMapFs) SetXattr(name, attr string, value []byte) error {
+	if _, err := x.Stat(name); err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	key := x.key(name)
+	m, found := x.xattrs[key]
+	if !found {
+		m = make(map[string][]byte)
+		x.xattrs[key] = m
+	}
+	m[attr] = append([]byte(nil), value...)
+	return nil
+}
+
+// ListXattr implements XattrFs.
+func (x *XattrMapFs) ListXattr(name string) ([]string, error) {
+	if _, err := x.Stat(name); err != nil {
+		return nil, err
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var attrs []string
+	for attr := range x.xattrs[x.key(name)] {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	return attrs, nil
+}
+
+// Remove removes the named file and its extended attributes.
+func (x *XattrMapFs) Remove(name string) error {
+	if err := x.Fs.Remove(name); err != nil {
+		return err
+	}
+	x.mu.Lock()
+	delete(x.xattrs, x.key(name))
+	x.mu.Unlock()
+	return nil
+}
+
+// RemoveAll removes path and any children it contains, including their extended attributes.
+func (x *XattrMapFs) RemoveAll(path string) error {
+	if err := x.Fs.RemoveAll(path); err != nil {
+		return err
+	}
+	key := x.key(path)
+	x.mu.Lock()
+	for k := range x.xattrs {
+		if k == key || strings.HasPrefix(k, key+string(filepath.Separator)) {
+			delete(x.xattrs, k)
+		}
+	}
+	x.mu.Unlock()
+	return nil
+}
+
+// Rename renames a file, moving its extended attributes with it.
+func (x *XattrMapFs) Rename(oldname, newname string) error {
+	if err := x.Fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	oldkey, newkey := x.key(oldname), x.key(newname)
+	x.mu.Lock()
+	for k, v := range x.xattrs {
+		if k == oldkey || strings.HasPrefix(k, oldkey+string(filepath.Separator)) {
+			delete(x.xattrs, k)
+			x.xattrs[newkey+strings.TrimPrefix(k, oldkey)] = v
+		}
+	}
+	x.mu.Unlock()
+	return nil
+}
+
+func (x *XattrMapFs) key(name string) string {
+	return filepath.Clean(string(filepath.Separator) + name)
+}
@@ -0,0 +1,49 @@
+package overlayfs
+
+import (
+	"io/fs"
+	"strings"
+	"syscall"
+)
+
+const osXattrSupported = true
+
+// osXattrFs implements XattrFs for the OS filesystem.
+type osXattrFs struct{}
+
+func (osXattrFs) GetXattr(name, attr string) ([]byte, error) {
+	size, err := syscall.Getxattr(name, attr, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	b := make([]byte, size)
+	size, err = syscall.Getxattr(name, attr, b)
+	if err != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	return b[:size], nil
+}
+
+func (osXattrFs) SetXattr(name, attr string, value []byte) error {
+	if err := syscall.Setxattr(name, attr, value, 0); err != nil {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (osXattrFs) ListXattr(name string) ([]string, error) {
+	size, err := syscall.Listxattr(name, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: err}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	b := make([]byte, size)
+	size, err = syscall.Listxattr(name, b)
+	if err != nil {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: err}
+	}
+	// The names are NUL terminated.
+	return strings.Split(strings.TrimSuffix(string(b[:size]), "\x00"), "\x00"), nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package overlayfs
+
+import "io/fs"
+
+const osXattrSupported = false
+
+// osXattrFs is not supported on this platform.
+type osXattrFs struct{}
+
+func (osXattrFs) GetXattr(name, attr string) ([]byte, error) {
+	return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrXattrNotSupported}
+}
+
+func (osXattrFs) SetXattr(name, attr string, value []byte) error {
+	return &fs.PathError{Op: "setxattr", Path: name, Err: ErrXattrNotSupported}
+}
+
+func (osXattrFs) ListXattr(name string) ([]string, error) {
+	return nil, &fs.PathError{Op: "listxattr", Path: name, Err: ErrXattrNotSupported}
+}
@@ -0,0 +1,119 @@
+package overlayfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/spf13/afero"
+)
+
+func TestXattrMapFs(t *testing.T) {
+	c := qt.New(t)
+	fs1 := NewXattrMapFs(basicFs("1", "1"))
+	fs2 := NewXattrMapFs(basicFs("2", "2"))
+	ofs := New(Options{Fss: []afero.Fs{fs1, fs2}, FirstWritable: true})
+
+	c.Assert(fs2.SetXattr("mydir/f1-2.txt", "user.lang", []byte("en")), qt.IsNil)
+	v, err := ofs.GetXattr("mydir/f1-2.txt", "user.lang")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "en")
+	_, err = ofs.GetXattr("mydir/f1-2.txt", "user.notfound")
+	c.Assert(err, qt.ErrorIs, fs.ErrNotExist)
+
+	c.Assert(ofs.SetXattr("mydir/f1-1.txt", "user.b", []byte("b")), qt.IsNil)
+	c.Assert(ofs.SetXattr("mydir/f1-1.txt", "user.a", []byte("a")), qt.IsNil)
+	attrs, err := ofs.ListXattr("mydir/f1-1.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(attrs, qt.DeepEquals, []string{"user.a", "user.b"})
+
+	// Writes go to the first filesystem.
+	c.Assert(ofs.SetXattr("mydir/f1-2.txt", "user.lang", []byte("no")), qt.ErrorIs, fs.ErrNotExist)
+
+	c.Assert(ofs.Rename("mydir/f1-1.txt", "mydir/f3-1.txt"), qt.IsNil)
+	v, err = ofs.GetXattr("mydir/f3-1.txt", "user.a")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "a")
+
+	ofsReadOnly := New(Options{Fss: []afero.Fs{fs1, fs2}})
+	c.Assert(ofsReadOnly.SetXattr("mydir/f3-1.txt", "user.a", nil), qt.ErrorIs, fs.ErrPermission)
+
+	ofsScoped := New(Options{Fss: []afero.Fs{Layer{Fs: fs2, Only: []string{"mydir"}}}, FirstWritable: true})
+	c.Assert(ofsScoped.SetXattr("mydir/f2-2.txt", "user.lang", []byte("de")), qt.IsNil)
+	v, err = fs2.GetXattr("mydir/f2-2.txt", "user.lang")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "de")
+
+	ofsNoXattr := New(Options{Fss: []afero.Fs{basicFs("1", "1")}})
+	_, err = ofsNoXattr.GetXattr("mydir/f1-1.txt", "user.a")
+	c.Assert(err, qt.ErrorIs, ErrXattrNotSupported)
+}
+
+func TestXattrOsFs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("xattr only supported on Linux")
+	}
+	c := qt.New(t)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "f.txt")
+	c.Assert(os.WriteFile(filename, []byte("f"), 0o666), qt.IsNil)
+
+	ofs := New(Options{Fss: []afero.Fs{afero.NewOsFs()}, FirstWritable: true})
+	if err := ofs.SetXattr(filename, "user.foo", []byte("bar")); err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			t.Skip("xattr not supported by the temp dir filesystem")
+		}
+		c.Fatal(err)
+	}
+	v, err := ofs.GetXattr(filename, "user.foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "bar")
+	attrs, err := ofs.ListXattr(filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(attrs, qt.Contains, "user.foo")
+}
+
+func TestXattrBasePathFs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("xattr only supported on Linux")
+	}
+	c := qt.New(t)
+	dir := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "f.txt"), []byte("f"), 0o666), qt.IsNil)
+
+	bfs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	ofs := New(Options{Fss: []afero.Fs{bfs}, FirstWritable: true})
+	if err := ofs.SetXattr("f.txt", "user.foo", []byte("bar")); err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			t.Skip("xattr not supported by the temp dir filesystem")
+		}
+		c.Fatal(err)
+	}
+	v, err := ofs.GetXattr("f.txt", "user.foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "bar")
+	attrs, err := ofs.ListXattr("f.txt")
+	c.Assert(err, qt.IsNil)
+	c.Assert(attrs, qt.Contains, "user.foo")
+
+	// The attribute is set on the file below the base path.
+	v, err = New(Options{Fss: []afero.Fs{afero.NewOsFs()}}).GetXattr(filepath.Join(dir, "f.txt"), "user.foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "bar")
+
+	// Errors report the name seen by the caller.
+	_, err = ofs.GetXattr("f.txt", "user.notfound")
+	var perr *fs.PathError
+	c.Assert(errors.As(err, &perr), qt.IsTrue)
+	c.Assert(perr.Path, qt.Equals, filepath.FromSlash("/f.txt"))
+
+	// A base path on another filesystem is not supported.
+	ofsMem := New(Options{Fss: []afero.Fs{afero.NewBasePathFs(afero.NewMemMapFs(), dir)}})
+	_, err = ofsMem.ListXattr("f.txt")
+	c.Assert(err, qt.IsNotNil)
+}